@@ -5,6 +5,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/state"
+	"time"
 )
 
 //
@@ -12,12 +13,61 @@ import (
 // on the specified cluster. This is to prevent infinite queue
 // times - the case that the requested resources will -never- become
 // available on the user's chosen cluster
+// * DescribeCluster reports the cluster's capacity; a missing cluster is
+//   an exceptions.MissingResource
 //
 type Client interface {
 	Name() string
 	Initialize(conf config.Config) error
 	CanBeRun(clusterName string, definition state.Definition) (bool, error)
 	ListClusters() ([]string, error)
+	DescribeCluster(clusterName string) (Capacity, error)
+}
+
+//
+// Resources are memory, in MiB, and cpu units, 1024 to a cpu
+//
+type Resources struct {
+	Memory int64 `json:"memory"`
+	CPU    int64 `json:"cpu"`
+}
+
+//
+// Utilization is the share, from 0 to 1, of registered resources taken
+//
+type Utilization struct {
+	Memory float64 `json:"memory"`
+	CPU    float64 `json:"cpu"`
+}
+
+//
+// Instance is one of a cluster's hosts; Registered is what it offers
+// to tasks, and Remaining what the tasks running on it leave
+//
+type Instance struct {
+	InstanceID string    `json:"instance_id"`
+	Status     string    `json:"status"`
+	Registered Resources `json:"registered"`
+	Remaining  Resources `json:"remaining"`
+}
+
+//
+// Capacity is what a cluster's active instances can run, as of UpdatedAt
+// * InstanceCount is the number of active instances, Registered and
+//   Remaining are totals over them, and Largest the most of each that
+//   any one of them registered
+// * Instances lists every instance, including those not active, eg.
+//   draining ones
+//
+type Capacity struct {
+	Name          string      `json:"name"`
+	InstanceCount int         `json:"instance_count"`
+	Registered    Resources   `json:"registered"`
+	Remaining     Resources   `json:"remaining"`
+	Largest       Resources   `json:"largest_instance"`
+	Utilization   Utilization `json:"utilization"`
+	Instances     []Instance  `json:"instances"`
+	UpdatedAt     time.Time   `json:"updated_at"`
 }
 
 //
@@ -1,12 +1,14 @@
 package cluster
 
 import (
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/patrickmn/go-cache"
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/state"
 	"log"
 	"strings"
@@ -15,13 +17,24 @@ import (
 
 var LIST_CLUSTER_RESULTS int64 = 10
 
+// Most container instances DescribeContainerInstances takes at a time
+const describeInstancesLimit = 100
+
+// Status of container instances that accept tasks
+const activeStatus = "ACTIVE"
+
+// Reason of the failure ecs reports for clusters that do not exist
+const missingReason = "MISSING"
+
 //
 // ECSClusterClient is the default cluster client and maintains a
-// cached map[string]instanceResources which is used to check that
-// the resources requested by a definition  -at some point- could
+// cached map[string]Capacity, holding the registered and remaining
+// resources of each container instance, which is used to check that
+// the resources requested by a definition -at some point- could
 // become available on the specified cluster.
 //
-// [NOTE] This client assumes homogenous clusters
+// Each cluster's capacity is fetched again once it is older than
+// `cluster.refresh_seconds` (default 60).
 //
 type ECSClusterClient struct {
 	ecsClient    resourceClient
@@ -36,11 +49,6 @@ type resourceClient interface {
 	DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error)
 }
 
-type instanceResources struct {
-	memory int64
-	cpu    int64
-}
-
 //
 // Name is the name of the client
 //
@@ -63,9 +71,13 @@ func (ecc *ECSClusterClient) Initialize(conf config.Config) error {
 
 		ecc.ecsClient = ecs.New(sess)
 	}
+	refresh := 60 * time.Second
+	if conf.IsSet("cluster.refresh_seconds") {
+		refresh = time.Duration(conf.GetInt("cluster.refresh_seconds")) * time.Second
+	}
 	ecc.clusters = resourceCache{
-		duration:      15 * time.Minute,
-		internalCache: cache.New(15*time.Minute, 5*time.Minute),
+		duration:      refresh,
+		internalCache: cache.New(refresh, 5*time.Minute),
 	}
 	ecc.clusterNames = clusterNamesCache{
 		duration:      15 * time.Minute,
@@ -79,23 +91,42 @@ func (ecc *ECSClusterClient) Initialize(conf config.Config) error {
 // can be run on clusterName
 //
 func (ecc *ECSClusterClient) CanBeRun(clusterName string, definition state.Definition) (bool, error) {
-	var (
-		resources *instanceResources
-		err       error
-	)
-	resources, found := ecc.clusters.getInstanceResources(clusterName)
-	if !found {
-		resources, err = ecc.fetchResources(clusterName)
-		if err != nil {
-			return false, errors.Wrapf(err, "problem getting available resources for cluster [%s]", clusterName)
-		}
-		if resources == nil {
-			return false, nil
-		}
-		ecc.clusters.setInstanceResources(clusterName, resources)
+	capacity, err := ecc.capacity(clusterName)
+	if err != nil {
+		return false, errors.Wrapf(err, "problem getting available resources for cluster [%s]", clusterName)
 	}
+	return ecc.validate(capacity, definition), nil
+}
 
-	return ecc.validate(resources, definition), nil
+//
+// DescribeCluster reports the capacity of clusterName as last fetched
+//
+func (ecc *ECSClusterClient) DescribeCluster(clusterName string) (Capacity, error) {
+	capacity, err := ecc.capacity(clusterName)
+	if err != nil {
+		return Capacity{}, errors.Wrapf(err, "problem getting capacity of cluster [%s]", clusterName)
+	}
+	if capacity == nil {
+		return Capacity{}, exceptions.MissingResource{
+			ErrorString: fmt.Sprintf("cluster [%s] was not found", clusterName)}
+	}
+	return *capacity, nil
+}
+
+//
+// capacity gets the capacity of clusterName from the cache, fetching it
+// when missing or stale; nil if the cluster does not exist
+//
+func (ecc *ECSClusterClient) capacity(clusterName string) (*Capacity, error) {
+	if capacity, found := ecc.clusters.getCapacity(clusterName); found {
+		return capacity, nil
+	}
+	capacity, err := ecc.fetchCapacity(clusterName)
+	if err != nil || capacity == nil {
+		return nil, err
+	}
+	ecc.clusters.setCapacity(clusterName, capacity)
+	return capacity, nil
 }
 
 //
@@ -146,27 +177,83 @@ func (ecc *ECSClusterClient) getClusterNamesFromApi() ([]string, error) {
 	return clusterNames, nil
 }
 
-func (ecc *ECSClusterClient) validate(resources *instanceResources, definition state.Definition) bool {
-	if resources != nil && definition.Memory != nil && int64(*definition.Memory) < resources.memory {
-		// TODO - check cpu when available on the definition
-		return true
+//
+// validate checks the definition's memory, and its cpu if it reserves
+// any, fit within the registered resources of at least one of the
+// cluster's active instances; that is, of the largest for the definition
+//
+func (ecc *ECSClusterClient) validate(capacity *Capacity, definition state.Definition) bool {
+	if capacity == nil || definition.Memory == nil {
+		return false
+	}
+	for _, instance := range capacity.Instances {
+		if instance.Status != activeStatus {
+			continue
+		}
+		if *definition.Memory < instance.Registered.Memory &&
+			(definition.CPU == nil || *definition.CPU <= instance.Registered.CPU) {
+			return true
+		}
 	}
 	return false
 }
 
-func (ecc *ECSClusterClient) fetchResources(clusterName string) (*instanceResources, error) {
+func (ecc *ECSClusterClient) fetchCapacity(clusterName string) (*Capacity, error) {
 	exists, err := ecc.clusterExists(clusterName)
 	if err != nil {
 		return nil, errors.Wrapf(err, "problem checking for cluster existence of cluster [%s]", clusterName)
 	}
-	if exists {
-		rsrc, err := ecc.clusterInstanceResources(clusterName)
-		if err != nil {
-			return nil, errors.Wrap(err, "problem fetching cluster resources")
+	if !exists {
+		return nil, nil
+	}
+	instances, err := ecc.clusterInstances(clusterName)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem fetching cluster resources")
+	}
+	capacity := newCapacity(clusterName, instances)
+	return &capacity, nil
+}
+
+//
+// newCapacity totals the resources of the cluster's active instances
+//
+func newCapacity(clusterName string, instances []Instance) Capacity {
+	capacity := Capacity{
+		Name:      clusterName,
+		Instances: instances,
+		UpdatedAt: time.Now().UTC(),
+	}
+	if capacity.Instances == nil {
+		capacity.Instances = []Instance{}
+	}
+	for _, instance := range instances {
+		if instance.Status != activeStatus {
+			continue
+		}
+		capacity.InstanceCount++
+		capacity.Registered.Memory += instance.Registered.Memory
+		capacity.Registered.CPU += instance.Registered.CPU
+		capacity.Remaining.Memory += instance.Remaining.Memory
+		capacity.Remaining.CPU += instance.Remaining.CPU
+		if instance.Registered.Memory > capacity.Largest.Memory {
+			capacity.Largest.Memory = instance.Registered.Memory
 		}
-		return rsrc, nil
+		if instance.Registered.CPU > capacity.Largest.CPU {
+			capacity.Largest.CPU = instance.Registered.CPU
+		}
+	}
+	capacity.Utilization = Utilization{
+		Memory: utilization(capacity.Registered.Memory, capacity.Remaining.Memory),
+		CPU:    utilization(capacity.Registered.CPU, capacity.Remaining.CPU),
 	}
-	return nil, nil
+	return capacity
+}
+
+func utilization(registered int64, remaining int64) float64 {
+	if registered <= 0 {
+		return 0
+	}
+	return float64(registered-remaining) / float64(registered)
 }
 
 func (ecc *ECSClusterClient) clusterExists(clusterName string) (bool, error) {
@@ -179,11 +266,14 @@ func (ecc *ECSClusterClient) clusterExists(clusterName string) (bool, error) {
 	if err != nil {
 		return false, errors.Wrapf(err, "problem describing ecs cluster with name: [%s]", clusterName)
 	}
-	if len(result.Failures) != 0 {
-		msg := make([]string, len(result.Failures))
-		for i, failure := range result.Failures {
-			msg[i] = *failure.Reason
+	// ecs reports clusters that do not exist as MISSING failures
+	var msg []string
+	for _, failure := range result.Failures {
+		if failure.Reason != nil && *failure.Reason != missingReason {
+			msg = append(msg, *failure.Reason)
 		}
+	}
+	if len(msg) != 0 {
 		return false, errors.Errorf("ERRORS: %s", strings.Join(msg, "\n"))
 	}
 	if len(result.Clusters) == 0 {
@@ -192,40 +282,30 @@ func (ecc *ECSClusterClient) clusterExists(clusterName string) (bool, error) {
 	return true, nil
 }
 
-func (ecc *ECSClusterClient) clusterInstanceResources(clusterName string) (*instanceResources, error) {
-	var result instanceResources
-
-	instances, err := ecc.listInstances(&ecs.ListContainerInstancesInput{
+func (ecc *ECSClusterClient) clusterInstances(clusterName string) ([]Instance, error) {
+	arns, err := ecc.listInstances(&ecs.ListContainerInstancesInput{
 		Cluster: &clusterName,
 	})
 	if err != nil {
 		return nil, errors.Wrapf(err, "problem listing ecs container instances for cluster [%s]", clusterName)
 	}
 
-	if len(instances) == 0 {
-		return nil, nil // short-circuit to avoid additional spurious api call with zero instances
-	}
-
-	resources, err := ecc.describeInstances(&ecs.DescribeContainerInstancesInput{
-		Cluster:            &clusterName,
-		ContainerInstances: instances,
-	})
-
-	if err != nil {
-		return nil, errors.Wrapf(err, "problem describing container instances for cluster [%s]", clusterName)
-	}
-
-	//
-	// Assumes -all- instances in the cluster have identical registered resources
-	// While this is certainly the most manageable way to configure ecs clusters
-	// it is -not- the only way in practice
-	//
-	if resources != nil && len(resources) > 0 {
-		// An alternative, and potentially better handling of heterogeneous clusters,
-		// is to return the resources with the -highest- memory and cpu
-		result = resources[0]
+	var instances []Instance
+	for start := 0; start < len(arns); start += describeInstancesLimit {
+		end := start + describeInstancesLimit
+		if end > len(arns) {
+			end = len(arns)
+		}
+		described, err := ecc.describeInstances(&ecs.DescribeContainerInstancesInput{
+			Cluster:            &clusterName,
+			ContainerInstances: arns[start:end],
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem describing container instances for cluster [%s]", clusterName)
+		}
+		instances = append(instances, described...)
 	}
-	return &result, nil
+	return instances, nil
 }
 
 func (ecc *ECSClusterClient) listInstances(input *ecs.ListContainerInstancesInput) ([]*string, error) {
@@ -249,7 +329,7 @@ func (ecc *ECSClusterClient) listInstances(input *ecs.ListContainerInstancesInpu
 	return subset, nil
 }
 
-func (ecc *ECSClusterClient) describeInstances(input *ecs.DescribeContainerInstancesInput) ([]instanceResources, error) {
+func (ecc *ECSClusterClient) describeInstances(input *ecs.DescribeContainerInstancesInput) ([]Instance, error) {
 	result, err := ecc.ecsClient.DescribeContainerInstances(input)
 	if err != nil {
 		return nil, errors.Wrap(err, "problem describing ecs container instances")
@@ -263,37 +343,52 @@ func (ecc *ECSClusterClient) describeInstances(input *ecs.DescribeContainerInsta
 		return nil, errors.Errorf("ERRORS: %s", strings.Join(msg, "\n"))
 	}
 
-	res := make([]instanceResources, len(result.ContainerInstances))
+	res := make([]Instance, len(result.ContainerInstances))
 	for i, ci := range result.ContainerInstances {
-		irs := instanceResources{}
-		for _, rsrc := range ci.RegisteredResources {
-			if *rsrc.Name == "CPU" {
-				irs.cpu = *rsrc.IntegerValue
-			} else if *rsrc.Name == "MEMORY" {
-				irs.memory = *rsrc.IntegerValue
-			}
+		res[i] = Instance{
+			InstanceID: aws.StringValue(ci.Ec2InstanceId),
+			Status:     aws.StringValue(ci.Status),
+			Registered: resourcesOf(ci.RegisteredResources),
+			Remaining:  resourcesOf(ci.RemainingResources),
 		}
-		res[i] = irs
 	}
 	return res, nil
 }
 
+//
+// resourcesOf picks the memory and cpu out of an instance's resources
+//
+func resourcesOf(ecsResources []*ecs.Resource) Resources {
+	var res Resources
+	for _, rsrc := range ecsResources {
+		if rsrc.Name == nil || rsrc.IntegerValue == nil {
+			continue
+		}
+		if *rsrc.Name == "CPU" {
+			res.CPU = *rsrc.IntegerValue
+		} else if *rsrc.Name == "MEMORY" {
+			res.Memory = *rsrc.IntegerValue
+		}
+	}
+	return res
+}
+
 type resourceCache struct {
 	duration      time.Duration
 	internalCache *cache.Cache
 }
 
-func (rc *resourceCache) getInstanceResources(clusterName string) (*instanceResources, bool) {
-	resources, found := rc.internalCache.Get(clusterName)
+func (rc *resourceCache) getCapacity(clusterName string) (*Capacity, bool) {
+	capacity, found := rc.internalCache.Get(clusterName)
 	if found {
-		ir := resources.(instanceResources)
-		return &ir, true
+		c := capacity.(Capacity)
+		return &c, true
 	}
-	return &instanceResources{}, false
+	return nil, false
 }
 
-func (rc *resourceCache) setInstanceResources(clusterName string, resources *instanceResources) {
-	rc.internalCache.Set(clusterName, *resources, rc.duration)
+func (rc *resourceCache) setCapacity(clusterName string, capacity *Capacity) {
+	rc.internalCache.Set(clusterName, *capacity, rc.duration)
 }
 
 type clusterNamesCache struct {
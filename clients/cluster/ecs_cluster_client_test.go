@@ -3,14 +3,18 @@ package cluster
 import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/patrickmn/go-cache"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/state"
 	"testing"
+	"time"
 )
 
 type testResourceClient struct {
-	t          *testing.T
-	listCalled int
+	t              *testing.T
+	listCalled     int
+	describeCalled int
 }
 
 func (trc *testResourceClient) DescribeClusters(input *ecs.DescribeClustersInput) (*ecs.DescribeClustersOutput, error) {
@@ -19,6 +23,7 @@ func (trc *testResourceClient) DescribeClusters(input *ecs.DescribeClustersInput
 	}
 
 	clusters := make([]*ecs.Cluster, 0, len(input.Clusters))
+	var failures []*ecs.Failure
 
 	for _, identifier := range input.Clusters {
 		if identifier == nil || len(*identifier) == 0 {
@@ -29,11 +34,20 @@ func (trc *testResourceClient) DescribeClusters(input *ecs.DescribeClustersInput
 		} else if *identifier == "cluster_arn" {
 			name := "cluster_name"
 			clusters = append(clusters, &ecs.Cluster{ClusterName: &name})
+		} else if *identifier == "brokenclusta" {
+			reason := "UNAVAILABLE"
+			failures = append(failures, &ecs.Failure{Arn: identifier, Reason: &reason})
+		} else {
+			// What ecs reports for clusters that do not exist
+			arn := "arn:aws:ecs:us-east-1:123456789012:cluster/" + *identifier
+			reason := "MISSING"
+			failures = append(failures, &ecs.Failure{Arn: &arn, Reason: &reason})
 		}
 	}
 
 	res := ecs.DescribeClustersOutput{
 		Clusters: clusters,
+		Failures: failures,
 	}
 	return &res, nil
 }
@@ -120,33 +134,39 @@ func (trc *testResourceClient) DescribeContainerInstances(input *ecs.DescribeCon
 			&failure,
 		}
 	} else {
-		cpu := int64(10)
-		cpuKey := "CPU"
-		mem := int64(100)
-		memKey := "MEMORY"
-		cpuResource := ecs.Resource{
-			Name:         &cpuKey,
-			IntegerValue: &cpu,
-		}
-		memResource := ecs.Resource{
-			Name:         &memKey,
-			IntegerValue: &mem,
-		}
-
-		ci := ecs.ContainerInstance{
-			RegisteredResources: []*ecs.Resource{
-				&memResource,
-				&cpuResource,
-			},
-		}
-		res.ContainerInstances = []*ecs.ContainerInstance{
-			&ci,
+		// arn1 has the most memory and arn2 the most cpu
+		for _, arn := range input.ContainerInstances {
+			if *arn == "arn1" {
+				res.ContainerInstances = append(res.ContainerInstances,
+					testContainerInstance("i-1", 100, 10, 40, 5))
+			} else {
+				res.ContainerInstances = append(res.ContainerInstances,
+					testContainerInstance("i-2", 50, 20, 50, 20))
+			}
 		}
 	}
+	trc.describeCalled++
 
 	return &res, nil
 }
 
+func testContainerInstance(instanceID string, mem int64, cpu int64, remainingMem int64, remainingCPU int64) *ecs.ContainerInstance {
+	resources := func(mem int64, cpu int64) []*ecs.Resource {
+		memKey, cpuKey := "MEMORY", "CPU"
+		return []*ecs.Resource{
+			{Name: &memKey, IntegerValue: &mem},
+			{Name: &cpuKey, IntegerValue: &cpu},
+		}
+	}
+	status := "ACTIVE"
+	return &ecs.ContainerInstance{
+		Ec2InstanceId:       &instanceID,
+		Status:              &status,
+		RegisteredResources: resources(mem, cpu),
+		RemainingResources:  resources(remainingMem, remainingCPU),
+	}
+}
+
 func setUp() ECSClusterClient {
 	confDir := "../../conf"
 	c, _ := config.NewConfig(&confDir)
@@ -186,6 +206,24 @@ func TestECSClusterClient_CanBeRun(t *testing.T) {
 		t.Errorf("Definition with %v memory is runnable, yet got false", justRight)
 	}
 
+	// The instance with 100 memory has 10 cpu units
+	tooManyCPUs, enoughCPUs := int64(11), int64(10)
+	yes, _ = cc.CanBeRun("clusta", state.Definition{Memory: &justRight, CPU: &tooManyCPUs})
+	if yes {
+		t.Errorf("Definition with %v memory and %v cpu is not runnable, yet got true", justRight, tooManyCPUs)
+	}
+	yes, _ = cc.CanBeRun("clusta", state.Definition{Memory: &justRight, CPU: &enoughCPUs})
+	if !yes {
+		t.Errorf("Definition with %v cpu is runnable, yet got false", enoughCPUs)
+	}
+
+	// The instance with 20 cpu units has 50 memory
+	littleMemory := int64(49)
+	yes, _ = cc.CanBeRun("clusta", state.Definition{Memory: &littleMemory, CPU: &tooManyCPUs})
+	if !yes {
+		t.Errorf("Definition with %v memory and %v cpu is runnable, yet got false", littleMemory, tooManyCPUs)
+	}
+
 	trc.listCalled = 0
 	yes, _ = cc.CanBeRun("noclusta", runnable)
 	if yes {
@@ -222,3 +260,96 @@ func TestECSClusterClient_ListClusters(t *testing.T) {
 		return
 	}
 }
+
+func TestECSClusterClient_DescribeCluster(t *testing.T) {
+	cc := setUp()
+
+	trc := &testResourceClient{
+		t:          t,
+		listCalled: 0,
+	}
+	cc.ecsClient = trc
+
+	capacity, err := cc.DescribeCluster("clusta")
+	if err != nil {
+		t.Fatalf("Did not expect error describing cluster: %v", err)
+	}
+	if capacity.Name != "clusta" || capacity.InstanceCount != 2 || len(capacity.Instances) != 2 {
+		t.Errorf("Expected clusta with 2 instances, got %v", capacity)
+	}
+	if capacity.Registered != (Resources{Memory: 150, CPU: 30}) || capacity.Remaining != (Resources{Memory: 90, CPU: 25}) {
+		t.Errorf("Expected totals of both instances, got %v and %v remaining", capacity.Registered, capacity.Remaining)
+	}
+	if capacity.Largest != (Resources{Memory: 100, CPU: 20}) {
+		t.Errorf("Expected the most memory and cpu of any instance, got %v", capacity.Largest)
+	}
+	if capacity.Utilization.Memory != 0.4 || capacity.Utilization.CPU != float64(5)/30 {
+		t.Errorf("Expected 0.4 of memory and 1/6 of cpu used, got %v", capacity.Utilization)
+	}
+	if capacity.Instances[0].InstanceID != "i-1" || capacity.Instances[0].Remaining.Memory != 40 {
+		t.Errorf("Expected each instance's resources, got %v", capacity.Instances[0])
+	}
+
+	trc.listCalled = 0
+	if _, err = cc.DescribeCluster("noclusta"); err == nil {
+		t.Errorf("Expected missing cluster to be an error")
+	} else if _, ok := err.(exceptions.MissingResource); !ok {
+		t.Errorf("Expected missing cluster to be a missing resource, got %v", err)
+	}
+
+	if _, err = cc.DescribeCluster("brokenclusta"); err == nil {
+		t.Errorf("Expected failures other than a missing cluster to be an error")
+	} else if _, ok := err.(exceptions.MissingResource); ok {
+		t.Errorf("Expected failures other than a missing cluster not to be a missing resource")
+	}
+}
+
+func TestECSClusterClient_Refresh(t *testing.T) {
+	cc := setUp()
+	cc.clusters = resourceCache{
+		duration:      50 * time.Millisecond,
+		internalCache: cache.New(50*time.Millisecond, time.Minute),
+	}
+
+	trc := &testResourceClient{
+		t:          t,
+		listCalled: 0,
+	}
+	cc.ecsClient = trc
+
+	first, _ := cc.DescribeCluster("clusta")
+	trc.listCalled = 0
+	if cached, _ := cc.DescribeCluster("clusta"); trc.describeCalled != 1 || !cached.UpdatedAt.Equal(first.UpdatedAt) {
+		t.Errorf("Expected capacity to be cached, described instances %d times", trc.describeCalled)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if refreshed, _ := cc.DescribeCluster("clusta"); trc.describeCalled != 2 || !refreshed.UpdatedAt.After(first.UpdatedAt) {
+		t.Errorf("Expected stale capacity to be fetched again, described instances %d times", trc.describeCalled)
+	}
+}
+
+func TestNewCapacity(t *testing.T) {
+	instances := []Instance{
+		{InstanceID: "i-1", Status: "ACTIVE", Registered: Resources{Memory: 100, CPU: 10}},
+		{InstanceID: "i-2", Status: "DRAINING", Registered: Resources{Memory: 400, CPU: 40}},
+	}
+	capacity := newCapacity("clusta", instances)
+	if capacity.InstanceCount != 1 || capacity.Largest != (Resources{Memory: 100, CPU: 10}) || len(capacity.Instances) != 2 {
+		t.Errorf("Expected draining instances to be listed but not counted, got %v", capacity)
+	}
+	if capacity.Utilization.Memory != 1 {
+		t.Errorf("Expected an instance without remaining resources to be used up, got %v", capacity.Utilization)
+	}
+
+	empty := newCapacity("clustb", nil)
+	if empty.Instances == nil || empty.Utilization.Memory != 0 {
+		t.Errorf("Expected a cluster without instances to have none used, got %v", empty)
+	}
+
+	cc := setUp()
+	littleMemory, cpu := int64(50), int64(20)
+	if cc.validate(&capacity, state.Definition{Memory: &littleMemory, CPU: &cpu}) {
+		t.Errorf("Expected draining instances not to run definitions")
+	}
+}
@@ -59,7 +59,10 @@ type Client struct {
 	Host       string
 	Timeout    time.Duration
 	RetryCount int
-	Executor   RequestExecutor
+	// RetryBackoff is the wait before the first retry; it doubles with
+	// each retry after that. Defaults to 3 seconds
+	RetryBackoff time.Duration
+	Executor     RequestExecutor
 }
 
 func (c *Client) Get(path string, headers map[string]string, entity interface{}) error {
@@ -151,7 +154,19 @@ func (c *Client) doRequestWithRetry(req *http.Request, entity interface{}) error
 	if c.Executor == nil {
 		c.Executor = &defaultExecutor{}
 	}
-	err := c.retryRequest(3*time.Second, func() error {
+	backoff := c.RetryBackoff
+	if backoff == 0 {
+		backoff = 3 * time.Second
+	}
+	err := c.retryRequest(backoff, func() error {
+		// A retried request must send its body again
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			req.Body = body
+		}
 		return c.Executor.Do(req, c.Timeout, entity)
 	})
 	return err
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -145,3 +146,33 @@ func TestClientDo(t *testing.T) {
 		t.Errorf("Expected err to be nil got %s", err.Error())
 	}
 }
+
+type BodyRecordingExecutor struct {
+	Bodies []string
+}
+
+func (be *BodyRecordingExecutor) Do(req *http.Request, timeout time.Duration, entity interface{}) error {
+	body, _ := ioutil.ReadAll(req.Body)
+	be.Bodies = append(be.Bodies, string(body))
+	return HttpRetryableError{errors.New("bork")}
+}
+
+func TestClientRetryResendsBody(t *testing.T) {
+	be := &BodyRecordingExecutor{}
+	client := &Client{
+		Host:         "nope",
+		RetryCount:   2,
+		RetryBackoff: time.Millisecond,
+		Executor:     be,
+	}
+
+	client.Post("/", nil, &Cupcake{"vomit", true}, &Cupcake{})
+	if len(be.Bodies) != 3 {
+		t.Fatalf("Expected to try request [%v] times but got [%v]", 3, len(be.Bodies))
+	}
+	for i, body := range be.Bodies {
+		if body != be.Bodies[0] || len(body) == 0 {
+			t.Errorf("Expected attempt %v to send body %s but sent %s", i, be.Bodies[0], body)
+		}
+	}
+}
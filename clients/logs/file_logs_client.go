@@ -0,0 +1,215 @@
+package logs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//
+// FileLogsClient returns logs for runs from files in a directory, one per
+// run, written by the execution engine or a log shipper
+// * a run's logs are in <run_id>.log
+// * rotated logs of a run are <run_id>.log.1, <run_id>.log.2 and so on,
+//   with higher numbers holding older logs
+// * any of them can be gzip compressed, as <run_id>.log.gz or <run_id>.log.1.gz
+//
+// The lastSeen cursor is a byte offset into the run's uncompressed logs, so it
+// stays valid as they are rotated and compressed
+//
+type FileLogsClient struct {
+	directory string
+	maxBytes  int64
+}
+
+// Default limit of bytes of logs returned at a time
+const defaultFileLogsMaxBytes = 1024 * 1024
+
+type logSegment struct {
+	path       string
+	compressed bool
+}
+
+//
+// Name returns the name of the logs client
+//
+func (flc *FileLogsClient) Name() string {
+	return "file"
+}
+
+//
+// Initialize sets up the FileLogsClient
+//
+func (flc *FileLogsClient) Initialize(conf config.Config) error {
+	flc.directory = conf.GetString("log.file.directory")
+	if len(flc.directory) == 0 {
+		return errors.Errorf("FileLogsClient needs [log.file.directory] set in config")
+	}
+
+	info, err := os.Stat(flc.directory)
+	if err != nil {
+		return errors.Wrapf(err, "problem reading log directory [%s]", flc.directory)
+	}
+	if !info.IsDir() {
+		return errors.Errorf("log directory [%s] is not a directory", flc.directory)
+	}
+
+	flc.maxBytes = int64(conf.GetInt("log.file.max_bytes"))
+	if flc.maxBytes <= 0 {
+		flc.maxBytes = defaultFileLogsMaxBytes
+	}
+	return nil
+}
+
+//
+// Logs returns logs of the run after the lastSeen byte offset
+// * returns at most log.file.max_bytes at a time
+// * logs of runs that are not stopped end at the last complete line,
+//   since the rest of the line may still be being written
+//
+func (flc *FileLogsClient) Logs(definition state.Definition, run state.Run, lastSeen *string) (string, *string, error) {
+	var offset int64
+	if lastSeen != nil && len(*lastSeen) > 0 {
+		var err error
+		offset, err = strconv.ParseInt(*lastSeen, 10, 64)
+		if err != nil || offset < 0 {
+			return "", nil, exceptions.MalformedInput{
+				ErrorString: fmt.Sprintf("last_seen [%s] is not a byte offset", *lastSeen)}
+		}
+	}
+
+	segments, err := flc.segments(run.RunID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(segments) == 0 {
+		return "", nil, exceptions.MissingResource{
+			ErrorString: fmt.Sprintf("no logs found for run [%s]", run.RunID)}
+	}
+
+	var buf bytes.Buffer
+	skip := offset
+	for _, segment := range segments {
+		if int64(buf.Len()) >= flc.maxBytes {
+			break
+		}
+		if skip, err = flc.read(segment, skip, flc.maxBytes-int64(buf.Len()), &buf); err != nil {
+			return "", nil, err
+		}
+	}
+
+	logs := buf.Bytes()
+	if run.Status != state.StatusStopped {
+		if last := bytes.LastIndexByte(logs, '\n'); last >= 0 {
+			logs = logs[:last+1]
+		} else if int64(len(logs)) < flc.maxBytes {
+			logs = nil
+		}
+	}
+
+	next := strconv.FormatInt(offset+int64(len(logs)), 10)
+	return string(logs), &next, nil
+}
+
+//
+// segments returns the run's log files, oldest first
+//
+func (flc *FileLogsClient) segments(runID string) ([]logSegment, error) {
+	if len(runID) == 0 || strings.ContainsAny(runID, `/\`) || runID == "." || runID == ".." {
+		return nil, exceptions.MalformedInput{ErrorString: fmt.Sprintf("invalid run id [%s]", runID)}
+	}
+
+	var segments []logSegment
+	for i := 0; ; i++ {
+		name := runID + ".log"
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", name, i)
+		}
+
+		segment, found, err := flc.segment(filepath.Join(flc.directory, name))
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			if i == 0 {
+				// A finished run's logs may have been rotated away entirely
+				continue
+			}
+			break
+		}
+		segments = append([]logSegment{segment}, segments...)
+	}
+	return segments, nil
+}
+
+func (flc *FileLogsClient) segment(path string) (logSegment, bool, error) {
+	// While a segment is being compressed both files exist; the
+	// uncompressed one is complete
+	for _, segment := range []logSegment{{path, false}, {path + ".gz", true}} {
+		_, err := os.Stat(segment.path)
+		if err == nil {
+			return segment, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return segment, false, errors.Wrapf(err, "problem reading log file [%s]", segment.path)
+		}
+	}
+	return logSegment{}, false, nil
+}
+
+//
+// read skips the first skip bytes of the segment, appends at most limit
+// of the bytes after them to buf, and returns how many bytes are still to
+// be skipped in later segments
+//
+func (flc *FileLogsClient) read(segment logSegment, skip int64, limit int64, buf *bytes.Buffer) (int64, error) {
+	f, err := os.Open(segment.path)
+	if err != nil {
+		return skip, errors.Wrapf(err, "problem opening log file [%s]", segment.path)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if segment.compressed {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return skip, errors.Wrapf(err, "problem decompressing log file [%s]", segment.path)
+		}
+		defer gz.Close()
+		r = gz
+
+		skipped, err := io.CopyN(ioutil.Discard, r, skip)
+		if err == io.EOF {
+			return skip - skipped, nil
+		}
+		if err != nil {
+			return skip, errors.Wrapf(err, "problem reading log file [%s]", segment.path)
+		}
+	} else {
+		info, err := f.Stat()
+		if err != nil {
+			return skip, errors.Wrapf(err, "problem reading log file [%s]", segment.path)
+		}
+		if skip >= info.Size() {
+			return skip - info.Size(), nil
+		}
+		if _, err = f.Seek(skip, io.SeekStart); err != nil {
+			return skip, errors.Wrapf(err, "problem reading log file [%s]", segment.path)
+		}
+	}
+
+	if _, err = io.CopyN(buf, r, limit); err != nil && err != io.EOF {
+		return 0, errors.Wrapf(err, "problem reading log file [%s]", segment.path)
+	}
+	return 0, nil
+}
@@ -0,0 +1,169 @@
+package logs
+
+import (
+	"compress/gzip"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setUpFileLogsClient(t *testing.T, maxBytes int64) (*FileLogsClient, string) {
+	dir, err := ioutil.TempDir("", "flotilla-logs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	return &FileLogsClient{directory: dir, maxBytes: maxBytes}, dir
+}
+
+func writeLogFile(t *testing.T, dir string, name string, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func writeCompressedLogFile(t *testing.T, dir string, name string, contents string) {
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	if _, err = gz.Write([]byte(contents)); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatalf(err.Error())
+	}
+}
+
+func TestFileLogsClient_Logs(t *testing.T) {
+	flc, dir := setUpFileLogsClient(t, 8)
+	defer os.RemoveAll(dir)
+
+	writeLogFile(t, dir, "run1.log", "abc\ndef\nghi\n")
+	run := state.Run{RunID: "run1", Status: state.StatusStopped}
+
+	// Logs are returned max bytes at a time, continuing from lastSeen
+	var all string
+	var lastSeen *string
+	for i := 0; i < 3; i++ {
+		logs, next, err := flc.Logs(state.Definition{}, run, lastSeen)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		all += logs
+		lastSeen = next
+	}
+
+	if all != "abc\ndef\nghi\n" {
+		t.Errorf("Expected all logs to be read, got [%s]", all)
+	}
+	if lastSeen == nil || *lastSeen != "12" {
+		t.Errorf("Expected lastSeen [12], got %v", lastSeen)
+	}
+
+	// Nothing new after the end
+	logs, next, err := flc.Logs(state.Definition{}, run, lastSeen)
+	if err != nil || len(logs) != 0 || next == nil || *next != "12" {
+		t.Errorf("Expected no logs at the end, got [%s], %v, %v", logs, next, err)
+	}
+}
+
+func TestFileLogsClient_LogsRotated(t *testing.T) {
+	flc, dir := setUpFileLogsClient(t, 1024)
+	defer os.RemoveAll(dir)
+
+	writeCompressedLogFile(t, dir, "run1.log.2.gz", "one\n")
+	writeLogFile(t, dir, "run1.log.1", "two\n")
+	writeCompressedLogFile(t, dir, "run1.log.1.gz", "partial")
+	writeCompressedLogFile(t, dir, "run1.log.gz", "three\n")
+	run := state.Run{RunID: "run1", Status: state.StatusStopped}
+
+	logs, next, err := flc.Logs(state.Definition{}, run, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if logs != "one\ntwo\nthree\n" || *next != "14" {
+		t.Errorf("Expected rotated logs oldest first, got [%s] at %s", logs, *next)
+	}
+
+	// Offsets span segments
+	lastSeen := "6"
+	logs, next, err = flc.Logs(state.Definition{}, run, &lastSeen)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if logs != "o\nthree\n" || *next != "14" {
+		t.Errorf("Expected logs after offset 6, got [%s] at %s", logs, *next)
+	}
+
+	// The current file is rotated away; offsets stay valid
+	os.Remove(filepath.Join(dir, "run1.log.gz"))
+	writeCompressedLogFile(t, dir, "run1.log.3.gz", "one\n")
+	writeCompressedLogFile(t, dir, "run1.log.2.gz", "two\n")
+	os.Remove(filepath.Join(dir, "run1.log.1"))
+	writeCompressedLogFile(t, dir, "run1.log.1.gz", "three\n")
+	logs, next, err = flc.Logs(state.Definition{}, run, &lastSeen)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if logs != "o\nthree\n" || *next != "14" {
+		t.Errorf("Expected logs after offset 6 once rotated, got [%s] at %s", logs, *next)
+	}
+}
+
+func TestFileLogsClient_LogsRunning(t *testing.T) {
+	flc, dir := setUpFileLogsClient(t, 1024)
+	defer os.RemoveAll(dir)
+
+	writeLogFile(t, dir, "run1.log", "abc\nde")
+	run := state.Run{RunID: "run1", Status: state.StatusRunning}
+
+	// The partial line of a running run is left for later
+	logs, next, err := flc.Logs(state.Definition{}, run, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if logs != "abc\n" || *next != "4" {
+		t.Errorf("Expected only complete lines, got [%s] at %s", logs, *next)
+	}
+
+	logs, next, err = flc.Logs(state.Definition{}, run, next)
+	if err != nil || len(logs) != 0 || *next != "4" {
+		t.Errorf("Expected no logs until the line is complete, got [%s] at %v, %v", logs, next, err)
+	}
+
+	// Once stopped the rest is returned
+	run.Status = state.StatusStopped
+	logs, next, err = flc.Logs(state.Definition{}, run, next)
+	if err != nil || logs != "de" || *next != "6" {
+		t.Errorf("Expected the rest of the logs once stopped, got [%s] at %v, %v", logs, next, err)
+	}
+}
+
+func TestFileLogsClient_LogsErrors(t *testing.T) {
+	flc, dir := setUpFileLogsClient(t, 1024)
+	defer os.RemoveAll(dir)
+
+	writeLogFile(t, dir, "run1.log", "abc\n")
+
+	_, _, err := flc.Logs(state.Definition{}, state.Run{RunID: "nope"}, nil)
+	if _, ok := err.(exceptions.MissingResource); !ok {
+		t.Errorf("Expected MissingResource for a run without logs, got %v", err)
+	}
+
+	lastSeen := "token"
+	_, _, err = flc.Logs(state.Definition{}, state.Run{RunID: "run1"}, &lastSeen)
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for an invalid lastSeen, got %v", err)
+	}
+
+	_, _, err = flc.Logs(state.Definition{}, state.Run{RunID: "../run1"}, nil)
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for a run id outside the directory, got %v", err)
+	}
+}
@@ -35,6 +35,13 @@ func NewLogsClient(conf config.Config, logger flotillaLog.Logger) (Client, error
 			return nil, errors.Wrap(err, "problem initializing CloudWatchLogsClient")
 		}
 		return cwlc, nil
+	case "file":
+		// files written per run by the execution engine or a log shipper
+		flc := &FileLogsClient{}
+		if err := flc.Initialize(conf); err != nil {
+			return nil, errors.Wrap(err, "problem initializing FileLogsClient")
+		}
+		return flc, nil
 	default:
 		return nil, fmt.Errorf("No Client named [%s] was found", name)
 	}
@@ -0,0 +1,347 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/httpclient"
+	"github.com/stitchfix/flotilla-os/config"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// SignatureHeader holds the hex encoded HMAC-SHA256 of the request body,
+// keyed with the webhook's secret, as "sha256=<signature>"
+const SignatureHeader = "X-Flotilla-Signature"
+
+// DeliveryHeader holds the id of the delivery
+const DeliveryHeader = "X-Flotilla-Delivery"
+
+// Number of webhooks fetched at a time
+const webhookBatchSize = 100
+
+//
+// Notifier sends run status transitions to the webhooks subscribed to them
+//
+type Notifier interface {
+	Notify(run state.Run)
+}
+
+//
+// NewNotifier configures and returns a Notifier
+// - webhook.timeout_seconds bounds each attempt at a delivery (default 10)
+// - webhook.retry_count is the number of retries of failed deliveries (default 3)
+// - the notifiers of a process share webhook.workers goroutines (default 8)
+//   delivering at most webhook.queue_size queued deliveries (default 1000);
+//   they are configured by the first notifier created
+//
+func NewNotifier(conf config.Config, sm state.Manager, logger flotillaLog.Logger) (Notifier, error) {
+	hn := httpNotifier{
+		sm:         sm,
+		log:        logger,
+		timeout:    10 * time.Second,
+		retryCount: 3,
+	}
+	if conf.IsSet("webhook.timeout_seconds") {
+		hn.timeout = time.Duration(conf.GetInt("webhook.timeout_seconds")) * time.Second
+	}
+	if conf.IsSet("webhook.retry_count") {
+		hn.retryCount = conf.GetInt("webhook.retry_count")
+	}
+
+	workers, queueSize := 8, 1000
+	if conf.IsSet("webhook.workers") {
+		workers = conf.GetInt("webhook.workers")
+	}
+	if conf.IsSet("webhook.queue_size") {
+		queueSize = conf.GetInt("webhook.queue_size")
+	}
+	if workers < 1 || queueSize < 0 {
+		return nil, errors.New("webhook.workers must be positive and webhook.queue_size not negative")
+	}
+	hn.pool = sharedPool(workers, queueSize)
+	return &hn, nil
+}
+
+var (
+	poolMu sync.Mutex
+	pool   *deliveryPool
+)
+
+func sharedPool(workers int, queueSize int) *deliveryPool {
+	poolMu.Lock()
+	defer poolMu.Unlock()
+	if pool == nil {
+		pool = newDeliveryPool(workers, queueSize)
+	}
+	return pool
+}
+
+//
+// Drain stops taking deliveries and waits, until ctx is done, for those
+// queued to finish; deliveries made after it are dropped
+//
+func Drain(ctx context.Context) error {
+	poolMu.Lock()
+	p := pool
+	pool = nil
+	poolMu.Unlock()
+	if p == nil {
+		return nil
+	}
+	return p.drain(ctx)
+}
+
+//
+// deliveryPool runs queued deliveries on a fixed number of goroutines
+//
+type deliveryPool struct {
+	mu     sync.RWMutex
+	closed bool
+	jobs   chan func()
+	wg     sync.WaitGroup
+}
+
+func newDeliveryPool(workers int, queueSize int) *deliveryPool {
+	p := &deliveryPool{jobs: make(chan func(), queueSize)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+//
+// submit queues job; returns false if the queue is full or drained
+//
+func (p *deliveryPool) submit(job func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+	select {
+	case p.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *deliveryPool) drain(ctx context.Context) error {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.jobs)
+	}
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "gave up waiting on webhook deliveries")
+	}
+}
+
+//
+// Sign returns the signature of body with secret
+//
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type httpNotifier struct {
+	sm           state.Manager
+	log          flotillaLog.Logger
+	pool         *deliveryPool
+	timeout      time.Duration
+	retryCount   int
+	retryBackoff time.Duration
+}
+
+//
+// Notify POSTs the run to every webhook it matches; deliveries are queued
+// and made in the background, and recorded when they finish. Those that
+// do not fit in the queue are dropped, and recorded as failed
+//
+func (hn *httpNotifier) Notify(run state.Run) {
+	hooks, err := hn.matching(run)
+	if err != nil {
+		hn.log.Log("message", "Error listing webhooks", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	for _, hook := range hooks {
+		hook := hook
+		if !hn.pool.submit(func() { hn.deliver(hook, run) }) {
+			hn.drop(hook, run)
+		}
+	}
+}
+
+func (hn *httpNotifier) matching(run state.Run) ([]state.Webhook, error) {
+	var matched []state.Webhook
+	for offset := 0; ; offset += webhookBatchSize {
+		wl, err := hn.sm.ListWebhooks(webhookBatchSize, offset, nil)
+		if err != nil {
+			return matched, errors.Wrap(err, "problem listing webhooks")
+		}
+		for _, hook := range wl.Webhooks {
+			if hook.Matches(run) {
+				matched = append(matched, hook)
+			}
+		}
+		if len(wl.Webhooks) < webhookBatchSize {
+			return matched, nil
+		}
+	}
+}
+
+//
+// deliver sends the run to the webhook, retrying failures, and
+// records the outcome
+//
+func (hn *httpNotifier) deliver(hook state.Webhook, run state.Run) state.WebhookDelivery {
+	delivery := state.WebhookDelivery{
+		WebhookID: hook.WebhookID,
+		RunID:     run.RunID,
+		RunStatus: run.Status,
+	}
+
+	executor := &deliveryExecutor{}
+	err := hn.post(hook, run, &delivery, executor)
+	delivery.Attempts = executor.attempts
+	delivery.ResponseCode = executor.statusCode
+	if err != nil {
+		delivery.Error = err.Error()
+		hn.log.Log("message", "Error delivering webhook", "webhook_id", hook.WebhookID, "run_id", run.RunID, "error", err.Error())
+	} else {
+		delivery.Succeeded = true
+	}
+
+	if err = hn.sm.CreateWebhookDelivery(delivery); err != nil {
+		hn.log.Log("message", "Error recording webhook delivery", "webhook_id", hook.WebhookID, "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+	}
+	return delivery
+}
+
+//
+// drop records a delivery that was never attempted
+//
+func (hn *httpNotifier) drop(hook state.Webhook, run state.Run) {
+	hn.log.Log("message", "Dropping webhook delivery, queue is full", "webhook_id", hook.WebhookID, "run_id", run.RunID)
+	delivery := state.WebhookDelivery{
+		WebhookID: hook.WebhookID,
+		RunID:     run.RunID,
+		RunStatus: run.Status,
+		Error:     "dropped: webhook delivery queue is full",
+	}
+	deliveryID, err := state.NewWebhookDeliveryID()
+	if err == nil {
+		delivery.DeliveryID = deliveryID
+		err = hn.sm.CreateWebhookDelivery(delivery)
+	}
+	if err != nil {
+		hn.log.Log("message", "Error recording webhook delivery", "webhook_id", hook.WebhookID, "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+	}
+}
+
+func (hn *httpNotifier) post(
+	hook state.Webhook, run state.Run, delivery *state.WebhookDelivery, executor *deliveryExecutor) error {
+	deliveryID, err := state.NewWebhookDeliveryID()
+	if err != nil {
+		return errors.Wrap(err, "problem generating delivery id")
+	}
+	delivery.DeliveryID = deliveryID
+
+	body, err := json.Marshal(run)
+	if err != nil {
+		return errors.Wrap(err, "problem encoding run")
+	}
+
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return errors.Wrapf(err, "problem parsing webhook url [%s]", hook.URL)
+	}
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+		DeliveryHeader: deliveryID,
+	}
+	if len(hook.Secret) > 0 {
+		headers[SignatureHeader] = "sha256=" + Sign(hook.Secret, body)
+	}
+
+	client := httpclient.Client{
+		Host:         hook.URL,
+		Timeout:      hn.timeout,
+		RetryCount:   hn.retryCount,
+		RetryBackoff: hn.retryBackoff,
+		Executor:     executor,
+	}
+	return client.Post(u.RequestURI(), headers, json.RawMessage(body), nil)
+}
+
+type retryableError struct {
+	e error
+}
+
+func (re retryableError) Error() string {
+	return re.e.Error()
+}
+
+func (re retryableError) Err() string {
+	return re.e.Error()
+}
+
+//
+// deliveryExecutor counts attempts and keeps the last response code;
+// connection errors, 5xx and 429 responses are retried
+//
+type deliveryExecutor struct {
+	attempts   int64
+	statusCode int64
+}
+
+func (de *deliveryExecutor) Do(req *http.Request, timeout time.Duration, entity interface{}) error {
+	de.attempts++
+	client := http.Client{Timeout: timeout}
+
+	r, err := client.Do(req)
+	if err != nil {
+		de.statusCode = 0
+		return retryableError{err}
+	}
+	r.Body.Close()
+
+	de.statusCode = int64(r.StatusCode)
+	if r.StatusCode >= 200 && r.StatusCode < 300 {
+		return nil
+	}
+	err = fmt.Errorf("Error response: %v", r.Status)
+	if r.StatusCode >= 500 || r.StatusCode == http.StatusTooManyRequests {
+		return retryableError{err}
+	}
+	return err
+}
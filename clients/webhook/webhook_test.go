@@ -0,0 +1,180 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	gklog "github.com/go-kit/kit/log"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func setUp(t *testing.T) (*httpNotifier, *testutils.ImplementsAllTheThings) {
+	l := gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr))
+	logger := flotillaLog.NewLogger(l, nil)
+
+	imp := testutils.ImplementsAllTheThings{T: t}
+	return &httpNotifier{
+		sm:           &imp,
+		log:          logger,
+		timeout:      time.Second,
+		retryCount:   2,
+		retryBackoff: time.Millisecond,
+	}, &imp
+}
+
+func TestHttpNotifier_Deliver(t *testing.T) {
+	hn, imp := setUp(t)
+
+	var received []*http.Request
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = append(received, r)
+		bodies = append(bodies, body)
+		if len(received) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	hook := state.Webhook{WebhookID: "w1", URL: server.URL + "/hooks/flotilla?team=ds", Secret: "s3cret"}
+	run := state.Run{RunID: "run1", Status: state.StatusStopped}
+
+	// The first attempt fails and is retried
+	delivery := hn.deliver(hook, run)
+	if !delivery.Succeeded || delivery.Attempts != 2 || delivery.ResponseCode != http.StatusOK {
+		t.Errorf("Expected delivery to succeed on its second attempt, got %v", delivery)
+	}
+	if len(imp.WebhookDeliveries) != 1 || imp.WebhookDeliveries[0].DeliveryID != delivery.DeliveryID {
+		t.Errorf("Expected delivery to be recorded, got %v", imp.WebhookDeliveries)
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 requests but got %v", len(received))
+	}
+	r := received[1]
+	if r.Method != "POST" || r.URL.Path != "/hooks/flotilla" || r.URL.Query().Get("team") != "ds" {
+		t.Errorf("Expected POST to the webhook url, got %s %s", r.Method, r.URL.String())
+	}
+	if r.Header.Get(DeliveryHeader) != delivery.DeliveryID {
+		t.Errorf("Expected delivery id header [%s], got [%s]", delivery.DeliveryID, r.Header.Get(DeliveryHeader))
+	}
+
+	body := bodies[1]
+	if string(body) != string(bodies[0]) {
+		t.Errorf("Expected retry to send the same body")
+	}
+	if expected := "sha256=" + Sign("s3cret", body); r.Header.Get(SignatureHeader) != expected {
+		t.Errorf("Expected signature [%s], got [%s]", expected, r.Header.Get(SignatureHeader))
+	}
+
+	var sent state.Run
+	if err := json.Unmarshal(body, &sent); err != nil || sent.RunID != "run1" || sent.Status != state.StatusStopped {
+		t.Errorf("Expected the run as the body, got %s", string(body))
+	}
+}
+
+func TestHttpNotifier_DeliverFailure(t *testing.T) {
+	hn, imp := setUp(t)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get(SignatureHeader) != "" {
+			t.Errorf("Expected no signature for a webhook without a secret")
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	// Client errors are not retried
+	delivery := hn.deliver(state.Webhook{WebhookID: "w1", URL: server.URL}, state.Run{RunID: "run1"})
+	if delivery.Succeeded || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusNotFound ||
+		len(delivery.Error) == 0 {
+		t.Errorf("Expected a single failed attempt, got %v", delivery)
+	}
+	if requests != 1 || len(imp.WebhookDeliveries) != 1 {
+		t.Errorf("Expected 1 request and 1 recorded delivery, got %v and %v", requests, len(imp.WebhookDeliveries))
+	}
+}
+
+func TestHttpNotifier_Matching(t *testing.T) {
+	hn, imp := setUp(t)
+	imp.Webhooks = map[string]state.Webhook{
+		"global":  {WebhookID: "global"},
+		"groupA":  {WebhookID: "groupA", GroupName: "A"},
+		"groupB":  {WebhookID: "groupB", GroupName: "B"},
+		"running": {WebhookID: "running", Statuses: &state.StatusList{state.StatusRunning}},
+	}
+
+	matched, err := hn.matching(state.Run{GroupName: "A", Status: state.StatusStopped})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(matched) != 2 || matched[0].WebhookID != "global" || matched[1].WebhookID != "groupA" {
+		t.Errorf("Expected the global and group A webhooks to match, got %v", matched)
+	}
+}
+
+func TestHttpNotifier_NotifyQueueFull(t *testing.T) {
+	hn, imp := setUp(t)
+	// No workers, so only a single delivery fits
+	hn.pool = newDeliveryPool(0, 1)
+	imp.Webhooks = map[string]state.Webhook{
+		"w1": {WebhookID: "w1"},
+		"w2": {WebhookID: "w2"},
+	}
+
+	hn.Notify(state.Run{RunID: "run1", Status: state.StatusStopped})
+	if len(imp.WebhookDeliveries) != 1 {
+		t.Fatalf("Expected 1 dropped delivery to be recorded, got %v", len(imp.WebhookDeliveries))
+	}
+	dropped := imp.WebhookDeliveries[0]
+	if dropped.WebhookID != "w2" || dropped.Succeeded || dropped.Attempts != 0 ||
+		len(dropped.DeliveryID) == 0 || len(dropped.Error) == 0 {
+		t.Errorf("Expected an unattempted, failed delivery to w2, got %v", dropped)
+	}
+}
+
+func TestHttpNotifier_Drain(t *testing.T) {
+	hn, imp := setUp(t)
+	hn.pool = newDeliveryPool(1, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	imp.Webhooks = map[string]state.Webhook{
+		"w1": {WebhookID: "w1", URL: server.URL},
+		"w2": {WebhookID: "w2", URL: server.URL},
+		"w3": {WebhookID: "w3", URL: server.URL},
+	}
+
+	hn.Notify(state.Run{RunID: "run1", Status: state.StatusStopped})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := hn.pool.drain(ctx); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(imp.WebhookDeliveries) != 3 {
+		t.Fatalf("Expected drain to wait on 3 deliveries, got %v", len(imp.WebhookDeliveries))
+	}
+	for _, delivery := range imp.WebhookDeliveries {
+		if !delivery.Succeeded {
+			t.Errorf("Expected delivery to succeed, got %v", delivery)
+		}
+	}
+
+	if hn.pool.submit(func() {}) {
+		t.Errorf("Expected a drained pool to refuse deliveries")
+	}
+}
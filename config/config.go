@@ -16,6 +16,7 @@ type Config interface {
 	GetInt(key string) int
 	GetBool(key string) bool
 	IsSet(key string) bool
+	Set(key string, value interface{})
 }
 
 //
@@ -68,3 +69,10 @@ func (c *conf) GetStringSlice(key string) []string {
 func (c *conf) IsSet(key string) bool {
 	return c.v.IsSet(key)
 }
+
+//
+// Set overrides the value of key, from config.yml or the environment
+//
+func (c *conf) Set(key string, value interface{}) {
+	c.v.Set(key, value)
+}
@@ -24,3 +24,15 @@ func TestNewConfig(t *testing.T) {
 			c.GetString("queue.namespace"))
 	}
 }
+
+func TestConf_Set(t *testing.T) {
+	os.Setenv("CREATE_DATABASE_SCHEMA", "false")
+	defer os.Unsetenv("CREATE_DATABASE_SCHEMA")
+
+	confDir := "../conf"
+	c, _ := NewConfig(&confDir)
+	c.Set("create_database_schema", true)
+	if !c.GetBool("create_database_schema") {
+		t.Errorf("Expected set value to override the environment")
+	}
+}
@@ -34,3 +34,27 @@ type MissingResource struct {
 func (e MissingResource) Error() string {
 	return e.ErrorString
 }
+
+//
+// Unauthorized describes a request without valid credentials
+// eg. missing, unknown or revoked api token
+//
+type Unauthorized struct {
+	ErrorString string
+}
+
+func (e Unauthorized) Error() string {
+	return e.ErrorString
+}
+
+//
+// Forbidden describes a request whose credentials do not allow it
+// eg. an api token without the scope the request needs
+//
+type Forbidden struct {
+	ErrorString string
+}
+
+func (e Forbidden) Error() string {
+	return e.ErrorString
+}
@@ -14,7 +14,7 @@ import (
 //
 type ECSAdapter interface {
 	AdaptTask(task ecs.Task) state.Run
-	AdaptRun(definition state.Definition, run state.Run) ecs.RunTaskInput
+	AdaptRun(run state.Run) ecs.RunTaskInput
 	AdaptDefinition(definition state.Definition) ecs.RegisterTaskDefinitionInput
 	AdaptTaskDef(taskDef ecs.TaskDefinition) state.Definition
 }
@@ -108,92 +108,114 @@ func (a *ecsAdapter) AdaptTask(task ecs.Task) state.Run {
 		run.Status = state.StatusStopped
 	}
 
-	if a.needsRetried(run, task) {
-		run.Status = state.StatusNeedsRetry
-		run.InstanceID = ""
-		run.InstanceDNSName = ""
+	//
+	// This is a -strong- indication of abnormal exit, not internal to the run
+	//
+	if run.Status == state.StatusStopped && run.ExitCode == nil {
+		run.FailureReason = a.failureReason(task)
+		if a.needsRetried(run.FailureReason) {
+			run.Status = state.StatusNeedsRetry
+			run.InstanceID = ""
+			run.InstanceDNSName = ""
+		}
 	}
 
 	return run
 }
 
-func (a *ecsAdapter) needsRetried(run state.Run, task ecs.Task) bool {
-	//
-	// This is a -strong- indication of abnormal exit, not internal to the run
-	//
-	if run.Status == state.StatusStopped && run.ExitCode == nil {
-		containerReason := "?"
-		if len(task.Containers) == 1 {
-			container := task.Containers[0]
-			if container != nil && container.Reason != nil {
-				containerReason = *container.Reason
-			}
+//
+// failureReason is the container's stopped reason, falling back to
+// the task's when the container has none
+//
+func (a *ecsAdapter) failureReason(task ecs.Task) string {
+	if len(task.Containers) == 1 {
+		container := task.Containers[0]
+		if container != nil && container.Reason != nil && len(*container.Reason) > 0 {
+			return *container.Reason
 		}
+	}
+	if task.StoppedReason != nil && len(*task.StoppedReason) > 0 {
+		return *task.StoppedReason
+	}
+	return "?"
+}
 
-		for _, retriable := range a.retriable {
-			// Container's stopped reason contains a retriable error
-			if strings.Contains(containerReason, retriable) {
-				return true
-			}
+func (a *ecsAdapter) needsRetried(failureReason string) bool {
+	for _, retriable := range a.retriable {
+		// Container's stopped reason contains a retriable error
+		if strings.Contains(failureReason, retriable) {
+			return true
 		}
 	}
 	return false
 }
 
 //
-// AdaptRun translates the definition and run into the required arguments
-// to run an ecs task. There are -several- simplifications to be aware of
+// AdaptRun translates the run into the required arguments to run an ecs task.
+// There are -several- simplifications to be aware of
 //
 // 1. There is currently only ever *1* container per definition
 // 2. There is only ever *1* task launched per run at a time
-// 3. Only environment variable overrides are supported (think of these as parameters)
-//    Once we start copying the definition information (eg. command, memory, cpu) directly
-//    onto the run we will make use of these overrides since it's important to run what
-//    we asked for -at the time- of run creation
+// 3. The task definition launched is the one registered when the run was created;
+//    the command, memory, cpu, and environment copied onto the run are passed as overrides
+//    since it's important to run what we asked for -at the time- of run creation
 //
-func (a *ecsAdapter) AdaptRun(definition state.Definition, run state.Run) ecs.RunTaskInput {
+func (a *ecsAdapter) AdaptRun(run state.Run) ecs.RunTaskInput {
 	n := int64(1)
 
 	overrides := ecs.TaskOverride{
-		ContainerOverrides: []*ecs.ContainerOverride{a.envOverrides(definition, run)},
+		ContainerOverrides: []*ecs.ContainerOverride{a.containerOverrides(run)},
 	}
 
 	rti := ecs.RunTaskInput{
 		Cluster:        &run.ClusterName,
 		Count:          &n,
 		StartedBy:      aws.String("flotilla"),
-		TaskDefinition: &definition.Arn,
+		TaskDefinition: &run.DefinitionArn,
 		Overrides:      &overrides,
 	}
 	return rti
 }
 
-func (a *ecsAdapter) envOverrides(definition state.Definition, run state.Run) *ecs.ContainerOverride {
-	if run.Env == nil {
-		return nil
-	}
-
-	pairs := make([]*ecs.KeyValuePair, len(*run.Env))
-	for i, ev := range *run.Env {
-		name := ev.Name
-		value := ev.Value
-		pairs[i] = &ecs.KeyValuePair{
-			Name:  &name,
-			Value: &value,
-		}
-	}
-
+func (a *ecsAdapter) containerOverrides(run state.Run) *ecs.ContainerOverride {
 	//
 	// Support legacy case of differing container name and definition id
 	//
-	containerName := definition.DefinitionID
-	if definition.ContainerName != definition.DefinitionID {
-		containerName = definition.ContainerName
+	containerName := run.DefinitionID
+	if len(run.ContainerName) > 0 && run.ContainerName != run.DefinitionID {
+		containerName = run.ContainerName
 	}
 
 	res := ecs.ContainerOverride{
-		Name:        &containerName,
-		Environment: pairs,
+		Name:              &containerName,
+		Memory:            run.Memory,
+		MemoryReservation: run.MemoryReserved,
+		Cpu:               run.CPU,
+	}
+
+	if run.Env != nil {
+		pairs := make([]*ecs.KeyValuePair, len(*run.Env))
+		for i, ev := range *run.Env {
+			name := ev.Name
+			value := ev.Value
+			pairs[i] = &ecs.KeyValuePair{
+				Name:  &name,
+				Value: &value,
+			}
+		}
+		res.Environment = pairs
+	}
+
+	if len(run.Command) > 0 {
+		cmdString, err := run.WrappedCommand()
+		if err != nil {
+			// Fallback
+			cmdString = run.Command
+		}
+		cmds := []string{"bash", "-l", "-c", cmdString}
+		res.Command = []*string{
+			&cmds[0], &cmds[1], &cmds[2], &cmds[3],
+		}
 	}
 	return &res
 }
@@ -210,13 +232,15 @@ func (a *ecsAdapter) envOverrides(definition state.Definition, run state.Run) *e
 //       networking; MOST runs will not use this currently as we're using "host" networking mode
 // * we wrap the command specified to ensure lines are echoed and the exit code is captured and is an injection
 //   point for other infra related concerns
-//
-// TODO - add CPU
+// * memory is the container's hard limit and memory reservation its soft limit; cpu is the
+//   container's cpu units
 //
 func (a *ecsAdapter) AdaptDefinition(definition state.Definition) ecs.RegisterTaskDefinitionInput {
 	containerDef := a.defaultContainerDefinition()
 	containerDef.Image = &definition.Image
 	containerDef.Memory = definition.Memory
+	containerDef.MemoryReservation = definition.MemoryReserved
+	containerDef.Cpu = definition.CPU
 	containerDef.Name = &definition.DefinitionID
 	containerDef.DockerLabels = map[string]*string{
 		"alias":      &definition.Alias,
@@ -286,6 +310,8 @@ func (a *ecsAdapter) AdaptTaskDef(taskDef ecs.TaskDefinition) state.Definition {
 		container := taskDef.ContainerDefinitions[0]
 
 		adapted.Memory = container.Memory
+		adapted.MemoryReserved = container.MemoryReservation
+		adapted.CPU = container.Cpu
 		adapted.Image = *container.Image
 
 		alias, _ := container.DockerLabels["alias"]
@@ -74,12 +74,6 @@ func setUp(t *testing.T) ecsAdapter {
 func TestEcsAdapter_AdaptRun(t *testing.T) {
 	adapter := setUp(t)
 
-	definition := state.Definition{
-		Arn:           "darn",
-		GroupName:     "groupa",
-		ContainerName: "mynameiswhat",
-	}
-
 	k1 := "ENVVAR_A"
 	k2 := "ENVVAR_B"
 	v1 := "VALUEA"
@@ -89,17 +83,39 @@ func TestEcsAdapter_AdaptRun(t *testing.T) {
 		{Name: k2, Value: v2},
 	})
 
+	memory := int64(512)
 	run := state.Run{
-		ClusterName: "clusta",
-		GroupName:   "groupa",
-		Env:         &env,
+		ClusterName:   "clusta",
+		GroupName:     "groupa",
+		DefinitionArn: "darn",
+		ContainerName: "mynameiswhat",
+		Command:       "echo hi",
+		Memory:        &memory,
+		Env:           &env,
 	}
-	rti := adapter.AdaptRun(definition, run)
+	rti := adapter.AdaptRun(run)
 
 	if rti.Cluster == nil || *rti.Cluster != run.ClusterName {
 		t.Errorf("Expected cluster name clusta")
 	}
 
+	if rti.TaskDefinition == nil || *rti.TaskDefinition != run.DefinitionArn {
+		t.Errorf("Expected the task definition registered when the run was created [darn]")
+	}
+
+	if rti.Overrides != nil && len(rti.Overrides.ContainerOverrides) > 0 {
+		override := rti.Overrides.ContainerOverrides[0]
+		if override.Name == nil || *override.Name != run.ContainerName {
+			t.Errorf("Expected container override for [%s]", run.ContainerName)
+		}
+		if override.Memory == nil || *override.Memory != memory {
+			t.Errorf("Expected memory override of %v", memory)
+		}
+		if len(override.Command) != 4 || *override.Command[0] != "bash" {
+			t.Errorf("Expected wrapped bash command override, got %v", override.Command)
+		}
+	}
+
 	if rti.Overrides != nil && len(rti.Overrides.ContainerOverrides) > 0 {
 		envOverrides := rti.Overrides.ContainerOverrides[0].Environment
 		if len(envOverrides) != len(env) {
@@ -276,6 +292,27 @@ func TestEcsAdapter_AdaptTask(t *testing.T) {
 	if adapted.Status != state.StatusNeedsRetry {
 		t.Errorf("Expected status %s, was %s", state.StatusNeedsRetry, adapted.Status)
 	}
+
+	if adapted.FailureReason != retriableReason {
+		t.Errorf("Expected failure reason %s, was %s", retriableReason, adapted.FailureReason)
+	}
+
+	// Failed, but not for a reason the adapter retries
+	otherReason := "killed: out of memory"
+	task4 := task3
+	task4.Containers = []*ecs.Container{{
+		ExitCode:   nil,
+		Reason:     &otherReason,
+		LastStatus: &state.StatusStopped,
+	}}
+	adapted = adapter.AdaptTask(task4)
+	if adapted.Status != state.StatusStopped {
+		t.Errorf("Expected status %s, was %s", state.StatusStopped, adapted.Status)
+	}
+
+	if adapted.FailureReason != otherReason {
+		t.Errorf("Expected failure reason %s, was %s", otherReason, adapted.FailureReason)
+	}
 }
 
 func TestEcsAdapter_AdaptDefinition(t *testing.T) {
@@ -0,0 +1,254 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// dockerServiceClient is the subset of the docker engine api
+// used by the DockerExecutionEngine
+//
+type dockerServiceClient interface {
+	ContainerCreate(name string, config *container.Config, hostConfig *container.HostConfig) (string, error)
+	ContainerStart(containerID string) error
+	ContainerStop(containerID string, timeout time.Duration) error
+	ContainerRemove(containerID string) error
+	ContainerInspect(containerID string) (types.ContainerJSON, error)
+	ContainerList(labels []string) ([]types.Container, error)
+	ImagePull(image string) error
+}
+
+//
+// dockerAPIError wraps a non-2xx response from the docker engine api
+//
+type dockerAPIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e dockerAPIError) Error() string {
+	return fmt.Sprintf("docker engine api error [%d]: %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	apiErr, ok := errors.Cause(err).(dockerAPIError)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+func isDockerConflict(err error) bool {
+	apiErr, ok := errors.Cause(err).(dockerAPIError)
+	return ok && apiErr.StatusCode == http.StatusConflict
+}
+
+//
+// dockerHTTPClient talks to the docker engine api directly over http;
+// either on a unix socket (unix:///var/run/docker.sock) or tcp (tcp://host:2375)
+//
+type dockerHTTPClient struct {
+	baseURL    string
+	apiVersion string
+	client     *http.Client
+}
+
+type containerCreateRequest struct {
+	*container.Config
+	HostConfig *container.HostConfig `json:"HostConfig,omitempty"`
+}
+
+type containerCreateResponse struct {
+	ID       string   `json:"Id"`
+	Warnings []string `json:"Warnings"`
+}
+
+func newDockerHTTPClient(host string, apiVersion string) (*dockerHTTPClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem parsing docker host [%s]", host)
+	}
+
+	dc := &dockerHTTPClient{apiVersion: apiVersion}
+	switch u.Scheme {
+	case "unix":
+		socketPath := u.Path
+		dc.baseURL = "http://docker"
+		dc.client = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		}
+	case "tcp", "http":
+		dc.baseURL = fmt.Sprintf("http://%s", u.Host)
+		dc.client = &http.Client{}
+	default:
+		return nil, errors.Errorf("unsupported docker host scheme [%s], must be one of (unix, tcp)", u.Scheme)
+	}
+	return dc, nil
+}
+
+func (dc *dockerHTTPClient) url(path string, query url.Values) string {
+	u := fmt.Sprintf("%s/v%s%s", dc.baseURL, dc.apiVersion, path)
+	if len(query) > 0 {
+		u = fmt.Sprintf("%s?%s", u, query.Encode())
+	}
+	return u
+}
+
+func (dc *dockerHTTPClient) do(method string, path string, query url.Values, in interface{}, out interface{}) error {
+	body, err := dc.open(method, path, query, in)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if out == nil {
+		// Drain so the connection is reused
+		_, err = io.Copy(ioutil.Discard, body)
+		return err
+	}
+	return json.NewDecoder(body).Decode(out)
+}
+
+//
+// open makes the request and returns the body of a successful response;
+// the caller closes it
+//
+func (dc *dockerHTTPClient) open(method string, path string, query url.Values, in interface{}) (io.ReadCloser, error) {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return nil, errors.Wrapf(err, "problem encoding docker request body for [%s %s]", method, path)
+		}
+		body = strings.NewReader(string(encoded))
+	}
+
+	req, err := http.NewRequest(method, dc.url(path, query), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem creating docker request [%s %s]", method, path)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := dc.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "problem calling docker engine api [%s %s]", method, path)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		raw, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(raw, &apiErr) != nil || len(apiErr.Message) == 0 {
+			apiErr.Message = strings.TrimSpace(string(raw))
+		}
+		return nil, dockerAPIError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+	}
+	return resp.Body, nil
+}
+
+func (dc *dockerHTTPClient) ContainerCreate(
+	name string, config *container.Config, hostConfig *container.HostConfig) (string, error) {
+	var created containerCreateResponse
+	err := dc.do("POST", "/containers/create", url.Values{"name": {name}},
+		containerCreateRequest{Config: config, HostConfig: hostConfig}, &created)
+	return created.ID, err
+}
+
+func (dc *dockerHTTPClient) ContainerStart(containerID string) error {
+	return dc.do("POST", fmt.Sprintf("/containers/%s/start", containerID), nil, nil, nil)
+}
+
+func (dc *dockerHTTPClient) ContainerStop(containerID string, timeout time.Duration) error {
+	query := url.Values{"t": {fmt.Sprintf("%d", int(timeout.Seconds()))}}
+	err := dc.do("POST", fmt.Sprintf("/containers/%s/stop", containerID), query, nil, nil)
+	if apiErr, ok := err.(dockerAPIError); ok && apiErr.StatusCode == http.StatusNotModified {
+		// Already stopped
+		return nil
+	}
+	return err
+}
+
+func (dc *dockerHTTPClient) ContainerRemove(containerID string) error {
+	return dc.do("DELETE", fmt.Sprintf("/containers/%s", containerID), url.Values{"v": {"1"}}, nil, nil)
+}
+
+func (dc *dockerHTTPClient) ContainerInspect(containerID string) (types.ContainerJSON, error) {
+	var inspected types.ContainerJSON
+	err := dc.do("GET", fmt.Sprintf("/containers/%s/json", containerID), nil, nil, &inspected)
+	return inspected, err
+}
+
+func (dc *dockerHTTPClient) ContainerList(labels []string) ([]types.Container, error) {
+	var containers []types.Container
+	filters, err := json.Marshal(map[string][]string{"label": labels})
+	if err != nil {
+		return containers, errors.Wrap(err, "problem encoding docker container list filters")
+	}
+	query := url.Values{
+		"all":     {"1"},
+		"filters": {string(filters)},
+	}
+	err = dc.do("GET", "/containers/json", query, nil, &containers)
+	return containers, err
+}
+
+//
+// ImagePull pulls the image; the pull is complete when its progress
+// stream ends, and failures part way (eg. a missing tag or denied access)
+// are only reported in the stream
+//
+func (dc *dockerHTTPClient) ImagePull(image string) error {
+	body, err := dc.open("POST", "/images/create", url.Values{"fromImage": {image}}, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return readPullProgress(body)
+}
+
+type pullProgress struct {
+	Error       string `json:"error"`
+	ErrorDetail struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
+
+//
+// readPullProgress reads an image pull's progress stream to its end and
+// returns the first error reported in it
+//
+func readPullProgress(stream io.Reader) error {
+	decoder := json.NewDecoder(stream)
+	for {
+		var progress pullProgress
+		if err := decoder.Decode(&progress); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "problem reading image pull progress")
+		}
+		if len(progress.ErrorDetail.Message) > 0 {
+			return errors.New(progress.ErrorDetail.Message)
+		}
+		if len(progress.Error) > 0 {
+			return errors.New(progress.Error)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+package engine
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/queue"
+	"github.com/stitchfix/flotilla-os/state"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dockerRunIDLabel        = "flotilla.run_id"
+	dockerDefinitionIDLabel = "flotilla.definition_id"
+	dockerServerModeLabel   = "flotilla.server_mode"
+	dockerRunEnvLabel       = "flotilla.run_env"
+)
+
+//
+// DockerExecutionEngine runs containers on a single docker host using the
+// docker engine api. It is intended for local development and CI where there
+// is no ECS cluster available.
+//
+// * Runs are buffered using the configured queue.Manager, exactly as with ECS
+// * Definitions are not registered anywhere; the definition fields copied onto
+//   the run (image, command, memory, env and ports) -are- the container spec
+// * Status changes are found by listing flotilla containers on the host and
+//   reporting any whose status differs from the last one reported. Only the
+//   containers this engine saw unfinished are tracked: each is dropped once
+//   its STOPPED status is reported or it is removed, so containers that
+//   stopped before the engine started, or while it was down, are left to
+//   the reconcile worker rather than reported again
+// * a change handed out but never acked, eg. for a container without a run,
+//   goes to the back of the line so the other containers' changes are still
+//   reported
+//
+type DockerExecutionEngine struct {
+	dockerClient  dockerServiceClient
+	qm            queue.Manager
+	mode          string
+	networkMode   string
+	instanceID    string
+	stopTimeout   time.Duration
+	removeStopped bool
+	reportedMu    sync.Mutex
+	reported      map[string]string // tracked containers' last reported status, "" for none yet
+	attempted     map[string]string
+}
+
+//
+// Initialize configures the DockerExecutionEngine and initializes the docker client
+//
+func (de *DockerExecutionEngine) Initialize(conf config.Config) error {
+	de.mode = conf.GetString("flotilla_mode")
+	de.reported = make(map[string]string)
+	de.attempted = make(map[string]string)
+
+	host := "unix:///var/run/docker.sock"
+	if conf.IsSet("docker.host") {
+		host = conf.GetString("docker.host")
+	}
+
+	apiVersion := "1.24"
+	if conf.IsSet("docker.api_version") {
+		apiVersion = conf.GetString("docker.api_version")
+	}
+
+	de.networkMode = "bridge"
+	if conf.IsSet("docker.network_mode") {
+		de.networkMode = conf.GetString("docker.network_mode")
+	}
+
+	de.stopTimeout = 10 * time.Second
+	if conf.IsSet("docker.stop_timeout_seconds") {
+		de.stopTimeout = time.Duration(conf.GetInt("docker.stop_timeout_seconds")) * time.Second
+	}
+	de.removeStopped = conf.GetBool("docker.remove_stopped")
+
+	de.instanceID, _ = os.Hostname()
+
+	if de.mode != "test" {
+		dc, err := newDockerHTTPClient(host, apiVersion)
+		if err != nil {
+			return errors.Wrap(err, "problem initializing docker client")
+		}
+		de.dockerClient = dc
+	}
+
+	if de.qm == nil {
+		return errors.Errorf("no queue.Manager implementation; DockerExecutionEngine needs a queue.Manager")
+	}
+	return nil
+}
+
+//
+// PollStatus returns -at most- one run whose container status has changed since it was last reported
+//
+func (de *DockerExecutionEngine) PollStatus() (RunReceipt, error) {
+	var receipt RunReceipt
+
+	containers, err := de.dockerClient.ContainerList([]string{
+		dockerRunIDLabel,
+		fmt.Sprintf("%s=%s", dockerServerModeLabel, de.mode),
+	})
+	if err != nil {
+		return receipt, errors.Wrap(err, "problem listing flotilla containers")
+	}
+
+	c, found := de.nextChanged(containers)
+	if !found {
+		return receipt, nil
+	}
+
+	inspected, err := de.dockerClient.ContainerInspect(c.ID)
+	if err != nil {
+		return receipt, errors.Wrapf(err, "problem inspecting container [%s]", c.ID)
+	}
+
+	adapted := de.adaptContainer(inspected)
+	containerID := c.ID
+	receipt.Run = &adapted
+	receipt.Done = func() error {
+		return de.markReported(containerID, adapted.Status)
+	}
+	return receipt, nil
+}
+
+//
+// nextChanged picks the next container whose status was not reported,
+// skipping those already handed out at that status until every changed
+// container has been; it marks the one picked as handed out. Containers
+// no longer listed are forgotten
+//
+func (de *DockerExecutionEngine) nextChanged(containers []types.Container) (types.Container, bool) {
+	de.reportedMu.Lock()
+	defer de.reportedMu.Unlock()
+
+	listed := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		listed[c.ID] = true
+	}
+	for containerID := range de.reported {
+		if !listed[containerID] {
+			delete(de.reported, containerID)
+			delete(de.attempted, containerID)
+		}
+	}
+
+	var changed []types.Container
+	for _, c := range containers {
+		status := de.statusFor(c.State)
+		last, tracked := de.reported[c.ID]
+		if !tracked {
+			if status == state.StatusStopped {
+				// Stopped before it was tracked, or already reported
+				continue
+			}
+			de.reported[c.ID] = ""
+		}
+		if last == status {
+			continue
+		}
+		if attempted, ok := de.attempted[c.ID]; !ok || attempted != status {
+			de.attempted[c.ID] = status
+			return c, true
+		}
+		changed = append(changed, c)
+	}
+	if len(changed) == 0 {
+		return types.Container{}, false
+	}
+
+	// All were handed out without being acked; start over
+	for _, c := range changed {
+		delete(de.attempted, c.ID)
+	}
+	de.attempted[changed[0].ID] = de.statusFor(changed[0].State)
+	return changed[0], true
+}
+
+//
+// markReported records the container's reported status; a STOPPED
+// container is no longer tracked, and is removed if so configured
+//
+func (de *DockerExecutionEngine) markReported(containerID string, status string) error {
+	if status == state.StatusStopped && de.removeStopped {
+		if err := de.dockerClient.ContainerRemove(containerID); err != nil && !isDockerNotFound(err) {
+			return errors.Wrapf(err, "problem removing stopped container [%s]", containerID)
+		}
+	}
+
+	de.reportedMu.Lock()
+	defer de.reportedMu.Unlock()
+	if status == state.StatusStopped {
+		delete(de.reported, containerID)
+	} else {
+		de.reported[containerID] = status
+	}
+	delete(de.attempted, containerID)
+	return nil
+}
+
+//
+// track has the container's status changes reported, starting with
+// the first
+//
+func (de *DockerExecutionEngine) track(containerID string) {
+	de.reportedMu.Lock()
+	defer de.reportedMu.Unlock()
+	if _, ok := de.reported[containerID]; !ok {
+		de.reported[containerID] = ""
+	}
+}
+
+//
+// PollRuns receives -at most- one run per queue that is pending execution
+//
+func (de *DockerExecutionEngine) PollRuns() ([]RunReceipt, error) {
+	return pollRuns(de.qm)
+}
+
+//
+// Enqueue pushes a run onto the queue using the QueueManager
+//
+func (de *DockerExecutionEngine) Enqueue(run state.Run) error {
+	return enqueueRun(de.qm, run)
+}
+
+//
+// CanEnqueueTx reports whether the QueueManager can enqueue within a transaction
+//
+func (de *DockerExecutionEngine) CanEnqueueTx() bool {
+	return canEnqueueTx(de.qm)
+}
+
+//
+// EnqueueTx pushes a run onto the queue as part of tx
+//
+func (de *DockerExecutionEngine) EnqueueTx(tx *sql.Tx, run state.Run) error {
+	return enqueueRunTx(de.qm, tx, run)
+}
+
+//
+// Execute creates and starts a container for the run
+// * the image is pulled if it is not present on the host
+// * a run's container is named after the run, so re-submitting
+//   an already launched run returns the existing container
+//
+func (de *DockerExecutionEngine) Execute(run state.Run) (state.Run, bool, error) {
+	var executed state.Run
+
+	name := de.containerName(run)
+	cfg, hostCfg, err := de.containerConfig(run)
+	if err != nil {
+		return executed, false, errors.Wrapf(err, "problem building container config for run [%s]", run.RunID)
+	}
+
+	containerID, err := de.dockerClient.ContainerCreate(name, cfg, hostCfg)
+	if err != nil && isDockerNotFound(err) {
+		// Image isn't on the host yet
+		if err = de.dockerClient.ImagePull(cfg.Image); err != nil {
+			return executed, false, errors.Wrapf(err, "problem pulling image [%s] for run [%s]", cfg.Image, run.RunID)
+		}
+		containerID, err = de.dockerClient.ContainerCreate(name, cfg, hostCfg)
+	}
+
+	if err != nil {
+		if isDockerConflict(err) {
+			// Already created, report what exists
+			inspected, inspectErr := de.dockerClient.ContainerInspect(name)
+			if inspectErr != nil {
+				return executed, true, errors.Wrapf(inspectErr, "problem inspecting existing container for run [%s]", run.RunID)
+			}
+			return de.adaptContainer(inspected), false, nil
+		}
+		return executed, true, errors.Wrapf(err, "problem creating container for run [%s]", run.RunID)
+	}
+
+	// Tracked before it starts so a container that exits at once is reported
+	de.track(containerID)
+	if err = de.dockerClient.ContainerStart(containerID); err != nil {
+		//
+		// Failure to start (eg. a missing executable) is not an infra issue;
+		// clean up the container and do not retry
+		//
+		de.dockerClient.ContainerRemove(containerID)
+		return executed, false, errors.Wrapf(err, "problem starting container for run [%s]", run.RunID)
+	}
+
+	inspected, err := de.dockerClient.ContainerInspect(containerID)
+	if err != nil {
+		// The container is started; the status worker will fill in the rest
+		return state.Run{TaskArn: containerID, Status: state.StatusPending}, false, nil
+	}
+	return de.adaptContainer(inspected), false, nil
+}
+
+//
+// Terminate stops the run's container
+//
+func (de *DockerExecutionEngine) Terminate(run state.Run) error {
+	if err := de.dockerClient.ContainerStop(run.TaskArn, de.stopTimeout); err != nil {
+		return errors.Wrapf(err, "problem stopping run [%s] with container id [%s]", run.RunID, run.TaskArn)
+	}
+	return nil
+}
+
+//
+// Describe inspects the run's container
+//
+func (de *DockerExecutionEngine) Describe(run state.Run) (state.Run, error) {
+	inspected, err := de.dockerClient.ContainerInspect(run.TaskArn)
+	if err != nil {
+		if isDockerNotFound(err) {
+			return state.Run{}, exceptions.MissingResource{
+				ErrorString: fmt.Sprintf("docker has no container [%s] for run [%s]", run.TaskArn, run.RunID)}
+		}
+		return state.Run{}, errors.Wrapf(
+			err, "problem inspecting run [%s] with container id [%s]", run.RunID, run.TaskArn)
+	}
+	return de.adaptContainer(inspected), nil
+}
+
+//
+// Define "registers" the definition; there is nothing to register with docker, the definition
+// fields copied onto each run are used as the container spec at execution time
+//
+func (de *DockerExecutionEngine) Define(definition state.Definition) (state.Definition, error) {
+	defined := definition
+	defined.Arn = fmt.Sprintf("docker:%s", definition.DefinitionID)
+	defined.ContainerName = definition.DefinitionID
+	return defined, nil
+}
+
+//
+// Deregister is a no-op for docker
+//
+func (de *DockerExecutionEngine) Deregister(definition state.Definition) error {
+	return nil
+}
+
+func (de *DockerExecutionEngine) containerName(run state.Run) string {
+	return fmt.Sprintf("flotilla-%s", run.RunID)
+}
+
+//
+// containerConfig translates the run into docker container configuration
+// * the command is wrapped exactly as it is for ecs
+// * the run env already has the definition env merged in
+//
+func (de *DockerExecutionEngine) containerConfig(run state.Run) (*container.Config, *container.HostConfig, error) {
+
+	cmdString, err := run.WrappedCommand()
+	if err != nil {
+		// Fallback
+		cmdString = run.Command
+	}
+
+	var (
+		env         []string
+		runEnvNames []string
+	)
+	if run.Env != nil {
+		for _, e := range *run.Env {
+			env = append(env, fmt.Sprintf("%s=%s", e.Name, e.Value))
+			runEnvNames = append(runEnvNames, e.Name)
+		}
+	}
+
+	cfg := &container.Config{
+		Image: run.Image,
+		Cmd:   []string{"bash", "-l", "-c", cmdString},
+		Env:   env,
+		Labels: map[string]string{
+			dockerRunIDLabel:        run.RunID,
+			dockerDefinitionIDLabel: run.DefinitionID,
+			dockerServerModeLabel:   de.mode,
+			dockerRunEnvLabel:       strings.Join(runEnvNames, ","),
+			"alias":                 run.Alias,
+			"group.name":            run.GroupName,
+		},
+	}
+
+	hostCfg := &container.HostConfig{
+		NetworkMode: container.NetworkMode(de.networkMode),
+	}
+	if run.Memory != nil {
+		// Run memory is in MiB
+		hostCfg.Memory = *run.Memory * 1024 * 1024
+	}
+	if run.MemoryReserved != nil {
+		hostCfg.MemoryReservation = *run.MemoryReserved * 1024 * 1024
+	}
+	if run.CPU != nil {
+		// Cpu units are docker's cpu shares, 1024 to a cpu
+		hostCfg.CPUShares = *run.CPU
+	}
+
+	if run.Ports != nil && len(*run.Ports) > 0 {
+		cfg.ExposedPorts = nat.PortSet{}
+		hostCfg.PortBindings = nat.PortMap{}
+		for _, p := range *run.Ports {
+			port, err := nat.NewPort("tcp", fmt.Sprintf("%d", p))
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "invalid port [%d]", p)
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+			hostCfg.PortBindings[port] = []nat.PortBinding{
+				{HostPort: fmt.Sprintf("%d", p)},
+			}
+		}
+	}
+	return cfg, hostCfg, nil
+}
+
+func (de *DockerExecutionEngine) statusFor(containerState string) string {
+	switch containerState {
+	case "created":
+		return state.StatusPending
+	case "running", "restarting", "paused":
+		return state.StatusRunning
+	case "exited", "dead", "removing":
+		return state.StatusStopped
+	default:
+		return state.StatusPending
+	}
+}
+
+//
+// adaptContainer converts from an inspected container to a generic run
+//
+func (de *DockerExecutionEngine) adaptContainer(inspected types.ContainerJSON) state.Run {
+	run := state.Run{
+		InstanceID:      de.instanceID,
+		InstanceDNSName: de.instanceID,
+	}
+	if inspected.ContainerJSONBase != nil {
+		run.TaskArn = inspected.ID
+		if inspected.State != nil {
+			run.Status = de.statusFor(inspected.State.Status)
+			run.StartedAt = de.parseTime(inspected.State.StartedAt)
+			if run.Status == state.StatusStopped {
+				exitCode := int64(inspected.State.ExitCode)
+				run.ExitCode = &exitCode
+				run.FinishedAt = de.parseTime(inspected.State.FinishedAt)
+			}
+		}
+	}
+
+	if inspected.Config != nil {
+		run.RunID = inspected.Config.Labels[dockerRunIDLabel]
+		run.DefinitionID = inspected.Config.Labels[dockerDefinitionIDLabel]
+		//
+		// The container's env includes image env; only report the run's
+		// own env, mirroring ecs container overrides
+		//
+		runEnvNames := make(map[string]bool)
+		for _, name := range strings.Split(inspected.Config.Labels[dockerRunEnvLabel], ",") {
+			runEnvNames[name] = true
+		}
+		var env []state.EnvVar
+		for _, kv := range inspected.Config.Env {
+			split := strings.SplitN(kv, "=", 2)
+			if len(split) == 2 && runEnvNames[split[0]] {
+				env = append(env, state.EnvVar{Name: split[0], Value: split[1]})
+			}
+		}
+		if len(env) > 0 {
+			cast := state.EnvList(env)
+			run.Env = &cast
+		}
+	}
+	return run
+}
+
+//
+// parseTime parses docker's timestamps; docker reports unset times as the zero time
+//
+func (de *DockerExecutionEngine) parseTime(value string) *time.Time {
+	if len(value) == 0 {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil || t.IsZero() || t.Year() <= 1 {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,376 @@
+package engine
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mockDockerClient struct {
+	t          *testing.T
+	images     map[string]bool
+	containers map[string]types.ContainerJSON
+	created    []*container.Config
+	hostConfig []*container.HostConfig
+	calls      []string
+}
+
+func (mdc *mockDockerClient) ContainerCreate(
+	name string, config *container.Config, hostConfig *container.HostConfig) (string, error) {
+	mdc.calls = append(mdc.calls, "ContainerCreate")
+	if !mdc.images[config.Image] {
+		return "", dockerAPIError{StatusCode: http.StatusNotFound, Message: "No such image"}
+	}
+	if _, ok := mdc.containers[name]; ok {
+		return "", dockerAPIError{StatusCode: http.StatusConflict, Message: "Conflict"}
+	}
+	mdc.created = append(mdc.created, config)
+	mdc.hostConfig = append(mdc.hostConfig, hostConfig)
+	mdc.containers[name] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    name,
+			State: &types.ContainerState{Status: "created"},
+		},
+		Config: config,
+	}
+	return name, nil
+}
+
+func (mdc *mockDockerClient) ContainerStart(containerID string) error {
+	mdc.calls = append(mdc.calls, "ContainerStart")
+	c := mdc.containers[containerID]
+	c.State = &types.ContainerState{Status: "running", StartedAt: "2017-12-02T15:00:08.922Z"}
+	mdc.containers[containerID] = c
+	return nil
+}
+
+func (mdc *mockDockerClient) ContainerStop(containerID string, timeout time.Duration) error {
+	mdc.calls = append(mdc.calls, "ContainerStop")
+	return nil
+}
+
+func (mdc *mockDockerClient) ContainerRemove(containerID string) error {
+	mdc.calls = append(mdc.calls, "ContainerRemove")
+	delete(mdc.containers, containerID)
+	return nil
+}
+
+func (mdc *mockDockerClient) ContainerInspect(containerID string) (types.ContainerJSON, error) {
+	mdc.calls = append(mdc.calls, "ContainerInspect")
+	c, ok := mdc.containers[containerID]
+	if !ok {
+		return c, dockerAPIError{StatusCode: http.StatusNotFound, Message: "No such container"}
+	}
+	return c, nil
+}
+
+func (mdc *mockDockerClient) ContainerList(labels []string) ([]types.Container, error) {
+	mdc.calls = append(mdc.calls, "ContainerList")
+	var listed []types.Container
+	for id, c := range mdc.containers {
+		listed = append(listed, types.Container{ID: id, State: c.State.Status})
+	}
+	return listed, nil
+}
+
+func (mdc *mockDockerClient) ImagePull(image string) error {
+	mdc.calls = append(mdc.calls, "ImagePull")
+	mdc.images[image] = true
+	return nil
+}
+
+func setUpDockerEngine(t *testing.T) (*DockerExecutionEngine, *mockDockerClient) {
+	conf, _ := config.NewConfig(nil)
+	client := &mockDockerClient{
+		t:          t,
+		images:     map[string]bool{"cupcake:latest": true},
+		containers: map[string]types.ContainerJSON{},
+	}
+	eng := &DockerExecutionEngine{qm: &mockQueueManager{}}
+	eng.Initialize(conf)
+	eng.mode = "test"
+	eng.dockerClient = client
+	return eng, client
+}
+
+func TestDockerExecutionEngine_Execute(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	memory, cpu := int64(512), int64(256)
+	ports := state.PortsList{8080}
+	defEnv := state.EnvList{{Name: "DEF_VAR", Value: "a"}}
+	runEnv := state.EnvList{{Name: "FLOTILLA_SERVER_MODE", Value: "test"}, {Name: "RUN_VAR", Value: "b"}}
+	definition := state.Definition{
+		DefinitionID: "def:cupcake",
+		Image:        "cupcake:latest",
+		Command:      "echo hi",
+		Memory:       &memory,
+		CPU:          &cpu,
+		Ports:        &ports,
+		Env:          &defEnv,
+	}
+	run := state.Run{RunID: "run:cupcake", Env: &runEnv}
+	run.SnapshotDefinition(definition)
+
+	launched, retryable, err := eng.Execute(run)
+	if err != nil {
+		t.Errorf("Expected no error, got %v (retryable: %v)", err, retryable)
+	}
+
+	if launched.TaskArn != "flotilla-run:cupcake" {
+		t.Errorf("Expected task arn [flotilla-run:cupcake] but was [%s]", launched.TaskArn)
+	}
+
+	if launched.Status != state.StatusRunning {
+		t.Errorf("Expected status [%s] but was [%s]", state.StatusRunning, launched.Status)
+	}
+
+	if len(client.created) != 1 {
+		t.Fatalf("Expected 1 container to be created but was %v", len(client.created))
+	}
+
+	cfg := client.created[0]
+	if len(cfg.Cmd) != 4 || cfg.Cmd[0] != "bash" {
+		t.Errorf("Expected wrapped bash command, got %v", cfg.Cmd)
+	}
+
+	if len(cfg.Env) != 3 || cfg.Env[0] != "DEF_VAR=a" {
+		t.Errorf("Expected definition env followed by run env, got %v", cfg.Env)
+	}
+
+	hostCfg := client.hostConfig[0]
+	if hostCfg.Memory != 512*1024*1024 {
+		t.Errorf("Expected memory limit of 512MiB in bytes but was %v", hostCfg.Memory)
+	}
+	if hostCfg.CPUShares != 256 {
+		t.Errorf("Expected 256 cpu shares but was %v", hostCfg.CPUShares)
+	}
+
+	if len(hostCfg.PortBindings) != 1 {
+		t.Errorf("Expected 1 port binding but was %v", len(hostCfg.PortBindings))
+	}
+
+	if launched.Env == nil || len(*launched.Env) != 3 {
+		t.Errorf("Expected the run env to be reported, got %v", launched.Env)
+	}
+}
+
+func TestDockerExecutionEngine_ExecutePullsMissingImage(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	memory := int64(512)
+	run := state.Run{
+		RunID:        "run:shoebox",
+		DefinitionID: "def:shoebox",
+		Image:        "shoebox:latest",
+		Command:      "echo hi",
+		Memory:       &memory,
+	}
+
+	_, _, err := eng.Execute(run)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	expected := []string{"ContainerCreate", "ImagePull", "ContainerCreate", "ContainerStart", "ContainerInspect"}
+	if len(client.calls) != len(expected) {
+		t.Fatalf("Expected calls %v but was %v", expected, client.calls)
+	}
+	for i, call := range expected {
+		if client.calls[i] != call {
+			t.Errorf("Expected call %v to be [%s] but was [%s]", i, call, client.calls[i])
+		}
+	}
+}
+
+func TestDockerExecutionEngine_PollStatus(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	exited := types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID: "flotilla-run:cupcake",
+			State: &types.ContainerState{
+				Status:     "exited",
+				ExitCode:   1,
+				StartedAt:  "2017-12-02T15:00:08.922Z",
+				FinishedAt: "2017-12-02T15:06:37.429Z",
+			},
+		},
+		Config: &container.Config{
+			Env: []string{"PATH=/usr/bin", "FLOTILLA_SERVER_MODE=test"},
+			Labels: map[string]string{
+				dockerRunIDLabel:  "run:cupcake",
+				dockerRunEnvLabel: "FLOTILLA_SERVER_MODE",
+			},
+		},
+	}
+	running := exited
+	running.ContainerJSONBase = &types.ContainerJSONBase{
+		ID:    "flotilla-run:cupcake",
+		State: &types.ContainerState{Status: "running", StartedAt: "2017-12-02T15:00:08.922Z"},
+	}
+	client.containers["flotilla-run:cupcake"] = running
+
+	receipt, err := eng.PollStatus()
+	if err != nil || receipt.Run == nil || receipt.Run.Status != state.StatusRunning {
+		t.Fatalf("Expected a running status update, got %v and %v", receipt.Run, err)
+	}
+	receipt.Done()
+
+	client.containers["flotilla-run:cupcake"] = exited
+
+	receipt, err = eng.PollStatus()
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	run := receipt.Run
+	if run == nil {
+		t.Fatalf("Expected a status update")
+	}
+
+	if run.Status != state.StatusStopped {
+		t.Errorf("Expected status [%s] but was [%s]", state.StatusStopped, run.Status)
+	}
+
+	if run.ExitCode == nil || *run.ExitCode != 1 {
+		t.Errorf("Expected exit code 1, got %v", run.ExitCode)
+	}
+
+	if run.FinishedAt == nil {
+		t.Errorf("Expected non-nil finished at")
+	}
+
+	if run.Env == nil || len(*run.Env) != 1 {
+		t.Errorf("Expected only run env to be reported, got %v", run.Env)
+	}
+
+	if err = receipt.Done(); err != nil {
+		t.Errorf("Expected no error acking status update, got %v", err)
+	}
+
+	receipt, _ = eng.PollStatus()
+	if receipt.Run != nil {
+		t.Errorf("Expected no further status updates once reported, got %v", receipt.Run)
+	}
+	if len(eng.reported) != 0 {
+		t.Errorf("Expected a reported stopped container to be forgotten, got %v", eng.reported)
+	}
+}
+
+func TestDockerExecutionEngine_PollStatusUntracked(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	// Eg. stopped while the engine was down
+	client.containers["flotilla-run:cupcake"] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "flotilla-run:cupcake",
+			State: &types.ContainerState{Status: "exited", ExitCode: 0},
+		},
+		Config: &container.Config{Labels: map[string]string{dockerRunIDLabel: "run:cupcake"}},
+	}
+	receipt, _ := eng.PollStatus()
+	if receipt.Run != nil {
+		t.Errorf("Expected containers stopped before they were tracked not to be reported, got %v", receipt.Run)
+	}
+
+	// A tracked container that is removed is forgotten
+	launched, _, err := eng.Execute(state.Run{RunID: "run:muffin", Image: "cupcake:latest", Command: "echo hi"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, ok := eng.reported[launched.TaskArn]; !ok {
+		t.Errorf("Expected launched container to be tracked")
+	}
+	delete(client.containers, launched.TaskArn)
+	receipt, _ = eng.PollStatus()
+	if receipt.Run != nil || len(eng.reported) != 0 || len(eng.attempted) != 0 {
+		t.Errorf("Expected removed container to be forgotten, got %v, %v and %v",
+			receipt.Run, eng.reported, eng.attempted)
+	}
+}
+
+func TestDockerExecutionEngine_PollStatusUnacked(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	for _, runID := range []string{"run:cupcake", "run:muffin"} {
+		client.containers["flotilla-"+runID] = types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{
+				ID:    "flotilla-" + runID,
+				State: &types.ContainerState{Status: "running", StartedAt: "2017-12-02T15:00:08.922Z"},
+			},
+			Config: &container.Config{Labels: map[string]string{dockerRunIDLabel: runID}},
+		}
+	}
+
+	// An update that is never acked, eg. of a container without a run,
+	// does not hold up the others
+	first, _ := eng.PollStatus()
+	second, _ := eng.PollStatus()
+	if first.Run == nil || second.Run == nil || first.Run.TaskArn == second.Run.TaskArn {
+		t.Fatalf("Expected the other container's update after an unacked one, got %v and %v", first.Run, second.Run)
+	}
+	if err := second.Done(); err != nil {
+		t.Errorf("Expected no error acking status update, got %v", err)
+	}
+
+	third, _ := eng.PollStatus()
+	if third.Run == nil || third.Run.TaskArn != first.Run.TaskArn {
+		t.Errorf("Expected the unacked update to be handed out again, got %v", third.Run)
+	}
+}
+
+func TestDockerExecutionEngine_Describe(t *testing.T) {
+	eng, client := setUpDockerEngine(t)
+
+	client.containers["flotilla-run:cupcake"] = types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:    "flotilla-run:cupcake",
+			State: &types.ContainerState{Status: "exited", ExitCode: 2, FinishedAt: "2017-12-02T15:06:37.429Z"},
+		},
+		Config: &container.Config{Labels: map[string]string{dockerRunIDLabel: "run:cupcake"}},
+	}
+
+	described, err := eng.Describe(state.Run{RunID: "run:cupcake", TaskArn: "flotilla-run:cupcake"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if described.Status != state.StatusStopped || described.ExitCode == nil || *described.ExitCode != 2 {
+		t.Errorf("Expected stopped with exit code 2, got %s %v", described.Status, described.ExitCode)
+	}
+
+	_, err = eng.Describe(state.Run{RunID: "run:gone", TaskArn: "flotilla-run:gone"})
+	if _, ok := err.(exceptions.MissingResource); !ok {
+		t.Errorf("Expected removed containers to be missing, got %v", err)
+	}
+}
+
+func TestDockerHTTPClient_ImagePull(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fromImage") == "cupcake:missing" {
+			w.Write([]byte(`{"status":"Pulling from library/cupcake","id":"missing"}` + "\n"))
+			w.Write([]byte(`{"errorDetail":{"message":"manifest unknown"},"error":"manifest unknown"}` + "\n"))
+			return
+		}
+		w.Write([]byte(`{"status":"Pulling from library/cupcake","id":"latest"}` + "\n"))
+		w.Write([]byte(`{"status":"Status: Downloaded newer image for cupcake:latest"}` + "\n"))
+	}))
+	defer server.Close()
+
+	dc, err := newDockerHTTPClient(server.URL, "1.24")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if err = dc.ImagePull("cupcake:latest"); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err = dc.ImagePull("cupcake:missing"); err == nil || err.Error() != "manifest unknown" {
+		t.Errorf("Expected the error in the pull stream, got %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
@@ -12,6 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/execution/adapter"
 	"github.com/stitchfix/flotilla-os/queue"
 	"github.com/stitchfix/flotilla-os/state"
@@ -36,6 +38,7 @@ type ecsServiceClient interface {
 	DeregisterTaskDefinition(input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error)
 	RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error)
 	DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error)
+	DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error)
 }
 
 type cloudwatchServiceClient interface {
@@ -264,55 +267,37 @@ func (ee *ECSExecutionEngine) PollStatus() (RunReceipt, error) {
 // PollRuns receives -at most- one run per queue that is pending execution
 //
 func (ee *ECSExecutionEngine) PollRuns() ([]RunReceipt, error) {
-	queues, err := ee.qm.List()
-	if err != nil {
-		return nil, errors.Wrap(err, "problem listing queues to poll")
-	}
-
-	var runs []RunReceipt
-	for _, qurl := range queues {
-		//
-		// Get new queued Run
-		//
-		runReceipt, err := ee.qm.ReceiveRun(qurl)
-
-		if err != nil {
-			return runs, errors.Wrapf(err, "problem receiving run from queue url [%s]", qurl)
-		}
-
-		if runReceipt.Run == nil {
-			continue
-		}
-
-		runs = append(runs, RunReceipt{runReceipt})
-	}
-	return runs, nil
+	return pollRuns(ee.qm)
 }
 
 //
 // Enqueue pushes a run onto the queue using the QueueManager
 //
 func (ee *ECSExecutionEngine) Enqueue(run state.Run) error {
-	// Get qurl
-	qurl, err := ee.qm.QurlFor(run.ClusterName, true)
-	if err != nil {
-		return errors.Wrapf(err, "problem getting queue url for [%s]", run.ClusterName)
-	}
+	return enqueueRun(ee.qm, run)
+}
 
-	// Queue run
-	if err = ee.qm.Enqueue(qurl, run); err != nil {
-		return errors.Wrapf(err, "problem enqueing run [%s] to queue [%s]", run.RunID, qurl)
-	}
-	return nil
+//
+// CanEnqueueTx reports whether the QueueManager can enqueue within a transaction
+//
+func (ee *ECSExecutionEngine) CanEnqueueTx() bool {
+	return canEnqueueTx(ee.qm)
+}
+
+//
+// EnqueueTx pushes a run onto the queue as part of tx
+//
+func (ee *ECSExecutionEngine) EnqueueTx(tx *sql.Tx, run state.Run) error {
+	return enqueueRunTx(ee.qm, tx, run)
 }
 
 //
-// Execute takes a pre-configured run and definition and submits them for execution
+// Execute takes a pre-configured run and submits it for execution
 // to AWS ECS
 //
-func (ee *ECSExecutionEngine) Execute(definition state.Definition, run state.Run) (state.Run, bool, error) {
+func (ee *ECSExecutionEngine) Execute(run state.Run) (state.Run, bool, error) {
 	var executed state.Run
-	rti := ee.toRunTaskInput(definition, run)
+	rti := ee.toRunTaskInput(run)
 	result, err := ee.ecsClient.RunTask(&rti)
 	if err != nil {
 		retryable := false
@@ -355,6 +340,36 @@ func (ee *ECSExecutionEngine) Terminate(run state.Run) error {
 	return nil
 }
 
+//
+// Describe returns ecs's current view of the run's task; ecs forgets
+// tasks about an hour after they stop, and reports them as MISSING
+//
+func (ee *ECSExecutionEngine) Describe(run state.Run) (state.Run, error) {
+	result, err := ee.ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: &run.ClusterName,
+		Tasks:   []*string{&run.TaskArn},
+	})
+	if err != nil {
+		return state.Run{}, errors.Wrapf(
+			err, "problem describing run [%s] with task arn [%s]", run.RunID, run.TaskArn)
+	}
+
+	if len(result.Tasks) == 1 {
+		return ee.translateTask(*result.Tasks[0]), nil
+	}
+
+	reason := "no task described"
+	if len(result.Failures) > 0 && result.Failures[0].Reason != nil {
+		reason = *result.Failures[0].Reason
+	}
+	if reason == "MISSING" {
+		return state.Run{}, exceptions.MissingResource{
+			ErrorString: fmt.Sprintf("ecs has no task [%s] for run [%s]", run.TaskArn, run.RunID)}
+	}
+	return state.Run{}, errors.Errorf(
+		"problem describing run [%s] with task arn [%s]: %s", run.RunID, run.TaskArn, reason)
+}
+
 //
 // Define creates or updates a task definition with ecs
 //
@@ -398,8 +413,8 @@ func (ee *ECSExecutionEngine) Deregister(definition state.Definition) error {
 	return nil
 }
 
-func (ee *ECSExecutionEngine) toRunTaskInput(definition state.Definition, run state.Run) ecs.RunTaskInput {
-	return ee.adapter.AdaptRun(definition, run)
+func (ee *ECSExecutionEngine) toRunTaskInput(run state.Run) ecs.RunTaskInput {
+	return ee.adapter.AdaptRun(run)
 }
 
 func (ee *ECSExecutionEngine) translateTask(task ecs.Task) state.Run {
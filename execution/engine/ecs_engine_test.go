@@ -7,6 +7,7 @@ import (
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/execution/adapter"
 	"github.com/stitchfix/flotilla-os/queue"
 	"github.com/stitchfix/flotilla-os/state"
@@ -178,3 +179,71 @@ func TestECSExecutionEngine_PollStatus(t *testing.T) {
 		t.Errorf("Expected task arn: [arn1] but was %s", run.TaskArn)
 	}
 }
+
+// mockECSClient describes the tasks it knows of, and reports the rest MISSING
+type mockECSClient struct {
+	testClient
+	tasks map[string]*ecs.Task
+}
+
+func (mecs *mockECSClient) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, error) {
+	return &ecs.RunTaskOutput{}, nil
+}
+
+func (mecs *mockECSClient) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func (mecs *mockECSClient) DeregisterTaskDefinition(
+	input *ecs.DeregisterTaskDefinitionInput) (*ecs.DeregisterTaskDefinitionOutput, error) {
+	return &ecs.DeregisterTaskDefinitionOutput{}, nil
+}
+
+func (mecs *mockECSClient) RegisterTaskDefinition(
+	input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	return &ecs.RegisterTaskDefinitionOutput{}, nil
+}
+
+func (mecs *mockECSClient) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	out := &ecs.DescribeTasksOutput{}
+	for _, arn := range input.Tasks {
+		if task, ok := mecs.tasks[*arn]; ok {
+			out.Tasks = append(out.Tasks, task)
+		} else {
+			out.Failures = append(out.Failures, &ecs.Failure{Arn: arn, Reason: aws.String("MISSING")})
+		}
+	}
+	return out, nil
+}
+
+func TestECSExecutionEngine_Describe(t *testing.T) {
+	eng := setUp(t)
+	eng.ecsClient = &mockECSClient{
+		testClient: testClient{t: t, instanceID: "cupcake", instanceDNSName: "sprinkles"},
+		tasks: map[string]*ecs.Task{
+			"arn1": {
+				TaskArn:              aws.String("arn1"),
+				ClusterArn:           aws.String("clusterarn"),
+				ContainerInstanceArn: aws.String("ciarn"),
+				LastStatus:           aws.String(state.StatusStopped),
+				DesiredStatus:        aws.String(state.StatusStopped),
+				Containers: []*ecs.Container{
+					{ExitCode: aws.Int64(3), LastStatus: aws.String(state.StatusStopped)},
+				},
+			},
+		},
+	}
+
+	described, err := eng.Describe(state.Run{RunID: "run1", TaskArn: "arn1", ClusterName: "cluster"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if described.Status != state.StatusStopped || described.ExitCode == nil || *described.ExitCode != 3 {
+		t.Errorf("Expected stopped with exit code 3, got %s %v", described.Status, described.ExitCode)
+	}
+
+	_, err = eng.Describe(state.Run{RunID: "run2", TaskArn: "arn2", ClusterName: "cluster"})
+	if _, ok := err.(exceptions.MissingResource); !ok {
+		t.Errorf("Expected tasks ecs forgot to be missing, got %v", err)
+	}
+}
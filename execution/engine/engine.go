@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"database/sql"
 	"fmt"
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
@@ -13,11 +14,9 @@ import (
 //
 type Engine interface {
 	Initialize(conf config.Config) error
-	// v0
-	Execute(definition state.Definition, run state.Run) (state.Run, bool, error)
-
-	// v1 - once runs contain a copy of relevant definition info
-	// Execute(run state.Run) error
+	// Execute launches the run using only the definition information
+	// copied onto it at creation time
+	Execute(run state.Run) (state.Run, bool, error)
 
 	Define(definition state.Definition) (state.Definition, error)
 
@@ -25,6 +24,10 @@ type Engine interface {
 
 	Terminate(run state.Run) error
 
+	// Describe returns the engine's current view of the run's task, or
+	// exceptions.MissingResource when the engine no longer knows of it
+	Describe(run state.Run) (state.Run, error)
+
 	Enqueue(run state.Run) error
 
 	PollRuns() ([]RunReceipt, error)
@@ -32,6 +35,16 @@ type Engine interface {
 	PollStatus() (RunReceipt, error)
 }
 
+//
+// TxEnqueuer is implemented by engines that can enqueue a run as part of a
+// database transaction, making creating and queueing a run atomic.
+// CanEnqueueTx reports whether the configured queue.Manager supports it
+//
+type TxEnqueuer interface {
+	CanEnqueueTx() bool
+	EnqueueTx(tx *sql.Tx, run state.Run) error
+}
+
 type RunReceipt struct {
 	queue.RunReceipt
 }
@@ -52,7 +65,94 @@ func NewExecutionEngine(conf config.Config, qm queue.Manager) (Engine, error) {
 			return nil, errors.Wrap(err, "problem initializing ECSExecutionEngine")
 		}
 		return eng, nil
+	case "docker":
+		eng := &DockerExecutionEngine{qm: qm}
+		if err := eng.Initialize(conf); err != nil {
+			return nil, errors.Wrap(err, "problem initializing DockerExecutionEngine")
+		}
+		return eng, nil
+	case "kubernetes":
+		eng := &KubernetesExecutionEngine{qm: qm}
+		if err := eng.Initialize(conf); err != nil {
+			return nil, errors.Wrap(err, "problem initializing KubernetesExecutionEngine")
+		}
+		return eng, nil
 	default:
 		return nil, fmt.Errorf("no Engine named [%s] was found", name)
 	}
 }
+
+//
+// pollRuns receives -at most- one run per queue that is pending execution;
+// shared by engines that use a queue.Manager to buffer runs
+//
+func pollRuns(qm queue.Manager) ([]RunReceipt, error) {
+	queues, err := qm.List()
+	if err != nil {
+		return nil, errors.Wrap(err, "problem listing queues to poll")
+	}
+
+	var runs []RunReceipt
+	for _, qurl := range queues {
+		//
+		// Get new queued Run
+		//
+		runReceipt, err := qm.ReceiveRun(qurl)
+
+		if err != nil {
+			return runs, errors.Wrapf(err, "problem receiving run from queue url [%s]", qurl)
+		}
+
+		if runReceipt.Run == nil {
+			continue
+		}
+
+		runs = append(runs, RunReceipt{runReceipt})
+	}
+	return runs, nil
+}
+
+//
+// enqueueRun pushes a run onto the queue for its cluster
+//
+func enqueueRun(qm queue.Manager, run state.Run) error {
+	// Get qurl
+	qurl, err := qm.QurlFor(run.ClusterName, true)
+	if err != nil {
+		return errors.Wrapf(err, "problem getting queue url for [%s]", run.ClusterName)
+	}
+
+	// Queue run
+	if err = qm.Enqueue(qurl, run); err != nil {
+		return errors.Wrapf(err, "problem enqueing run [%s] to queue [%s]", run.RunID, qurl)
+	}
+	return nil
+}
+
+//
+// canEnqueueTx reports whether qm can enqueue within a database transaction
+//
+func canEnqueueTx(qm queue.Manager) bool {
+	_, ok := qm.(queue.TxEnqueuer)
+	return ok
+}
+
+//
+// enqueueRunTx pushes a run onto the queue for its cluster as part of tx
+//
+func enqueueRunTx(qm queue.Manager, tx *sql.Tx, run state.Run) error {
+	txqm, ok := qm.(queue.TxEnqueuer)
+	if !ok {
+		return errors.Errorf("queue manager [%s] can't enqueue within a transaction", qm.Name())
+	}
+
+	qurl, err := qm.QurlFor(run.ClusterName, true)
+	if err != nil {
+		return errors.Wrapf(err, "problem getting queue url for [%s]", run.ClusterName)
+	}
+
+	if err = txqm.EnqueueTx(tx, qurl, run); err != nil {
+		return errors.Wrapf(err, "problem enqueing run [%s] to queue [%s]", run.RunID, qurl)
+	}
+	return nil
+}
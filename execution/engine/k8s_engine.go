@@ -0,0 +1,740 @@
+package engine
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/queue"
+	"github.com/stitchfix/flotilla-os/state"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	k8sRunIDLabel        = "flotilla-run-id"
+	k8sServerModeLabel   = "flotilla-server-mode"
+	k8sDefinitionIDLabel = "flotilla-definition"
+	k8sRunEnvAnnotation  = "flotilla/run-env"
+)
+
+var invalidK8sNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+//
+// KubernetesExecutionEngine runs each run as a kubernetes batch/v1 Job
+//
+// * Definitions are stored as PodTemplates so they are visible in the cluster; the Job
+//   for a run is built from the definition fields copied onto the run, never from the
+//   current template
+// * Runs are buffered using the configured queue.Manager, exactly as with ECS
+// * Status changes are observed with shared informers on the Jobs and Pods flotilla
+//   creates, started by the first PollStatus so only the status worker watches, and
+//   buffered until acked; the buffer holds the latest update of each run
+// * an update handed out but not acked goes to the back of the buffer, and is dropped
+//   after maxStatusAttempts; the reconcile worker repairs what that leaves behind
+//
+type KubernetesExecutionEngine struct {
+	kClient   kubernetes.Interface
+	qm        queue.Manager
+	namespace string
+	mode      string
+	resync    time.Duration
+	stopCh    chan struct{}
+	watchOnce sync.Once
+	updatesMu sync.Mutex
+	updates   map[string]*pendingUpdate
+	order     []string
+}
+
+// Times a status update is handed out without being acked before it is dropped
+const maxStatusAttempts = 5
+
+//
+// pendingUpdate is the latest status update of a run's task; version counts
+// replacements so that acking an older one leaves a newer one buffered
+//
+type pendingUpdate struct {
+	run      state.Run
+	version  int
+	attempts int
+}
+
+//
+// Initialize configures the KubernetesExecutionEngine and initializes the kubernetes client
+//
+func (ke *KubernetesExecutionEngine) Initialize(conf config.Config) error {
+	ke.mode = conf.GetString("flotilla_mode")
+	ke.stopCh = make(chan struct{})
+	ke.updates = make(map[string]*pendingUpdate)
+
+	ke.namespace = "default"
+	if conf.IsSet("kubernetes.namespace") {
+		ke.namespace = conf.GetString("kubernetes.namespace")
+	}
+
+	ke.resync = 5 * time.Minute
+	if conf.IsSet("kubernetes.resync_interval") {
+		resync, err := time.ParseDuration(conf.GetString("kubernetes.resync_interval"))
+		if err != nil {
+			return errors.Wrap(err, "problem parsing [kubernetes.resync_interval]")
+		}
+		ke.resync = resync
+	}
+
+	if ke.kClient == nil && ke.mode != "test" {
+		restConf, err := ke.restConfig(conf)
+		if err != nil {
+			return errors.Wrap(err, "problem loading kubernetes client configuration")
+		}
+		ke.kClient, err = kubernetes.NewForConfig(restConf)
+		if err != nil {
+			return errors.Wrap(err, "problem initializing kubernetes client")
+		}
+	}
+
+	if ke.qm == nil {
+		return errors.Errorf("no queue.Manager implementation; KubernetesExecutionEngine needs a queue.Manager")
+	}
+	return nil
+}
+
+//
+// restConfig uses [kubernetes.kubeconfig] when set, otherwise assumes flotilla is running in-cluster
+//
+func (ke *KubernetesExecutionEngine) restConfig(conf config.Config) (*rest.Config, error) {
+	if conf.IsSet("kubernetes.kubeconfig") {
+		return clientcmd.BuildConfigFromFlags("", conf.GetString("kubernetes.kubeconfig"))
+	}
+	return rest.InClusterConfig()
+}
+
+//
+// watch starts the informers on flotilla Jobs and Pods
+//
+func (ke *KubernetesExecutionEngine) watch() {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		ke.kClient, ke.resync,
+		informers.WithNamespace(ke.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = fmt.Sprintf("%s=%s", k8sServerModeLabel, ke.labelValue(ke.mode))
+		}))
+
+	factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				ke.push(ke.adaptPod(pod))
+			}
+		},
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			oldPod, oldOk := oldObj.(*corev1.Pod)
+			newPod, newOk := newObj.(*corev1.Pod)
+			if oldOk && newOk && oldPod.ResourceVersion != newPod.ResourceVersion {
+				ke.push(ke.adaptPod(newPod))
+			}
+		},
+	})
+
+	factory.Batch().V1().Jobs().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			// Resyncs repeat jobs unchanged
+			oldJob, oldOk := oldObj.(*batchv1.Job)
+			job, ok := newObj.(*batchv1.Job)
+			if oldOk && ok && oldJob.ResourceVersion != job.ResourceVersion && ke.jobFinished(job) {
+				ke.push(ke.adaptJob(job))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if job, ok := obj.(*batchv1.Job); ok {
+				// A deleted job (eg. terminated) is always stopped
+				adapted := ke.adaptJob(job)
+				adapted.Status = state.StatusStopped
+				ke.push(adapted)
+			}
+		},
+	})
+
+	factory.Start(ke.stopCh)
+}
+
+//
+// push buffers the update, replacing any buffered for the same task unless
+// that one is further along in the run lifecycle
+//
+func (ke *KubernetesExecutionEngine) push(run state.Run) {
+	if len(run.TaskArn) == 0 {
+		return
+	}
+	ke.updatesMu.Lock()
+	defer ke.updatesMu.Unlock()
+
+	pending, ok := ke.updates[run.TaskArn]
+	if !ok {
+		ke.updates[run.TaskArn] = &pendingUpdate{run: run}
+		ke.order = append(ke.order, run.TaskArn)
+		return
+	}
+	if pending.run.Status != run.Status && pending.run.HasReached(run.Status) {
+		return
+	}
+	pending.run = run
+	pending.version++
+	pending.attempts = 0
+}
+
+//
+// PollStatus hands out -at most- one buffered status update observed by the
+// informers, starting them the first time; the update stays buffered until
+// acked
+//
+func (ke *KubernetesExecutionEngine) PollStatus() (RunReceipt, error) {
+	var receipt RunReceipt
+	if ke.kClient != nil {
+		ke.watchOnce.Do(ke.watch)
+	}
+
+	ke.updatesMu.Lock()
+	defer ke.updatesMu.Unlock()
+	for len(ke.order) > 0 {
+		taskArn := ke.order[0]
+		ke.order = ke.order[1:]
+		pending := ke.updates[taskArn]
+		if pending.attempts >= maxStatusAttempts {
+			delete(ke.updates, taskArn)
+			continue
+		}
+
+		pending.attempts++
+		ke.order = append(ke.order, taskArn)
+		run, version := pending.run, pending.version
+		receipt.Run = &run
+		receipt.Done = func() error {
+			ke.ack(taskArn, version)
+			return nil
+		}
+		return receipt, nil
+	}
+	return receipt, nil
+}
+
+//
+// ack drops the buffered update of the task, unless it was replaced by a
+// newer one since it was handed out
+//
+func (ke *KubernetesExecutionEngine) ack(taskArn string, version int) {
+	ke.updatesMu.Lock()
+	defer ke.updatesMu.Unlock()
+
+	pending, ok := ke.updates[taskArn]
+	if !ok || pending.version != version {
+		return
+	}
+	delete(ke.updates, taskArn)
+	for i, arn := range ke.order {
+		if arn == taskArn {
+			ke.order = append(ke.order[:i], ke.order[i+1:]...)
+			break
+		}
+	}
+}
+
+//
+// PollRuns receives -at most- one run per queue that is pending execution
+//
+func (ke *KubernetesExecutionEngine) PollRuns() ([]RunReceipt, error) {
+	return pollRuns(ke.qm)
+}
+
+//
+// Enqueue pushes a run onto the queue using the QueueManager
+//
+func (ke *KubernetesExecutionEngine) Enqueue(run state.Run) error {
+	return enqueueRun(ke.qm, run)
+}
+
+//
+// CanEnqueueTx reports whether the QueueManager can enqueue within a transaction
+//
+func (ke *KubernetesExecutionEngine) CanEnqueueTx() bool {
+	return canEnqueueTx(ke.qm)
+}
+
+//
+// EnqueueTx pushes a run onto the queue as part of tx
+//
+func (ke *KubernetesExecutionEngine) EnqueueTx(tx *sql.Tx, run state.Run) error {
+	return enqueueRunTx(ke.qm, tx, run)
+}
+
+//
+// Execute creates a Job for the run from the definition fields copied onto it
+//
+func (ke *KubernetesExecutionEngine) Execute(run state.Run) (state.Run, bool, error) {
+	var executed state.Run
+	ctx := context.Background()
+
+	job, err := ke.jobFor(run)
+	if err != nil {
+		return executed, false, errors.Wrapf(err, "problem building job for run [%s]", run.RunID)
+	}
+
+	created, err := ke.kClient.BatchV1().Jobs(ke.namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err != nil {
+		if k8serrors.IsAlreadyExists(err) {
+			// Already submitted, report what exists
+			existing, getErr := ke.kClient.BatchV1().Jobs(ke.namespace).Get(ctx, job.Name, metav1.GetOptions{})
+			if getErr != nil {
+				return executed, true, errors.Wrapf(getErr, "problem getting existing job for run [%s]", run.RunID)
+			}
+			return ke.adaptJob(existing), false, nil
+		}
+		if k8serrors.IsInvalid(err) || k8serrors.IsForbidden(err) {
+			return executed, false, errors.Wrapf(err, "problem creating job for run [%s]", run.RunID)
+		}
+		return executed, true, errors.Wrapf(err, "problem creating job for run [%s]", run.RunID)
+	}
+	return ke.adaptJob(created), false, nil
+}
+
+//
+// Terminate deletes the run's Job along with its Pods
+//
+func (ke *KubernetesExecutionEngine) Terminate(run state.Run) error {
+	propagation := metav1.DeletePropagationBackground
+	err := ke.kClient.BatchV1().Jobs(ke.namespace).Delete(
+		context.Background(), ke.jobNameFromArn(run.TaskArn), metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "problem deleting job for run [%s] with task arn [%s]", run.RunID, run.TaskArn)
+	}
+	return nil
+}
+
+//
+// Describe gets the run's Job, and its Pod for the exit code
+//
+func (ke *KubernetesExecutionEngine) Describe(run state.Run) (state.Run, error) {
+	ctx := context.Background()
+	job, err := ke.kClient.BatchV1().Jobs(ke.namespace).Get(ctx, ke.jobNameFromArn(run.TaskArn), metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return state.Run{}, exceptions.MissingResource{
+				ErrorString: fmt.Sprintf("kubernetes has no job [%s] for run [%s]", run.TaskArn, run.RunID)}
+		}
+		return state.Run{}, errors.Wrapf(err, "problem getting job for run [%s] with task arn [%s]", run.RunID, run.TaskArn)
+	}
+	described := ke.adaptJob(job)
+
+	pods, err := ke.kClient.CoreV1().Pods(ke.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", k8sRunIDLabel, ke.labelValue(run.RunID)),
+	})
+	if err != nil {
+		return state.Run{}, errors.Wrapf(err, "problem listing pods for run [%s]", run.RunID)
+	}
+	if len(pods.Items) == 0 {
+		return described, nil
+	}
+
+	// The job is the authority on whether the run finished, the pod on how
+	fromPod := ke.adaptPod(&pods.Items[0])
+	fromPod.TaskArn = described.TaskArn
+	fromPod.FailureReason = described.FailureReason
+	if described.Status == state.StatusStopped {
+		fromPod.Status = state.StatusStopped
+		if fromPod.FinishedAt == nil {
+			fromPod.FinishedAt = described.FinishedAt
+		}
+	}
+	return fromPod, nil
+}
+
+//
+// Define creates or updates the PodTemplate for the definition
+//
+func (ke *KubernetesExecutionEngine) Define(definition state.Definition) (state.Definition, error) {
+	ctx := context.Background()
+	template, err := ke.podTemplateFor(definition)
+	if err != nil {
+		return state.Definition{}, errors.Wrapf(err, "problem building pod template for definition [%s]", definition.DefinitionID)
+	}
+
+	templates := ke.kClient.CoreV1().PodTemplates(ke.namespace)
+	existing, err := templates.Get(ctx, template.Name, metav1.GetOptions{})
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			return state.Definition{}, errors.Wrapf(err, "problem getting pod template for definition [%s]", definition.DefinitionID)
+		}
+		_, err = templates.Create(ctx, template, metav1.CreateOptions{})
+	} else {
+		template.ResourceVersion = existing.ResourceVersion
+		_, err = templates.Update(ctx, template, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return state.Definition{}, errors.Wrapf(err, "problem storing pod template for definition [%s]", definition.DefinitionID)
+	}
+
+	defined := definition
+	defined.Arn = fmt.Sprintf("%s/podtemplates/%s", ke.namespace, template.Name)
+	defined.ContainerName = template.Name
+	return defined, nil
+}
+
+//
+// Deregister deletes the definition's PodTemplate
+//
+func (ke *KubernetesExecutionEngine) Deregister(definition state.Definition) error {
+	err := ke.kClient.CoreV1().PodTemplates(ke.namespace).Delete(
+		context.Background(), ke.templateName(definition), metav1.DeleteOptions{})
+	if err != nil && !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "problem deleting pod template for definition [%s]", definition.DefinitionID)
+	}
+	return nil
+}
+
+func (ke *KubernetesExecutionEngine) podTemplateFor(definition state.Definition) (*corev1.PodTemplate, error) {
+	cmdString, err := definition.WrappedCommand()
+	if err != nil {
+		// Fallback
+		cmdString = definition.Command
+	}
+
+	main, err := ke.containerFor(definition.Image, cmdString, containerResources{
+		memory: definition.Memory, memoryReserved: definition.MemoryReserved, cpu: definition.CPU,
+	}, definition.Env, definition.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	name := ke.templateName(definition)
+	labels := map[string]string{
+		k8sDefinitionIDLabel: ke.labelValue(definition.DefinitionID),
+		k8sServerModeLabel:   ke.labelValue(ke.mode),
+	}
+	return &corev1.PodTemplate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+			Annotations: map[string]string{
+				"flotilla/definition-id": definition.DefinitionID,
+				"flotilla/alias":         definition.Alias,
+				"flotilla/group-name":    definition.GroupName,
+			},
+		},
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels},
+			Spec: corev1.PodSpec{
+				RestartPolicy: corev1.RestartPolicyNever,
+				Containers:    []corev1.Container{main},
+			},
+		},
+	}, nil
+}
+
+//
+// containerResources are what a definition or run asks for: memory and
+// its reservation in MiB, and cpu in ecs cpu units, 1024 to a cpu
+//
+type containerResources struct {
+	memory         *int64
+	memoryReserved *int64
+	cpu            *int64
+}
+
+//
+// containerFor builds the single flotilla container
+// * cmdString is the already wrapped command, run exactly as it is for ecs
+// * memory (MiB) is the limit, and the request unless a memory
+//   reservation is given
+// * cpu is only requested; as on ecs, it does not limit the container
+//
+func (ke *KubernetesExecutionEngine) containerFor(
+	image string, cmdString string, resources containerResources,
+	env *state.EnvList, ports *state.PortsList) (corev1.Container, error) {
+	main := corev1.Container{
+		Name:    "main",
+		Image:   image,
+		Command: []string{"bash", "-l", "-c", cmdString},
+	}
+
+	if resources.memory != nil {
+		limit, err := resource.ParseQuantity(fmt.Sprintf("%dMi", *resources.memory))
+		if err != nil {
+			return main, errors.Wrapf(err, "invalid memory [%d]", *resources.memory)
+		}
+		request := limit
+		if resources.memoryReserved != nil {
+			if request, err = resource.ParseQuantity(fmt.Sprintf("%dMi", *resources.memoryReserved)); err != nil {
+				return main, errors.Wrapf(err, "invalid memory reservation [%d]", *resources.memoryReserved)
+			}
+		}
+		main.Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: request},
+			Limits:   corev1.ResourceList{corev1.ResourceMemory: limit},
+		}
+	}
+
+	if resources.cpu != nil {
+		// Millicpus, at least one
+		millis := *resources.cpu * 1000 / 1024
+		if millis < 1 {
+			millis = 1
+		}
+		if main.Resources.Requests == nil {
+			main.Resources.Requests = corev1.ResourceList{}
+		}
+		main.Resources.Requests[corev1.ResourceCPU] = *resource.NewMilliQuantity(millis, resource.DecimalSI)
+	}
+
+	if env != nil {
+		for _, e := range *env {
+			main.Env = append(main.Env, corev1.EnvVar{Name: e.Name, Value: e.Value})
+		}
+	}
+
+	if ports != nil {
+		for _, p := range *ports {
+			main.Ports = append(main.Ports, corev1.ContainerPort{
+				ContainerPort: int32(p),
+				Protocol:      corev1.ProtocolTCP,
+			})
+		}
+	}
+	return main, nil
+}
+
+//
+// jobFor builds a Job for the run
+// * the run's env already has the definition env merged in
+// * jobs are never retried by kubernetes; retries are flotilla's responsibility
+//
+func (ke *KubernetesExecutionEngine) jobFor(run state.Run) (*batchv1.Job, error) {
+	cmdString, err := run.WrappedCommand()
+	if err != nil {
+		// Fallback
+		cmdString = run.Command
+	}
+
+	main, err := ke.containerFor(run.Image, cmdString, containerResources{
+		memory: run.Memory, memoryReserved: run.MemoryReserved, cpu: run.CPU,
+	}, run.Env, run.Ports)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := map[string]string{
+		k8sDefinitionIDLabel: ke.labelValue(run.DefinitionID),
+		k8sRunIDLabel:        ke.labelValue(run.RunID),
+		k8sServerModeLabel:   ke.labelValue(ke.mode),
+	}
+
+	var runEnvNames []string
+	for _, e := range main.Env {
+		runEnvNames = append(runEnvNames, e.Name)
+	}
+	annotations := map[string]string{
+		k8sRunEnvAnnotation:      strings.Join(runEnvNames, ","),
+		"flotilla/run-id":        run.RunID,
+		"flotilla/definition-id": run.DefinitionID,
+	}
+
+	backoffLimit := int32(0)
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        ke.jobName(run.RunID),
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: &backoffLimit,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers:    []corev1.Container{main},
+				},
+			},
+		},
+	}, nil
+}
+
+//
+// adaptPod converts from a run's pod to a generic run
+//
+func (ke *KubernetesExecutionEngine) adaptPod(pod *corev1.Pod) state.Run {
+	run := state.Run{
+		RunID:      pod.Annotations["flotilla/run-id"],
+		InstanceID: pod.Spec.NodeName,
+		Env:        ke.runEnv(pod.Annotations[k8sRunEnvAnnotation], pod.Spec.Containers),
+	}
+	if len(run.RunID) > 0 {
+		run.TaskArn = ke.taskArn(ke.jobName(run.RunID))
+	}
+	if len(pod.Status.HostIP) > 0 {
+		run.InstanceDNSName = pod.Status.HostIP
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodPending:
+		run.Status = state.StatusPending
+	case corev1.PodRunning:
+		run.Status = state.StatusRunning
+	case corev1.PodSucceeded, corev1.PodFailed:
+		run.Status = state.StatusStopped
+	}
+
+	if pod.Status.StartTime != nil {
+		startedAt := pod.Status.StartTime.Time
+		run.StartedAt = &startedAt
+	}
+
+	if len(pod.Status.ContainerStatuses) > 0 {
+		cs := pod.Status.ContainerStatuses[0]
+		if cs.State.Running != nil {
+			startedAt := cs.State.Running.StartedAt.Time
+			run.StartedAt = &startedAt
+		}
+		if terminated := cs.State.Terminated; terminated != nil {
+			exitCode := int64(terminated.ExitCode)
+			startedAt := terminated.StartedAt.Time
+			finishedAt := terminated.FinishedAt.Time
+			run.Status = state.StatusStopped
+			run.ExitCode = &exitCode
+			run.StartedAt = &startedAt
+			run.FinishedAt = &finishedAt
+		}
+	}
+	return run
+}
+
+//
+// adaptJob converts from a run's job to a generic run; jobs don't carry exit codes
+// so pod updates are the main source of status information
+//
+func (ke *KubernetesExecutionEngine) adaptJob(job *batchv1.Job) state.Run {
+	run := state.Run{
+		TaskArn: ke.taskArn(job.Name),
+		RunID:   job.Annotations["flotilla/run-id"],
+		Status:  state.StatusPending,
+		Env:     ke.runEnv(job.Annotations[k8sRunEnvAnnotation], job.Spec.Template.Spec.Containers),
+	}
+
+	if job.Status.StartTime != nil {
+		startedAt := job.Status.StartTime.Time
+		run.StartedAt = &startedAt
+	}
+	if job.Status.Active > 0 {
+		run.Status = state.StatusRunning
+	}
+	if ke.jobFinished(job) {
+		run.Status = state.StatusStopped
+		if job.Status.CompletionTime != nil {
+			finishedAt := job.Status.CompletionTime.Time
+			run.FinishedAt = &finishedAt
+		}
+		run.FailureReason = ke.jobFailureReason(job)
+	}
+	return run
+}
+
+//
+// jobFailureReason is the reason and message of the job's failed
+// condition, if it has one
+//
+func (ke *KubernetesExecutionEngine) jobFailureReason(job *batchv1.Job) string {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			if len(c.Message) > 0 {
+				return fmt.Sprintf("%s: %s", c.Reason, c.Message)
+			}
+			return c.Reason
+		}
+	}
+	return ""
+}
+
+func (ke *KubernetesExecutionEngine) jobFinished(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if (c.Type == batchv1.JobComplete || c.Type == batchv1.JobFailed) && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// runEnv returns only the run's own env from the main container, mirroring ecs container overrides
+//
+func (ke *KubernetesExecutionEngine) runEnv(names string, containers []corev1.Container) *state.EnvList {
+	if len(names) == 0 || len(containers) == 0 {
+		return nil
+	}
+	wanted := make(map[string]bool)
+	for _, name := range strings.Split(names, ",") {
+		wanted[name] = true
+	}
+	var env []state.EnvVar
+	for _, e := range containers[0].Env {
+		if wanted[e.Name] {
+			env = append(env, state.EnvVar{Name: e.Name, Value: e.Value})
+		}
+	}
+	cast := state.EnvList(env)
+	return &cast
+}
+
+func (ke *KubernetesExecutionEngine) templateName(definition state.Definition) string {
+	return ke.resourceName(fmt.Sprintf("flotilla-%s", definition.DefinitionID))
+}
+
+func (ke *KubernetesExecutionEngine) jobName(runID string) string {
+	return ke.resourceName(fmt.Sprintf("flotilla-%s", runID))
+}
+
+func (ke *KubernetesExecutionEngine) taskArn(jobName string) string {
+	return fmt.Sprintf("%s/jobs/%s", ke.namespace, jobName)
+}
+
+func (ke *KubernetesExecutionEngine) jobNameFromArn(taskArn string) string {
+	splits := strings.Split(taskArn, "/")
+	return splits[len(splits)-1]
+}
+
+//
+// resourceName coerces a name into a valid kubernetes (DNS-1123) resource name
+//
+func (ke *KubernetesExecutionEngine) resourceName(name string) string {
+	name = invalidK8sNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	if len(name) > 253 {
+		name = name[:253]
+	}
+	return strings.Trim(name, "-")
+}
+
+//
+// labelValue coerces a value into a valid kubernetes label value
+//
+func (ke *KubernetesExecutionEngine) labelValue(value string) string {
+	value = invalidK8sNameChars.ReplaceAllString(strings.ToLower(value), "-")
+	if len(value) > 63 {
+		value = value[:63]
+	}
+	return strings.Trim(value, "-")
+}
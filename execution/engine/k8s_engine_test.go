@@ -0,0 +1,378 @@
+package engine
+
+import (
+	"context"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"os"
+	"testing"
+	"time"
+)
+
+func setUpKubernetesEngine(t *testing.T) (*KubernetesExecutionEngine, *fake.Clientset) {
+	os.Setenv("FLOTILLA_MODE", "test")
+	conf, _ := config.NewConfig(nil)
+
+	client := fake.NewSimpleClientset()
+	eng := &KubernetesExecutionEngine{qm: &mockQueueManager{}, kClient: client}
+	if err := eng.Initialize(conf); err != nil {
+		t.Fatalf("Expected no error initializing, got %v", err)
+	}
+	return eng, client
+}
+
+func k8sTestDefinition() state.Definition {
+	memory := int64(512)
+	ports := state.PortsList{8080}
+	env := state.EnvList{{Name: "DEF_VAR", Value: "a"}}
+	return state.Definition{
+		DefinitionID: "Group_A-cupcake",
+		Alias:        "cupcake",
+		GroupName:    "Group_A",
+		Image:        "cupcake:latest",
+		Command:      "echo hi",
+		Memory:       &memory,
+		Ports:        &ports,
+		Env:          &env,
+	}
+}
+
+func TestKubernetesExecutionEngine_Define(t *testing.T) {
+	eng, client := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	definition := k8sTestDefinition()
+	reserved, cpu := int64(256), int64(512)
+	definition.MemoryReserved, definition.CPU = &reserved, &cpu
+	defined, err := eng.Define(definition)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if defined.Arn != "default/podtemplates/flotilla-group-a-cupcake" {
+		t.Errorf("Expected arn [default/podtemplates/flotilla-group-a-cupcake] but was [%s]", defined.Arn)
+	}
+
+	template, err := client.CoreV1().PodTemplates("default").Get(
+		context.Background(), "flotilla-group-a-cupcake", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected pod template to be stored, got %v", err)
+	}
+
+	main := template.Template.Spec.Containers[0]
+	if len(main.Command) != 4 || main.Command[0] != "bash" {
+		t.Errorf("Expected wrapped bash command, got %v", main.Command)
+	}
+
+	memory := main.Resources.Limits[corev1.ResourceMemory]
+	if memory.Value() != 512*1024*1024 {
+		t.Errorf("Expected memory limit of 512Mi but was %v", memory.String())
+	}
+	request := main.Resources.Requests[corev1.ResourceMemory]
+	if request.Value() != 256*1024*1024 {
+		t.Errorf("Expected memory request of the 256Mi reserved but was %v", request.String())
+	}
+	cpuRequest := main.Resources.Requests[corev1.ResourceCPU]
+	if cpuRequest.MilliValue() != 500 {
+		t.Errorf("Expected cpu request of 500m for 512 cpu units but was %v", cpuRequest.String())
+	}
+
+	if len(main.Ports) != 1 || main.Ports[0].ContainerPort != 8080 {
+		t.Errorf("Expected container port 8080, got %v", main.Ports)
+	}
+
+	// Defining again updates in place
+	if _, err = eng.Define(k8sTestDefinition()); err != nil {
+		t.Errorf("Expected no error redefining, got %v", err)
+	}
+}
+
+func TestKubernetesExecutionEngine_Execute(t *testing.T) {
+	eng, client := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	definition, _ := eng.Define(k8sTestDefinition())
+	env := state.EnvList{{Name: "FLOTILLA_SERVER_MODE", Value: "test"}}
+	run := state.Run{RunID: "run-cupcake", Env: &env}
+	run.SnapshotDefinition(definition)
+
+	// Changes to the definition after the run is created are not launched
+	definition.Image = "shoebox:latest"
+	if _, err := eng.Define(definition); err != nil {
+		t.Fatalf("Expected no error redefining, got %v", err)
+	}
+
+	launched, retryable, err := eng.Execute(run)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v (retryable: %v)", err, retryable)
+	}
+
+	if launched.TaskArn != "default/jobs/flotilla-run-cupcake" {
+		t.Errorf("Expected task arn [default/jobs/flotilla-run-cupcake] but was [%s]", launched.TaskArn)
+	}
+
+	job, err := client.BatchV1().Jobs("default").Get(context.Background(), "flotilla-run-cupcake", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected job to be created, got %v", err)
+	}
+
+	if *job.Spec.BackoffLimit != 0 {
+		t.Errorf("Expected jobs to never be retried by kubernetes")
+	}
+
+	main := job.Spec.Template.Spec.Containers[0]
+	if main.Image != "cupcake:latest" {
+		t.Errorf("Expected the image snapshotted onto the run [cupcake:latest] but was [%s]", main.Image)
+	}
+
+	if len(main.Env) != 2 || main.Env[1].Name != "FLOTILLA_SERVER_MODE" {
+		t.Errorf("Expected run env appended to definition env, got %v", main.Env)
+	}
+
+	// Executing again is idempotent
+	if _, _, err = eng.Execute(run); err != nil {
+		t.Errorf("Expected no error re-executing, got %v", err)
+	}
+
+	if err = eng.Terminate(launched); err != nil {
+		t.Errorf("Expected no error terminating, got %v", err)
+	}
+
+	_, err = client.BatchV1().Jobs("default").Get(context.Background(), "flotilla-run-cupcake", metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("Expected job to be deleted on terminate")
+	}
+}
+
+func TestKubernetesExecutionEngine_PollStatus(t *testing.T) {
+	eng, client := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	started := metav1.NewTime(time.Now().Add(-1 * time.Minute))
+	finished := metav1.NewTime(time.Now())
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "flotilla-run-cupcake-abcde",
+			Namespace: "default",
+			Labels: map[string]string{
+				k8sRunIDLabel:      "run-cupcake",
+				k8sServerModeLabel: "test",
+			},
+			Annotations: map[string]string{
+				"flotilla/run-id":   "run-cupcake",
+				k8sRunEnvAnnotation: "FLOTILLA_SERVER_MODE",
+			},
+		},
+		Spec: corev1.PodSpec{
+			NodeName: "node-1",
+			Containers: []corev1.Container{{
+				Name: "main",
+				Env: []corev1.EnvVar{
+					{Name: "DEF_VAR", Value: "a"},
+					{Name: "FLOTILLA_SERVER_MODE", Value: "test"},
+				},
+			}},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodFailed,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name: "main",
+				State: corev1.ContainerState{
+					Terminated: &corev1.ContainerStateTerminated{
+						ExitCode:   3,
+						StartedAt:  started,
+						FinishedAt: finished,
+					},
+				},
+			}},
+		},
+	}
+
+	if _, err := client.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Expected no error creating pod, got %v", err)
+	}
+
+	var receipt RunReceipt
+	for i := 0; i < 50 && receipt.Run == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		receipt, _ = eng.PollStatus()
+	}
+
+	run := receipt.Run
+	if run == nil {
+		t.Fatalf("Expected a status update from the pod informer")
+	}
+
+	if run.TaskArn != "default/jobs/flotilla-run-cupcake" {
+		t.Errorf("Expected task arn [default/jobs/flotilla-run-cupcake] but was [%s]", run.TaskArn)
+	}
+
+	if run.Status != state.StatusStopped {
+		t.Errorf("Expected status [%s] but was [%s]", state.StatusStopped, run.Status)
+	}
+
+	if run.ExitCode == nil || *run.ExitCode != 3 {
+		t.Errorf("Expected exit code 3, got %v", run.ExitCode)
+	}
+
+	if run.InstanceID != "node-1" {
+		t.Errorf("Expected node name [node-1] as instance id but was [%s]", run.InstanceID)
+	}
+
+	if run.Env == nil || len(*run.Env) != 1 {
+		t.Errorf("Expected only the run env to be reported, got %v", run.Env)
+	}
+
+	if err := receipt.Done(); err != nil {
+		t.Errorf("Expected no error acking, got %v", err)
+	}
+}
+
+func TestKubernetesExecutionEngine_StatusBuffer(t *testing.T) {
+	eng, _ := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	// The latest update of each run is buffered, unless it goes backwards
+	eng.push(state.Run{TaskArn: "default/jobs/a", Status: state.StatusPending})
+	eng.push(state.Run{TaskArn: "default/jobs/a", Status: state.StatusStopped})
+	eng.push(state.Run{TaskArn: "default/jobs/a", Status: state.StatusRunning})
+	eng.push(state.Run{TaskArn: "default/jobs/b", Status: state.StatusRunning})
+	if len(eng.updates) != 2 || eng.updates["default/jobs/a"].run.Status != state.StatusStopped {
+		t.Fatalf("Expected the furthest update of each run, got %v", eng.updates)
+	}
+
+	// Unacked updates go to the back and stay buffered
+	first, _ := eng.PollStatus()
+	second, _ := eng.PollStatus()
+	if first.Run == nil || second.Run == nil || first.Run.TaskArn != "default/jobs/a" || second.Run.TaskArn != "default/jobs/b" {
+		t.Fatalf("Expected both runs' updates in turn, got %v and %v", first.Run, second.Run)
+	}
+	second.Done()
+	if third, _ := eng.PollStatus(); third.Run == nil || third.Run.TaskArn != "default/jobs/a" {
+		t.Errorf("Expected the unacked update again, got %v", third.Run)
+	}
+
+	// Acking an update replaced since it was handed out keeps the newer one
+	eng.push(state.Run{TaskArn: "default/jobs/c", Status: state.StatusRunning})
+	eng.ack("default/jobs/a", eng.updates["default/jobs/a"].version)
+	handed, _ := eng.PollStatus()
+	eng.push(state.Run{TaskArn: "default/jobs/c", Status: state.StatusStopped})
+	handed.Done()
+	if pending, ok := eng.updates["default/jobs/c"]; !ok || pending.run.Status != state.StatusStopped {
+		t.Errorf("Expected the newer update to stay buffered, got %v", eng.updates)
+	}
+
+	// Updates never acked are dropped
+	for i := 0; i <= maxStatusAttempts; i++ {
+		eng.PollStatus()
+	}
+	if receipt, _ := eng.PollStatus(); receipt.Run != nil || len(eng.updates) != 0 {
+		t.Errorf("Expected updates never acked to be dropped, got %v", eng.updates)
+	}
+}
+
+func TestKubernetesExecutionEngine_JobResync(t *testing.T) {
+	eng, client := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "flotilla-run-cupcake",
+			Namespace:       "default",
+			ResourceVersion: "1",
+			Labels:          map[string]string{k8sRunIDLabel: "run-cupcake", k8sServerModeLabel: "test"},
+		},
+		Status: batchv1.JobStatus{
+			Succeeded:  1,
+			Conditions: []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}},
+		},
+	}
+	if _, err := client.BatchV1().Jobs("default").Create(context.Background(), job, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Expected no error creating job, got %v", err)
+	}
+
+	// The watch starts with the first poll
+	eng.PollStatus()
+	time.Sleep(100 * time.Millisecond)
+
+	// An update that does not change the job, as on resync, is not buffered
+	eng.updatesMu.Lock()
+	eng.updates = make(map[string]*pendingUpdate)
+	eng.order = nil
+	eng.updatesMu.Unlock()
+	if _, err := client.BatchV1().Jobs("default").Update(context.Background(), job, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Expected no error updating job, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if receipt, _ := eng.PollStatus(); receipt.Run != nil {
+		t.Errorf("Expected an unchanged job not to be reported again, got %v", receipt.Run)
+	}
+
+	changed := job.DeepCopy()
+	changed.ResourceVersion = "2"
+	if _, err := client.BatchV1().Jobs("default").Update(context.Background(), changed, metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("Expected no error updating job, got %v", err)
+	}
+	var receipt RunReceipt
+	for i := 0; i < 50 && receipt.Run == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		receipt, _ = eng.PollStatus()
+	}
+	if receipt.Run == nil || receipt.Run.Status != state.StatusStopped {
+		t.Errorf("Expected the finished job to be reported, got %v", receipt.Run)
+	}
+}
+
+func TestKubernetesExecutionEngine_Describe(t *testing.T) {
+	eng, client := setUpKubernetesEngine(t)
+	defer close(eng.stopCh)
+
+	definition, _ := eng.Define(k8sTestDefinition())
+	run := state.Run{RunID: "run-cupcake"}
+	run.SnapshotDefinition(definition)
+	launched, _, err := eng.Execute(run)
+	if err != nil {
+		t.Fatalf("Expected no error executing, got %v", err)
+	}
+	launched.RunID = run.RunID
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "flotilla-run-cupcake-abcde",
+			Namespace:   "default",
+			Labels:      map[string]string{k8sRunIDLabel: "run-cupcake"},
+			Annotations: map[string]string{"flotilla/run-id": "run-cupcake"},
+		},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:  "main",
+				State: corev1.ContainerState{Running: &corev1.ContainerStateRunning{StartedAt: metav1.Now()}},
+			}},
+		},
+	}
+	if _, err = client.CoreV1().Pods("default").Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Expected no error creating pod, got %v", err)
+	}
+
+	described, err := eng.Describe(launched)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if described.Status != state.StatusRunning || described.TaskArn != launched.TaskArn {
+		t.Errorf("Expected the running pod's view of [%s], got %s [%s]", launched.TaskArn, described.Status, described.TaskArn)
+	}
+
+	if err = eng.Terminate(launched); err != nil {
+		t.Fatalf("Expected no error terminating, got %v", err)
+	}
+	_, err = eng.Describe(launched)
+	if _, ok := err.(exceptions.MissingResource); !ok {
+		t.Errorf("Expected deleted jobs to be missing, got %v", err)
+	}
+}
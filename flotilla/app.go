@@ -1,19 +1,27 @@
 package flotilla
 
 import (
+	"context"
+	"github.com/gorilla/mux"
 	"github.com/pkg/errors"
 	"github.com/rs/cors"
 	"github.com/stitchfix/flotilla-os/clients/cluster"
 	"github.com/stitchfix/flotilla-os/clients/logs"
 	"github.com/stitchfix/flotilla-os/clients/registry"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/services"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/worker"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -24,23 +32,112 @@ type App struct {
 	logger             flotillaLog.Logger
 	readTimeout        time.Duration
 	writeTimeout       time.Duration
+	shutdownTimeout    time.Duration
 	handler            http.Handler
 	workers            []worker.Worker
+	sm                 state.Manager
 }
 
+//
+// Run serves http and runs the workers until SIGTERM or SIGINT, and then
+// shuts down; see Serve
+//
 func (app *App) Run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			app.logger.Log("message", "Received signal, shutting down", "signal", sig.String())
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return app.Serve(ctx)
+}
+
+//
+// Serve serves http and runs the workers until ctx is done, and then
+// shuts down in order
+// * the server stops accepting connections and waits for the requests
+//   it is handling
+// * workers finish what they are working on
+// * queued webhook deliveries are made
+// * the state manager is closed
+// Waiting on requests, workers and deliveries takes at most shutdown_timeout_seconds
+//
+func (app *App) Serve(ctx context.Context) error {
 	srv := &http.Server{
 		Addr:         app.address,
 		Handler:      app.handler,
 		ReadTimeout:  app.readTimeout,
 		WriteTimeout: app.writeTimeout,
 	}
-	for _, worker := range app.workers {
-		go worker.Run()
+
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	var wg sync.WaitGroup
+	for _, wk := range app.workers {
+		wg.Add(1)
+		go func(wk worker.Worker) {
+			defer wg.Done()
+			wk.Run(workerCtx)
+		}(wk)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var err error
+	select {
+	case err = <-serveErr:
+		err = errors.Wrap(err, "problem serving http")
+	case <-ctx.Done():
+	}
+
+	deadline, cancel := context.WithTimeout(context.Background(), app.shutdownTimeout)
+	defer cancel()
+
+	if shutdownErr := srv.Shutdown(deadline); shutdownErr != nil {
+		app.logger.Log("message", "Problem shutting down http server", "error", shutdownErr.Error())
+	}
+
+	stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		app.logger.Log("message", "Workers stopped")
+	case <-deadline.Done():
+		app.logger.Log("message", "Gave up waiting on workers to stop", "timeout", app.shutdownTimeout.String())
+	}
+
+	if drainErr := webhook.Drain(deadline); drainErr != nil {
+		app.logger.Log("message", "Problem draining webhook deliveries", "error", drainErr.Error())
 	}
-	return srv.ListenAndServe()
+
+	if app.sm != nil {
+		if cleanupErr := app.sm.Cleanup(); cleanupErr != nil && err == nil {
+			err = errors.Wrap(cleanupErr, "problem cleaning up state manager")
+		}
+	}
+	return err
 }
 
+//
+// NewApp configures an App that serves the http api and runs the
+// workers in enabled_workers
+//
 func NewApp(conf config.Config,
 	log flotillaLog.Logger,
 	lc logs.Client,
@@ -49,34 +146,128 @@ func NewApp(conf config.Config,
 	cc cluster.Client,
 	rc registry.Client) (App, error) {
 
-	var app App
-	app.logger = log
-	app.configure(conf)
+	app := newApp(conf, log, sm)
+	executionService, err := services.NewExecutionService(conf, ee, sm, cc, rc, log)
+	if err != nil {
+		return app, errors.Wrap(err, "problem initializing execution service")
+	}
+	if err = app.initializeServer(conf, lc, ee, sm, executionService); err != nil {
+		return app, err
+	}
+	if err = app.initializeWorkers(conf, log, ee, sm, executionService, conf.GetStringSlice("enabled_workers")); err != nil {
+		return app, errors.Wrap(err, "problem initializing workers")
+	}
+	return app, nil
+}
 
-	executionService, err := services.NewExecutionService(conf, ee, sm, cc, rc)
+//
+// NewServerApp configures an App that only serves the http api
+//
+func NewServerApp(conf config.Config,
+	log flotillaLog.Logger,
+	lc logs.Client,
+	ee engine.Engine,
+	sm state.Manager,
+	cc cluster.Client,
+	rc registry.Client) (App, error) {
+
+	app := newApp(conf, log, sm)
+	executionService, err := services.NewExecutionService(conf, ee, sm, cc, rc, log)
 	if err != nil {
 		return app, errors.Wrap(err, "problem initializing execution service")
 	}
+	return app, app.initializeServer(conf, lc, ee, sm, executionService)
+}
+
+//
+// NewWorkerApp configures an App that runs workers of workerTypes, and
+// only serves their metrics over http
+// * cc and rc are only needed by the schedule worker, which creates runs,
+//   and may be nil otherwise
+//
+func NewWorkerApp(conf config.Config,
+	log flotillaLog.Logger,
+	ee engine.Engine,
+	sm state.Manager,
+	cc cluster.Client,
+	rc registry.Client,
+	workerTypes []string) (App, error) {
+
+	app := newApp(conf, log, sm)
+	router := mux.NewRouter()
+	router.Handle("/metrics", metrics.Default.Handler()).Methods("GET")
+	app.handler = router
+
+	var executionService services.ExecutionService
+	if cc != nil && rc != nil {
+		var err error
+		if executionService, err = services.NewExecutionService(conf, ee, sm, cc, rc, log); err != nil {
+			return app, errors.Wrap(err, "problem initializing execution service")
+		}
+	}
+	if err := app.initializeWorkers(conf, log, ee, sm, executionService, workerTypes); err != nil {
+		return app, errors.Wrap(err, "problem initializing workers")
+	}
+	return app, nil
+}
+
+func newApp(conf config.Config, log flotillaLog.Logger, sm state.Manager) App {
+	var app App
+	app.logger = log
+	app.sm = sm
+	app.configure(conf)
+	return app
+}
+
+func (app *App) initializeServer(
+	conf config.Config,
+	lc logs.Client,
+	ee engine.Engine,
+	sm state.Manager,
+	executionService services.ExecutionService) error {
 	definitionService, err := services.NewDefinitionService(conf, ee, sm)
 	if err != nil {
-		return app, errors.Wrap(err, "problem initializing definition service")
+		return errors.Wrap(err, "problem initializing definition service")
 	}
 	logService, err := services.NewLogService(conf, sm, lc)
 	if err != nil {
-		return app, errors.Wrap(err, "problem initializing log service")
+		return errors.Wrap(err, "problem initializing log service")
+	}
+	scheduleService, err := services.NewScheduleService(conf, sm)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing schedule service")
+	}
+	webhookService, err := services.NewWebhookService(conf, sm)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook service")
+	}
+	roleService, err := services.NewRoleService(conf, sm)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing role service")
 	}
 
 	ep := endpoints{
 		executionService:  executionService,
 		definitionService: definitionService,
 		logService:        logService,
+		scheduleService:   scheduleService,
+		webhookService:    webhookService,
+		roleService:       roleService,
+	}
+	if conf.GetBool("auth.rbac.enabled") && !conf.GetBool("auth.enabled") {
+		return errors.New("auth.rbac.enabled needs auth.enabled, to know who is making requests")
+	}
+	if conf.GetBool("auth.enabled") {
+		if ep.tokenService, err = services.NewTokenService(conf, sm); err != nil {
+			return errors.Wrap(err, "problem initializing token service")
+		}
+	}
+	if app.writeTimeout > time.Second {
+		ep.streamTimeout = app.writeTimeout - time.Second
 	}
 
 	app.configureRoutes(ep)
-	if err = app.initializeWorkers(conf, log, ee, sm); err != nil {
-		return app, errors.Wrap(err, "problem initializing workers")
-	}
-	return app, nil
+	return nil
 }
 
 func (app *App) configure(conf config.Config) {
@@ -96,6 +287,12 @@ func (app *App) configure(conf config.Config) {
 	app.readTimeout = time.Duration(readTimeout) * time.Second
 	app.writeTimeout = time.Duration(writeTimeout) * time.Second
 
+	shutdownTimeout := conf.GetInt("shutdown_timeout_seconds")
+	if shutdownTimeout == 0 {
+		shutdownTimeout = 30
+	}
+	app.shutdownTimeout = time.Duration(shutdownTimeout) * time.Second
+
 	app.mode = conf.GetString("flotilla_mode")
 	app.corsAllowedOrigins = conf.GetStringSlice("http.server.cors_allowed_origins")
 }
@@ -109,10 +306,11 @@ func (app *App) configureRoutes(ep endpoints) {
 		c := cors.New(cors.Options{
 			AllowedOrigins: app.corsAllowedOrigins,
 			AllowedMethods: []string{"GET", "DELETE", "POST", "PUT"},
+			AllowedHeaders: []string{"Origin", "Accept", "Content-Type", "X-Requested-With", "Authorization", "Idempotency-Key"},
 		})
-		app.handler = c.Handler(router)
+		app.handler = c.Handler(instrument(router))
 	} else {
-		app.handler = NewRouter(ep)
+		app.handler = instrument(NewRouter(ep))
 	}
 }
 
@@ -120,9 +318,11 @@ func (app *App) initializeWorkers(
 	conf config.Config,
 	log flotillaLog.Logger,
 	ee engine.Engine,
-	sm state.Manager) error {
-	for _, workerName := range conf.GetStringSlice("enabled_workers") {
-		wk, err := worker.NewWorker(workerName, log, conf, ee, sm)
+	sm state.Manager,
+	es services.ExecutionService,
+	workerTypes []string) error {
+	for _, workerName := range workerTypes {
+		wk, err := worker.NewWorker(workerName, log, conf, ee, sm, es)
 		app.logger.Log("message", "Starting worker", "name", workerName)
 		if err != nil {
 			return errors.Wrapf(err, "problem initializing worker with name [%s]", workerName)
@@ -0,0 +1,109 @@
+package flotilla
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"github.com/stitchfix/flotilla-os/worker"
+)
+
+// slowWorker takes a while to finish the poll it is in when stopped
+type slowWorker struct {
+	mu       sync.Mutex
+	started  chan struct{}
+	finished bool
+}
+
+func (sw *slowWorker) Initialize(
+	conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error {
+	return nil
+}
+
+func (sw *slowWorker) Run(ctx context.Context) {
+	close(sw.started)
+	<-ctx.Done()
+	time.Sleep(50 * time.Millisecond)
+	sw.mu.Lock()
+	sw.finished = true
+	sw.mu.Unlock()
+}
+
+func TestApp_Serve(t *testing.T) {
+	imp := testutils.ImplementsAllTheThings{T: t}
+	wk := &slowWorker{started: make(chan struct{})}
+	app := App{
+		address:         "127.0.0.1:0",
+		logger:          flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil),
+		shutdownTimeout: 5 * time.Second,
+		handler:         http.NotFoundHandler(),
+		workers:         []worker.Worker{wk},
+		sm:              &imp,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- app.Serve(ctx)
+	}()
+
+	<-wk.started
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected app to shut down")
+	}
+
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+	if !wk.finished {
+		t.Errorf("Expected shutting down to wait on workers")
+	}
+	if len(imp.Calls) != 1 || imp.Calls[0] != "Cleanup" {
+		t.Errorf("Expected state manager to be cleaned up, got %v", imp.Calls)
+	}
+}
+
+func TestNewWorkerApp(t *testing.T) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{T: t}
+	logger := flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+
+	app, err := NewWorkerApp(c, logger, &imp, &imp, nil, nil, []string{"retry", "status"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(app.workers) != 2 {
+		t.Errorf("Expected 2 workers, got %v", len(app.workers))
+	}
+
+	// Only metrics are served
+	for path, expected := range map[string]int{"/metrics": 200, "/api/v1/task": 404} {
+		w := httptest.NewRecorder()
+		app.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("Expected status %v for [%s], was %v", expected, path, w.Code)
+		}
+	}
+
+	// Schedule workers create runs, which needs the clients to validate them
+	if _, err = NewWorkerApp(c, logger, &imp, &imp, nil, nil, []string{"schedule"}); err == nil {
+		t.Errorf("Expected schedule workers to need the cluster and registry clients")
+	}
+}
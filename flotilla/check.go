@@ -0,0 +1,82 @@
+package flotilla
+
+import (
+	"fmt"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/worker"
+	"strings"
+)
+
+//
+// CheckConfig checks, without connecting to anything, that conf names
+// managers and clients that exist, and has what they and the enabled
+// workers need; returns false and the reasons if it does not
+//
+func CheckConfig(conf config.Config) (bool, []string) {
+	var reasons []string
+
+	named := func(key string, dflt string, valid ...string) string {
+		name := dflt
+		if conf.IsSet(key) {
+			name = conf.GetString(key)
+		}
+		for _, v := range valid {
+			if name == v {
+				return name
+			}
+		}
+		reasons = append(reasons, fmt.Sprintf(
+			"[%s] must be one of [%s], was [%s]", key, strings.Join(valid, ", "), name))
+		return name
+	}
+
+	stateManager := named("state_manager", "postgres", "postgres", "memory", "sqlite")
+	queueManager := named("queue_manager", "sqs", "sqs", "postgres")
+	named("execution_engine", "ecs", "ecs", "docker", "kubernetes")
+	named("cluster_client", "ecs", "ecs")
+	logDriver := named("log.driver.name", "awslogs", "awslogs", "file")
+
+	conditions := []validationCondition{
+		{len(conf.GetString("flotilla_mode")) == 0,
+			"[flotilla_mode] must be set; status updates are only applied to runs of the same mode"},
+		{(stateManager == "postgres" || stateManager == "sqlite" || queueManager == "postgres") &&
+			len(conf.GetString("database_url")) == 0,
+			"[database_url] must be set for the postgres and sqlite state managers and the postgres queue manager"},
+		{stateManager == "sqlite" && queueManager == "postgres",
+			"[queue_manager] postgres needs [database_url] to be a postgres database, not the sqlite state manager's file"},
+		{len(conf.GetString("queue.namespace")) == 0,
+			"[queue.namespace] must be set"},
+		{logDriver == "file" && len(conf.GetString("log.file.directory")) == 0,
+			"[log.file.directory] must be set for the file logs client"},
+		{conf.GetBool("auth.rbac.enabled") && !conf.GetBool("auth.enabled"),
+			"[auth.rbac.enabled] needs [auth.enabled], to know who is making requests"},
+	}
+	for _, cond := range conditions {
+		if cond.condition {
+			reasons = append(reasons, cond.reason)
+		}
+	}
+
+	for _, workerType := range conf.GetStringSlice("enabled_workers") {
+		if !worker.IsValidType(workerType) {
+			reasons = append(reasons, fmt.Sprintf(
+				"[enabled_workers] must be some of [%s], had [%s]", strings.Join(worker.Types, ", "), workerType))
+			continue
+		}
+		if _, err := worker.GetPollInterval(workerType, conf); err != nil {
+			reasons = append(reasons, fmt.Sprintf(
+				"[worker.%s_interval] must be a duration: %s", workerType, err.Error()))
+		}
+		if workerType == "reconcile" {
+			if _, err := worker.GetRequeueAfter(conf); err != nil {
+				reasons = append(reasons, fmt.Sprintf("[worker.reconcile_requeue_after] %s", err.Error()))
+			}
+		}
+	}
+	return len(reasons) == 0, reasons
+}
+
+type validationCondition struct {
+	condition bool
+	reason    string
+}
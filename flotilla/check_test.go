@@ -0,0 +1,58 @@
+package flotilla
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stitchfix/flotilla-os/config"
+)
+
+func TestCheckConfig(t *testing.T) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+
+	if ok, reasons := CheckConfig(c); !ok {
+		t.Errorf("Expected the default config to be valid, got %v", reasons)
+	}
+
+	os.Setenv("QUEUE_MANAGER", "carrier-pigeon")
+	os.Setenv("WORKER_STATUS_INTERVAL", "often")
+	os.Setenv("AUTH_RBAC_ENABLED", "true")
+	os.Setenv("WORKER_RECONCILE_REQUEUE_AFTER", "soon")
+	defer os.Unsetenv("WORKER_RECONCILE_REQUEUE_AFTER")
+	defer os.Unsetenv("QUEUE_MANAGER")
+	defer os.Unsetenv("WORKER_STATUS_INTERVAL")
+	defer os.Unsetenv("AUTH_RBAC_ENABLED")
+
+	ok, reasons := CheckConfig(c)
+	if ok || len(reasons) != 4 {
+		t.Fatalf("Expected 4 reasons the config is invalid, got %v", reasons)
+	}
+	for i, expected := range []string{
+		"[queue_manager]", "[auth.rbac.enabled]", "[worker.status_interval]", "[worker.reconcile_requeue_after]"} {
+		if !strings.Contains(reasons[i], expected) {
+			t.Errorf("Expected reason [%s] to be about %s", reasons[i], expected)
+		}
+	}
+}
+
+func TestCheckConfig_SQLite(t *testing.T) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+
+	os.Setenv("STATE_MANAGER", "sqlite")
+	os.Setenv("QUEUE_MANAGER", "postgres")
+	defer os.Unsetenv("STATE_MANAGER")
+	defer os.Unsetenv("QUEUE_MANAGER")
+
+	ok, reasons := CheckConfig(c)
+	if ok || len(reasons) != 1 || !strings.Contains(reasons[0], "[queue_manager]") {
+		t.Errorf("Expected the postgres queue manager to be refused with sqlite, got %v", reasons)
+	}
+
+	os.Setenv("QUEUE_MANAGER", "sqs")
+	if ok, reasons = CheckConfig(c); !ok {
+		t.Errorf("Expected the sqlite state manager to be valid, got %v", reasons)
+	}
+}
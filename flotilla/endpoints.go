@@ -1,12 +1,15 @@
 package flotilla
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stitchfix/flotilla-os/exceptions"
@@ -18,6 +21,16 @@ type endpoints struct {
 	executionService  services.ExecutionService
 	definitionService services.DefinitionService
 	logService        services.LogService
+	scheduleService   services.ScheduleService
+	webhookService    services.WebhookService
+	roleService       services.RoleService
+
+	// Requests must bear an api token, if set
+	tokenService services.TokenService
+
+	// Log streams and waits on runs end after this long, if set, so that
+	// the server's write timeout does not cut them off
+	streamTimeout time.Duration
 }
 
 type listRequest struct {
@@ -30,8 +43,35 @@ type listRequest struct {
 }
 
 type launchRequest struct {
-	ClusterName string         `json:"cluster"`
-	Env         *state.EnvList `json:"env"`
+	ClusterName    string         `json:"cluster"`
+	Env            *state.EnvList `json:"env"`
+	TimeoutSeconds *int64         `json:"timeout"`
+	IdempotencyKey string         `json:"idempotency_key"`
+	Memory         *int64         `json:"memory"`
+	MemoryReserved *int64         `json:"memory_reservation"`
+	CPU            *int64         `json:"cpu"`
+}
+
+//
+// runOptions are the launch request's options; the idempotency key may
+// be given as the Idempotency-Key header instead
+//
+func (lr *launchRequest) runOptions(r *http.Request) (services.RunOptions, error) {
+	opts := services.RunOptions{
+		TimeoutSeconds: lr.TimeoutSeconds,
+		IdempotencyKey: lr.IdempotencyKey,
+		Memory:         lr.Memory,
+		MemoryReserved: lr.MemoryReserved,
+		CPU:            lr.CPU,
+	}
+	if header := r.Header.Get("Idempotency-Key"); len(header) > 0 {
+		if len(opts.IdempotencyKey) > 0 && opts.IdempotencyKey != header {
+			return opts, exceptions.MalformedInput{
+				ErrorString: "the Idempotency-Key header and [idempotency_key] must match when both are given"}
+		}
+		opts.IdempotencyKey = header
+	}
+	return opts, nil
 }
 
 type launchRequestV2 struct {
@@ -110,6 +150,11 @@ func (ep endpoints) encodeError(w http.ResponseWriter, err error) {
 		w.WriteHeader(http.StatusConflict)
 	case exceptions.MissingResource:
 		w.WriteHeader(http.StatusNotFound)
+	case exceptions.Unauthorized:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="flotilla"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	case exceptions.Forbidden:
+		w.WriteHeader(http.StatusForbidden)
 	default:
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -123,6 +168,49 @@ func (ep *endpoints) encodeResponse(w http.ResponseWriter, response interface{})
 	json.NewEncoder(w).Encode(response)
 }
 
+type tokenContextKey struct{}
+
+//
+// authenticated wraps h so that, if api tokens are required, it is only
+// called for requests bearing a valid token that has scope
+// * an empty scope allows any valid token
+// * the token is available to h through principal
+//
+func (ep *endpoints) authenticated(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ep.tokenService == nil {
+			h(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+		if !strings.HasPrefix(header, "Bearer ") {
+			ep.encodeError(w, exceptions.Unauthorized{ErrorString: "request must have a bearer api token"})
+			return
+		}
+
+		token, err := ep.tokenService.Authenticate(strings.TrimSpace(strings.TrimPrefix(header, "Bearer ")))
+		if err != nil {
+			ep.encodeError(w, err)
+			return
+		}
+		if len(scope) > 0 && !token.HasScope(scope) {
+			ep.encodeError(w, exceptions.Forbidden{
+				ErrorString: fmt.Sprintf("api token does not have scope [%s]", scope)})
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey{}, token)))
+	}
+}
+
+//
+// principal returns who the request's api token acts as, if it has one
+//
+func (ep *endpoints) principal(r *http.Request) (string, bool) {
+	token, ok := r.Context().Value(tokenContextKey{}).(state.Token)
+	return token.Principal, ok
+}
+
 func (ep *endpoints) ListDefinitions(w http.ResponseWriter, r *http.Request) {
 	lr := ep.decodeListRequest(r)
 
@@ -177,7 +265,8 @@ func (ep *endpoints) CreateDefinition(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	created, err := ep.definitionService.Create(&definition)
+	principal, _ := ep.principal(r)
+	created, err := ep.definitionService.Create(&definition, principal)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -194,7 +283,8 @@ func (ep *endpoints) UpdateDefinition(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	updated, err := ep.definitionService.Update(vars["definition_id"], definition)
+	principal, _ := ep.principal(r)
+	updated, err := ep.definitionService.Update(vars["definition_id"], definition, principal)
 
 	if err != nil {
 		ep.encodeError(w, err)
@@ -205,7 +295,262 @@ func (ep *endpoints) UpdateDefinition(w http.ResponseWriter, r *http.Request) {
 
 func (ep *endpoints) DeleteDefinition(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	err := ep.definitionService.Delete(vars["definition_id"])
+	principal, _ := ep.principal(r)
+	err := ep.definitionService.Delete(vars["definition_id"], principal)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, map[string]bool{"deleted": true})
+	}
+}
+
+func (ep *endpoints) decodeRevision(value string) (int64, error) {
+	revision, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || revision < 1 {
+		return 0, exceptions.MalformedInput{
+			ErrorString: fmt.Sprintf("revision must be a positive integer, was [%s]", value)}
+	}
+	return revision, nil
+}
+
+func (ep *endpoints) ListDefinitionRevisions(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	vars := mux.Vars(r)
+	revisionList, err := ep.definitionService.ListRevisions(vars["definition_id"], lr.limit, lr.offset)
+	if revisionList.Revisions == nil {
+		revisionList.Revisions = []state.DefinitionRevision{}
+	}
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = revisionList.Total
+		response["revisions"] = revisionList.Revisions
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		ep.encodeResponse(w, response)
+	}
+}
+
+func (ep *endpoints) GetDefinitionRevision(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	revision, err := ep.decodeRevision(vars["revision"])
+	if err != nil {
+		ep.encodeError(w, err)
+		return
+	}
+
+	var diffFrom *int64
+	if from := ep.getURLParam(r.URL.Query(), "diff_from", ""); len(from) > 0 {
+		parsed, err := ep.decodeRevision(from)
+		if err != nil {
+			ep.encodeError(w, err)
+			return
+		}
+		diffFrom = &parsed
+	}
+
+	dr, err := ep.definitionService.GetRevision(vars["definition_id"], revision, diffFrom)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, dr)
+	}
+}
+
+func (ep *endpoints) RollbackDefinition(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	revision, err := ep.decodeRevision(vars["revision"])
+	if err != nil {
+		ep.encodeError(w, err)
+		return
+	}
+
+	principal, _ := ep.principal(r)
+	updated, err := ep.definitionService.Rollback(vars["definition_id"], revision, principal)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, updated)
+	}
+}
+
+func (ep *endpoints) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	// Only these fields of a schedule can be filtered on
+	filters := make(map[string][]string)
+	for _, k := range []string{"definition_id", "alias", "cluster_name", "owner_id"} {
+		if v, ok := lr.filters[k]; ok {
+			filters[k] = v
+		}
+	}
+
+	vars := mux.Vars(r)
+	if definitionID, ok := vars["definition_id"]; ok {
+		filters["definition_id"] = []string{definitionID}
+	}
+
+	scheduleList, err := ep.scheduleService.List(lr.limit, lr.offset, filters)
+	if scheduleList.Schedules == nil {
+		scheduleList.Schedules = []state.Schedule{}
+	}
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = scheduleList.Total
+		response["schedules"] = scheduleList.Schedules
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		for k, v := range filters {
+			response[k] = v
+		}
+		ep.encodeResponse(w, response)
+	}
+}
+
+func (ep *endpoints) GetSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	schedule, err := ep.scheduleService.Get(vars["schedule_id"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, schedule)
+	}
+}
+
+func (ep *endpoints) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule state.Schedule
+	err := ep.decodeRequest(r, &schedule)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	principal, ok := ep.principal(r)
+	if ok {
+		schedule.OwnerID = principal
+	}
+
+	created, err := ep.scheduleService.Create(&schedule, principal)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, created)
+	}
+}
+
+func (ep *endpoints) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	var schedule state.Schedule
+	err := ep.decodeRequest(r, &schedule)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	principal, ok := ep.principal(r)
+	if ok {
+		schedule.OwnerID = principal
+	}
+
+	vars := mux.Vars(r)
+	updated, err := ep.scheduleService.Update(vars["schedule_id"], schedule, principal)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, updated)
+	}
+}
+
+func (ep *endpoints) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	principal, _ := ep.principal(r)
+	err := ep.scheduleService.Delete(vars["schedule_id"], principal)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, map[string]bool{"deleted": true})
+	}
+}
+
+func (ep *endpoints) ListWebhooks(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	// Only these fields of a webhook can be filtered on
+	filters := make(map[string][]string)
+	for _, k := range []string{"definition_id", "group_name"} {
+		if v, ok := lr.filters[k]; ok {
+			filters[k] = v
+		}
+	}
+
+	webhookList, err := ep.webhookService.List(lr.limit, lr.offset, filters)
+	if webhookList.Webhooks == nil {
+		webhookList.Webhooks = []state.Webhook{}
+	}
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = webhookList.Total
+		response["webhooks"] = webhookList.Webhooks
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		for k, v := range filters {
+			response[k] = v
+		}
+		ep.encodeResponse(w, response)
+	}
+}
+
+func (ep *endpoints) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	webhook, err := ep.webhookService.Get(vars["webhook_id"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, webhook)
+	}
+}
+
+func (ep *endpoints) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook state.Webhook
+	err := ep.decodeRequest(r, &webhook)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	created, err := ep.webhookService.Create(&webhook)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, created)
+	}
+}
+
+func (ep *endpoints) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	var webhook state.Webhook
+	err := ep.decodeRequest(r, &webhook)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	vars := mux.Vars(r)
+	updated, err := ep.webhookService.Update(vars["webhook_id"], webhook)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, updated)
+	}
+}
+
+func (ep *endpoints) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	err := ep.webhookService.Delete(vars["webhook_id"])
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -213,6 +558,26 @@ func (ep *endpoints) DeleteDefinition(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (ep *endpoints) ListWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	vars := mux.Vars(r)
+	deliveryList, err := ep.webhookService.ListDeliveries(vars["webhook_id"], lr.limit, lr.offset)
+	if deliveryList.Deliveries == nil {
+		deliveryList.Deliveries = []state.WebhookDelivery{}
+	}
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = deliveryList.Total
+		response["deliveries"] = deliveryList.Deliveries
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		ep.encodeResponse(w, response)
+	}
+}
+
 func (ep *endpoints) ListRuns(w http.ResponseWriter, r *http.Request) {
 	lr := ep.decodeListRequest(r)
 
@@ -252,6 +617,44 @@ func (ep *endpoints) GetRun(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//
+// WaitForRun responds with the run once it reaches the status parameter
+// (default STOPPED), or as it is once the timeout parameter, in seconds,
+// runs out; waits are cut short to end before the server's write timeout
+//
+func (ep *endpoints) WaitForRun(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	params := r.URL.Query()
+
+	timeout := ep.streamTimeout
+	if value := ep.getURLParam(params, "timeout", ""); len(value) > 0 {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 1 {
+			ep.encodeError(w, exceptions.MalformedInput{
+				ErrorString: fmt.Sprintf("timeout must be a positive number of seconds, was [%s]", value)})
+			return
+		}
+		if requested := time.Duration(seconds) * time.Second; timeout == 0 || requested < timeout {
+			timeout = requested
+		}
+	}
+
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	status := ep.getURLParam(params, "status", state.StatusStopped)
+	run, err := ep.executionService.Wait(ctx, vars["run_id"], status)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, run)
+	}
+}
+
 func (ep *endpoints) CreateRun(w http.ResponseWriter, r *http.Request) {
 	var lr launchRequest
 	err := ep.decodeRequest(r, &lr)
@@ -260,8 +663,19 @@ func (ep *endpoints) CreateRun(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ownerID := "v1-unknown"
+	if principal, ok := ep.principal(r); ok {
+		ownerID = principal
+	}
+
+	opts, err := lr.runOptions(r)
+	if err != nil {
+		ep.encodeError(w, err)
+		return
+	}
+
 	vars := mux.Vars(r)
-	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, "v1-unknown")
+	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, ownerID, opts)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -277,14 +691,24 @@ func (ep *endpoints) CreateRunV2(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(lr.RunTags.OwnerEmail) == 0 || len(lr.RunTags.TeamName) == 0 {
-		ep.encodeError(w, exceptions.MalformedInput{
-			ErrorString: fmt.Sprintf("run_tags must exist in body and contain [owner_email] and [team_name]")})
+	ownerID, ok := ep.principal(r)
+	if !ok {
+		if len(lr.RunTags.OwnerEmail) == 0 || len(lr.RunTags.TeamName) == 0 {
+			ep.encodeError(w, exceptions.MalformedInput{
+				ErrorString: fmt.Sprintf("run_tags must exist in body and contain [owner_email] and [team_name]")})
+			return
+		}
+		ownerID = lr.RunTags.OwnerEmail
+	}
+
+	opts, err := lr.runOptions(r)
+	if err != nil {
+		ep.encodeError(w, err)
 		return
 	}
 
 	vars := mux.Vars(r)
-	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, lr.RunTags.OwnerEmail)
+	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, ownerID, opts)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -300,14 +724,20 @@ func (ep *endpoints) CreateRunV4(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(lr.RunTags.OwnerID) == 0 {
-		ep.encodeError(w, exceptions.MalformedInput{
-			ErrorString: fmt.Sprintf("run_tags must exist in body and contain [owner_id]")})
+	ownerID, err := ep.runOwner(r, lr)
+	if err != nil {
+		ep.encodeError(w, err)
+		return
+	}
+
+	opts, err := lr.runOptions(r)
+	if err != nil {
+		ep.encodeError(w, err)
 		return
 	}
 
 	vars := mux.Vars(r)
-	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, lr.RunTags.OwnerID)
+	run, err := ep.executionService.Create(vars["definition_id"], lr.ClusterName, lr.Env, ownerID, opts)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -323,14 +753,20 @@ func (ep *endpoints) CreateRunByAlias(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(lr.RunTags.OwnerID) == 0 {
-		ep.encodeError(w, exceptions.MalformedInput{
-			ErrorString: fmt.Sprintf("run_tags must exist in body and contain [owner_id]")})
+	ownerID, err := ep.runOwner(r, lr)
+	if err != nil {
+		ep.encodeError(w, err)
+		return
+	}
+
+	opts, err := lr.runOptions(r)
+	if err != nil {
+		ep.encodeError(w, err)
 		return
 	}
 
 	vars := mux.Vars(r)
-	run, err := ep.executionService.CreateByAlias(vars["alias"], lr.ClusterName, lr.Env, lr.RunTags.OwnerID)
+	run, err := ep.executionService.CreateByAlias(vars["alias"], lr.ClusterName, lr.Env, ownerID, opts)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -338,9 +774,25 @@ func (ep *endpoints) CreateRunByAlias(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+//
+// runOwner returns who the run being launched belongs to: the request's
+// principal, if it has an api token, and run_tags.owner_id otherwise
+//
+func (ep *endpoints) runOwner(r *http.Request, lr launchRequestV2) (string, error) {
+	if principal, ok := ep.principal(r); ok {
+		return principal, nil
+	}
+	if len(lr.RunTags.OwnerID) == 0 {
+		return "", exceptions.MalformedInput{
+			ErrorString: fmt.Sprintf("run_tags must exist in body and contain [owner_id]")}
+	}
+	return lr.RunTags.OwnerID, nil
+}
+
 func (ep *endpoints) StopRun(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	err := ep.executionService.Terminate(vars["run_id"])
+	principal, _ := ep.principal(r)
+	err := ep.executionService.Terminate(vars["run_id"], principal)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -357,7 +809,8 @@ func (ep *endpoints) UpdateRun(w http.ResponseWriter, r *http.Request) {
 	}
 
 	vars := mux.Vars(r)
-	err = ep.executionService.UpdateStatus(vars["run_id"], run.Status, run.ExitCode)
+	principal, _ := ep.principal(r)
+	err = ep.executionService.UpdateStatus(vars["run_id"], run.Status, run.ExitCode, principal)
 	if err != nil {
 		ep.encodeError(w, err)
 	} else {
@@ -385,6 +838,102 @@ func (ep *endpoints) GetLogs(w http.ResponseWriter, r *http.Request) {
 	ep.encodeResponse(w, res)
 }
 
+//
+// StreamLogs tails a run's logs until it stops
+// * as server-sent events if the client accepts text/event-stream; each
+//   event's id is the position in the logs to resume from with Last-Event-ID
+// * as plain chunked text otherwise, with status changes as lines of their own
+//
+func (ep *endpoints) StreamLogs(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		ep.encodeError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	vars := mux.Vars(r)
+	var lastSeen *string
+	if id := r.Header.Get("Last-Event-ID"); len(id) > 0 {
+		lastSeen = &id
+	} else if seen := ep.getURLParam(r.URL.Query(), "last_seen", ""); len(seen) > 0 {
+		lastSeen = &seen
+	}
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+
+	ctx := r.Context()
+	if ep.streamTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ep.streamTimeout)
+		defer cancel()
+	}
+
+	started := false
+	err := ep.logService.Tail(ctx, vars["run_id"], lastSeen, func(event services.LogEvent) error {
+		if !started {
+			if sse {
+				w.Header().Set("Content-Type", "text/event-stream")
+			} else {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			}
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+
+		var err error
+		if sse {
+			err = ep.writeServerSentEvent(w, event.Type, event.LastSeen, event.Data)
+		} else {
+			err = ep.writeLogText(w, event)
+		}
+		flusher.Flush()
+		return err
+	})
+
+	if err != nil {
+		if !started {
+			// Nothing is written yet, so errors like missing runs keep their status code
+			ep.encodeError(w, err)
+			return
+		}
+		if sse {
+			ep.writeServerSentEvent(w, "error", nil, err.Error())
+		}
+		flusher.Flush()
+	}
+}
+
+func (ep *endpoints) writeServerSentEvent(w http.ResponseWriter, event string, id *string, data string) error {
+	var buf bytes.Buffer
+	if id != nil && len(*id) > 0 {
+		fmt.Fprintf(&buf, "id: %s\n", *id)
+	}
+	fmt.Fprintf(&buf, "event: %s\n", event)
+	for _, line := range strings.Split(strings.TrimSuffix(data, "\n"), "\n") {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (ep *endpoints) writeLogText(w http.ResponseWriter, event services.LogEvent) error {
+	var text string
+	switch event.Type {
+	case services.LogEventLog:
+		text = event.Data
+		if !strings.HasSuffix(text, "\n") {
+			text = text + "\n"
+		}
+	case services.LogEventStatus:
+		text = fmt.Sprintf("[flotilla] run is %s\n", event.Data)
+	default:
+		return nil
+	}
+	_, err := w.Write([]byte(text))
+	return err
+}
+
 func (ep *endpoints) GetGroups(w http.ResponseWriter, r *http.Request) {
 	lr := ep.decodeListRequest(r)
 
@@ -437,3 +986,132 @@ func (ep *endpoints) ListClusters(w http.ResponseWriter, r *http.Request) {
 		ep.encodeResponse(w, response)
 	}
 }
+
+//
+// GetCluster responds with the cluster's capacity, instances and
+// utilization
+//
+func (ep *endpoints) GetCluster(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	capacity, err := ep.executionService.GetCluster(vars["cluster_name"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, capacity)
+	}
+}
+
+func (ep *endpoints) ListTokens(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	filters := make(map[string][]string)
+	if principal, ok := lr.filters["principal"]; ok {
+		filters["principal"] = principal
+	}
+
+	tokens, err := ep.tokenService.List(lr.limit, lr.offset, filters)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = tokens.Total
+		response["tokens"] = tokens.Tokens
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		ep.encodeResponse(w, response)
+	}
+}
+
+func (ep *endpoints) GetToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token, err := ep.tokenService.Get(vars["token_id"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, token)
+	}
+}
+
+//
+// CreateToken responds with the new token's details and, under "token",
+// the token itself; it is not shown again
+//
+func (ep *endpoints) CreateToken(w http.ResponseWriter, r *http.Request) {
+	var token state.Token
+	err := ep.decodeRequest(r, &token)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	created, secret, err := ep.tokenService.Create(&token)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, struct {
+			state.Token
+			Secret string `json:"token"`
+		}{created, secret})
+	}
+}
+
+func (ep *endpoints) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token, err := ep.tokenService.Revoke(vars["token_id"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, token)
+	}
+}
+
+func (ep *endpoints) ListRoleBindings(w http.ResponseWriter, r *http.Request) {
+	lr := ep.decodeListRequest(r)
+
+	filters := make(map[string][]string)
+	for _, k := range []string{"principal", "group_name"} {
+		if v, ok := lr.filters[k]; ok {
+			filters[k] = v
+		}
+	}
+
+	bindings, err := ep.roleService.List(lr.limit, lr.offset, filters)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		response := make(map[string]interface{})
+		response["total"] = bindings.Total
+		response["role_bindings"] = bindings.RoleBindings
+		response["limit"] = lr.limit
+		response["offset"] = lr.offset
+		ep.encodeResponse(w, response)
+	}
+}
+
+func (ep *endpoints) PutRoleBinding(w http.ResponseWriter, r *http.Request) {
+	var binding state.RoleBinding
+	err := ep.decodeRequest(r, &binding)
+	if err != nil {
+		ep.encodeError(w, exceptions.MalformedInput{ErrorString: err.Error()})
+		return
+	}
+
+	principal, _ := ep.principal(r)
+	granted, err := ep.roleService.Grant(principal, binding)
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, granted)
+	}
+}
+
+func (ep *endpoints) DeleteRoleBinding(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	principal, _ := ep.principal(r)
+	err := ep.roleService.Revoke(principal, vars["group_name"], vars["principal"])
+	if err != nil {
+		ep.encodeError(w, err)
+	} else {
+		ep.encodeResponse(w, map[string]bool{"deleted": true})
+	}
+}
@@ -3,11 +3,18 @@ package flotilla
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	gklog "github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
+	"github.com/stitchfix/flotilla-os/clients/cluster"
 	"github.com/stitchfix/flotilla-os/config"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
 	"github.com/stitchfix/flotilla-os/services"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/testutils"
@@ -39,9 +46,13 @@ func setUp(t *testing.T) *mux.Router {
 		Tags:   []string{"t1", "t2", "t3"},
 	}
 	ds, _ := services.NewDefinitionService(c, &imp, &imp)
-	es, _ := services.NewExecutionService(c, &imp, &imp, &imp, &imp)
+	logger := flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+	es, _ := services.NewExecutionService(c, &imp, &imp, &imp, &imp, logger)
 	ls, _ := services.NewLogService(c, &imp, &imp)
-	ep := endpoints{definitionService: ds, executionService: es, logService: ls}
+	ss, _ := services.NewScheduleService(c, &imp)
+	ws, _ := services.NewWebhookService(c, &imp)
+	ep := endpoints{
+		definitionService: ds, executionService: es, logService: ls, scheduleService: ss, webhookService: ws}
 	return NewRouter(ep)
 }
 
@@ -139,6 +150,43 @@ func TestEndpoints_CreateRun(t *testing.T) {
 	}
 }
 
+func TestEndpoints_CreateRunIdempotent(t *testing.T) {
+	router := setUp(t)
+
+	create := func(body string, key string) (int, state.Run) {
+		req := httptest.NewRequest("PUT", "/api/v1/task/A/execute", bytes.NewBufferString(body))
+		if len(key) > 0 {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		var r state.Run
+		json.NewDecoder(w.Result().Body).Decode(&r)
+		return w.Result().StatusCode, r
+	}
+
+	newRun := `{"cluster":"cupcake", "env":[{"name":"E1","value":"V1"}]}`
+	_, first := create(newRun, "k1")
+	code, repeat := create(newRun, "k1")
+	if code != 200 || repeat.RunID != first.RunID {
+		t.Errorf("Expected repeated request to return run [%s], got %v [%s]", first.RunID, code, repeat.RunID)
+	}
+
+	// The key can be given in the body instead
+	code, repeat = create(`{"cluster":"cupcake", "env":[{"name":"E1","value":"V1"}], "idempotency_key":"k1"}`, "")
+	if code != 200 || repeat.RunID != first.RunID {
+		t.Errorf("Expected repeated request to return run [%s], got %v [%s]", first.RunID, code, repeat.RunID)
+	}
+
+	if code, _ = create(`{"cluster":"cupcake"}`, "k1"); code != 409 {
+		t.Errorf("Expected reusing the key for a different request to be 409, was %v", code)
+	}
+
+	if code, _ = create(`{"cluster":"cupcake", "idempotency_key":"k2"}`, "k1"); code != 400 {
+		t.Errorf("Expected different header and body keys to be 400, was %v", code)
+	}
+}
+
 func TestEndpoints_CreateRun2(t *testing.T) {
 	router := setUp(t)
 
@@ -409,6 +457,84 @@ func TestEndpoints_GetLogs(t *testing.T) {
 	}
 }
 
+func setUpStreamLogs(t *testing.T) *mux.Router {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A"},
+		},
+		Runs: map[string]state.Run{
+			"runA": {DefinitionID: "A", RunID: "runA", Status: state.StatusStopped},
+		},
+		LogChunks: []string{"hello\nworld\n", "bye"},
+	}
+	ls, _ := services.NewLogService(c, &imp, &imp)
+	return NewRouter(endpoints{logService: ls})
+}
+
+func TestEndpoints_StreamLogs(t *testing.T) {
+	router := setUpStreamLogs(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/runA/logs/stream", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected status 200 event stream, was %v [%s]", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	expected := "event: status\ndata: STOPPED\n\n" +
+		"id: 1\nevent: log\ndata: hello\ndata: world\n\n" +
+		"id: 2\nevent: log\ndata: bye\n\n" +
+		"id: 2\nevent: done\ndata: STOPPED\n\n"
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected events:\n%s\nbut got:\n%s", expected, body)
+	}
+
+	// Resuming skips the logs already seen
+	req = httptest.NewRequest("GET", "/api/v1/runA/logs/stream", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", "1")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	expected = "id: 1\nevent: status\ndata: STOPPED\n\n" +
+		"id: 2\nevent: log\ndata: bye\n\n" +
+		"id: 2\nevent: done\ndata: STOPPED\n\n"
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected resumed events:\n%s\nbut got:\n%s", expected, body)
+	}
+}
+
+func TestEndpoints_StreamLogsText(t *testing.T) {
+	router := setUpStreamLogs(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/runA/logs/stream", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Expected plain text, was [%s]", resp.Header.Get("Content-Type"))
+	}
+
+	expected := "[flotilla] run is STOPPED\nhello\nworld\nbye\n"
+	if body := w.Body.String(); body != expected {
+		t.Errorf("Expected text:\n%s\nbut got:\n%s", expected, body)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/nope/logs/stream", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode == 200 {
+		t.Errorf("Expected error status for missing run")
+	}
+}
+
 func TestEndpoints_GetRun(t *testing.T) {
 	router := setUp(t)
 
@@ -470,6 +596,85 @@ func TestEndpoints_GetRun2(t *testing.T) {
 	}
 }
 
+func TestEndpoints_WaitForRun(t *testing.T) {
+	router := setUp(t)
+
+	// Already reached
+	req := httptest.NewRequest("GET", "/api/v1/history/runA/wait?status=RUNNING", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	var r state.Run
+	json.NewDecoder(resp.Body).Decode(&r)
+	if resp.StatusCode != 200 || r.RunID != "runA" || r.Status != state.StatusRunning {
+		t.Errorf("Expected running run [runA] with status 200, was %v [%s] %s", resp.StatusCode, r.RunID, r.Status)
+	}
+
+	// Times out with the run as it is
+	start := time.Now()
+	req = httptest.NewRequest("GET", "/api/v1/history/runA/wait?timeout=1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	json.NewDecoder(resp.Body).Decode(&r)
+	if resp.StatusCode != 200 || r.Status != state.StatusRunning {
+		t.Errorf("Expected running run with status 200 once timed out, was %v %s", resp.StatusCode, r.Status)
+	}
+	if waited := time.Since(start); waited < time.Second || waited > 5*time.Second {
+		t.Errorf("Expected to wait about a second, waited %s", waited)
+	}
+
+	for _, query := range []string{"timeout=soon", "timeout=0", "status=DONE"} {
+		req = httptest.NewRequest("GET", "/api/v1/history/runA/wait?"+query, nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Result().StatusCode != 400 {
+			t.Errorf("Expected status 400 for [%s], was %v", query, w.Result().StatusCode)
+		}
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/history/nope/wait", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode == 200 {
+		t.Errorf("Expected waiting on a missing run to fail")
+	}
+}
+
+func TestEndpoints_GetCluster(t *testing.T) {
+	router := setUp(t)
+
+	req := httptest.NewRequest("GET", "/api/v1/clusters/cluster0", nil)
+	w := httptest.NewRecorder()
+
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, was %v", resp.StatusCode)
+	}
+
+	var capacity cluster.Capacity
+	if err := json.NewDecoder(resp.Body).Decode(&capacity); err != nil {
+		t.Errorf(err.Error())
+	}
+	if capacity.Name != "cluster0" || capacity.InstanceCount != 1 || capacity.Registered.Memory != 2048 {
+		t.Errorf("Expected capacity of cluster0, got %v", capacity)
+	}
+	if capacity.Utilization.Memory != 0.5 || len(capacity.Instances) != 1 {
+		t.Errorf("Expected utilization and instances of cluster0, got %v", capacity)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/clusters/nocluster", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected status 404 for a missing cluster, was %v", w.Result().StatusCode)
+	}
+}
+
 func TestEndpoints_GetTags(t *testing.T) {
 	router := setUp(t)
 
@@ -736,3 +941,493 @@ func TestEndpoints_UpdateRun(t *testing.T) {
 		t.Errorf("Expected [updated] acknowledgement")
 	}
 }
+
+func TestEndpoints_DefinitionRevisions(t *testing.T) {
+	router := setUp(t)
+
+	for _, image := range []string{"cupcake:1", "cupcake:2"} {
+		req := httptest.NewRequest(
+			"PUT", "/api/v1/task/A", bytes.NewBufferString(fmt.Sprintf(`{"image":"%s"}`, image)))
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/task/A/revisions", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, was %v", resp.StatusCode)
+	}
+
+	var listed struct {
+		Total     int                        `json:"total"`
+		Revisions []state.DefinitionRevision `json:"revisions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if listed.Total != 2 || len(listed.Revisions) != 2 || listed.Revisions[0].Revision != 2 {
+		t.Errorf("Expected 2 revisions, newest first, got %v", listed.Revisions)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/task/A/revisions/2?diff_from=1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var dr state.DefinitionRevision
+	if err := json.NewDecoder(resp.Body).Decode(&dr); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if dr.Image != "cupcake:2" {
+		t.Errorf("Expected image [cupcake:2] but was [%s]", dr.Image)
+	}
+
+	if change, ok := dr.Diff["image"]; !ok || change.From != "cupcake:1" || change.To != "cupcake:2" {
+		t.Errorf("Expected image change from [cupcake:1] to [cupcake:2], got %v", dr.Diff)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/task/A/revisions/1/rollback", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var rolledBack state.Definition
+	if err := json.NewDecoder(resp.Body).Decode(&rolledBack); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if rolledBack.Image != "cupcake:1" || rolledBack.Revision != 3 {
+		t.Errorf("Expected rollback to create revision 3 with image [cupcake:1], got revision %v with image [%s]",
+			rolledBack.Revision, rolledBack.Image)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/task/A/revisions/nope", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected status 400 for invalid revision, was %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/task/A/revisions/42", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 404 {
+		t.Errorf("Expected status 404 for missing revision, was %v", w.Result().StatusCode)
+	}
+}
+
+func TestEndpoints_Schedules(t *testing.T) {
+	router := setUp(t)
+
+	newSchedule := `{"definition_id":"A", "cron":"*/15 * * * *", "timezone":"America/New_York", "cluster":"clusta"}`
+	req := httptest.NewRequest("POST", "/api/v1/schedule", bytes.NewBufferString(newSchedule))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, was %v", resp.StatusCode)
+	}
+
+	var created state.Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if len(created.ScheduleID) == 0 || created.NextRunAt == nil {
+		t.Errorf("Expected schedule id and next run to be set, got %v", created)
+	}
+
+	if created.MissedPolicy != state.ScheduleMissedSkip || created.Enabled == nil || !*created.Enabled {
+		t.Errorf("Expected enabled schedule with default missed policy [skip], got %v", created)
+	}
+
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/schedule/%s", created.ScheduleID),
+		bytes.NewBufferString(`{"enabled":false}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var updated state.Schedule
+	if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if updated.Enabled == nil || *updated.Enabled {
+		t.Errorf("Expected schedule to be disabled")
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/task/A/schedules", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var listed struct {
+		Total     int              `json:"total"`
+		Schedules []state.Schedule `json:"schedules"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if listed.Total != 1 {
+		t.Errorf("Expected 1 schedule, got %v", listed.Total)
+	}
+
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/schedule/%s", created.ScheduleID), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/schedule/%s", created.ScheduleID), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected status 404 for deleted schedule, was %v", resp.StatusCode)
+	}
+}
+
+func TestEndpoints_CreateScheduleInvalid(t *testing.T) {
+	router := setUp(t)
+
+	invalid := []string{
+		`{"definition_id":"A", "cron":"61 * * * *", "cluster":"clusta"}`,
+		`{"definition_id":"A", "alias":"aliasA", "cron":"* * * * *", "cluster":"clusta"}`,
+		`{"definition_id":"A", "cron":"* * * * *", "cluster":"clusta", "timezone":"Mars/Olympus"}`,
+		`{"definition_id":"A", "cron":"* * * * *", "cluster":"clusta", "missed_policy":"sometimes"}`,
+	}
+
+	for _, body := range invalid {
+		req := httptest.NewRequest("POST", "/api/v1/schedule", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Result().StatusCode != 400 {
+			t.Errorf("Expected status 400 for %s, was %v", body, w.Result().StatusCode)
+		}
+	}
+}
+
+func TestEndpoints_Webhooks(t *testing.T) {
+	router := setUp(t)
+
+	newWebhook := `{"url":"https://example.com/hook", "secret":"s3cret", "group_name":"A", "statuses":["STOPPED"], "failed_only":true}`
+	req := httptest.NewRequest("POST", "/api/v1/webhook", bytes.NewBufferString(newWebhook))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, was %v", resp.StatusCode)
+	}
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	webhookID, _ := created["webhook_id"].(string)
+	if len(webhookID) == 0 || created["failed_only"] != true || created["has_secret"] != true {
+		t.Errorf("Expected failed only webhook with a secret, got %v", created)
+	}
+	if _, ok := created["secret"]; ok {
+		t.Errorf("Expected secret not to be returned")
+	}
+
+	req = httptest.NewRequest("PUT", fmt.Sprintf("/api/v1/webhook/%s", webhookID),
+		bytes.NewBufferString(`{"failed_only":false}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var updated state.Webhook
+	if err := json.NewDecoder(resp.Body).Decode(&updated); err != nil {
+		t.Errorf(err.Error())
+	}
+	if updated.IsFailedOnly() || updated.GroupName != "A" {
+		t.Errorf("Expected webhook to fire for all stopped runs of group A, got %v", updated)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/webhook?group_name=A", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var listed struct {
+		Total    int             `json:"total"`
+		Webhooks []state.Webhook `json:"webhooks"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		t.Errorf(err.Error())
+	}
+	if listed.Total != 1 {
+		t.Errorf("Expected 1 webhook, got %v", listed.Total)
+	}
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/webhook/%s/deliveries", webhookID), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var deliveries struct {
+		Total      int                     `json:"total"`
+		Deliveries []state.WebhookDelivery `json:"deliveries"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&deliveries); err != nil {
+		t.Errorf(err.Error())
+	}
+	if resp.StatusCode != 200 || deliveries.Total != 0 || deliveries.Deliveries == nil {
+		t.Errorf("Expected empty delivery log, got %v", deliveries)
+	}
+
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/webhook/%s", webhookID), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/api/v1/webhook/%s", webhookID), nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	if resp.StatusCode != 404 {
+		t.Errorf("Expected status 404 for deleted webhook, was %v", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/webhook", bytes.NewBufferString(`{"url":"https://example.com/hook", "statuses":["DONE"]}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 400 {
+		t.Errorf("Expected status 400 for unknown status, was %v", w.Result().StatusCode)
+	}
+}
+
+func setUpAuth(t *testing.T, rbac bool) *mux.Router {
+	os.Setenv("AUTH_BOOTSTRAP_TOKEN", "let-me-in")
+	defer os.Unsetenv("AUTH_BOOTSTRAP_TOKEN")
+	if rbac {
+		os.Setenv("AUTH_RBAC_ENABLED", "true")
+		defer os.Unsetenv("AUTH_RBAC_ENABLED")
+	}
+
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A", Alias: "aliasA", GroupName: "g1"},
+		},
+		Runs:   map[string]state.Run{},
+		Qurls:  map[string]string{"A": "a/"},
+		Tokens: map[string]state.Token{},
+	}
+	ds, _ := services.NewDefinitionService(c, &imp, &imp)
+	logger := flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+	es, _ := services.NewExecutionService(c, &imp, &imp, &imp, &imp, logger)
+	ts, _ := services.NewTokenService(c, &imp)
+	rs, _ := services.NewRoleService(c, &imp)
+	ep := endpoints{definitionService: ds, executionService: es, tokenService: ts, roleService: rs}
+	return NewRouter(ep)
+}
+
+func TestEndpoints_Tokens(t *testing.T) {
+	router := setUpAuth(t, false)
+
+	req := httptest.NewRequest("GET", "/api/v1/task", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp := w.Result()
+
+	if resp.StatusCode != 401 || len(resp.Header.Get("WWW-Authenticate")) == 0 {
+		t.Errorf("Expected status 401 without a token, was %v", resp.StatusCode)
+	}
+
+	newToken := `{"name":"ci", "principal":"ci-bot", "scopes":["runs:execute"]}`
+	req = httptest.NewRequest("POST", "/api/v1/token", bytes.NewBufferString(newToken))
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Expected status 200, was %v", resp.StatusCode)
+	}
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Errorf(err.Error())
+	}
+	secret, _ := created["token"].(string)
+	tokenID, _ := created["token_id"].(string)
+	if len(secret) == 0 || len(tokenID) == 0 {
+		t.Fatalf("Expected the new token in the response, got %v", created)
+	}
+
+	// Reads need any valid token
+	req = httptest.NewRequest("GET", "/api/v1/task", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected status 200 reading with a token, was %v", w.Result().StatusCode)
+	}
+
+	// Changes need the matching scope
+	req = httptest.NewRequest("DELETE", "/api/v1/task/A", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected status 403 without the definitions:write scope, was %v", w.Result().StatusCode)
+	}
+
+	// Runs belong to the token's principal
+	req = httptest.NewRequest("PUT", "/api/v1/task/A/execute", bytes.NewBufferString(`{"cluster":"cupcake"}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var run state.Run
+	if err := json.NewDecoder(resp.Body).Decode(&run); err != nil {
+		t.Errorf(err.Error())
+	}
+	if resp.StatusCode != 200 || run.User != "ci-bot" {
+		t.Errorf("Expected run owned by ci-bot, got status %v and user [%s]", resp.StatusCode, run.User)
+	}
+
+	// Only admins manage tokens
+	req = httptest.NewRequest("GET", "/api/v1/token", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected status 403 listing tokens without tokens:admin, was %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest("DELETE", fmt.Sprintf("/api/v1/token/%s", tokenID), nil)
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	resp = w.Result()
+
+	var revoked state.Token
+	if err := json.NewDecoder(resp.Body).Decode(&revoked); err != nil {
+		t.Errorf(err.Error())
+	}
+	if !revoked.IsRevoked() {
+		t.Errorf("Expected token to be revoked, got %v", revoked)
+	}
+
+	req = httptest.NewRequest("GET", "/api/v1/task", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 401 {
+		t.Errorf("Expected status 401 with a revoked token, was %v", w.Result().StatusCode)
+	}
+}
+
+func TestEndpoints_Roles(t *testing.T) {
+	router := setUpAuth(t, true)
+
+	req := httptest.NewRequest("POST", "/api/v1/token",
+		bytes.NewBufferString(`{"name":"ci", "principal":"ci-bot", "scopes":["definitions:write", "runs:execute"]}`))
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	var created map[string]interface{}
+	if err := json.NewDecoder(w.Result().Body).Decode(&created); err != nil {
+		t.Fatalf(err.Error())
+	}
+	secret, _ := created["token"].(string)
+
+	// Scopes are not enough without a role in the group
+	req = httptest.NewRequest("PUT", "/api/v1/task/A/execute", bytes.NewBufferString(`{"cluster":"cupcake"}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected status 403 without a role in the group, was %v", w.Result().StatusCode)
+	}
+
+	// Only admins grant roles
+	grant := `{"principal":"ci-bot", "group_name":"g1", "role":"runner"}`
+	req = httptest.NewRequest("PUT", "/api/v1/role", bytes.NewBufferString(grant))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected status 403 granting roles without the admin role, was %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/v1/role", bytes.NewBufferString(grant))
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected status 200 granting a role as an admin, was %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest("PUT", "/api/v1/task/A/execute", bytes.NewBufferString(`{"cluster":"cupcake"}`))
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected status 200 launching as a runner, was %v", w.Result().StatusCode)
+	}
+
+	// Runners can not edit
+	req = httptest.NewRequest("DELETE", "/api/v1/task/A", nil)
+	req.Header.Set("Authorization", "Bearer "+secret)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 403 {
+		t.Errorf("Expected status 403 deleting as a runner, was %v", w.Result().StatusCode)
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/v1/role/g1/ci-bot", nil)
+	req.Header.Set("Authorization", "Bearer let-me-in")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Result().StatusCode != 200 {
+		t.Errorf("Expected status 200 revoking a role as an admin, was %v", w.Result().StatusCode)
+	}
+}
+
+func TestEndpoints_Metrics(t *testing.T) {
+	router := instrument(setUp(t))
+
+	req := httptest.NewRequest("DELETE", "/api/v1/task/A/history/runA", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	// Stopping a submitted run only counts once its status is stopped
+	req = httptest.NewRequest("PUT", "/api/v1/runA/status", bytes.NewBufferString(`{"status":"STOPPED"}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	req = httptest.NewRequest("GET", "/metrics", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Result().StatusCode != 200 {
+		t.Fatalf("Expected status 200, was %v", w.Result().StatusCode)
+	}
+
+	body := w.Body.String()
+	for _, expected := range []string{
+		`flotilla_http_requests_total{route="/api/v1/task/{definition_id}/history/{run_id}",method="DELETE",code="200"}`,
+		`flotilla_http_request_duration_seconds_count{route="/api/v1/task/{definition_id}/history/{run_id}",method="DELETE"}`,
+		`flotilla_runs_stopped_total{cluster="A",group="A"}`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected [%s] in metrics:\n%s", expected, body)
+		}
+	}
+}
@@ -1,37 +1,129 @@
 package flotilla
 
-import "github.com/gorilla/mux"
+import (
+	"github.com/gorilla/mux"
+	"github.com/stitchfix/flotilla-os/metrics"
+	"github.com/stitchfix/flotilla-os/state"
+	"net/http"
+	"strconv"
+	"time"
+)
 
 func NewRouter(ep endpoints) *mux.Router {
 	r := mux.NewRouter()
+	// Any valid api token may read; changes need the given scope
+	auth := ep.authenticated
 	v1 := r.PathPrefix("/api/v1").Subrouter()
 
-	v1.HandleFunc("/task", ep.ListDefinitions).Methods("GET")
-	v1.HandleFunc("/task", ep.CreateDefinition).Methods("POST")
-	v1.HandleFunc("/task/{definition_id}", ep.GetDefinition).Methods("GET")
-	v1.HandleFunc("/task/{definition_id}", ep.UpdateDefinition).Methods("PUT")
-	v1.HandleFunc("/task/{definition_id}", ep.DeleteDefinition).Methods("DELETE")
-	v1.HandleFunc("/task/{definition_id}/execute", ep.CreateRun).Methods("PUT")
-	v1.HandleFunc("/task/alias/{alias}", ep.GetDefinitionByAlias).Methods("GET")
-	v1.HandleFunc("/task/alias/{alias}/execute", ep.CreateRunByAlias).Methods("PUT")
-
-	v1.HandleFunc("/history", ep.ListRuns).Methods("GET")
-	v1.HandleFunc("/history/{run_id}", ep.GetRun).Methods("GET")
-	v1.HandleFunc("/task/history/{run_id}", ep.GetRun).Methods("GET")
-	v1.HandleFunc("/task/{definition_id}/history", ep.ListRuns).Methods("GET")
-	v1.HandleFunc("/task/{definition_id}/history/{run_id}", ep.GetRun).Methods("GET")
-	v1.HandleFunc("/task/{definition_id}/history/{run_id}", ep.StopRun).Methods("DELETE")
-
-	v1.HandleFunc("/{run_id}/status", ep.UpdateRun).Methods("PUT")
-	v1.HandleFunc("/{run_id}/logs", ep.GetLogs).Methods("GET")
-	v1.HandleFunc("/groups", ep.GetGroups).Methods("GET")
-	v1.HandleFunc("/tags", ep.GetTags).Methods("GET")
-	v1.HandleFunc("/clusters", ep.ListClusters).Methods("GET")
+	v1.HandleFunc("/task", auth("", ep.ListDefinitions)).Methods("GET")
+	v1.HandleFunc("/task", auth(state.ScopeDefinitionsWrite, ep.CreateDefinition)).Methods("POST")
+	v1.HandleFunc("/task/{definition_id}", auth("", ep.GetDefinition)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}", auth(state.ScopeDefinitionsWrite, ep.UpdateDefinition)).Methods("PUT")
+	v1.HandleFunc("/task/{definition_id}", auth(state.ScopeDefinitionsWrite, ep.DeleteDefinition)).Methods("DELETE")
+	v1.HandleFunc("/task/{definition_id}/execute", auth(state.ScopeRunsExecute, ep.CreateRun)).Methods("PUT")
+	v1.HandleFunc("/task/{definition_id}/revisions", auth("", ep.ListDefinitionRevisions)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}/revisions/{revision}", auth("", ep.GetDefinitionRevision)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}/revisions/{revision}/rollback", auth(state.ScopeDefinitionsWrite, ep.RollbackDefinition)).Methods("POST")
+	v1.HandleFunc("/task/{definition_id}/schedules", auth("", ep.ListSchedules)).Methods("GET")
+	v1.HandleFunc("/task/alias/{alias}", auth("", ep.GetDefinitionByAlias)).Methods("GET")
+	v1.HandleFunc("/task/alias/{alias}/execute", auth(state.ScopeRunsExecute, ep.CreateRunByAlias)).Methods("PUT")
+
+	v1.HandleFunc("/history", auth("", ep.ListRuns)).Methods("GET")
+	v1.HandleFunc("/history/{run_id}", auth("", ep.GetRun)).Methods("GET")
+	v1.HandleFunc("/history/{run_id}/wait", auth("", ep.WaitForRun)).Methods("GET")
+	v1.HandleFunc("/task/history/{run_id}", auth("", ep.GetRun)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}/history", auth("", ep.ListRuns)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}/history/{run_id}", auth("", ep.GetRun)).Methods("GET")
+	v1.HandleFunc("/task/{definition_id}/history/{run_id}", auth(state.ScopeRunsStop, ep.StopRun)).Methods("DELETE")
+
+	v1.HandleFunc("/schedule", auth("", ep.ListSchedules)).Methods("GET")
+	v1.HandleFunc("/schedule", auth(state.ScopeSchedulesWrite, ep.CreateSchedule)).Methods("POST")
+	v1.HandleFunc("/schedule/{schedule_id}", auth("", ep.GetSchedule)).Methods("GET")
+	v1.HandleFunc("/schedule/{schedule_id}", auth(state.ScopeSchedulesWrite, ep.UpdateSchedule)).Methods("PUT")
+	v1.HandleFunc("/schedule/{schedule_id}", auth(state.ScopeSchedulesWrite, ep.DeleteSchedule)).Methods("DELETE")
+
+	v1.HandleFunc("/webhook", auth("", ep.ListWebhooks)).Methods("GET")
+	v1.HandleFunc("/webhook", auth(state.ScopeWebhooksWrite, ep.CreateWebhook)).Methods("POST")
+	v1.HandleFunc("/webhook/{webhook_id}", auth("", ep.GetWebhook)).Methods("GET")
+	v1.HandleFunc("/webhook/{webhook_id}", auth(state.ScopeWebhooksWrite, ep.UpdateWebhook)).Methods("PUT")
+	v1.HandleFunc("/webhook/{webhook_id}", auth(state.ScopeWebhooksWrite, ep.DeleteWebhook)).Methods("DELETE")
+	v1.HandleFunc("/webhook/{webhook_id}/deliveries", auth("", ep.ListWebhookDeliveries)).Methods("GET")
+
+	if ep.tokenService != nil {
+		v1.HandleFunc("/token", auth(state.ScopeTokensAdmin, ep.ListTokens)).Methods("GET")
+		v1.HandleFunc("/token", auth(state.ScopeTokensAdmin, ep.CreateToken)).Methods("POST")
+		v1.HandleFunc("/token/{token_id}", auth(state.ScopeTokensAdmin, ep.GetToken)).Methods("GET")
+		v1.HandleFunc("/token/{token_id}", auth(state.ScopeTokensAdmin, ep.RevokeToken)).Methods("DELETE")
+	}
+
+	if ep.roleService != nil {
+		// Granting and revoking roles needs the admin role in the group
+		v1.HandleFunc("/role", auth("", ep.ListRoleBindings)).Methods("GET")
+		v1.HandleFunc("/role", auth("", ep.PutRoleBinding)).Methods("PUT")
+		v1.HandleFunc("/role/{group_name}/{principal}", auth("", ep.DeleteRoleBinding)).Methods("DELETE")
+	}
+
+	v1.HandleFunc("/{run_id}/status", auth(state.ScopeRunsUpdate, ep.UpdateRun)).Methods("PUT")
+	v1.HandleFunc("/{run_id}/logs", auth("", ep.GetLogs)).Methods("GET")
+	v1.HandleFunc("/{run_id}/logs/stream", auth("", ep.StreamLogs)).Methods("GET")
+	v1.HandleFunc("/groups", auth("", ep.GetGroups)).Methods("GET")
+	v1.HandleFunc("/tags", auth("", ep.GetTags)).Methods("GET")
+	v1.HandleFunc("/clusters", auth("", ep.ListClusters)).Methods("GET")
+	v1.HandleFunc("/clusters/{cluster_name}", auth("", ep.GetCluster)).Methods("GET")
 
 	v2 := r.PathPrefix("/api/v2").Subrouter()
-	v2.HandleFunc("/task/{definition_id}/execute", ep.CreateRunV2).Methods("PUT")
+	v2.HandleFunc("/task/{definition_id}/execute", auth(state.ScopeRunsExecute, ep.CreateRunV2)).Methods("PUT")
 
 	v4 := r.PathPrefix("/api/v4").Subrouter()
-	v4.HandleFunc("/task/{definition_id}/execute", ep.CreateRunV4).Methods("PUT")
+	v4.HandleFunc("/task/{definition_id}/execute", auth(state.ScopeRunsExecute, ep.CreateRunV4)).Methods("PUT")
+
+	// Scraped by prometheus, which does not bear api tokens
+	r.Handle("/metrics", metrics.Default.Handler()).Methods("GET")
 	return r
 }
+
+//
+// instrument wraps router to count and time requests by the path
+// template of the route they match, to keep the number of routes
+// reported bounded
+//
+func instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tmpl
+			}
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		router.ServeHTTP(sw, r)
+
+		metrics.HTTPRequests.Inc(route, r.Method, strconv.Itoa(sw.status))
+		metrics.HTTPRequestDuration.ObserveSince(start, route, r.Method)
+	})
+}
+
+//
+// statusWriter remembers the status code written
+//
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+//
+// Flush lets streamed responses, like the logs stream, through
+//
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
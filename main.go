@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	gklog "github.com/go-kit/kit/log"
 	"github.com/pkg/errors"
@@ -11,17 +12,60 @@ import (
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	"github.com/stitchfix/flotilla-os/flotilla"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
-	"github.com/stitchfix/flotilla-os/queue"
 	"github.com/stitchfix/flotilla-os/state"
-	"log"
+	"github.com/stitchfix/flotilla-os/worker"
 	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 )
 
+const usage = `Usage: flotilla-os <command> [flags] <conf_dir>
+
+Commands:
+  serve          Serve the http api
+  worker         Run background workers; --type names which, eg. --type submit,status
+  migrate        Migrate the database schema: migrate [status|up|down] [--steps n] <conf_dir>
+                 up (default) applies --steps pending migrations, all of them by default;
+                 down reverts the last --steps applied migrations, 1 by default
+  check-config   Check the configuration without connecting to anything
+
+flotilla-os <conf_dir> serves the http api and runs the workers in enabled_workers
+`
+
 func main() {
+	args := os.Args[1:]
+	if len(args) < 1 {
+		fmt.Print(usage)
+		os.Exit(1)
+	}
+
+	command := ""
+	switch args[0] {
+	case "serve", "worker", "migrate", "check-config":
+		command, args = args[0], args[1:]
+	}
+	migration := "up"
+	if command == "migrate" && len(args) > 0 {
+		switch args[0] {
+		case "status", "up", "down":
+			migration, args = args[0], args[1:]
+		}
+	}
 
-	args := os.Args
-	if len(args) < 2 {
-		fmt.Println("Usage: flotilla-os <conf_dir>")
+	flags := flag.NewFlagSet("flotilla-os", flag.ExitOnError)
+	flags.Usage = func() { fmt.Print(usage) }
+	var workerTypes string
+	if command == "worker" {
+		flags.StringVar(&workerTypes, "type", "", "comma separated types of worker to run")
+	}
+	var steps int
+	if command == "migrate" {
+		flags.IntVar(&steps, "steps", 0, "number of migrations to apply or revert")
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Print(usage)
 		os.Exit(1)
 	}
 
@@ -35,75 +79,205 @@ func main() {
 	//
 	// Wrap viper for configuration
 	//
-	confDir := args[1]
+	confDir := flags.Arg(0)
 	c, err := config.NewConfig(&confDir)
 	if err != nil {
 		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize config"))
 		os.Exit(1)
 	}
 
-	//
-	// Get state manager for reading and writing
-	// state about definitions and runs
-	//
-	sm, err := state.NewStateManager(c)
+	w := &wiring{conf: c, logger: logger}
+	switch command {
+	case "serve":
+		err = serve(w)
+	case "worker":
+		err = runWorkers(w, workerTypes)
+	case "migrate":
+		err = migrate(w, migration, steps)
+	case "check-config":
+		err = checkConfig(c)
+	default:
+		err = serveAndRunWorkers(w)
+	}
+
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize state manager"))
+		fmt.Printf("%+v\n", err)
 		os.Exit(1)
 	}
+}
 
-	//
-	// Get registry client for validating images
-	//
-	rc, err := registry.NewRegistryClient(c)
+//
+// serveAndRunWorkers serves the http api and runs enabled_workers
+// in one process
+//
+func serveAndRunWorkers(w *wiring) error {
+	lc, ee, sm, cc, rc, err := serverDependencies(w)
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize registry client"))
-		os.Exit(1)
+		return err
 	}
+	app, err := flotilla.NewApp(w.conf, w.logger, lc, ee, sm, cc, rc)
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize app")
+	}
+	return app.Run()
+}
 
-	//
-	// Get cluster client for validating definitions
-	// against execution clusters
-	//
-	cc, err := cluster.NewClusterClient(c)
+//
+// serve serves the http api
+//
+func serve(w *wiring) error {
+	lc, ee, sm, cc, rc, err := serverDependencies(w)
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize cluster client"))
-		os.Exit(1)
+		return err
+	}
+	app, err := flotilla.NewServerApp(w.conf, w.logger, lc, ee, sm, cc, rc)
+	if err != nil {
+		return errors.Wrap(err, "unable to initialize app")
 	}
+	return app.Run()
+}
 
-	//
-	// Get logs client for reading run logs
-	//
-	lc, err := logs.NewLogsClient(c, logger)
+func serverDependencies(w *wiring) (
+	lc logs.Client, ee engine.Engine, sm state.Manager, cc cluster.Client, rc registry.Client, err error) {
+	if sm, err = w.stateManager(); err != nil {
+		return
+	}
+	if rc, err = w.registryClient(); err != nil {
+		return
+	}
+	if cc, err = w.clusterClient(); err != nil {
+		return
+	}
+	if lc, err = w.logsClient(); err != nil {
+		return
+	}
+	ee, err = w.engine()
+	return
+}
+
+//
+// runWorkers runs the workers of the comma separated workerTypes
+// * only the schedule worker creates runs, and needs the clients
+//   for validating them
+//
+func runWorkers(w *wiring, workerTypes string) error {
+	var types []string
+	needsRuns := false
+	for _, workerType := range strings.Split(workerTypes, ",") {
+		workerType = strings.TrimSpace(workerType)
+		if len(workerType) == 0 {
+			continue
+		}
+		if !worker.IsValidType(workerType) {
+			return errors.Errorf(
+				"no worker type [%s]; valid types are [%s]", workerType, strings.Join(worker.Types, ", "))
+		}
+		needsRuns = needsRuns || workerType == "schedule"
+		types = append(types, workerType)
+	}
+	if len(types) == 0 {
+		return errors.New("worker needs --type, the types of worker to run")
+	}
+
+	sm, err := w.stateManager()
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize logs client"))
-		os.Exit(1)
+		return err
+	}
+	ee, err := w.engine()
+	if err != nil {
+		return err
 	}
 
-	//
-	// Get queue manager for queuing runs
-	//
-	qm, err := queue.NewQueueManager(c)
+	var (
+		cc cluster.Client
+		rc registry.Client
+	)
+	if needsRuns {
+		if rc, err = w.registryClient(); err != nil {
+			return err
+		}
+		if cc, err = w.clusterClient(); err != nil {
+			return err
+		}
+	}
+
+	app, err := flotilla.NewWorkerApp(w.conf, w.logger, ee, sm, cc, rc, types)
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize queue manager"))
-		os.Exit(1)
+		return errors.Wrap(err, "unable to initialize app")
 	}
+	return app.Run()
+}
 
-	//
-	// Get execution engine for interacting with backend
-	// execution management framework (eg. ECS)
-	//
-	ee, err := engine.NewExecutionEngine(c, qm)
+//
+// migrate shows or changes the version of the state manager's schema
+// * up also creates the queue manager's tables, when it keeps queues
+//   in the database
+//
+func migrate(w *wiring, migration string, steps int) error {
+	migrator, err := state.NewMigrator(w.conf)
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize execution engine"))
-		os.Exit(1)
+		return errors.Wrap(err, "unable to initialize migrator")
+	}
+	defer migrator.Close()
+
+	switch migration {
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		for _, status := range statuses {
+			applied, appliedAt := "pending", ""
+			if status.AppliedAt != nil {
+				applied, appliedAt = "applied", status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.Unknown {
+				applied = "unknown, applied by a newer flotilla"
+			} else if status.Modified {
+				applied = "modified since applied"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", status.Version, status.Name, applied, appliedAt)
+		}
+		return tw.Flush()
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		reverted, err := migrator.Down(steps)
+		for _, m := range reverted {
+			w.logger.Log("message", "Reverted migration", "version", m.Version, "name", m.Name)
+		}
+		return err
 	}
 
-	app, err := flotilla.NewApp(c, logger, lc, ee, sm, cc, rc)
+	applied, err := migrator.Up(steps)
+	for _, m := range applied {
+		w.logger.Log("message", "Applied migration", "version", m.Version, "name", m.Name)
+	}
 	if err != nil {
-		fmt.Printf("%+v\n", errors.Wrap(err, "unable to initialize app"))
-		os.Exit(1)
+		return err
 	}
 
-	log.Fatal(app.Run())
+	if w.conf.GetString("queue_manager") == "postgres" {
+		w.conf.Set("create_database_schema", true)
+		if _, err = w.queueManager(); err != nil {
+			return err
+		}
+	}
+	w.logger.Log("message", "Database schema is migrated")
+	return nil
+}
+
+//
+// checkConfig checks the configuration without connecting to anything
+//
+func checkConfig(c config.Config) error {
+	if ok, reasons := flotilla.CheckConfig(c); !ok {
+		// Reasons are for people, so without a stack trace
+		return fmt.Errorf("invalid configuration:\n%s", strings.Join(reasons, "\n"))
+	}
+	fmt.Println("Configuration is valid")
+	return nil
 }
@@ -0,0 +1,76 @@
+package metrics
+
+//
+// Metrics of the flotilla server and its workers, kept in Default
+//
+var (
+	// HTTPRequests counts requests by route template, method, and status code
+	HTTPRequests = Default.NewCounterVec(
+		"flotilla_http_requests_total",
+		"Number of http requests handled, by route, method, and status code.",
+		"route", "method", "code")
+
+	// HTTPRequestDuration times requests by route template and method
+	HTTPRequestDuration = Default.NewHistogramVec(
+		"flotilla_http_request_duration_seconds",
+		"Time taken to handle http requests, by route and method.",
+		nil, "route", "method")
+
+	// RunsCreated counts runs created, and queued, by cluster and group
+	RunsCreated = Default.NewCounterVec(
+		"flotilla_runs_created_total",
+		"Number of runs created, by cluster and group.",
+		"cluster", "group")
+
+	// RunsSubmitted counts runs the submit worker launched successfully
+	RunsSubmitted = Default.NewCounterVec(
+		"flotilla_runs_submitted_total",
+		"Number of runs submitted to the execution engine, by cluster and group.",
+		"cluster", "group")
+
+	// RunsRetried counts runs the retry worker requeued for another attempt
+	RunsRetried = Default.NewCounterVec(
+		"flotilla_runs_retried_total",
+		"Number of runs requeued for another attempt, by cluster and group.",
+		"cluster", "group")
+
+	// RunsStopped counts runs moved to STOPPED, however they stopped
+	RunsStopped = Default.NewCounterVec(
+		"flotilla_runs_stopped_total",
+		"Number of runs that stopped, by cluster and group.",
+		"cluster", "group")
+
+	// RunsReconciled counts runs the reconcile worker repaired, by the
+	// kind of drift repaired
+	RunsReconciled = Default.NewCounterVec(
+		"flotilla_runs_reconciled_total",
+		"Number of runs whose state drifted from the execution engine's and was repaired, by cluster and repair.",
+		"cluster", "repair")
+
+	// QueueReceiveLatency times how long runs wait in queues before the
+	// submit worker receives them
+	QueueReceiveLatency = Default.NewHistogramVec(
+		"flotilla_queue_receive_latency_seconds",
+		"Time from a run being queued to it being received by the submit worker, by cluster.",
+		[]float64{.1, .5, 1, 5, 10, 30, 60, 120, 300, 600, 1800},
+		"cluster")
+
+	// QueuedToRunning times how long runs take to start running once queued
+	QueuedToRunning = Default.NewHistogramVec(
+		"flotilla_run_queued_to_running_seconds",
+		"Time from a run being queued to it running, by cluster and group.",
+		[]float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
+		"cluster", "group")
+
+	// WorkerLoopDuration times each pass of the workers
+	WorkerLoopDuration = Default.NewHistogramVec(
+		"flotilla_worker_loop_duration_seconds",
+		"Time taken by one pass of a background worker, by worker.",
+		nil, "worker")
+
+	// WorkerErrors counts errors the workers ran into
+	WorkerErrors = Default.NewCounterVec(
+		"flotilla_worker_errors_total",
+		"Number of errors encountered by background workers, by worker.",
+		"worker")
+)
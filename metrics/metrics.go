@@ -0,0 +1,323 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// DefaultBuckets are the upper bounds, in seconds, of histograms that are
+// not given their own
+//
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//
+// Registry holds metrics and writes them in the Prometheus text
+// exposition format
+//
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+//
+// Default is the registry flotilla's own metrics are kept in
+//
+var Default = NewRegistry()
+
+//
+// NewRegistry returns an empty Registry
+//
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+//
+// WriteTo writes every metric of the registry, in the order they were
+// created, in the Prometheus text exposition format
+//
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := make([]metric, len(r.metrics))
+	copy(metrics, r.metrics)
+	r.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+//
+// Handler serves the registry's metrics for scraping
+//
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+//
+// CounterVec is a set of counters, one per combination of label values
+//
+type CounterVec struct {
+	desc
+	values map[string]*counter
+}
+
+type counter struct {
+	labelValues []string
+	value       float64
+}
+
+//
+// NewCounterVec creates a CounterVec in the registry; it is called name,
+// and is labelled by labels
+//
+func (r *Registry) NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{
+		desc:   desc{name: name, help: help, labels: labels},
+		values: make(map[string]*counter),
+	}
+	r.register(cv)
+	return cv
+}
+
+//
+// Inc adds one to the counter with labelValues
+//
+func (cv *CounterVec) Inc(labelValues ...string) {
+	cv.Add(1, labelValues...)
+}
+
+//
+// Add adds v, which must not be negative, to the counter with labelValues
+//
+func (cv *CounterVec) Add(v float64, labelValues ...string) {
+	if v < 0 {
+		return
+	}
+	key := cv.key(labelValues)
+
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, ok := cv.values[key]
+	if !ok {
+		c = &counter{labelValues: cv.pad(labelValues)}
+		cv.values[key] = c
+	}
+	c.value += v
+}
+
+//
+// Value returns the count of the counter with labelValues
+//
+func (cv *CounterVec) Value(labelValues ...string) float64 {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if c, ok := cv.values[cv.key(labelValues)]; ok {
+		return c.value
+	}
+	return 0
+}
+
+func (cv *CounterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+
+	cv.header(w, "counter")
+	for _, key := range sortedKeys(cv.values) {
+		c := cv.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, cv.labelPairs(c.labelValues, "", ""), formatFloat(c.value))
+	}
+}
+
+//
+// HistogramVec is a set of histograms, one per combination of label values
+//
+type HistogramVec struct {
+	desc
+	buckets []float64
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+//
+// NewHistogramVec creates a HistogramVec in the registry; it is called name,
+// is labelled by labels, and counts observations in buckets, or
+// DefaultBuckets if buckets is nil
+//
+func (r *Registry) NewHistogramVec(
+	name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	sorted := make([]float64, len(buckets))
+	copy(sorted, buckets)
+	sort.Float64s(sorted)
+
+	hv := &HistogramVec{
+		desc:    desc{name: name, help: help, labels: labels},
+		buckets: sorted,
+		values:  make(map[string]*histogram),
+	}
+	r.register(hv)
+	return hv
+}
+
+//
+// Observe records v in the histogram with labelValues
+//
+func (hv *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := hv.key(labelValues)
+
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.values[key]
+	if !ok {
+		h = &histogram{labelValues: hv.pad(labelValues), counts: make([]uint64, len(hv.buckets))}
+		hv.values[key] = h
+	}
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+//
+// ObserveSince records the seconds since start in the histogram
+// with labelValues
+//
+func (hv *HistogramVec) ObserveSince(start time.Time, labelValues ...string) {
+	hv.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+//
+// Count returns the number of observations in the histogram with labelValues
+//
+func (hv *HistogramVec) Count(labelValues ...string) uint64 {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	if h, ok := hv.values[hv.key(labelValues)]; ok {
+		return h.count
+	}
+	return 0
+}
+
+func (hv *HistogramVec) write(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+
+	hv.header(w, "histogram")
+	for _, key := range sortedKeys(hv.values) {
+		h := hv.values[key]
+		for i, upper := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n",
+				hv.name, hv.labelPairs(h.labelValues, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, hv.labelPairs(h.labelValues, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, hv.labelPairs(h.labelValues, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, hv.labelPairs(h.labelValues, "", ""), h.count)
+	}
+}
+
+//
+// desc is what counters and histograms have in common
+//
+type desc struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer, kind string) {
+	help := strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(d.help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, help, d.name, kind)
+}
+
+//
+// pad makes labelValues exactly as long as the labels; missing values
+// are empty and extra values are dropped
+//
+func (d *desc) pad(labelValues []string) []string {
+	padded := make([]string, len(d.labels))
+	copy(padded, labelValues)
+	return padded
+}
+
+func (d *desc) key(labelValues []string) string {
+	return strings.Join(d.pad(labelValues), "\xff")
+}
+
+func (d *desc) labelPairs(labelValues []string, extraLabel string, extraValue string) string {
+	var pairs []string
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, label := range d.labels {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escape.Replace(labelValues[i])))
+	}
+	if len(extraLabel) > 0 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extraLabel, extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch values := m.(type) {
+	case map[string]*counter:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range values {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	cv := r.NewCounterVec("things_total", "Number of things.", "kind")
+
+	cv.Inc("a")
+	cv.Inc("a")
+	cv.Add(2.5, "b")
+	cv.Add(-1, "b")
+
+	if cv.Value("a") != 2 || cv.Value("b") != 2.5 || cv.Value("c") != 0 {
+		t.Errorf("Expected counts of 2, 2.5, and 0, got %v, %v, and %v", cv.Value("a"), cv.Value("b"), cv.Value("c"))
+	}
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	expected := `# HELP things_total Number of things.
+# TYPE things_total counter
+things_total{kind="a"} 2
+things_total{kind="b"} 2.5
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	hv := r.NewHistogramVec("wait_seconds", "Time waited.", []float64{5, 1}, "queue")
+
+	hv.Observe(0.5, "q")
+	hv.Observe(3, "q")
+	hv.Observe(30, "q")
+
+	if hv.Count("q") != 3 {
+		t.Errorf("Expected 3 observations, got %v", hv.Count("q"))
+	}
+
+	var buf bytes.Buffer
+	r.WriteTo(&buf)
+	expected := `# HELP wait_seconds Time waited.
+# TYPE wait_seconds histogram
+wait_seconds_bucket{queue="q",le="1"} 1
+wait_seconds_bucket{queue="q",le="5"} 2
+wait_seconds_bucket{queue="q",le="+Inf"} 3
+wait_seconds_sum{queue="q"} 33.5
+wait_seconds_count{queue="q"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	cv := r.NewCounterVec("escaped_total", "Label values are escaped.", "name", "missing")
+	cv.Inc("say \"hi\"\n")
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected prometheus text format, got [%s]", w.Header().Get("Content-Type"))
+	}
+	expected := `escaped_total{name="say \"hi\"\n",missing=""} 1`
+	if !strings.Contains(w.Body.String(), expected) {
+		t.Errorf("Expected [%s] in:\n%s", expected, w.Body.String())
+	}
+}
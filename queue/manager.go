@@ -54,6 +54,12 @@ func NewQueueManager(conf config.Config) (Manager, error) {
 			return nil, errors.Wrap(err, "problem initializing SQSManager")
 		}
 		return sqsm, nil
+	case "postgres":
+		pgqm := &PGQueueManager{}
+		if err := pgqm.Initialize(conf); err != nil {
+			return nil, errors.Wrap(err, "problem initializing PGQueueManager")
+		}
+		return pgqm, nil
 	default:
 		return nil, fmt.Errorf("No QueueManager named [%s] was found", name)
 	}
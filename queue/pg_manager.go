@@ -0,0 +1,251 @@
+package queue
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	// Pull in postgres specific drivers
+	_ "github.com/lib/pq"
+	"github.com/nu7hatch/gouuid"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/state"
+	"math"
+	"time"
+)
+
+//
+// PGQueueManager - queue manager implementation backed by postgres
+// * queue urls are simply the (possibly prefixed) queue names
+// * receivers claim messages with SELECT ... FOR UPDATE SKIP LOCKED so
+//   concurrent pollers never block on, or double-receive, the same message
+//
+type PGQueueManager struct {
+	namespace         string
+	retentionSeconds  int64
+	visibilityTimeout int64
+	db                *sqlx.DB
+}
+
+//
+// TxEnqueuer is implemented by queue managers that can enqueue a run
+// as part of an existing database transaction
+//
+type TxEnqueuer interface {
+	EnqueueTx(tx *sql.Tx, qURL string, run state.Run) error
+}
+
+//
+// Name of queue manager - matches value in configuration
+//
+func (qm *PGQueueManager) Name() string {
+	return "postgres"
+}
+
+//
+// Initialize new postgres queue manager
+//
+func (qm *PGQueueManager) Initialize(conf config.Config) error {
+	if !conf.IsSet("database_url") {
+		return errors.Errorf("PGQueueManager needs [database_url] set in config")
+	}
+
+	if !conf.IsSet("queue.namespace") {
+		return errors.Errorf("PGQueueManager needs [queue.namespace] set in config")
+	}
+
+	qm.retentionSeconds = 604800
+	if conf.IsSet("queue.retention_seconds") {
+		qm.retentionSeconds = int64(conf.GetInt("queue.retention_seconds"))
+	}
+
+	qm.visibilityTimeout = 45
+	if conf.IsSet("queue.process_time") {
+		qm.visibilityTimeout = int64(conf.GetInt("queue.process_time"))
+	}
+
+	qm.namespace = conf.GetString("queue.namespace")
+
+	var err error
+	if qm.db, err = sqlx.Open("postgres", conf.GetString("database_url")); err != nil {
+		return errors.Wrap(err, "unable to open postgres db")
+	}
+
+	if conf.GetBool("create_database_schema") {
+		if err = qm.db.Ping(); err != nil {
+			// Try 3 more times
+			// 5, 10, 20
+			for i := 0; i < 3 && err != nil; i++ {
+				time.Sleep(time.Duration(5*math.Pow(2, float64(i))) * time.Second)
+				err = qm.db.Ping()
+			}
+			if err != nil {
+				return errors.Wrap(err, "error trying to connect to postgres db, retries exhausted")
+			}
+		}
+
+		if _, err = qm.db.Exec(CreateQueueTablesSQL); err != nil {
+			return errors.Wrap(err, "problem executing create queue tables sql")
+		}
+	}
+	return nil
+}
+
+//
+// QurlFor returns the queue url that corresponds to the given name
+// * if the queue does not exist it is created
+//
+func (qm *PGQueueManager) QurlFor(name string, prefixed bool) (string, error) {
+	qname := name
+	if prefixed {
+		qname = fmt.Sprintf("%s-%s", qm.namespace, name)
+	}
+
+	if _, err := qm.db.Exec(CreateQueueSQL, qname); err != nil {
+		return "", errors.Wrapf(err, "problem trying to create queue with name [%s]", qname)
+	}
+	return qname, nil
+}
+
+//
+// Enqueue queues run
+//
+func (qm *PGQueueManager) Enqueue(qURL string, run state.Run) error {
+	return qm.enqueue(qm.db, qURL, run)
+}
+
+//
+// EnqueueTx queues run as part of tx; the message only becomes
+// visible to receivers if and when tx commits
+//
+func (qm *PGQueueManager) EnqueueTx(tx *sql.Tx, qURL string, run state.Run) error {
+	return qm.enqueue(tx, qURL, run)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (qm *PGQueueManager) enqueue(ex execer, qURL string, run state.Run) error {
+	if len(qURL) == 0 {
+		return errors.Errorf("no queue url specified, can't enqueue")
+	}
+
+	jsonized, err := json.Marshal(run)
+	if err != nil {
+		return errors.Wrapf(err, "problem trying to serialize run with id [%s] as json", run.RunID)
+	}
+
+	if _, err = ex.Exec(EnqueueSQL, qURL, string(jsonized)); err != nil {
+		return errors.Wrapf(err, "problem enqueuing run with id [%s] to queue [%s]", run.RunID, qURL)
+	}
+	return nil
+}
+
+//
+// ReceiveRun receives a new run to operate on
+//
+func (qm *PGQueueManager) ReceiveRun(qURL string) (RunReceipt, error) {
+	var receipt RunReceipt
+
+	id, handle, body, err := qm.receive(qURL)
+	if err != nil || body == nil {
+		return receipt, err
+	}
+
+	var run state.Run
+	if err = json.Unmarshal([]byte(*body), &run); err != nil {
+		return receipt, errors.Wrapf(err, "problem trying to deserialize run from json [%s]", *body)
+	}
+
+	receipt.Run = &run
+	receipt.Done = func() error {
+		return qm.ack(qURL, id, handle)
+	}
+	return receipt, nil
+}
+
+//
+// ReceiveStatus receives a new status update to apply
+//
+func (qm *PGQueueManager) ReceiveStatus(qURL string) (StatusReceipt, error) {
+	var receipt StatusReceipt
+
+	id, handle, body, err := qm.receive(qURL)
+	if err != nil || body == nil {
+		return receipt, err
+	}
+
+	receipt.StatusUpdate = body
+	receipt.Done = func() error {
+		return qm.ack(qURL, id, handle)
+	}
+	return receipt, nil
+}
+
+//
+// receive claims at most one message from the queue; a nil body
+// means there was nothing visible to receive
+//
+func (qm *PGQueueManager) receive(qURL string) (int64, string, *string, error) {
+	var (
+		id   int64
+		body string
+	)
+
+	if len(qURL) == 0 {
+		return id, "", nil, errors.Errorf("no queue url specified, can't dequeue")
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return id, "", nil, errors.Wrap(err, "problem generating message receipt")
+	}
+	handle := u.String()
+
+	err = qm.db.QueryRow(ReceiveSQL, qURL, qm.visibilityTimeout, handle).Scan(&id, &body)
+	if err == sql.ErrNoRows {
+		return id, "", nil, nil
+	}
+	if err != nil {
+		return id, "", nil, errors.Wrapf(err, "problem receiving message from queue [%s]", qURL)
+	}
+	return id, handle, &body, nil
+}
+
+//
+// Ack acknowledges the receipt -AND- processing of
+// the message referred to by id and handle. If the visibility
+// timeout lapsed and the message was received again the handle
+// is stale and the message is left for its new receiver
+//
+func (qm *PGQueueManager) ack(qURL string, id int64, handle string) error {
+	res, err := qm.db.Exec(AckSQL, id, handle)
+	if err != nil {
+		return errors.Wrapf(
+			err, "problem deleting message with handle [%s] from queue [%s]", handle, qURL)
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errors.Errorf(
+			"message with handle [%s] on queue [%s] was already acknowledged or its receipt expired", handle, qURL)
+	}
+	return nil
+}
+
+//
+// List lists all the queue URLS available
+// * messages past the retention period are purged as a side effect
+//
+func (qm *PGQueueManager) List() ([]string, error) {
+	if _, err := qm.db.Exec(PurgeExpiredSQL, qm.retentionSeconds); err != nil {
+		return nil, errors.Wrap(err, "problem purging expired queue messages")
+	}
+
+	listed := []string{}
+	if err := qm.db.Select(&listed, ListQueuesSQL, qm.namespace); err != nil {
+		return nil, errors.Wrap(err, "problem listing queues")
+	}
+	return listed, nil
+}
@@ -0,0 +1,178 @@
+package queue
+
+import (
+	"log"
+	"os"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/state"
+)
+
+func setUpPG(t *testing.T) *PGQueueManager {
+	conf, _ := config.NewConfig(nil)
+	//
+	// Implicit testing - this will create tables
+	//
+	os.Setenv("QUEUE_NAMESPACE", "pgtest")
+	os.Setenv("CREATE_DATABASE_SCHEMA", "true")
+
+	qm := &PGQueueManager{}
+	if err := qm.Initialize(conf); err != nil {
+		t.Fatal(err)
+	}
+	return qm
+}
+
+func tearDownPG() {
+	conf, _ := config.NewConfig(nil)
+	db, err := sqlx.Connect("postgres", conf.GetString("database_url"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.MustExec(`drop table if exists queue_message, queue cascade;`)
+}
+
+func TestPGQueueManager_QurlFor(t *testing.T) {
+	defer tearDownPG()
+	qm := setUpPG(t)
+
+	qurl, err := qm.QurlFor("cluster", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if qurl != "pgtest-cluster" {
+		t.Errorf("Expected prefixed qurl [pgtest-cluster] but was [%s]", qurl)
+	}
+
+	// Idempotent
+	if _, err = qm.QurlFor("cluster", true); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if _, err = qm.QurlFor("status", false); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	listed, err := qm.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listed) != 1 || listed[0] != "pgtest-cluster" {
+		t.Errorf("Expected only the prefixed queue to be listed, got %v", listed)
+	}
+}
+
+func TestPGQueueManager_ReceiveRun(t *testing.T) {
+	defer tearDownPG()
+	qm := setUpPG(t)
+
+	qurl, _ := qm.QurlFor("cluster", true)
+	qm.Enqueue(qurl, state.Run{RunID: "run1"})
+	qm.Enqueue(qurl, state.Run{RunID: "run2"})
+
+	first, err := qm.ReceiveRun(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Run == nil || first.Run.RunID != "run1" {
+		t.Fatalf("Expected to receive run1 first, got %v", first.Run)
+	}
+
+	// The received message is invisible until its timeout lapses
+	second, err := qm.ReceiveRun(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if second.Run == nil || second.Run.RunID != "run2" {
+		t.Fatalf("Expected to receive run2 second, got %v", second.Run)
+	}
+
+	empty, err := qm.ReceiveRun(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if empty.Run != nil {
+		t.Errorf("Expected no run while received messages are invisible, got %v", empty.Run)
+	}
+
+	if err = first.Done(); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if err = first.Done(); err == nil {
+		t.Errorf("Expected error acknowledging an already acknowledged message")
+	}
+}
+
+func TestPGQueueManager_VisibilityTimeout(t *testing.T) {
+	defer tearDownPG()
+	qm := setUpPG(t)
+	qm.visibilityTimeout = 0
+
+	qurl, _ := qm.QurlFor("status", false)
+	status := `{"detail":{}}`
+	qm.db.MustExec(EnqueueSQL, qurl, status)
+
+	first, err := qm.ReceiveStatus(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.StatusUpdate == nil || *first.StatusUpdate != status {
+		t.Fatalf("Expected status update %s, got %v", status, first.StatusUpdate)
+	}
+
+	// Not acknowledged in time; received again under a new receipt
+	again, err := qm.ReceiveStatus(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.StatusUpdate == nil {
+		t.Fatalf("Expected status update to be redelivered after its visibility timeout")
+	}
+
+	if err = first.Done(); err == nil {
+		t.Errorf("Expected error acknowledging with a stale receipt")
+	}
+
+	if err = again.Done(); err != nil {
+		t.Errorf(err.Error())
+	}
+}
+
+func TestPGQueueManager_EnqueueTx(t *testing.T) {
+	defer tearDownPG()
+	qm := setUpPG(t)
+
+	qurl, _ := qm.QurlFor("cluster", true)
+
+	tx, _ := qm.db.Begin()
+	if err := qm.EnqueueTx(tx, qurl, state.Run{RunID: "rolledback"}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+
+	tx, _ = qm.db.Begin()
+	if err := qm.EnqueueTx(tx, qurl, state.Run{RunID: "committed"}); err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	receipt, err := qm.ReceiveRun(qurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receipt.Run == nil || receipt.Run.RunID != "committed" {
+		t.Errorf("Expected only the committed run to be queued, got %v", receipt.Run)
+	}
+}
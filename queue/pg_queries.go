@@ -0,0 +1,82 @@
+package queue
+
+//
+// CreateQueueTablesSQL postgres specific query for creating the
+// queue registry and queue message tables
+//
+const CreateQueueTablesSQL = `
+CREATE TABLE IF NOT EXISTS queue (
+  name character varying PRIMARY KEY,
+  created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS queue_message (
+  message_id bigserial PRIMARY KEY,
+  queue_name character varying NOT NULL REFERENCES queue(name),
+  body text NOT NULL,
+  receipt character varying,
+  receive_count integer NOT NULL DEFAULT 0,
+  visible_at timestamp with time zone NOT NULL DEFAULT now(),
+  created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_queue_message_visible ON queue_message(queue_name, visible_at);
+CREATE INDEX IF NOT EXISTS ix_queue_message_created_at ON queue_message(created_at);
+`
+
+//
+// CreateQueueSQL registers a queue, doing nothing if it already exists
+//
+const CreateQueueSQL = `
+INSERT INTO queue (name) VALUES ($1) ON CONFLICT (name) DO NOTHING
+`
+
+//
+// ListQueuesSQL lists queues whose name starts with the given prefix
+//
+const ListQueuesSQL = `
+SELECT name FROM queue WHERE name LIKE $1 || '%' ORDER BY name
+`
+
+//
+// EnqueueSQL inserts a new, immediately visible, message
+//
+const EnqueueSQL = `
+INSERT INTO queue_message (queue_name, body) VALUES ($1, $2)
+`
+
+//
+// ReceiveSQL claims the oldest visible message in a queue. Rows locked by
+// concurrent receivers are skipped rather than waited on; the claimed
+// message is hidden for the visibility timeout ($2, in seconds) and
+// tagged with a fresh receipt ($3) which must be presented to ack it
+//
+const ReceiveSQL = `
+UPDATE queue_message SET
+  visible_at = now() + $2 * interval '1 second',
+  receipt = $3,
+  receive_count = receive_count + 1
+WHERE message_id = (
+  SELECT message_id FROM queue_message
+  WHERE queue_name = $1 AND visible_at <= now()
+  ORDER BY message_id
+  LIMIT 1
+  FOR UPDATE SKIP LOCKED
+)
+RETURNING message_id, body
+`
+
+//
+// AckSQL deletes a message, but only if it has not since been received
+// again under a different receipt
+//
+const AckSQL = `
+DELETE FROM queue_message WHERE message_id = $1 AND receipt = $2
+`
+
+//
+// PurgeExpiredSQL deletes messages older than the retention period ($1, in seconds)
+//
+const PurgeExpiredSQL = `
+DELETE FROM queue_message WHERE created_at < now() - $1 * interval '1 second'
+`
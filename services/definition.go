@@ -13,16 +13,23 @@ import (
 // DefinitionService defines an interface for operations involving
 // definitions
 // * Like the ExecutionService, is an intermediary layer between state and the execution engine
+// * changes are made on behalf of a principal, who needs the editor
+//   role in the definition's group
 //
 type DefinitionService interface {
-	Create(definition *state.Definition) (state.Definition, error)
+	Create(definition *state.Definition, principal string) (state.Definition, error)
 	Get(definitionID string) (state.Definition, error)
 	GetByAlias(alias string) (state.Definition, error)
 	List(limit int, offset int, sortBy string,
 		order string, filters map[string][]string,
 		envFilters map[string]string) (state.DefinitionList, error)
-	Update(definitionID string, updates state.Definition) (state.Definition, error)
-	Delete(definitionID string) error
+	Update(definitionID string, updates state.Definition, principal string) (state.Definition, error)
+	Delete(definitionID string, principal string) error
+
+	// Revision oriented
+	ListRevisions(definitionID string, limit int, offset int) (state.DefinitionRevisionList, error)
+	GetRevision(definitionID string, revision int64, diffFrom *int64) (state.DefinitionRevision, error)
+	Rollback(definitionID string, revision int64, principal string) (state.Definition, error)
 
 	// Metadata oriented
 	ListGroups(limit int, offset int, name *string) (state.GroupsList, error)
@@ -32,13 +39,18 @@ type DefinitionService interface {
 type definitionService struct {
 	sm state.Manager
 	ee engine.Engine
+	az Authorizer
 }
 
 //
 // NewDefinitionService configures and returns a DefinitionService
 //
 func NewDefinitionService(conf config.Config, ee engine.Engine, sm state.Manager) (DefinitionService, error) {
-	ds := definitionService{sm: sm, ee: ee}
+	az, err := NewAuthorizer(conf, sm)
+	if err != nil {
+		return nil, err
+	}
+	ds := definitionService{sm: sm, ee: ee, az: az}
 	return &ds, nil
 }
 
@@ -48,11 +60,15 @@ func NewDefinitionService(conf config.Config, ee engine.Engine, sm state.Manager
 // * Defines definition with execution engine
 // * Stores definition using state manager
 //
-func (ds *definitionService) Create(definition *state.Definition) (state.Definition, error) {
+func (ds *definitionService) Create(definition *state.Definition, principal string) (state.Definition, error) {
 	if valid, reasons := definition.IsValid(); !valid {
 		return state.Definition{}, exceptions.MalformedInput{strings.Join(reasons, "\n")}
 	}
 
+	if err := ds.az.Authorize(principal, definition.GroupName, state.RoleEditor); err != nil {
+		return state.Definition{}, err
+	}
+
 	exists, err := ds.aliasExists(definition.Alias)
 	if err != nil {
 		return state.Definition{}, err
@@ -73,6 +89,7 @@ func (ds *definitionService) Create(definition *state.Definition) (state.Definit
 	if err != nil {
 		return state.Definition{}, err
 	}
+	defined.Revision = 1
 	return defined, ds.sm.CreateDefinition(defined)
 }
 
@@ -112,12 +129,24 @@ func (ds *definitionService) List(limit int, offset int, sortBy string,
 }
 
 // Update updates the definition specified by definitionID with the given updates
-func (ds *definitionService) Update(definitionID string, updates state.Definition) (state.Definition, error) {
+// * each update is stored as a new revision of the definition
+// * moving the definition to another group needs the editor role in both groups
+func (ds *definitionService) Update(
+	definitionID string, updates state.Definition, principal string) (state.Definition, error) {
 	definition, err := ds.sm.GetDefinition(definitionID)
 	if err != nil {
 		return definition, err
 	}
 
+	if err = ds.az.Authorize(principal, definition.GroupName, state.RoleEditor); err != nil {
+		return definition, err
+	}
+	if len(updates.GroupName) > 0 && updates.GroupName != definition.GroupName {
+		if err = ds.az.Authorize(principal, updates.GroupName, state.RoleEditor); err != nil {
+			return definition, err
+		}
+	}
+
 	definition.UpdateWith(updates)
 	defined, err := ds.ee.Define(definition)
 	if err != nil {
@@ -128,17 +157,84 @@ func (ds *definitionService) Update(definitionID string, updates state.Definitio
 }
 
 // Delete deletes and deregisters the definition specified by definitionID
-func (ds *definitionService) Delete(definitionID string) error {
+func (ds *definitionService) Delete(definitionID string, principal string) error {
 	definition, err := ds.sm.GetDefinition(definitionID)
 	if err != nil {
 		return err
 	}
+	if err = ds.az.Authorize(principal, definition.GroupName, state.RoleEditor); err != nil {
+		return err
+	}
 	if err = ds.ee.Deregister(definition); err != nil {
 		return err
 	}
 	return ds.sm.DeleteDefinition(definitionID)
 }
 
+//
+// ListRevisions lists the revisions of the definition specified by definitionID, newest first
+//
+func (ds *definitionService) ListRevisions(
+	definitionID string, limit int, offset int) (state.DefinitionRevisionList, error) {
+	if _, err := ds.sm.GetDefinition(definitionID); err != nil {
+		return state.DefinitionRevisionList{}, err
+	}
+	return ds.sm.ListDefinitionRevisions(definitionID, limit, offset)
+}
+
+//
+// GetRevision returns a single revision of the definition specified by definitionID
+// * if diffFrom is specified, the changes from that revision are included
+//
+func (ds *definitionService) GetRevision(
+	definitionID string, revision int64, diffFrom *int64) (state.DefinitionRevision, error) {
+	dr, err := ds.sm.GetDefinitionRevision(definitionID, revision)
+	if err != nil || diffFrom == nil {
+		return dr, err
+	}
+
+	from, err := ds.sm.GetDefinitionRevision(definitionID, *diffFrom)
+	if err != nil {
+		return dr, err
+	}
+	dr.DiffFrom = diffFrom
+	dr.Diff = from.Definition.Diff(dr.Definition)
+	return dr, nil
+}
+
+//
+// Rollback restores the definition specified by definitionID to a previous revision
+// * the restored definition is stored as a new revision; history is never rewritten
+// * every field is restored, including those the revision left empty;
+//   alias and group name are identity and are not rolled back
+//
+func (ds *definitionService) Rollback(
+	definitionID string, revision int64, principal string) (state.Definition, error) {
+	definition, err := ds.sm.GetDefinition(definitionID)
+	if err != nil {
+		return definition, err
+	}
+	if err = ds.az.Authorize(principal, definition.GroupName, state.RoleEditor); err != nil {
+		return definition, err
+	}
+
+	dr, err := ds.sm.GetDefinitionRevision(definitionID, revision)
+	if err != nil {
+		return definition, err
+	}
+
+	// Registered anew from the current registration
+	arn := definition.Arn
+	definition.Restore(dr.Definition)
+	definition.Arn = arn
+	defined, err := ds.ee.Define(definition)
+	if err != nil {
+		return definition, err
+	}
+
+	return ds.sm.ReplaceDefinition(definitionID, defined)
+}
+
 func (ds *definitionService) ListGroups(limit int, offset int, name *string) (state.GroupsList, error) {
 	return ds.sm.ListGroups(limit, offset, name)
 }
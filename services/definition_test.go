@@ -43,7 +43,7 @@ func TestDefinitionService_Create(t *testing.T) {
 		Memory:    &memory,
 		Command:   "echo 'hi'",
 	}
-	created, _ := ds.Create(&newValidDef)
+	created, _ := ds.Create(&newValidDef, "")
 	if len(created.DefinitionID) == 0 {
 		t.Errorf("Expected non-empty definition id")
 	}
@@ -78,7 +78,7 @@ func TestDefinitionService_Create2(t *testing.T) {
 		GroupName: "group-cupcake",
 	}
 
-	_, err = ds.Create(&invalid1)
+	_, err = ds.Create(&invalid1, "")
 	if err == nil {
 		t.Errorf("Expected invalid definition with nil memory to result in error")
 	}
@@ -89,7 +89,7 @@ func TestDefinitionService_Create2(t *testing.T) {
 		Memory:    &memory,
 		GroupName: `YUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGETOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOBIIIIIIIIIIIIIIIIIIIIIIIIIGGGGGGGGGGGGYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGEYUGETOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOOBIIIIIIIIIIIIIIIIIIIIIIIIIGGGGGGGGGGGG`,
 	}
-	_, err = ds.Create(&invalid2)
+	_, err = ds.Create(&invalid2, "")
 	if err == nil {
 		t.Errorf("Expected invalid definition with len(GroupName) > 255 to result in error")
 	}
@@ -99,7 +99,7 @@ func TestDefinitionService_Create2(t *testing.T) {
 		Memory:    &memory,
 		GroupName: "group-cupcake",
 	}
-	_, err = ds.Create(&invalid3)
+	_, err = ds.Create(&invalid3, "")
 	if err == nil {
 		t.Errorf("Expected invalid defintion with no alias to result in error")
 	}
@@ -109,7 +109,7 @@ func TestDefinitionService_Create2(t *testing.T) {
 		Memory:    &memory,
 		GroupName: "group-cupcake",
 	}
-	_, err = ds.Create(&invalid4)
+	_, err = ds.Create(&invalid4, "")
 	if err == nil {
 		t.Errorf("Expected invalid definition with no image to result in error")
 	}
@@ -120,7 +120,7 @@ func TestDefinitionService_Create2(t *testing.T) {
 		Memory:    &memory,
 		GroupName: "cant.have.dots",
 	}
-	_, err = ds.Create(&invalid5)
+	_, err = ds.Create(&invalid5, "")
 	if err == nil {
 		t.Errorf("Expected invalid definition with invalid GroupName to result in error")
 	}
@@ -132,7 +132,7 @@ func TestDefinitionService_Update(t *testing.T) {
 	d := state.Definition{
 		Memory: &memory,
 	}
-	ds.Update("A", d)
+	ds.Update("A", d, "")
 
 	// order matters
 	expected := []string{"GetDefinition", "Define", "UpdateDefinition"}
@@ -149,7 +149,7 @@ func TestDefinitionService_Update(t *testing.T) {
 
 func TestDefinitionService_Delete(t *testing.T) {
 	ds, imp := setUpDefinitionServiceTest(t)
-	ds.Delete("A")
+	ds.Delete("A", "")
 
 	// order matters
 	expected := []string{"GetDefinition", "Deregister", "DeleteDefinition"}
@@ -163,3 +163,114 @@ func TestDefinitionService_Delete(t *testing.T) {
 		}
 	}
 }
+
+func TestDefinitionService_Rollback(t *testing.T) {
+	ds, imp := setUpDefinitionServiceTest(t)
+	memory := int64(512)
+	env := state.EnvList{{Name: "K1", Value: "V1"}}
+	created, _ := ds.Create(&state.Definition{
+		Alias:     "cupcake",
+		Image:     "image:cupcake",
+		GroupName: "group-cupcake",
+		Memory:    &memory,
+		Command:   "echo 'hi'",
+	}, "")
+
+	if created.Revision != 1 {
+		t.Errorf("Expected new definition to be revision 1 but was %v", created.Revision)
+	}
+
+	updated, _ := ds.Update(created.DefinitionID, state.Definition{Image: "image:shoebox", Env: &env}, "")
+	if updated.Revision != 2 {
+		t.Errorf("Expected updated definition to be revision 2 but was %v", updated.Revision)
+	}
+
+	rolledBack, err := ds.Rollback(created.DefinitionID, 1, "")
+	if err != nil {
+		t.Fatalf("Expected no error rolling back, got %v", err)
+	}
+
+	if rolledBack.Revision != 3 {
+		t.Errorf("Expected rollback to create revision 3 but was %v", rolledBack.Revision)
+	}
+
+	if rolledBack.Image != "image:cupcake" {
+		t.Errorf("Expected image [image:cupcake] after rollback but was [%s]", rolledBack.Image)
+	}
+
+	if rolledBack.Env != nil && len(*rolledBack.Env) != 0 {
+		t.Errorf("Expected env added after revision 1 to be cleared, got %v", rolledBack.Env)
+	}
+
+	revisions, _ := ds.ListRevisions(created.DefinitionID, 10, 0)
+	if revisions.Total != 3 || revisions.Revisions[0].Revision != 3 {
+		t.Errorf("Expected 3 revisions, newest first, got %v", revisions.Revisions)
+	}
+
+	if _, err = ds.Rollback(created.DefinitionID, 42, ""); err == nil {
+		t.Errorf("Expected error rolling back to non-existent revision")
+	}
+
+	calls := len(imp.Calls)
+	if imp.Calls[calls-1] != "GetDefinitionRevision" {
+		t.Errorf("Expected rollback to a missing revision to stop at GetDefinitionRevision")
+	}
+}
+
+func TestDefinitionService_RollbackClearsFields(t *testing.T) {
+	// Test that fields revision 1 left empty are cleared, rather than kept
+	ds, _ := setUpDefinitionServiceTest(t)
+	memory := int64(512)
+	created, _ := ds.Create(&state.Definition{
+		Alias:     "cupcake",
+		Image:     "image:cupcake",
+		GroupName: "group-cupcake",
+		Memory:    &memory,
+		Command:   "echo 'hi'",
+	}, "")
+
+	timeout := int64(60)
+	cpu := int64(512)
+	ds.Update(created.DefinitionID, state.Definition{TimeoutSeconds: &timeout, CPU: &cpu}, "")
+
+	rolledBack, err := ds.Rollback(created.DefinitionID, 1, "")
+	if err != nil {
+		t.Fatalf("Expected no error rolling back, got %v", err)
+	}
+	if rolledBack.TimeoutSeconds != nil || rolledBack.CPU != nil {
+		t.Errorf("Expected timeout and cpu to be cleared, got %v and %v", rolledBack.TimeoutSeconds, rolledBack.CPU)
+	}
+	if rolledBack.Alias != "cupcake" || rolledBack.GroupName != "group-cupcake" {
+		t.Errorf("Expected alias and group to be kept, got [%s] and [%s]", rolledBack.Alias, rolledBack.GroupName)
+	}
+
+	stored, _ := ds.Get(created.DefinitionID)
+	if stored.TimeoutSeconds != nil || stored.CPU != nil {
+		t.Errorf("Expected stored timeout and cpu to be cleared, got %v and %v", stored.TimeoutSeconds, stored.CPU)
+	}
+}
+
+func TestDefinitionService_GetRevision(t *testing.T) {
+	ds, _ := setUpDefinitionServiceTest(t)
+	ds.Update("A", state.Definition{Image: "image:cupcake"}, "")
+	ds.Update("A", state.Definition{Image: "image:shoebox", Command: "echo 'hi'"}, "")
+
+	dr, err := ds.GetRevision("A", 2, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if dr.Image != "image:shoebox" || dr.Diff != nil {
+		t.Errorf("Expected revision 2 without diff, got %v", dr)
+	}
+
+	from := int64(1)
+	dr, _ = ds.GetRevision("A", 2, &from)
+	if len(dr.Diff) != 2 {
+		t.Errorf("Expected 2 changed fields but was %v", dr.Diff)
+	}
+
+	if change, ok := dr.Diff["image"]; !ok || change.From != "image:cupcake" || change.To != "image:shoebox" {
+		t.Errorf("Expected image change from [image:cupcake] to [image:shoebox], got %v", change)
+	}
+}
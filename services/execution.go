@@ -1,13 +1,24 @@
 package services
 
 import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/clients/cluster"
 	"github.com/stitchfix/flotilla-os/clients/registry"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 )
 
@@ -15,10 +26,19 @@ import (
 // ExecutionService interacts with the state manager and queue manager to queue runs, and perform
 // CRUD operations on them
 // * Acts as an intermediary layer between state and the execution engine
+// * runs are created for their owner, and stopped on behalf of a principal,
+//   who need the runner role in the run's group
+// * creating a run with an idempotency key the owner used within the
+//   retention window returns the run created with it, if the request
+//   was the same
+// * waiting on a run returns once it reaches a status, which is noticed
+//   as soon as the state manager tells of the change, if it can
 //
 type ExecutionService interface {
-	Create(definitionID string, clusterName string, env *state.EnvList, ownerID string) (state.Run, error)
-	CreateByAlias(alias string, clusterName string, env *state.EnvList, ownerID string) (state.Run, error)
+	Create(
+		definitionID string, clusterName string, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error)
+	CreateByAlias(
+		alias string, clusterName string, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error)
 	List(
 		limit int,
 		offset int,
@@ -27,18 +47,41 @@ type ExecutionService interface {
 		filters map[string][]string,
 		envFilters map[string]string) (state.RunList, error)
 	Get(runID string) (state.Run, error)
-	UpdateStatus(runID string, status string, exitCode *int64) error
-	Terminate(runID string) error
+	Wait(ctx context.Context, runID string, status string) (state.Run, error)
+	UpdateStatus(runID string, status string, exitCode *int64, principal string) error
+	Terminate(runID string, principal string) error
 	ReservedVariables() []string
 	ListClusters() ([]string, error)
+	GetCluster(clusterName string) (cluster.Capacity, error)
 }
 
+//
+// RunOptions are optional settings of a single run; when set they take
+// precedence over those of the run's definition
+//
+type RunOptions struct {
+	TimeoutSeconds *int64
+	IdempotencyKey string
+	Memory         *int64
+	MemoryReserved *int64
+	CPU            *int64
+}
+
+// Longest idempotency key accepted
+const maxIdempotencyKeyLength = 255
+
 type executionService struct {
 	sm          state.Manager
 	cc          cluster.Client
 	rc          registry.Client
 	ee          engine.Engine
+	az          Authorizer
+	notifier    webhook.Notifier
 	reservedEnv map[string]func(run state.Run) string
+	// How long idempotency keys are kept
+	idempotencyRetention time.Duration
+	// How often runs being waited on are read again
+	waitRecheck time.Duration
 }
 
 //
@@ -47,12 +90,32 @@ type executionService struct {
 func NewExecutionService(conf config.Config, ee engine.Engine,
 	sm state.Manager,
 	cc cluster.Client,
-	rc registry.Client) (ExecutionService, error) {
+	rc registry.Client,
+	log flotillaLog.Logger) (ExecutionService, error) {
+	az, err := NewAuthorizer(conf, sm)
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return nil, errors.Wrap(err, "problem initializing webhook notifier")
+	}
 	es := executionService{
-		sm: sm,
-		cc: cc,
-		rc: rc,
-		ee: ee,
+		sm:                   sm,
+		cc:                   cc,
+		rc:                   rc,
+		ee:                   ee,
+		az:                   az,
+		notifier:             notifier,
+		idempotencyRetention: 24 * time.Hour,
+		waitRecheck:          2 * time.Second,
+	}
+	if _, ok := sm.(state.RunWatcher); ok {
+		// Only a safety net for changes that were not notified
+		es.waitRecheck = 30 * time.Second
+	}
+	if conf.IsSet("idempotency_key_retention_hours") {
+		es.idempotencyRetention = time.Duration(conf.GetInt("idempotency_key_retention_hours")) * time.Hour
 	}
 	//
 	// Reserved environment variables dynamically generated
@@ -94,7 +157,7 @@ func (es *executionService) ReservedVariables() []string {
 // Create constructs and queues a new Run on the cluster specified
 //
 func (es *executionService) Create(
-	definitionID string, clusterName string, env *state.EnvList, ownerID string) (state.Run, error) {
+	definitionID string, clusterName string, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error) {
 
 	// Ensure definition exists
 	definition, err := es.sm.GetDefinition(definitionID)
@@ -102,14 +165,14 @@ func (es *executionService) Create(
 		return state.Run{}, err
 	}
 
-	return es.createFromDefinition(definition, clusterName, env, ownerID)
+	return es.createFromDefinition(definition, clusterName, env, ownerID, opts)
 }
 
 //
 // Create constructs and queues a new Run on the cluster specified, based on an alias
 //
 func (es *executionService) CreateByAlias(
-	alias string, clusterName string, env *state.EnvList, ownerID string) (state.Run, error) {
+	alias string, clusterName string, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error) {
 
 	// Ensure definition exists
 	definition, err := es.sm.GetDefinitionByAlias(alias)
@@ -117,39 +180,162 @@ func (es *executionService) CreateByAlias(
 		return state.Run{}, err
 	}
 
-	return es.createFromDefinition(definition, clusterName, env, ownerID)
+	return es.createFromDefinition(definition, clusterName, env, ownerID, opts)
 }
 
 func (es *executionService) createFromDefinition(
-	definition state.Definition, clusterName string, env *state.EnvList, ownerID string) (state.Run, error) {
+	definition state.Definition, clusterName string, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error) {
 	var (
-		run state.Run
-		err error
+		run   state.Run
+		err   error
+		saved bool
 	)
 
-	// Validate that definition can be run (image exists, cluster has resources)
-	if err = es.canBeRun(clusterName, definition, env); err != nil {
+	if opts.TimeoutSeconds != nil && *opts.TimeoutSeconds <= 0 {
+		return run, exceptions.MalformedInput{ErrorString: "int [timeout] must be a positive number of seconds"}
+	}
+
+	// The run's resources replace the definition's, for it to be checked
+	// against the cluster and copied onto the run
+	if opts.Memory != nil || opts.MemoryReserved != nil || opts.CPU != nil {
+		definition.UpdateWith(state.Definition{
+			Memory: opts.Memory, MemoryReserved: opts.MemoryReserved, CPU: opts.CPU})
+		if ok, reasons := definition.ResourcesAreValid(); !ok {
+			return run, exceptions.MalformedInput{ErrorString: strings.Join(reasons, "\n")}
+		}
+	}
+	if len(opts.IdempotencyKey) > maxIdempotencyKeyLength {
+		return run, exceptions.MalformedInput{ErrorString: fmt.Sprintf(
+			"idempotency key must be at most %d characters", maxIdempotencyKeyLength)}
+	}
+
+	if err = es.az.Authorize(ownerID, definition.GroupName, state.RoleRunner); err != nil {
 		return run, err
 	}
 
 	// Construct run object with StatusQueued and new UUID4 run id
-	run, err = es.constructRun(clusterName, definition, env, ownerID)
+	run, err = es.constructRun(clusterName, definition, env, ownerID, opts)
 	if err != nil {
 		return run, err
 	}
 
+	// A repeated request returns the run it created the first time
+	if len(opts.IdempotencyKey) > 0 {
+		var (
+			existing state.Run
+			claimed  bool
+		)
+		existing, claimed, err = es.claimIdempotencyKey(run, definition, clusterName, env, opts)
+		if err != nil || !claimed {
+			return existing, err
+		}
+		// Requests repeating the key may try again if the run is not saved;
+		// a saved run that failed to queue is queued by the reconcile worker
+		defer func() {
+			if err != nil && !saved {
+				es.sm.ReleaseIdempotencyKey(ownerID, opts.IdempotencyKey, run.RunID)
+			}
+		}()
+	}
+
+	// Validate that definition can be run (image exists, cluster has resources)
+	if err = es.canBeRun(clusterName, definition, env); err != nil {
+		return run, err
+	}
+
+	// When both the state manager and the engine's queue share a database
+	// save and queue the run in one transaction so that a run can never be
+	// saved without also being queued
+	if txsm, ok := es.sm.(state.TxRunCreator); ok {
+		if txee, ok := es.ee.(engine.TxEnqueuer); ok && txee.CanEnqueueTx() {
+			err = txsm.CreateRunWithin(run, func(tx *sql.Tx) error {
+				return txee.EnqueueTx(tx, run)
+			})
+			if err == nil {
+				metrics.RunsCreated.Inc(run.ClusterName, run.GroupName)
+			}
+			return run, err
+		}
+	}
+
 	// Save run to source of state - it is *CRITICAL* to do this
 	// -before- queuing to avoid processing unsaved runs
 	if err = es.sm.CreateRun(run); err != nil {
 		return run, err
 	}
+	saved = true
 
 	// Queue run
-	return run, es.ee.Enqueue(run)
+	if err = es.ee.Enqueue(run); err != nil {
+		return run, err
+	}
+	metrics.RunsCreated.Inc(run.ClusterName, run.GroupName)
+	return run, nil
+}
+
+//
+// claimIdempotencyKey claims the owner's idempotency key for run; if the
+// key is already claimed, returns the run it was claimed for, or a
+// ConflictingResource error if that was for a different request
+//
+func (es *executionService) claimIdempotencyKey(
+	run state.Run, definition state.Definition, clusterName string, env *state.EnvList, opts RunOptions) (state.Run, bool, error) {
+	hash, err := requestHash(definition, clusterName, env, opts)
+	if err != nil {
+		return run, false, err
+	}
+
+	now := time.Now()
+	claim, claimed, err := es.sm.ClaimIdempotencyKey(state.IdempotencyKey{
+		OwnerID:     run.User,
+		Key:         opts.IdempotencyKey,
+		RunID:       run.RunID,
+		RequestHash: hash,
+		CreatedAt:   now,
+	}, now.Add(-es.idempotencyRetention))
+	if err != nil || claimed {
+		return run, claimed, err
+	}
+
+	if claim.RequestHash != hash {
+		return state.Run{}, false, exceptions.ConflictingResource{ErrorString: fmt.Sprintf(
+			"idempotency key [%s] was already used for a different request", opts.IdempotencyKey)}
+	}
+	existing, err := es.sm.GetRun(claim.RunID)
+	if err != nil {
+		if _, ok := err.(exceptions.MissingResource); ok {
+			return state.Run{}, false, exceptions.ConflictingResource{ErrorString: fmt.Sprintf(
+				"the run for idempotency key [%s] is still being created", opts.IdempotencyKey)}
+		}
+		return state.Run{}, false, err
+	}
+	return existing, false, nil
+}
+
+//
+// requestHash identifies what a request to create a run asked for, so
+// that requests repeating an idempotency key can be checked to be the same
+//
+func requestHash(
+	definition state.Definition, clusterName string, env *state.EnvList, opts RunOptions) (string, error) {
+	request, err := json.Marshal(struct {
+		DefinitionID   string         `json:"definition_id"`
+		ClusterName    string         `json:"cluster"`
+		Env            *state.EnvList `json:"env"`
+		TimeoutSeconds *int64         `json:"timeout"`
+		Memory         *int64         `json:"memory,omitempty"`
+		MemoryReserved *int64         `json:"memory_reservation,omitempty"`
+		CPU            *int64         `json:"cpu,omitempty"`
+	}{definition.DefinitionID, clusterName, env, opts.TimeoutSeconds, opts.Memory, opts.MemoryReserved, opts.CPU})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(request)
+	return hex.EncodeToString(sum[:]), nil
 }
 
 func (es *executionService) constructRun(
-	clusterName string, definition state.Definition, env *state.EnvList, ownerID string) (state.Run, error) {
+	clusterName string, definition state.Definition, env *state.EnvList, ownerID string, opts RunOptions) (state.Run, error) {
 
 	var (
 		run state.Run
@@ -161,18 +347,24 @@ func (es *executionService) constructRun(
 		return run, err
 	}
 
+	queuedAt := time.Now()
 	run = state.Run{
-		RunID:        runID,
-		ClusterName:  clusterName,
-		GroupName:    definition.GroupName,
-		DefinitionID: definition.DefinitionID,
-		Alias:        definition.Alias,
-		Image:        definition.Image,
-		Status:       state.StatusQueued,
-		User:         ownerID,
+		RunID:       runID,
+		ClusterName: clusterName,
+		Status:      state.StatusQueued,
+		User:        ownerID,
+		Attempt:     1,
+		QueuedAt:    &queuedAt,
 	}
 	runEnv := es.constructEnviron(run, env)
 	run.Env = &runEnv
+
+	// Copy the definition onto the run so that it launches what was
+	// requested even if the definition changes before it is submitted
+	run.SnapshotDefinition(definition)
+	if opts.TimeoutSeconds != nil {
+		run.TimeoutSeconds = opts.TimeoutSeconds
+	}
 	return run, nil
 }
 
@@ -273,45 +465,145 @@ func (es *executionService) Get(runID string) (state.Run, error) {
 	return es.sm.GetRun(runID)
 }
 
+//
+// Wait returns the run once it has reached status, or as it is once ctx
+// is done
+// * without a state manager that can watch runs, or if a change is not
+//   notified, the run is read again every waitRecheck
+//
+func (es *executionService) Wait(ctx context.Context, runID string, status string) (state.Run, error) {
+	if !state.IsValidStatus(status) {
+		return state.Run{}, exceptions.MalformedInput{ErrorString: fmt.Sprintf("status %s is invalid", status)}
+	}
+
+	// Watch before reading the run, so that no change in between is missed
+	var changed <-chan struct{}
+	if watcher, ok := es.sm.(state.RunWatcher); ok {
+		c, stop, err := watcher.WatchRun(runID)
+		if err != nil {
+			return state.Run{}, err
+		}
+		defer stop()
+		changed = c
+	}
+
+	for {
+		run, err := es.sm.GetRun(runID)
+		if err != nil || run.HasReached(status) {
+			return run, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return run, nil
+		case <-changed:
+		case <-time.After(es.waitRecheck):
+		}
+	}
+}
+
 //
 // UpdateStatus is for supporting some legacy runs that still manually update their status
+// * like stopping the run, it needs the runner role in the run's group
 //
-func (es *executionService) UpdateStatus(runID string, status string, exitCode *int64) error {
+func (es *executionService) UpdateStatus(runID string, status string, exitCode *int64, principal string) error {
 	if !state.IsValidStatus(status) {
 		return exceptions.MalformedInput{ErrorString: fmt.Sprintf("status %s is invalid", status)}
 	}
-	_, err := es.sm.UpdateRun(runID, state.Run{Status: status, ExitCode: exitCode})
-	return err
+	run, err := es.sm.GetRun(runID)
+	if err != nil {
+		return err
+	}
+	if err = es.az.Authorize(principal, run.GroupName, state.RoleRunner); err != nil {
+		return err
+	}
+	updated, err := es.sm.UpdateRun(runID, state.Run{Status: status, ExitCode: exitCode})
+	if err != nil {
+		return err
+	}
+	if updated.Status != run.Status {
+		es.notifyStatusChange(updated)
+	}
+	return nil
 }
 
 //
 // Terminate stops the run with the given runID
 //
-func (es *executionService) Terminate(runID string) error {
+func (es *executionService) Terminate(runID string, principal string) error {
 	run, err := es.sm.GetRun(runID)
 	if err != nil {
 		return err
 	}
+	if err = es.az.Authorize(principal, run.GroupName, state.RoleRunner); err != nil {
+		return err
+	}
+
+	// If it's claimed for submission but has no task yet, stop it before it
+	// gets one; the submit worker terminates the task it launches for a run
+	// stopped meanwhile
+	if run.Status == state.StatusPending && len(run.TaskArn) == 0 {
+		stopped, err := es.sm.StopClaimedRun(runID)
+		if err != nil {
+			return err
+		}
+		if stopped {
+			run.Status = state.StatusStopped
+			es.notifyStatusChange(run)
+			return nil
+		}
+		// Submitted meanwhile
+		if run, err = es.sm.GetRun(runID); err != nil {
+			return err
+		}
+	}
+
+	// If it's queued and not submitted, or waiting for a retry, set status to
+	// stopped (checked by submit and retry workers); any task it has is from
+	// an attempt that already stopped
+	if run.Status == state.StatusQueued || run.Status == state.StatusNeedsRetry {
+		stopped, err := es.sm.UpdateRun(runID, state.Run{Status: state.StatusStopped})
+		if err != nil {
+			return err
+		}
+		es.notifyStatusChange(stopped)
+		return nil
+	}
 
 	// If it's been submitted, let the status update workers handle setting it to stopped
 	if run.Status != state.StatusStopped && len(run.TaskArn) > 0 && len(run.ClusterName) > 0 {
 		return es.ee.Terminate(run)
 	}
 
-	// If it's queued and not submitted, set status to stopped (checked by submit worker)
-	if run.Status == state.StatusQueued {
-		_, err = es.sm.UpdateRun(runID, state.Run{Status: state.StatusStopped})
-		return err
-	}
-
 	return exceptions.MalformedInput{
 		ErrorString: fmt.Sprintf(
 			"invalid run, state: %s, arn: %s, clusterName: %s", run.Status, run.TaskArn, run.ClusterName)}
 }
 
+//
+// notifyStatusChange tells those waiting on the run, and the webhooks
+// subscribed to it, of its status change, and counts runs that stopped; the
+// change is already made, and waiters notice it on their next recheck if
+// notifying fails
+//
+func (es *executionService) notifyStatusChange(run state.Run) {
+	if run.Status == state.StatusStopped {
+		metrics.RunsStopped.Inc(run.ClusterName, run.GroupName)
+	}
+	es.notifier.Notify(run)
+	state.NotifyStatusChange(es.sm, run)
+}
+
 //
 // ListClusters returns a list of all execution clusters available
 //
 func (es *executionService) ListClusters() ([]string, error) {
 	return es.cc.ListClusters()
 }
+
+//
+// GetCluster returns the capacity of the named execution cluster
+//
+func (es *executionService) GetCluster(clusterName string) (cluster.Capacity, error) {
+	return es.cc.DescribeCluster(clusterName)
+}
@@ -1,13 +1,26 @@
 package services
 
 import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
+	gklog "github.com/go-kit/kit/log"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/testutils"
 )
 
+func testLogger() flotillaLog.Logger {
+	return flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+}
+
 func setUp(t *testing.T) (ExecutionService, *testutils.ImplementsAllTheThings) {
 	confDir := "../conf"
 	c, _ := config.NewConfig(&confDir)
@@ -17,6 +30,14 @@ func setUp(t *testing.T) (ExecutionService, *testutils.ImplementsAllTheThings) {
 			"A": {DefinitionID: "A", Alias: "aliasA"},
 			"B": {DefinitionID: "B", Alias: "aliasB"},
 			"C": {DefinitionID: "C", Alias: "aliasC", Image: "invalidimage"},
+			"D": {
+				DefinitionID:  "D",
+				Alias:         "aliasD",
+				Arn:           "arn:D",
+				ContainerName: "D",
+				Command:       "echo D",
+				Env:           &state.EnvList{{Name: "DEF_VAR", Value: "def"}, {Name: "K1", Value: "def"}},
+			},
 		},
 		Runs: map[string]state.Run{
 			"runA": {DefinitionID: "A", ClusterName: "A", GroupName: "A", RunID: "runA"},
@@ -27,7 +48,7 @@ func setUp(t *testing.T) (ExecutionService, *testutils.ImplementsAllTheThings) {
 			"B": "b/",
 		},
 	}
-	es, _ := NewExecutionService(c, &imp, &imp, &imp, &imp)
+	es, _ := NewExecutionService(c, &imp, &imp, &imp, &imp, testLogger())
 	return es, &imp
 }
 
@@ -44,7 +65,7 @@ func TestExecutionService_Create(t *testing.T) {
 		"CreateRun":     true,
 		"Enqueue":       true,
 	}
-	run, err := es.Create("B", "clusta", env, "somebody")
+	run, err := es.Create("B", "clusta", env, "somebody", RunOptions{})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -101,6 +122,107 @@ func TestExecutionService_Create(t *testing.T) {
 	}
 }
 
+func TestExecutionService_CreateSnapshotsDefinition(t *testing.T) {
+	// Tests that the definition is copied onto the run at creation time
+	es, imp := setUp(t)
+	env := &state.EnvList{
+		{Name: "K1", Value: "V1"},
+	}
+	run, err := es.Create("D", "clusta", env, "somebody", RunOptions{})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if run.Command != "echo D" || run.DefinitionArn != "arn:D" || run.ContainerName != "D" {
+		t.Errorf("Expected definition command, arn, and container name to be copied onto run, got %v", run)
+	}
+
+	expectedEnv := map[string]string{"DEF_VAR": "def", "K1": "V1"}
+	for _, e := range *run.Env {
+		if expected, ok := expectedEnv[e.Name]; ok && e.Value != expected {
+			t.Errorf("Expected %s:%s in run environment but was %s", e.Name, expected, e.Value)
+		}
+	}
+
+	if len(*run.Env) != len(es.ReservedVariables())+len(expectedEnv) {
+		t.Errorf("Unexpected number of environment variables; expected %v but was %v",
+			len(es.ReservedVariables())+len(expectedEnv), len(*run.Env))
+	}
+
+	// Later changes to the definition do not change the run
+	imp.UpdateDefinition("D", state.Definition{Command: "echo changed"})
+	saved, _ := imp.GetRun(run.RunID)
+	if saved.Command != "echo D" {
+		t.Errorf("Expected saved run command 'echo D' but was '%s'", saved.Command)
+	}
+}
+
+type txStateManager struct {
+	*testutils.ImplementsAllTheThings
+}
+
+func (sm txStateManager) CreateRunWithin(r state.Run, within func(tx *sql.Tx) error) error {
+	sm.Calls = append(sm.Calls, "CreateRunWithin")
+	if err := within(nil); err != nil {
+		return err
+	}
+	sm.Runs[r.RunID] = r
+	return nil
+}
+
+type txEngine struct {
+	*testutils.ImplementsAllTheThings
+	err error
+}
+
+func (ee txEngine) CanEnqueueTx() bool {
+	return true
+}
+
+func (ee txEngine) EnqueueTx(tx *sql.Tx, run state.Run) error {
+	ee.Calls = append(ee.Calls, "EnqueueTx")
+	return ee.err
+}
+
+func TestExecutionService_CreateTransactional(t *testing.T) {
+	// Tests that the run is saved and queued in one transaction when supported
+	_, imp := setUp(t)
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	es, _ := NewExecutionService(c, txEngine{imp, nil}, txStateManager{imp}, imp, imp, testLogger())
+
+	run, err := es.Create("B", "clusta", nil, "somebody", RunOptions{})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	expectedCalls := []string{"GetDefinition", "IsImageValid", "CanBeRun", "CreateRunWithin", "EnqueueTx"}
+	if len(imp.Calls) != len(expectedCalls) {
+		t.Fatalf("Expected calls %v during run creation but was: %v", expectedCalls, imp.Calls)
+	}
+	for i, call := range expectedCalls {
+		if imp.Calls[i] != call {
+			t.Errorf("Expected call %v to be %s but was %s", i, call, imp.Calls[i])
+		}
+	}
+
+	if _, ok := imp.Runs[run.RunID]; !ok {
+		t.Errorf("Expected run [%s] to be saved", run.RunID)
+	}
+
+	// A failure to queue means the run is not saved either
+	imp.Calls = []string{}
+	es, _ = NewExecutionService(c, txEngine{imp, errors.New("nope")}, txStateManager{imp}, imp, imp, testLogger())
+	run, err = es.Create("B", "clusta", nil, "somebody", RunOptions{})
+	if err == nil {
+		t.Errorf("Expected error when run could not be queued")
+	}
+
+	if _, ok := imp.Runs[run.RunID]; ok {
+		t.Errorf("Expected run [%s] not to be saved when it could not be queued", run.RunID)
+	}
+}
+
 func TestExecutionService_CreateByAlias(t *testing.T) {
 	// Tests valid create
 	es, imp := setUp(t)
@@ -114,7 +236,7 @@ func TestExecutionService_CreateByAlias(t *testing.T) {
 		"CreateRun":            true,
 		"Enqueue":              true,
 	}
-	run, err := es.CreateByAlias("aliasB", "clusta", env, "somebody")
+	run, err := es.CreateByAlias("aliasB", "clusta", env, "somebody", RunOptions{})
 	if err != nil {
 		t.Errorf(err.Error())
 	}
@@ -181,22 +303,147 @@ func TestExecutionService_Create2(t *testing.T) {
 	var err error
 
 	// Invalid environment
-	_, err = es.Create("A", "clusta", env, "somebody")
+	_, err = es.Create("A", "clusta", env, "somebody", RunOptions{})
 	if err == nil {
 		t.Errorf("Expected non-nil error for invalid environment")
 	}
 
 	// Invalid image
-	_, err = es.Create("C", "clusta", nil, "somebody")
+	_, err = es.Create("C", "clusta", nil, "somebody", RunOptions{})
 	if err == nil {
 		t.Errorf("Expected non-nil error for invalid image")
 	}
 
 	// Invalid cluster
-	_, err = es.Create("A", "invalidcluster", nil, "somebody")
+	_, err = es.Create("A", "invalidcluster", nil, "somebody", RunOptions{})
 	if err == nil {
 		t.Errorf("Expected non-nil error for invalid cluster")
 	}
+
+	// Invalid timeout
+	timeout := int64(0)
+	_, err = es.Create("A", "clusta", nil, "somebody", RunOptions{TimeoutSeconds: &timeout})
+	if err == nil {
+		t.Errorf("Expected non-nil error for invalid timeout")
+	}
+}
+
+func TestExecutionService_CreateWithTimeout(t *testing.T) {
+	es, imp := setUp(t)
+	definitionTimeout := int64(3600)
+	defB := imp.Definitions["B"]
+	defB.TimeoutSeconds = &definitionTimeout
+	imp.Definitions["B"] = defB
+
+	run, err := es.Create("B", "clusta", nil, "somebody", RunOptions{})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if run.TimeoutSeconds == nil || *run.TimeoutSeconds != definitionTimeout {
+		t.Errorf("Expected run to take the definition's timeout of %v", definitionTimeout)
+	}
+
+	runTimeout := int64(60)
+	run, err = es.Create("B", "clusta", nil, "somebody", RunOptions{TimeoutSeconds: &runTimeout})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if run.TimeoutSeconds == nil || *run.TimeoutSeconds != runTimeout {
+		t.Errorf("Expected run's own timeout of %v to override the definition's", runTimeout)
+	}
+}
+
+func TestExecutionService_CreateWithResources(t *testing.T) {
+	es, imp := setUp(t)
+	definitionMemory := int64(1024)
+	defB := imp.Definitions["B"]
+	defB.Memory = &definitionMemory
+	imp.Definitions["B"] = defB
+
+	cpu, reserved := int64(512), int64(256)
+	run, err := es.Create("B", "clusta", nil, "somebody", RunOptions{CPU: &cpu, MemoryReserved: &reserved})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if run.CPU == nil || *run.CPU != cpu || run.MemoryReserved == nil || *run.MemoryReserved != reserved {
+		t.Errorf("Expected run's own cpu %v and memory reservation %v, got %v %v", cpu, reserved, run.CPU, run.MemoryReserved)
+	}
+	if run.Memory == nil || *run.Memory != definitionMemory {
+		t.Errorf("Expected run to take the definition's memory of %v", definitionMemory)
+	}
+	if imp.Definitions["B"].CPU != nil {
+		t.Errorf("Expected the definition to be left as it was")
+	}
+
+	// Reserving more memory than the run's limit
+	memory := int64(128)
+	_, err = es.Create("B", "clusta", nil, "somebody", RunOptions{Memory: &memory, MemoryReserved: &reserved})
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected a reservation above the memory limit to be malformed input, got %v", err)
+	}
+}
+
+func TestExecutionService_TerminateNotSubmitted(t *testing.T) {
+	es, imp := setUp(t)
+	es.(*executionService).notifier = imp
+
+	// Runs waiting on a retry, or requeued for one, still carry the task of their last attempt
+	for _, status := range []string{state.StatusQueued, state.StatusNeedsRetry} {
+		imp.Calls = []string{}
+		imp.Runs["runA"] = state.Run{
+			RunID: "runA", GroupName: "A", ClusterName: "A", TaskArn: "arn:task/1", Status: status}
+
+		if err := es.Terminate("runA", "me"); err != nil {
+			t.Fatalf("Expected no error stopping %s run, got %v", status, err)
+		}
+		if imp.Runs["runA"].Status != state.StatusStopped {
+			t.Errorf("Expected %s run to be stopped, was %s", status, imp.Runs["runA"].Status)
+		}
+		if len(imp.Notified) == 0 || imp.Notified[len(imp.Notified)-1].Status != state.StatusStopped {
+			t.Errorf("Expected webhooks to be notified of the stopped %s run", status)
+		}
+		for _, call := range imp.Calls {
+			if call == "Terminate" {
+				t.Errorf("Expected the stopped task of %s run not to be terminated", status)
+			}
+		}
+	}
+}
+
+func TestExecutionService_TerminateClaimed(t *testing.T) {
+	es, imp := setUp(t)
+	es.(*executionService).notifier = imp
+
+	// Claimed by a submit worker, but not yet given a task
+	imp.Runs["runA"] = state.Run{RunID: "runA", GroupName: "A", ClusterName: "A", Status: state.StatusPending}
+	if err := es.Terminate("runA", "me"); err != nil {
+		t.Fatalf("Expected no error stopping claimed run, got %v", err)
+	}
+	if imp.Runs["runA"].Status != state.StatusStopped {
+		t.Errorf("Expected claimed run to be stopped, was %s", imp.Runs["runA"].Status)
+	}
+	if len(imp.Notified) != 1 || imp.Notified[0].Status != state.StatusStopped {
+		t.Errorf("Expected webhooks to be notified of the stopped run, got %v", imp.Notified)
+	}
+	for _, call := range imp.Calls {
+		if call == "Terminate" {
+			t.Errorf("Expected claimed run without a task not to be terminated by the engine")
+		}
+	}
+}
+
+func TestExecutionService_UpdateStatus(t *testing.T) {
+	es, imp := setUp(t)
+	es.(*executionService).notifier = imp
+	imp.Runs["runA"] = state.Run{RunID: "runA", GroupName: "A", Status: state.StatusRunning}
+
+	exitCode := int64(0)
+	if err := es.UpdateStatus("runA", state.StatusStopped, &exitCode, ""); err != nil {
+		t.Fatalf("Expected no error updating status, got %v", err)
+	}
+	if len(imp.Notified) != 1 || imp.Notified[0].Status != state.StatusStopped {
+		t.Errorf("Expected webhooks to be notified of the stopped run, got %v", imp.Notified)
+	}
 }
 
 func TestExecutionService_List(t *testing.T) {
@@ -242,3 +489,161 @@ func TestExecutionService_List2(t *testing.T) {
 		}
 	}
 }
+
+func TestExecutionService_CreateIdempotent(t *testing.T) {
+	es, imp := setUp(t)
+	env := &state.EnvList{{Name: "K1", Value: "V1"}}
+	opts := RunOptions{IdempotencyKey: "retry-me"}
+
+	first, err := es.Create("B", "clusta", env, "somebody", opts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// The same request with the same key returns the same run
+	repeat, err := es.Create("B", "clusta", env, "somebody", opts)
+	if err != nil {
+		t.Fatalf("Expected no error repeating the request, got %v", err)
+	}
+	if repeat.RunID != first.RunID || len(imp.Queued) != 1 {
+		t.Errorf("Expected the run created the first time [%s], got [%s] and %d queued",
+			first.RunID, repeat.RunID, len(imp.Queued))
+	}
+
+	// Also when made by alias
+	repeat, err = es.CreateByAlias("aliasB", "clusta", env, "somebody", opts)
+	if err != nil || repeat.RunID != first.RunID {
+		t.Errorf("Expected the run created the first time [%s], got [%s] %v", first.RunID, repeat.RunID, err)
+	}
+
+	// A different request reusing the key conflicts
+	_, err = es.Create("B", "clustb", env, "somebody", opts)
+	if _, ok := err.(exceptions.ConflictingResource); !ok {
+		t.Errorf("Expected reusing the key for a different request to conflict, got %v", err)
+	}
+
+	// Keys are per owner
+	other, err := es.Create("B", "clusta", env, "somebody-else", opts)
+	if err != nil || other.RunID == first.RunID {
+		t.Errorf("Expected another owner's key to create another run, got [%s] %v", other.RunID, err)
+	}
+}
+
+func TestExecutionService_CreateIdempotentFailure(t *testing.T) {
+	es, imp := setUp(t)
+	opts := RunOptions{IdempotencyKey: "retry-me"}
+
+	// A run that could not be created leaves the key free to try again
+	if _, err := es.Create("C", "clusta", nil, "somebody", opts); err == nil {
+		t.Fatalf("Expected an invalid image to fail")
+	}
+	if len(imp.IdempotencyKeys) != 0 {
+		t.Errorf("Expected the key to be released, got %v", imp.IdempotencyKeys)
+	}
+
+	tooLong := RunOptions{IdempotencyKey: string(make([]byte, 256))}
+	if _, err := es.Create("B", "clusta", nil, "somebody", tooLong); err == nil {
+		t.Errorf("Expected too long keys to be rejected")
+	}
+}
+
+//
+// watchingStateManager tells of status changes; runs are guarded for
+// waiting on them from another goroutine
+//
+type watchingStateManager struct {
+	*testutils.ImplementsAllTheThings
+	mu      sync.Mutex
+	changed chan struct{}
+}
+
+func (wm *watchingStateManager) GetRun(runID string) (state.Run, error) {
+	wm.mu.Lock()
+	defer wm.mu.Unlock()
+	return wm.ImplementsAllTheThings.GetRun(runID)
+}
+
+func (wm *watchingStateManager) NotifyStatusChange(run state.Run) error {
+	select {
+	case wm.changed <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (wm *watchingStateManager) WatchRun(runID string) (<-chan struct{}, func(), error) {
+	return wm.changed, func() {}, nil
+}
+
+func (wm *watchingStateManager) setStatus(runID string, status string) {
+	wm.mu.Lock()
+	run := wm.Runs[runID]
+	run.Status = status
+	wm.Runs[runID] = run
+	wm.mu.Unlock()
+	wm.NotifyStatusChange(run)
+}
+
+func TestExecutionService_Wait(t *testing.T) {
+	_, imp := setUp(t)
+	imp.Runs["runA"] = state.Run{RunID: "runA", GroupName: "A", Status: state.StatusQueued}
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	wm := &watchingStateManager{ImplementsAllTheThings: imp, changed: make(chan struct{}, 1)}
+	es, _ := NewExecutionService(c, imp, wm, imp, imp, testLogger())
+	// Only notifications wake up waiters
+	es.(*executionService).waitRecheck = time.Hour
+
+	waited := make(chan state.Run)
+	go func() {
+		run, err := es.Wait(context.Background(), "runA", state.StatusRunning)
+		if err != nil {
+			t.Errorf("Expected no error waiting on run, got %v", err)
+		}
+		waited <- run
+	}()
+
+	wm.setStatus("runA", state.StatusPending)
+	time.Sleep(10 * time.Millisecond)
+	wm.setStatus("runA", state.StatusStopped)
+	select {
+	case run := <-waited:
+		if run.Status != state.StatusStopped {
+			t.Errorf("Expected run past the status waited on to be returned, was %s", run.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected wait to return once the run stopped")
+	}
+
+	// Already there
+	run, err := es.Wait(context.Background(), "runA", state.StatusStopped)
+	if err != nil || run.Status != state.StatusStopped {
+		t.Errorf("Expected stopped run to be returned right away, got %s %v", run.Status, err)
+	}
+
+	_, err = es.Wait(context.Background(), "runA", "DONE")
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected invalid status to be rejected, got %v", err)
+	}
+
+	if _, err = es.Wait(context.Background(), "nope", state.StatusStopped); err == nil {
+		t.Errorf("Expected waiting on a missing run to fail")
+	}
+}
+
+func TestExecutionService_WaitTimeout(t *testing.T) {
+	// Without notifications runs are read again every waitRecheck
+	es, imp := setUp(t)
+	imp.Runs["runA"] = state.Run{RunID: "runA", GroupName: "A", Status: state.StatusRunning}
+	es.(*executionService).waitRecheck = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	run, err := es.Wait(ctx, "runA", state.StatusStopped)
+	if err != nil || run.Status != state.StatusRunning {
+		t.Errorf("Expected the run as it is once timed out, got %s %v", run.Status, err)
+	}
+	if len(imp.Calls) < 3 {
+		t.Errorf("Expected the run to be read again while waiting, calls were %v", imp.Calls)
+	}
+}
@@ -1,22 +1,58 @@
 package services
 
 import (
+	"context"
 	"github.com/stitchfix/flotilla-os/clients/logs"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/state"
+	"time"
 )
 
+// LogEventLog carries log lines of a run
+const LogEventLog = "log"
+
+// LogEventStatus carries the new status of a run
+const LogEventStatus = "status"
+
+// LogEventDone carries the final status of a run; no events follow it
+const LogEventDone = "done"
+
+//
+// LogEvent is one event of a tailed run; LastSeen is the position in the
+// run's logs after the event, to resume tailing from
+//
+type LogEvent struct {
+	Type     string
+	Data     string
+	LastSeen *string
+}
+
 type LogService interface {
 	Logs(runID string, lastSeen *string) (string, *string, error)
+	Tail(ctx context.Context, runID string, lastSeen *string, emit func(LogEvent) error) error
 }
 
 type logService struct {
-	sm state.Manager
-	lc logs.Client
+	sm           state.Manager
+	lc           logs.Client
+	pollInterval time.Duration
 }
 
+//
+// NewLogService configures and returns a LogService
+// - log.stream_interval is how often tailed runs are polled for new logs (default 2s)
+//
 func NewLogService(conf config.Config, sm state.Manager, lc logs.Client) (LogService, error) {
-	return &logService{sm: sm, lc: lc}, nil
+	ls := logService{sm: sm, lc: lc, pollInterval: 2 * time.Second}
+	if conf.IsSet("log.stream_interval") {
+		pollInterval, err := time.ParseDuration(conf.GetString("log.stream_interval"))
+		if err != nil {
+			return nil, err
+		}
+		ls.pollInterval = pollInterval
+	}
+	return &ls, nil
 }
 
 func (ls *logService) Logs(runID string, lastSeen *string) (string, *string, error) {
@@ -37,3 +73,87 @@ func (ls *logService) Logs(runID string, lastSeen *string) (string, *string, err
 
 	return ls.lc.Logs(defn, run, lastSeen)
 }
+
+//
+// Tail emits the run's logs after lastSeen, and each change of its
+// status, until the run is stopped or ctx is done
+// * the run's current status is emitted first
+// * logs of a stopped run are still read until a poll interval after it
+//   finished, since log backends can lag behind the run
+// * an error returned by emit ends tailing with that error
+//
+func (ls *logService) Tail(ctx context.Context, runID string, lastSeen *string, emit func(LogEvent) error) error {
+	var (
+		status string
+		defn   *state.Definition
+	)
+
+	for {
+		run, err := ls.sm.GetRun(runID)
+		if err != nil {
+			return err
+		}
+
+		if run.Status != status {
+			status = run.Status
+			if err = emit(LogEvent{Type: LogEventStatus, Data: status, LastSeen: lastSeen}); err != nil {
+				return err
+			}
+		}
+
+		if status == state.StatusRunning || status == state.StatusStopped {
+			if defn == nil {
+				d, err := ls.sm.GetDefinition(run.DefinitionID)
+				if err != nil {
+					return err
+				}
+				defn = &d
+			}
+
+			if lastSeen, err = ls.drain(ctx, *defn, run, lastSeen, emit); err != nil {
+				return err
+			}
+
+			if status == state.StatusStopped &&
+				(run.FinishedAt == nil || time.Since(*run.FinishedAt) > ls.pollInterval) {
+				return emit(LogEvent{Type: LogEventDone, Data: status, LastSeen: lastSeen})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(ls.pollInterval):
+		}
+	}
+}
+
+//
+// drain emits all of the run's logs currently available after lastSeen
+// and returns the position after them
+//
+func (ls *logService) drain(
+	ctx context.Context, defn state.Definition, run state.Run, lastSeen *string, emit func(LogEvent) error) (*string, error) {
+	for ctx.Err() == nil {
+		logs, next, err := ls.lc.Logs(defn, run, lastSeen)
+		if err != nil {
+			if _, ok := err.(exceptions.MissingResource); ok {
+				// The run has not written any logs yet
+				return lastSeen, nil
+			}
+			return lastSeen, err
+		}
+
+		if next != nil {
+			lastSeen = next
+		}
+		if len(logs) == 0 {
+			return lastSeen, nil
+		}
+
+		if err = emit(LogEvent{Type: LogEventLog, Data: logs, LastSeen: lastSeen}); err != nil {
+			return lastSeen, err
+		}
+	}
+	return lastSeen, nil
+}
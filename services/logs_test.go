@@ -1,10 +1,18 @@
 package services
 
 import (
+	"context"
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stitchfix/flotilla-os/clients/logs"
 	"github.com/stitchfix/flotilla-os/config"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/testutils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func setUpLogServiceTest(t *testing.T) (LogService, *testutils.ImplementsAllTheThings) {
@@ -77,3 +85,122 @@ func TestLogService_Logs(t *testing.T) {
 		}
 	}
 }
+
+func TestLogService_Tail(t *testing.T) {
+	_, imp := setUpLogServiceTest(t)
+	ls := &logService{sm: imp, lc: imp, pollInterval: time.Millisecond}
+	imp.LogChunks = []string{"a\n", "b\n", "c\n"}
+
+	var events []LogEvent
+	emit := func(e LogEvent) error {
+		events = append(events, e)
+		if len(events) == 2 {
+			// The run stops while its logs are read
+			finishedAt := time.Now().Add(-time.Minute)
+			run := imp.Runs["running"]
+			run.Status = state.StatusStopped
+			run.FinishedAt = &finishedAt
+			imp.Runs["running"] = run
+		}
+		return nil
+	}
+
+	lastSeen := "1"
+	if err := ls.Tail(context.Background(), "running", &lastSeen, emit); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := []LogEvent{
+		{Type: LogEventStatus, Data: state.StatusRunning},
+		{Type: LogEventLog, Data: "b\n"},
+		{Type: LogEventLog, Data: "c\n"},
+		{Type: LogEventStatus, Data: state.StatusStopped},
+		{Type: LogEventDone, Data: state.StatusStopped},
+	}
+	expectedLastSeen := []string{"1", "2", "3", "3", "3"}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v events but got %v", len(expected), events)
+	}
+	for i, e := range events {
+		if e.Type != expected[i].Type || e.Data != expected[i].Data {
+			t.Errorf("Expected event %v to be %v but was %v", i, expected[i], e)
+		}
+		if e.LastSeen == nil || *e.LastSeen != expectedLastSeen[i] {
+			t.Errorf("Expected event %v to be at [%s] but was at %v", i, expectedLastSeen[i], e.LastSeen)
+		}
+	}
+}
+
+func TestLogService_TailCancelled(t *testing.T) {
+	_, imp := setUpLogServiceTest(t)
+	ls := &logService{sm: imp, lc: imp, pollInterval: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var events []LogEvent
+	emit := func(e LogEvent) error {
+		events = append(events, e)
+		cancel()
+		return nil
+	}
+
+	// Queued runs have no logs; tailing waits until cancelled
+	if err := ls.Tail(ctx, "isQueued", nil, emit); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(events) != 1 || events[0].Data != state.StatusQueued {
+		t.Errorf("Expected only the queued status event, got %v", events)
+	}
+	for _, call := range imp.Calls {
+		if call == "Logs" {
+			t.Errorf("Expected no logs to be read for a queued run")
+		}
+	}
+}
+
+func TestLogService_FileLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flotilla-logs")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("LOG_DRIVER_NAME", "file")
+	os.Setenv("LOG_FILE_DIRECTORY", dir)
+	defer os.Unsetenv("LOG_DRIVER_NAME")
+	defer os.Unsetenv("LOG_FILE_DIRECTORY")
+
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	l := gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr))
+	lc, err := logs.NewLogsClient(c, flotillaLog.NewLogger(l, nil))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	_, imp := setUpLogServiceTest(t)
+	ls, _ := NewLogService(c, imp, lc)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "running.log"), []byte("a\nb\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	lines, lastSeen, err := ls.Logs("running", nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if lines != "a\nb\n" || lastSeen == nil || *lastSeen != "4" {
+		t.Errorf("Expected the run's log file to be read, got [%s] at %v", lines, lastSeen)
+	}
+
+	f, _ := os.OpenFile(filepath.Join(dir, "running.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("c\n")
+	f.Close()
+
+	lines, lastSeen, err = ls.Logs("running", lastSeen)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if lines != "c\n" || *lastSeen != "6" {
+		t.Errorf("Expected only the new logs, got [%s] at %v", lines, *lastSeen)
+	}
+}
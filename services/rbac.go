@@ -0,0 +1,133 @@
+package services
+
+import (
+	"fmt"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"strings"
+)
+
+//
+// Authorizer decides whether principals may act on the definitions and
+// runs of a group; a denial is an exceptions.Forbidden error
+//
+type Authorizer interface {
+	Authorize(principal string, groupName string, role string) error
+}
+
+//
+// NewAuthorizer configures and returns an Authorizer
+// - with auth.rbac.enabled, principals need a role in a group, granted by
+//   a state.RoleBinding, to act on it
+// - auth.rbac.admins are principals that are admins of every group
+// - otherwise everyone may do anything
+//
+func NewAuthorizer(conf config.Config, sm state.Manager) (Authorizer, error) {
+	if !conf.GetBool("auth.rbac.enabled") {
+		return &openAuthorizer{}, nil
+	}
+
+	ra := roleAuthorizer{sm: sm, admins: make(map[string]bool)}
+	for _, admin := range conf.GetStringSlice("auth.rbac.admins") {
+		ra.admins[admin] = true
+	}
+	return &ra, nil
+}
+
+type openAuthorizer struct{}
+
+func (oa *openAuthorizer) Authorize(principal string, groupName string, role string) error {
+	return nil
+}
+
+type roleAuthorizer struct {
+	sm     state.Manager
+	admins map[string]bool
+}
+
+//
+// Authorize allows principal if they have role, or one that allows
+// everything it does, in groupName or in every group
+//
+func (ra *roleAuthorizer) Authorize(principal string, groupName string, role string) error {
+	if len(principal) == 0 {
+		return exceptions.Forbidden{ErrorString: "request has no principal to authorize"}
+	}
+	if ra.admins[principal] {
+		return nil
+	}
+
+	bl, err := ra.sm.ListRoleBindings(1024, 0, map[string][]string{"principal": {principal}})
+	if err != nil {
+		return err
+	}
+	for _, b := range bl.RoleBindings {
+		if b.Principal == principal &&
+			(b.GroupName == groupName || b.GroupName == state.AllGroups) && state.RoleAllows(b.Role, role) {
+			return nil
+		}
+	}
+	return exceptions.Forbidden{
+		ErrorString: fmt.Sprintf("[%s] needs the [%s] role in group [%s]", principal, role, groupName)}
+}
+
+//
+// RoleService defines an interface for granting and revoking the roles
+// of principals in groups
+//
+type RoleService interface {
+	List(limit int, offset int, filters map[string][]string) (state.RoleBindingList, error)
+	Grant(principal string, binding state.RoleBinding) (state.RoleBinding, error)
+	Revoke(principal string, groupName string, grantee string) error
+}
+
+type roleService struct {
+	sm state.Manager
+	az Authorizer
+}
+
+//
+// NewRoleService configures and returns a RoleService
+//
+func NewRoleService(conf config.Config, sm state.Manager) (RoleService, error) {
+	az, err := NewAuthorizer(conf, sm)
+	if err != nil {
+		return nil, err
+	}
+	rs := roleService{sm: sm, az: az}
+	return &rs, nil
+}
+
+//
+// List lists role bindings
+//
+func (rs *roleService) List(
+	limit int, offset int, filters map[string][]string) (state.RoleBindingList, error) {
+	return rs.sm.ListRoleBindings(limit, offset, filters)
+}
+
+//
+// Grant gives the binding's principal its role in its group, replacing
+// any role they had there; principal must be an admin of the group
+//
+func (rs *roleService) Grant(principal string, binding state.RoleBinding) (state.RoleBinding, error) {
+	if valid, reasons := binding.IsValid(); !valid {
+		return state.RoleBinding{}, exceptions.MalformedInput{ErrorString: strings.Join(reasons, "\n")}
+	}
+	if err := rs.az.Authorize(principal, binding.GroupName, state.RoleAdmin); err != nil {
+		return state.RoleBinding{}, err
+	}
+	return rs.sm.PutRoleBinding(binding)
+}
+
+//
+// Revoke removes grantee's role in the group; principal must be an admin
+// of the group
+//
+func (rs *roleService) Revoke(principal string, groupName string, grantee string) error {
+	if err := rs.az.Authorize(principal, groupName, state.RoleAdmin); err != nil {
+		return err
+	}
+	return rs.sm.DeleteRoleBinding(groupName, grantee)
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+)
+
+func setUpRBACTest(t *testing.T) (config.Config, *testutils.ImplementsAllTheThings) {
+	// Config reads the environment when it is used; callers unset it
+	os.Setenv("AUTH_RBAC_ENABLED", "true")
+
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A", Alias: "aliasA", GroupName: "g1"},
+		},
+		Runs: map[string]state.Run{
+			"runA": {DefinitionID: "A", ClusterName: "A", GroupName: "g1", RunID: "runA", TaskArn: "arn:A", Status: state.StatusRunning},
+		},
+		Qurls: map[string]string{"A": "a/"},
+		RoleBindings: []state.RoleBinding{
+			{Principal: "runner", GroupName: "g1", Role: state.RoleRunner},
+			{Principal: "editor", GroupName: "g1", Role: state.RoleEditor},
+			{Principal: "everywhere", GroupName: state.AllGroups, Role: state.RoleEditor},
+			{Principal: "other", GroupName: "g2", Role: state.RoleAdmin},
+		},
+	}
+	return c, &imp
+}
+
+func TestAuthorizer_Authorize(t *testing.T) {
+	c, imp := setUpRBACTest(t)
+	az, _ := NewAuthorizer(c, imp)
+	os.Unsetenv("AUTH_RBAC_ENABLED")
+
+	cases := []struct {
+		principal string
+		group     string
+		role      string
+		allowed   bool
+	}{
+		{"runner", "g1", state.RoleRunner, true},
+		{"runner", "g1", state.RoleEditor, false},
+		{"editor", "g1", state.RoleRunner, true},
+		{"everywhere", "g3", state.RoleEditor, true},
+		{"other", "g1", state.RoleViewer, false},
+		{"admin", "g1", state.RoleAdmin, true},
+		{"", "g1", state.RoleViewer, false},
+	}
+	for _, tc := range cases {
+		err := az.Authorize(tc.principal, tc.group, tc.role)
+		if tc.allowed && err != nil {
+			t.Errorf("Expected [%s] to be a %s of %s, got %v", tc.principal, tc.role, tc.group, err)
+		}
+		if !tc.allowed {
+			if _, ok := err.(exceptions.Forbidden); !ok {
+				t.Errorf("Expected [%s] to be forbidden as a %s of %s, got %v", tc.principal, tc.role, tc.group, err)
+			}
+		}
+	}
+
+	// Without rbac everything is allowed
+	open, _ := NewAuthorizer(c, imp)
+	if err := open.Authorize("", "g1", state.RoleAdmin); err != nil {
+		t.Errorf("Expected everything to be allowed without rbac, got %v", err)
+	}
+}
+
+func TestRBAC_DefinitionService(t *testing.T) {
+	c, imp := setUpRBACTest(t)
+	ds, _ := NewDefinitionService(c, imp, imp)
+	os.Unsetenv("AUTH_RBAC_ENABLED")
+
+	if _, err := ds.Update("A", state.Definition{Image: "image:cupcake"}, "runner"); err == nil {
+		t.Errorf("Expected runners not to be able to update definitions")
+	}
+	if err := ds.Delete("A", "runner"); err == nil {
+		t.Errorf("Expected runners not to be able to delete definitions")
+	}
+
+	if _, err := ds.Update("A", state.Definition{Image: "image:cupcake"}, "editor"); err != nil {
+		t.Errorf("Expected editors to be able to update definitions, got %v", err)
+	}
+
+	// Moving a definition needs the editor role in both groups
+	if _, err := ds.Update("A", state.Definition{GroupName: "g2"}, "editor"); err == nil {
+		t.Errorf("Expected editors not to be able to move definitions to other groups")
+	}
+	if _, err := ds.Update("A", state.Definition{GroupName: "g2"}, "everywhere"); err != nil {
+		t.Errorf("Expected editors of both groups to be able to move definitions, got %v", err)
+	}
+}
+
+func TestRBAC_ExecutionService(t *testing.T) {
+	c, imp := setUpRBACTest(t)
+	es, _ := NewExecutionService(c, imp, imp, imp, imp, testLogger())
+	os.Unsetenv("AUTH_RBAC_ENABLED")
+
+	if _, err := es.Create("A", "clusta", nil, "other", RunOptions{}); err == nil {
+		t.Errorf("Expected runs to need the runner role")
+	}
+	if _, err := es.Create("A", "clusta", nil, "runner", RunOptions{}); err != nil {
+		t.Errorf("Expected runners to be able to create runs, got %v", err)
+	}
+
+	if err := es.Terminate("runA", "other"); err == nil {
+		t.Errorf("Expected stopping runs to need the runner role")
+	}
+	if err := es.Terminate("runA", "runner"); err != nil {
+		t.Errorf("Expected runners to be able to stop runs, got %v", err)
+	}
+
+	if err := es.UpdateStatus("runA", state.StatusStopped, nil, "other"); err == nil {
+		t.Errorf("Expected updating the status of runs to need the runner role")
+	}
+	if err := es.UpdateStatus("runA", state.StatusStopped, nil, "runner"); err != nil {
+		t.Errorf("Expected runners to be able to update the status of runs, got %v", err)
+	}
+}
+
+func TestRBAC_ScheduleService(t *testing.T) {
+	c, imp := setUpRBACTest(t)
+	ss, _ := NewScheduleService(c, imp)
+	os.Unsetenv("AUTH_RBAC_ENABLED")
+	imp.Definitions["B"] = state.Definition{DefinitionID: "B", Alias: "aliasB", GroupName: "g2"}
+	imp.Schedules = map[string]state.Schedule{}
+
+	schedule := state.Schedule{DefinitionID: "A", CronExpression: "0 9 * * *", ClusterName: "clusta"}
+	if _, err := ss.Create(&schedule, "other"); err == nil {
+		t.Errorf("Expected creating schedules to need the runner role")
+	}
+	created, err := ss.Create(&schedule, "runner")
+	if err != nil {
+		t.Fatalf("Expected runners to be able to create schedules, got %v", err)
+	}
+
+	if _, err = ss.Update(created.ScheduleID, state.Schedule{CronExpression: "0 10 * * *"}, "other"); err == nil {
+		t.Errorf("Expected updating schedules to need the runner role")
+	}
+	if _, err = ss.Update(created.ScheduleID, state.Schedule{CronExpression: "0 10 * * *"}, "runner"); err != nil {
+		t.Errorf("Expected runners to be able to update schedules, got %v", err)
+	}
+
+	// Running another group's definition needs the runner role there too
+	if _, err = ss.Update(created.ScheduleID, state.Schedule{DefinitionID: "B"}, "runner"); err == nil {
+		t.Errorf("Expected runners not to be able to point schedules at other groups")
+	}
+
+	if err = ss.Delete(created.ScheduleID, "other"); err == nil {
+		t.Errorf("Expected deleting schedules to need the runner role")
+	}
+	if err = ss.Delete(created.ScheduleID, "runner"); err != nil {
+		t.Errorf("Expected runners to be able to delete schedules, got %v", err)
+	}
+}
+
+func TestRoleService_Grant(t *testing.T) {
+	c, imp := setUpRBACTest(t)
+	rs, _ := NewRoleService(c, imp)
+	os.Unsetenv("AUTH_RBAC_ENABLED")
+
+	binding := state.RoleBinding{Principal: "newcomer", GroupName: "g2", Role: state.RoleRunner}
+	if _, err := rs.Grant("editor", binding); err == nil {
+		t.Errorf("Expected only admins to grant roles")
+	}
+	if _, err := rs.Grant("other", binding); err != nil {
+		t.Errorf("Expected admins of g2 to grant roles in g2, got %v", err)
+	}
+
+	bl, _ := rs.List(10, 0, map[string][]string{"principal": {"newcomer"}})
+	if bl.Total != 1 || bl.RoleBindings[0].Role != state.RoleRunner {
+		t.Errorf("Expected newcomer to be a runner, got %v", bl.RoleBindings)
+	}
+
+	if err := rs.Revoke("other", "g2", "newcomer"); err != nil {
+		t.Errorf("Expected admins of g2 to revoke roles in g2, got %v", err)
+	}
+	if _, err := rs.Grant("other", state.RoleBinding{Principal: "x", GroupName: "g2", Role: "owner"}); err == nil {
+		t.Errorf("Expected unknown roles to be rejected")
+	}
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"strings"
+	"time"
+)
+
+//
+// ScheduleService defines an interface for operations involving
+// schedules; the schedule worker creates the runs themselves
+// * changing a schedule needs the runner role in the group of the
+//   definition it runs, as it launches runs there
+//
+type ScheduleService interface {
+	Create(schedule *state.Schedule, principal string) (state.Schedule, error)
+	Get(scheduleID string) (state.Schedule, error)
+	List(limit int, offset int, filters map[string][]string) (state.ScheduleList, error)
+	Update(scheduleID string, updates state.Schedule, principal string) (state.Schedule, error)
+	Delete(scheduleID string, principal string) error
+}
+
+type scheduleService struct {
+	sm state.Manager
+	az Authorizer
+}
+
+//
+// NewScheduleService configures and returns a ScheduleService
+//
+func NewScheduleService(conf config.Config, sm state.Manager) (ScheduleService, error) {
+	az, err := NewAuthorizer(conf, sm)
+	if err != nil {
+		return nil, err
+	}
+	ss := scheduleService{sm: sm, az: az}
+	return &ss, nil
+}
+
+//
+// Create fully initialize and save the new schedule
+// * Allocates new schedule id
+// * Ensures the definition or alias it runs exists
+// * Computes the first tick after now
+//
+func (ss *scheduleService) Create(schedule *state.Schedule, principal string) (state.Schedule, error) {
+	if len(schedule.Timezone) == 0 {
+		schedule.Timezone = "UTC"
+	}
+	if len(schedule.MissedPolicy) == 0 {
+		schedule.MissedPolicy = state.ScheduleMissedSkip
+	}
+
+	if err := ss.validate(*schedule); err != nil {
+		return state.Schedule{}, err
+	}
+	if err := ss.authorize(*schedule, principal); err != nil {
+		return state.Schedule{}, err
+	}
+
+	scheduleID, err := state.NewScheduleID()
+	if err != nil {
+		return state.Schedule{}, err
+	}
+	schedule.ScheduleID = scheduleID
+
+	next, err := schedule.NextAfter(time.Now())
+	if err != nil {
+		return state.Schedule{}, exceptions.MalformedInput{ErrorString: err.Error()}
+	}
+	schedule.NextRunAt = &next
+	schedule.LastRunAt = nil
+
+	return *schedule, ss.sm.CreateSchedule(*schedule)
+}
+
+//
+// Get returns the schedule specified by scheduleID
+//
+func (ss *scheduleService) Get(scheduleID string) (state.Schedule, error) {
+	return ss.sm.GetSchedule(scheduleID)
+}
+
+//
+// List lists schedules
+//
+func (ss *scheduleService) List(
+	limit int, offset int, filters map[string][]string) (state.ScheduleList, error) {
+	return ss.sm.ListSchedules(limit, offset, filters)
+}
+
+//
+// Update updates the schedule specified by scheduleID with the given updates
+// * changing when the schedule runs, or re-enabling it, moves the next tick
+//   to the first one after now; missed ticks of the old schedule are dropped
+// * pointing it at a definition of another group needs the runner role in both
+//
+func (ss *scheduleService) Update(
+	scheduleID string, updates state.Schedule, principal string) (state.Schedule, error) {
+	existing, err := ss.sm.GetSchedule(scheduleID)
+	if err != nil {
+		return existing, err
+	}
+	if err = ss.authorize(existing, principal); err != nil {
+		return existing, err
+	}
+
+	wasEnabled := existing.IsEnabled()
+	updates.ScheduleID = ""
+	updates.NextRunAt = nil
+	updates.LastRunAt = nil
+	existing.UpdateWith(updates)
+
+	if err = ss.validate(existing); err != nil {
+		return existing, err
+	}
+	if err = ss.authorize(existing, principal); err != nil {
+		return existing, err
+	}
+
+	if len(updates.CronExpression) > 0 || len(updates.Timezone) > 0 ||
+		(!wasEnabled && existing.IsEnabled()) || existing.NextRunAt == nil {
+		next, err := existing.NextAfter(time.Now())
+		if err != nil {
+			return existing, exceptions.MalformedInput{ErrorString: err.Error()}
+		}
+		existing.NextRunAt = &next
+	}
+
+	return ss.sm.UpdateSchedule(scheduleID, existing)
+}
+
+//
+// Delete deletes the schedule; runs it already created are unaffected
+// * schedules of definitions that no longer exist launch nothing, and may
+//   be deleted by anyone
+//
+func (ss *scheduleService) Delete(scheduleID string, principal string) error {
+	schedule, err := ss.sm.GetSchedule(scheduleID)
+	if err != nil {
+		return err
+	}
+	if err = ss.authorize(schedule, principal); err != nil {
+		if _, missing := errors.Cause(err).(exceptions.MissingResource); !missing {
+			return err
+		}
+	}
+	return ss.sm.DeleteSchedule(scheduleID)
+}
+
+func (ss *scheduleService) validate(schedule state.Schedule) error {
+	if valid, reasons := schedule.IsValid(); !valid {
+		return exceptions.MalformedInput{ErrorString: strings.Join(reasons, "\n")}
+	}
+
+	// Ensure what the schedule runs exists
+	_, err := ss.definitionOf(schedule)
+	return err
+}
+
+//
+// authorize allows principal to change the schedule if they may launch
+// runs of the definition it runs
+//
+func (ss *scheduleService) authorize(schedule state.Schedule, principal string) error {
+	definition, err := ss.definitionOf(schedule)
+	if err != nil {
+		return err
+	}
+	return ss.az.Authorize(principal, definition.GroupName, state.RoleRunner)
+}
+
+func (ss *scheduleService) definitionOf(schedule state.Schedule) (state.Definition, error) {
+	if len(schedule.Alias) > 0 {
+		return ss.sm.GetDefinitionByAlias(schedule.Alias)
+	}
+	return ss.sm.GetDefinition(schedule.DefinitionID)
+}
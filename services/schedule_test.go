@@ -0,0 +1,109 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+)
+
+func setUpScheduleServiceTest(t *testing.T) (ScheduleService, *testutils.ImplementsAllTheThings) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A", Alias: "aliasA"},
+		},
+		Schedules: map[string]state.Schedule{},
+	}
+	ss, _ := NewScheduleService(c, &imp)
+	return ss, &imp
+}
+
+func TestScheduleService_Create(t *testing.T) {
+	ss, imp := setUpScheduleServiceTest(t)
+
+	created, err := ss.Create(&state.Schedule{
+		DefinitionID:   "A",
+		CronExpression: "0 9 * * *",
+		Timezone:       "America/Los_Angeles",
+		ClusterName:    "clusta",
+	}, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if _, ok := imp.Schedules[created.ScheduleID]; !ok {
+		t.Errorf("Expected schedule [%s] to be saved", created.ScheduleID)
+	}
+
+	if created.MissedPolicy != state.ScheduleMissedSkip {
+		t.Errorf("Expected default missed policy [skip] but was [%s]", created.MissedPolicy)
+	}
+
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	next := created.NextRunAt.In(loc)
+	if next.Hour() != 9 || next.Minute() != 0 || !next.After(time.Now()) {
+		t.Errorf("Expected next run at 09:00 America/Los_Angeles in the future, was %v", next)
+	}
+
+	_, err = ss.Create(&state.Schedule{
+		DefinitionID: "A", CronExpression: "* * *", ClusterName: "clusta"}, "")
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for invalid cron expression, got %v", err)
+	}
+
+	_, err = ss.Create(&state.Schedule{
+		Alias: "nope", CronExpression: "* * * * *", ClusterName: "clusta"}, "")
+	if err == nil {
+		t.Errorf("Expected error creating schedule for unknown alias")
+	}
+}
+
+func TestScheduleService_Update(t *testing.T) {
+	ss, imp := setUpScheduleServiceTest(t)
+
+	tick := time.Date(2017, 7, 4, 0, 0, 0, 0, time.UTC)
+	imp.Schedules["s1"] = state.Schedule{
+		ScheduleID:     "s1",
+		DefinitionID:   "A",
+		CronExpression: "0 * * * *",
+		Timezone:       "UTC",
+		ClusterName:    "clusta",
+		MissedPolicy:   state.ScheduleMissedCatchUp,
+		NextRunAt:      &tick,
+	}
+
+	// Changing only what is run keeps pending ticks
+	updated, err := ss.Update("s1", state.Schedule{Alias: "aliasA"}, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if updated.Alias != "aliasA" || len(updated.DefinitionID) != 0 {
+		t.Errorf("Expected schedule to run alias [aliasA] only, got [%s] and [%s]",
+			updated.Alias, updated.DefinitionID)
+	}
+
+	if !updated.NextRunAt.Equal(tick) {
+		t.Errorf("Expected next run to be unchanged at %v, was %v", tick, updated.NextRunAt)
+	}
+
+	// Changing when it runs moves the next tick past now
+	updated, err = ss.Update("s1", state.Schedule{CronExpression: "30 * * * *"}, "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if !updated.NextRunAt.After(time.Now()) || updated.NextRunAt.Minute() != 30 {
+		t.Errorf("Expected next run at half past the hour after now, was %v", updated.NextRunAt)
+	}
+
+	if _, err = ss.Update("s1", state.Schedule{MissedPolicy: "nope"}, ""); err == nil {
+		t.Errorf("Expected error updating to an invalid missed policy")
+	}
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"strings"
+)
+
+// Prefix of api tokens, to make them easy to recognize (eg. by secret scanners)
+const tokenPrefix = "flo_"
+
+//
+// TokenService defines an interface for operations involving
+// api tokens, and authenticating requests bearing them
+//
+type TokenService interface {
+	Create(token *state.Token) (state.Token, string, error)
+	Get(tokenID string) (state.Token, error)
+	List(limit int, offset int, filters map[string][]string) (state.TokenList, error)
+	Revoke(tokenID string) (state.Token, error)
+	Authenticate(secret string) (state.Token, error)
+}
+
+type tokenService struct {
+	sm             state.Manager
+	bootstrapToken string
+	bootstrap      state.Token
+}
+
+//
+// NewTokenService configures and returns a TokenService
+// - auth.bootstrap_token, if set, is a token with every scope that is not
+//   stored, for creating the first stored tokens with
+// - auth.bootstrap_principal is who the bootstrap token acts as (default admin)
+//
+func NewTokenService(conf config.Config, sm state.Manager) (TokenService, error) {
+	ts := tokenService{sm: sm, bootstrapToken: conf.GetString("auth.bootstrap_token")}
+
+	principal := "admin"
+	if conf.IsSet("auth.bootstrap_principal") {
+		principal = conf.GetString("auth.bootstrap_principal")
+	}
+	ts.bootstrap = state.Token{
+		TokenID:   "bootstrap",
+		Name:      "bootstrap",
+		Principal: principal,
+		Scopes: &state.ScopeList{
+			state.ScopeDefinitionsWrite,
+			state.ScopeRunsExecute,
+			state.ScopeRunsStop,
+			state.ScopeRunsUpdate,
+			state.ScopeSchedulesWrite,
+			state.ScopeWebhooksWrite,
+			state.ScopeTokensAdmin,
+		},
+	}
+	return &ts, nil
+}
+
+//
+// Create fully initialize and save the new token
+// * Allocates new token id and the token itself
+// * Only a hash of the token is saved; the token is returned and
+//   can not be recovered later
+//
+func (ts *tokenService) Create(token *state.Token) (state.Token, string, error) {
+	if valid, reasons := token.IsValid(); !valid {
+		return state.Token{}, "", exceptions.MalformedInput{ErrorString: strings.Join(reasons, "\n")}
+	}
+
+	tokenID, err := state.NewTokenID()
+	if err != nil {
+		return state.Token{}, "", err
+	}
+
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return state.Token{}, "", err
+	}
+	secret := tokenPrefix + hex.EncodeToString(b)
+
+	token.TokenID = tokenID
+	token.Hash = hashToken(secret)
+	token.RevokedAt = nil
+	if err = ts.sm.CreateToken(*token); err != nil {
+		return state.Token{}, "", err
+	}
+	return *token, secret, nil
+}
+
+//
+// Get returns the token specified by tokenID
+//
+func (ts *tokenService) Get(tokenID string) (state.Token, error) {
+	return ts.sm.GetToken(tokenID)
+}
+
+//
+// List lists tokens
+//
+func (ts *tokenService) List(
+	limit int, offset int, filters map[string][]string) (state.TokenList, error) {
+	return ts.sm.ListTokens(limit, offset, filters)
+}
+
+//
+// Revoke revokes the token specified by tokenID
+//
+func (ts *tokenService) Revoke(tokenID string) (state.Token, error) {
+	return ts.sm.RevokeToken(tokenID)
+}
+
+//
+// Authenticate returns the unrevoked token secret is for, or an
+// Unauthorized error
+//
+func (ts *tokenService) Authenticate(secret string) (state.Token, error) {
+	if len(ts.bootstrapToken) > 0 &&
+		subtle.ConstantTimeCompare([]byte(secret), []byte(ts.bootstrapToken)) == 1 {
+		return ts.bootstrap, nil
+	}
+
+	unauthorized := exceptions.Unauthorized{ErrorString: "invalid api token"}
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return state.Token{}, unauthorized
+	}
+
+	token, err := ts.sm.GetTokenByHash(hashToken(secret))
+	if err != nil {
+		if _, ok := err.(exceptions.MissingResource); ok {
+			return token, unauthorized
+		}
+		return token, err
+	}
+	if token.IsRevoked() {
+		return state.Token{}, unauthorized
+	}
+	return token, nil
+}
+
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
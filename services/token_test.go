@@ -0,0 +1,93 @@
+package services
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+)
+
+func setUpTokenServiceTest(t *testing.T) (TokenService, *testutils.ImplementsAllTheThings) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T:      t,
+		Tokens: map[string]state.Token{},
+	}
+	ts, _ := NewTokenService(c, &imp)
+	return ts, &imp
+}
+
+func TestTokenService_Create(t *testing.T) {
+	ts, imp := setUpTokenServiceTest(t)
+
+	created, secret, err := ts.Create(&state.Token{
+		Name: "ci", Principal: "ci-bot", Scopes: &state.ScopeList{state.ScopeRunsExecute},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	saved, ok := imp.Tokens[created.TokenID]
+	if !ok || len(created.TokenID) == 0 {
+		t.Fatalf("Expected token [%s] to be saved", created.TokenID)
+	}
+	if !strings.HasPrefix(secret, tokenPrefix) || len(saved.Hash) == 0 || strings.Contains(saved.Hash, secret) {
+		t.Errorf("Expected only a hash of the token to be saved, got [%s]", saved.Hash)
+	}
+
+	_, _, err = ts.Create(&state.Token{Name: "ci", Principal: "ci-bot", Scopes: &state.ScopeList{"everything"}})
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for an unknown scope, got %v", err)
+	}
+}
+
+func TestTokenService_Authenticate(t *testing.T) {
+	ts, _ := setUpTokenServiceTest(t)
+
+	created, secret, err := ts.Create(&state.Token{
+		Name: "ci", Principal: "ci-bot", Scopes: &state.ScopeList{state.ScopeRunsExecute},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	token, err := ts.Authenticate(secret)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if token.TokenID != created.TokenID || token.Principal != "ci-bot" {
+		t.Errorf("Expected token [%s] for ci-bot, got %v", created.TokenID, token)
+	}
+
+	for _, bad := range []string{"", "flo_nope", secret + "x"} {
+		if _, err = ts.Authenticate(bad); err == nil {
+			t.Errorf("Expected [%s] to not authenticate", bad)
+		} else if _, ok := err.(exceptions.Unauthorized); !ok {
+			t.Errorf("Expected Unauthorized for [%s], got %v", bad, err)
+		}
+	}
+
+	ts.Revoke(created.TokenID)
+	if _, err = ts.Authenticate(secret); err == nil {
+		t.Errorf("Expected revoked token to not authenticate")
+	}
+}
+
+func TestTokenService_Bootstrap(t *testing.T) {
+	os.Setenv("AUTH_BOOTSTRAP_TOKEN", "let-me-in")
+	defer os.Unsetenv("AUTH_BOOTSTRAP_TOKEN")
+	ts, _ := setUpTokenServiceTest(t)
+
+	token, err := ts.Authenticate("let-me-in")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if token.Principal != "admin" || !token.HasScope(state.ScopeTokensAdmin) {
+		t.Errorf("Expected bootstrap token to be an admin, got %v", token)
+	}
+}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"strings"
+)
+
+//
+// WebhookService defines an interface for operations involving
+// webhooks; the status worker delivers to them
+//
+type WebhookService interface {
+	Create(webhook *state.Webhook) (state.Webhook, error)
+	Get(webhookID string) (state.Webhook, error)
+	List(limit int, offset int, filters map[string][]string) (state.WebhookList, error)
+	Update(webhookID string, updates state.Webhook) (state.Webhook, error)
+	Delete(webhookID string) error
+	ListDeliveries(webhookID string, limit int, offset int) (state.WebhookDeliveryList, error)
+}
+
+type webhookService struct {
+	sm state.Manager
+}
+
+//
+// NewWebhookService configures and returns a WebhookService
+//
+func NewWebhookService(conf config.Config, sm state.Manager) (WebhookService, error) {
+	ws := webhookService{sm: sm}
+	return &ws, nil
+}
+
+//
+// Create fully initialize and save the new webhook
+// * Allocates new webhook id
+// * Ensures the definition it is for, if any, exists
+//
+func (ws *webhookService) Create(webhook *state.Webhook) (state.Webhook, error) {
+	if err := ws.validate(*webhook); err != nil {
+		return state.Webhook{}, err
+	}
+
+	webhookID, err := state.NewWebhookID()
+	if err != nil {
+		return state.Webhook{}, err
+	}
+	webhook.WebhookID = webhookID
+
+	return *webhook, ws.sm.CreateWebhook(*webhook)
+}
+
+//
+// Get returns the webhook specified by webhookID
+//
+func (ws *webhookService) Get(webhookID string) (state.Webhook, error) {
+	return ws.sm.GetWebhook(webhookID)
+}
+
+//
+// List lists webhooks
+//
+func (ws *webhookService) List(
+	limit int, offset int, filters map[string][]string) (state.WebhookList, error) {
+	return ws.sm.ListWebhooks(limit, offset, filters)
+}
+
+//
+// Update updates the webhook specified by webhookID with the given updates
+//
+func (ws *webhookService) Update(webhookID string, updates state.Webhook) (state.Webhook, error) {
+	existing, err := ws.sm.GetWebhook(webhookID)
+	if err != nil {
+		return existing, err
+	}
+
+	updates.WebhookID = ""
+	existing.UpdateWith(updates)
+	if err = ws.validate(existing); err != nil {
+		return existing, err
+	}
+
+	return ws.sm.UpdateWebhook(webhookID, existing)
+}
+
+//
+// Delete deletes the webhook and its delivery log
+//
+func (ws *webhookService) Delete(webhookID string) error {
+	if _, err := ws.sm.GetWebhook(webhookID); err != nil {
+		return err
+	}
+	return ws.sm.DeleteWebhook(webhookID)
+}
+
+//
+// ListDeliveries lists the deliveries to the webhook, newest first
+//
+func (ws *webhookService) ListDeliveries(
+	webhookID string, limit int, offset int) (state.WebhookDeliveryList, error) {
+	if _, err := ws.sm.GetWebhook(webhookID); err != nil {
+		return state.WebhookDeliveryList{}, err
+	}
+	return ws.sm.ListWebhookDeliveries(webhookID, limit, offset)
+}
+
+func (ws *webhookService) validate(webhook state.Webhook) error {
+	if valid, reasons := webhook.IsValid(); !valid {
+		return exceptions.MalformedInput{ErrorString: strings.Join(reasons, "\n")}
+	}
+
+	if len(webhook.DefinitionID) > 0 {
+		_, err := ws.sm.GetDefinition(webhook.DefinitionID)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+)
+
+func setUpWebhookServiceTest(t *testing.T) (WebhookService, *testutils.ImplementsAllTheThings) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A", Alias: "aliasA"},
+		},
+		Webhooks: map[string]state.Webhook{},
+	}
+	ws, _ := NewWebhookService(c, &imp)
+	return ws, &imp
+}
+
+func TestWebhookService_Create(t *testing.T) {
+	ws, imp := setUpWebhookServiceTest(t)
+
+	created, err := ws.Create(&state.Webhook{
+		URL:          "https://example.com/hook",
+		DefinitionID: "A",
+		Statuses:     &state.StatusList{state.StatusStopped},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, ok := imp.Webhooks[created.WebhookID]; !ok || len(created.WebhookID) == 0 {
+		t.Errorf("Expected webhook [%s] to be saved", created.WebhookID)
+	}
+
+	_, err = ws.Create(&state.Webhook{URL: "ftp://example.com/hook"})
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for non http url, got %v", err)
+	}
+
+	if _, err = ws.Create(&state.Webhook{URL: "https://example.com/hook", DefinitionID: "nope"}); err == nil {
+		t.Errorf("Expected error for webhook of missing definition")
+	}
+}
+
+func TestWebhookService_Update(t *testing.T) {
+	ws, imp := setUpWebhookServiceTest(t)
+	imp.Webhooks["w1"] = state.Webhook{WebhookID: "w1", URL: "https://example.com/hook", DefinitionID: "A"}
+
+	updated, err := ws.Update("w1", state.Webhook{GroupName: "g1"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if updated.GroupName != "g1" || len(updated.DefinitionID) != 0 {
+		t.Errorf("Expected webhook to move to group g1, got %v", updated)
+	}
+
+	_, err = ws.Update("w1", state.Webhook{URL: "not a url"})
+	if _, ok := err.(exceptions.MalformedInput); !ok {
+		t.Errorf("Expected MalformedInput for invalid url, got %v", err)
+	}
+
+	if _, err = ws.Update("nope", state.Webhook{}); err == nil {
+		t.Errorf("Expected error updating missing webhook")
+	}
+}
+
+func TestWebhookService_ListDeliveries(t *testing.T) {
+	ws, imp := setUpWebhookServiceTest(t)
+	imp.Webhooks["w1"] = state.Webhook{WebhookID: "w1", URL: "https://example.com/hook"}
+	imp.WebhookDeliveries = []state.WebhookDelivery{
+		{DeliveryID: "d1", WebhookID: "w1", Succeeded: true},
+		{DeliveryID: "d2", WebhookID: "w2"},
+	}
+
+	dl, err := ws.ListDeliveries("w1", 10, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if dl.Total != 1 || dl.Deliveries[0].DeliveryID != "d1" {
+		t.Errorf("Expected only the deliveries of w1, got %v", dl.Deliveries)
+	}
+
+	if _, err = ws.ListDeliveries("nope", 10, 0); err == nil {
+		t.Errorf("Expected error listing deliveries of missing webhook")
+	}
+}
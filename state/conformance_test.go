@@ -0,0 +1,752 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/exceptions"
+)
+
+//
+// testManagerConformance checks that a state manager behaves as every
+// state manager must; newManager returns a manager with no state
+//
+func testManagerConformance(t *testing.T, newManager func() Manager) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, sm Manager)
+	}{
+		{"Definitions", testConformanceDefinitions},
+		{"ListDefinitions", testConformanceListDefinitions},
+		{"UpdateDefinition", testConformanceUpdateDefinition},
+		{"DeleteDefinition", testConformanceDeleteDefinition},
+		{"Runs", testConformanceRuns},
+		{"ListRuns", testConformanceListRuns},
+		{"ClaimRun", testConformanceClaimRun},
+		{"GroupsAndTags", testConformanceGroupsAndTags},
+		{"Schedules", testConformanceSchedules},
+		{"Webhooks", testConformanceWebhooks},
+		{"Tokens", testConformanceTokens},
+		{"RoleBindings", testConformanceRoleBindings},
+		{"IdempotencyKeys", testConformanceIdempotencyKeys},
+	}
+	for _, c := range cases {
+		sm := newManager()
+		seedConformance(t, sm)
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, sm)
+		})
+		sm.Cleanup()
+	}
+}
+
+var conformanceStart = time.Date(2017, 7, 4, 12, 0, 0, 0, time.UTC)
+
+//
+// seedConformance creates definitions A to D and runs run0 to run3
+//
+func seedConformance(t *testing.T, sm Manager) {
+	mem := func(m int64) *int64 { return &m }
+	at := func(minutes int) *time.Time {
+		t := conformanceStart.Add(time.Duration(minutes) * time.Minute)
+		return &t
+	}
+
+	definitions := []Definition{
+		{DefinitionID: "A", Alias: "aliasA", Image: "imageA", GroupName: "groupZ", ContainerName: "containerA",
+			Memory: mem(1024), Command: "echo 'a'", Env: &EnvList{{Name: "E_A1", Value: "V_A1"}},
+			Ports: &PortsList{10000}, Tags: &Tags{"tagA"}},
+		{DefinitionID: "B", Alias: "aliasB", Image: "imageB", GroupName: "groupY", ContainerName: "containerB",
+			Memory: mem(512), Command: "echo 'b'",
+			Env: &EnvList{{Name: "E_B1", Value: "V_B1"}, {Name: "E_B2", Value: "V_B2"}}},
+		{DefinitionID: "C", Alias: "aliasC", Image: "imageC", GroupName: "groupX", ContainerName: "containerC",
+			Command: "echo 'c'", Ports: &PortsList{}, Tags: &Tags{"tagC"}},
+		{DefinitionID: "D", Alias: "other", Image: "imageD", GroupName: "groupX", ContainerName: "containerD",
+			Memory: mem(2048)},
+	}
+	for _, d := range definitions {
+		if err := sm.CreateDefinition(d); err != nil {
+			t.Fatalf("Expected definition %s to be created, got %v", d.DefinitionID, err)
+		}
+	}
+
+	exitCode := int64(0)
+	runs := []Run{
+		{RunID: "run0", DefinitionID: "A", Alias: "aliasA", GroupName: "groupZ", ClusterName: "clusta",
+			Status: StatusRunning, StartedAt: at(0), Env: &EnvList{{Name: "E0", Value: "V0"}}},
+		{RunID: "run1", DefinitionID: "A", Alias: "aliasA", GroupName: "groupZ", ClusterName: "clusta",
+			Status: StatusStopped, StartedAt: at(10), FinishedAt: at(20), ExitCode: &exitCode},
+		{RunID: "run2", DefinitionID: "B", Alias: "aliasB", GroupName: "groupY", ClusterName: "clustb",
+			Status: StatusQueued, QueuedAt: at(30), Env: &EnvList{{Name: "E0", Value: "V0"}}},
+		{RunID: "run3", DefinitionID: "C", Alias: "aliasC", GroupName: "groupX", ClusterName: "clustb",
+			Status: StatusPending, StartedAt: at(40), User: "someone"},
+	}
+	for _, r := range runs {
+		if err := sm.CreateRun(r); err != nil {
+			t.Fatalf("Expected run %s to be created, got %v", r.RunID, err)
+		}
+	}
+}
+
+func isMissing(err error) bool {
+	_, missing := errors.Cause(err).(exceptions.MissingResource)
+	return missing
+}
+
+func definitionIDs(dl DefinitionList) []string {
+	ids := []string{}
+	for _, d := range dl.Definitions {
+		ids = append(ids, d.DefinitionID)
+	}
+	return ids
+}
+
+func runIDs(rl RunList) []string {
+	ids := []string{}
+	for _, r := range rl.Runs {
+		ids = append(ids, r.RunID)
+	}
+	return ids
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testConformanceDefinitions(t *testing.T, sm Manager) {
+	d, err := sm.GetDefinition("A")
+	if err != nil {
+		t.Fatalf("Expected definition A, got %v", err)
+	}
+	if d.Alias != "aliasA" || d.Revision != 1 || *d.Memory != 1024 || len(d.TaskType) != 0 {
+		t.Errorf("Expected definition A as created at its first revision, got %v", d)
+	}
+	if d.Env == nil || len(*d.Env) != 1 || (*d.Env)[0].Value != "V_A1" {
+		t.Errorf("Expected definition A's env, got %v", d.Env)
+	}
+	if d.Ports == nil || len(*d.Ports) != 1 || (*d.Ports)[0] != 10000 {
+		t.Errorf("Expected definition A's port, got %v", d.Ports)
+	}
+	if d.Tags == nil || len(*d.Tags) != 1 || (*d.Tags)[0] != "tagA" {
+		t.Errorf("Expected definition A's tag, got %v", d.Tags)
+	}
+
+	c, _ := sm.GetDefinition("C")
+	if c.Ports != nil || c.Memory != nil || c.Env != nil {
+		t.Errorf("Expected definition C without ports, memory or env, got %v %v %v", c.Ports, c.Memory, c.Env)
+	}
+
+	// What is returned is not what is stored
+	(*d.Env)[0].Value = "changed"
+	if d, _ = sm.GetDefinition("A"); (*d.Env)[0].Value != "V_A1" {
+		t.Errorf("Expected definition A not to be changed through a copy")
+	}
+
+	byAlias, err := sm.GetDefinitionByAlias("aliasB")
+	if err != nil || byAlias.DefinitionID != "B" {
+		t.Errorf("Expected definition B by alias, got %v %v", byAlias.DefinitionID, err)
+	}
+
+	if _, err = sm.GetDefinition("Z"); !isMissing(err) {
+		t.Errorf("Expected missing definition to be a missing resource, got %v", err)
+	}
+	if _, err = sm.GetDefinitionByAlias("aliasZ"); !isMissing(err) {
+		t.Errorf("Expected missing alias to be a missing resource, got %v", err)
+	}
+
+	if err = sm.CreateDefinition(Definition{
+		DefinitionID: "A", Alias: "aliasA2", Image: "i", GroupName: "g", ContainerName: "c"}); err == nil {
+		t.Errorf("Expected definition with a taken id not to be created")
+	}
+	if err = sm.CreateDefinition(Definition{
+		DefinitionID: "A2", Alias: "aliasA", Image: "i", GroupName: "g", ContainerName: "c"}); err == nil {
+		t.Errorf("Expected definition with a taken alias not to be created")
+	}
+}
+
+func testConformanceListDefinitions(t *testing.T, sm Manager) {
+	dl, err := sm.ListDefinitions(2, 1, "alias", "asc", nil, nil)
+	if err != nil {
+		t.Fatalf("Expected definitions, got %v", err)
+	}
+	if dl.Total != 4 || !sameStrings(definitionIDs(dl), []string{"B", "C"}) {
+		t.Errorf("Expected second page of 4 definitions by alias to be B, C, got %v of %d", definitionIDs(dl), dl.Total)
+	}
+
+	dl, _ = sm.ListDefinitions(10, 0, "memory", "asc", nil, nil)
+	if !sameStrings(definitionIDs(dl), []string{"B", "A", "D", "C"}) {
+		t.Errorf("Expected definitions by memory with none last, got %v", definitionIDs(dl))
+	}
+	dl, _ = sm.ListDefinitions(10, 0, "memory", "desc", nil, nil)
+	if !sameStrings(definitionIDs(dl), []string{"D", "A", "B", "C"}) {
+		t.Errorf("Expected definitions by memory descending with none last, got %v", definitionIDs(dl))
+	}
+
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", map[string][]string{"alias": {"lias"}}, nil)
+	if dl.Total != 3 || !sameStrings(definitionIDs(dl), []string{"A", "B", "C"}) {
+		t.Errorf("Expected a single alias to match as a substring, got %v", definitionIDs(dl))
+	}
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", map[string][]string{"alias": {"lias", "other"}}, nil)
+	if !sameStrings(definitionIDs(dl), []string{"D"}) {
+		t.Errorf("Expected several aliases to match exactly, got %v", definitionIDs(dl))
+	}
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", map[string][]string{
+		"group_name": {"groupX"}, "container_name": {"containerC"}}, nil)
+	if !sameStrings(definitionIDs(dl), []string{"C"}) {
+		t.Errorf("Expected filters to be joined with and, got %v", definitionIDs(dl))
+	}
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", map[string][]string{"memory": {"512"}}, nil)
+	if !sameStrings(definitionIDs(dl), []string{"B"}) {
+		t.Errorf("Expected definitions with 512 memory, got %v", definitionIDs(dl))
+	}
+
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", nil, map[string]string{"E_B1": "V_B1", "E_B2": "V_B2"})
+	if !sameStrings(definitionIDs(dl), []string{"B"}) {
+		t.Errorf("Expected definitions with both env vars, got %v", definitionIDs(dl))
+	}
+	dl, _ = sm.ListDefinitions(10, 0, "alias", "asc", nil, map[string]string{"E_B1": "V_B2"})
+	if dl.Total != 0 || len(dl.Definitions) != 0 {
+		t.Errorf("Expected env vars to match by name and value, got %v", definitionIDs(dl))
+	}
+
+	if _, err = sm.ListDefinitions(10, 0, "command", "asc", nil, nil); err == nil {
+		t.Errorf("Expected error sorting by an invalid field")
+	}
+	if _, err = sm.ListDefinitions(10, 0, "alias", "sideways", nil, nil); err == nil {
+		t.Errorf("Expected error sorting in an invalid order")
+	}
+	if _, err = sm.ListDefinitions(10, 0, "alias", "asc", map[string][]string{"nope": {"x"}}, nil); err == nil {
+		t.Errorf("Expected error filtering by an unknown field")
+	}
+}
+
+func testConformanceUpdateDefinition(t *testing.T, sm Manager) {
+	mem, reserved, cpu := int64(4096), int64(1024), int64(512)
+	updated, err := sm.UpdateDefinition("B", Definition{
+		Memory: &mem, MemoryReserved: &reserved, CPU: &cpu, Ports: &PortsList{8080}, Tags: &Tags{"tagB"}})
+	if err != nil {
+		t.Fatalf("Expected definition B to be updated, got %v", err)
+	}
+	if updated.Revision != 2 || *updated.Memory != 4096 || updated.Image != "imageB" {
+		t.Errorf("Expected partial update at the second revision, got %v", updated)
+	}
+
+	b, _ := sm.GetDefinition("B")
+	if b.Revision != 2 || *b.Memory != 4096 || b.Ports == nil || (*b.Ports)[0] != 8080 || (*b.Tags)[0] != "tagB" {
+		t.Errorf("Expected update of definition B to be stored, got %v", b)
+	}
+	if b.CPU == nil || *b.CPU != 512 || b.MemoryReserved == nil || *b.MemoryReserved != 1024 {
+		t.Errorf("Expected definition B's cpu and memory reservation to be stored, got %v %v", b.CPU, b.MemoryReserved)
+	}
+
+	if _, err = sm.UpdateDefinition("A", Definition{Ports: &PortsList{}}); err != nil {
+		t.Fatalf("Expected definition A to be updated, got %v", err)
+	}
+	if a, _ := sm.GetDefinition("A"); a.Ports != nil || a.Tags == nil {
+		t.Errorf("Expected definition A's ports to be replaced and its tags kept, got %v %v", a.Ports, a.Tags)
+	}
+
+	if _, err = sm.UpdateDefinition("B", Definition{Alias: "aliasA"}); err == nil {
+		t.Errorf("Expected update to a taken alias to fail")
+	}
+	if _, err = sm.UpdateDefinition("Z", Definition{Image: "imageZ"}); !isMissing(err) {
+		t.Errorf("Expected update of missing definition to be a missing resource, got %v", err)
+	}
+
+	revisions, err := sm.ListDefinitionRevisions("B", 10, 0)
+	if err != nil {
+		t.Fatalf("Expected revisions of definition B, got %v", err)
+	}
+	if revisions.Total != 2 || len(revisions.Revisions) != 2 ||
+		revisions.Revisions[0].Revision != 2 || revisions.Revisions[1].Revision != 1 {
+		t.Fatalf("Expected 2 revisions of definition B, newest first, got %v", revisions)
+	}
+	if revisions.Revisions[1].Memory == nil || *revisions.Revisions[1].Memory != 512 || revisions.Revisions[1].CPU != nil ||
+		revisions.Revisions[0].CreatedAt == nil || revisions.Revisions[0].CPU == nil {
+		t.Errorf("Expected first revision of definition B as created, got %v", revisions.Revisions[1])
+	}
+
+	page, _ := sm.ListDefinitionRevisions("B", 1, 1)
+	if page.Total != 2 || len(page.Revisions) != 1 || page.Revisions[0].Revision != 1 {
+		t.Errorf("Expected second page of revisions to hold the first revision, got %v", page)
+	}
+
+	first, err := sm.GetDefinitionRevision("B", 1)
+	if err != nil || first.Ports != nil || *first.Memory != 512 {
+		t.Errorf("Expected first revision of definition B, got %v %v", first, err)
+	}
+	if _, err = sm.GetDefinitionRevision("B", 3); !isMissing(err) {
+		t.Errorf("Expected missing revision to be a missing resource, got %v", err)
+	}
+
+	// Replacing restores every field, clearing those the first revision left empty
+	replaced, err := sm.ReplaceDefinition("B", first.Definition)
+	if err != nil {
+		t.Fatalf("Expected definition B to be replaced, got %v", err)
+	}
+	b, _ = sm.GetDefinition("B")
+	if replaced.Revision != 3 || b.Revision != 3 || b.CPU != nil || b.MemoryReserved != nil ||
+		b.Ports != nil || b.Tags != nil || *b.Memory != 512 || b.Alias != "aliasB" {
+		t.Errorf("Expected definition B to be its first revision again, got %v", b)
+	}
+	if _, err = sm.ReplaceDefinition("Z", first.Definition); !isMissing(err) {
+		t.Errorf("Expected replacing missing definition to be a missing resource, got %v", err)
+	}
+}
+
+func testConformanceDeleteDefinition(t *testing.T, sm Manager) {
+	if err := sm.CreateSchedule(Schedule{
+		ScheduleID: "sA", DefinitionID: "A", CronExpression: "0 * * * *", Timezone: "UTC",
+		ClusterName: "clusta", MissedPolicy: ScheduleMissedSkip}); err != nil {
+		t.Fatalf("Expected schedule to be created, got %v", err)
+	}
+
+	if err := sm.DeleteDefinition("A"); err != nil {
+		t.Fatalf("Expected definition A to be deleted, got %v", err)
+	}
+	if _, err := sm.GetDefinition("A"); !isMissing(err) {
+		t.Errorf("Expected deleted definition to be missing, got %v", err)
+	}
+	if _, err := sm.GetRun("run0"); !isMissing(err) {
+		t.Errorf("Expected runs of deleted definition to be deleted, got %v", err)
+	}
+	if _, err := sm.GetSchedule("sA"); !isMissing(err) {
+		t.Errorf("Expected schedules of deleted definition to be deleted, got %v", err)
+	}
+	if revisions, _ := sm.ListDefinitionRevisions("A", 10, 0); revisions.Total != 0 {
+		t.Errorf("Expected revisions of deleted definition to be deleted, got %v", revisions)
+	}
+	if _, err := sm.GetRun("run2"); err != nil {
+		t.Errorf("Expected runs of other definitions to be kept, got %v", err)
+	}
+
+	if err := sm.DeleteDefinition("A"); err != nil {
+		t.Errorf("Expected deleting a missing definition to succeed, got %v", err)
+	}
+}
+
+func testConformanceRuns(t *testing.T, sm Manager) {
+	r, err := sm.GetRun("run3")
+	if err != nil {
+		t.Fatalf("Expected run3, got %v", err)
+	}
+	if r.Status != StatusPending || r.TaskType != "task" || len(r.User) != 0 || r.Env != nil {
+		t.Errorf("Expected run3 as created, got %v", r)
+	}
+	if r.StartedAt == nil || !r.StartedAt.Equal(conformanceStart.Add(40*time.Minute)) {
+		t.Errorf("Expected run3's start time, got %v", r.StartedAt)
+	}
+
+	if _, err = sm.GetRun("run9"); !isMissing(err) {
+		t.Errorf("Expected missing run to be a missing resource, got %v", err)
+	}
+	if err = sm.CreateRun(Run{RunID: "run0", DefinitionID: "A"}); err == nil {
+		t.Errorf("Expected run with a taken id not to be created")
+	}
+	if err = sm.CreateRun(Run{RunID: "run9", DefinitionID: "Z"}); err == nil {
+		t.Errorf("Expected run of a missing definition not to be created")
+	}
+
+	exitCode := int64(1)
+	cpu := int64(256)
+	updated, err := sm.UpdateRun("run3", Run{Status: StatusStopped, ExitCode: &exitCode, InstanceID: "i-1", CPU: &cpu})
+	if err != nil {
+		t.Fatalf("Expected run3 to be updated, got %v", err)
+	}
+	if updated.Status != StatusStopped || *updated.ExitCode != 1 || updated.ClusterName != "clustb" {
+		t.Errorf("Expected partial update of run3, got %v", updated)
+	}
+
+	// A late update does not take a run back to an earlier status
+	if updated, _ = sm.UpdateRun("run3", Run{Status: StatusRunning}); updated.Status != StatusStopped {
+		t.Errorf("Expected stopped run to stay stopped, was %s", updated.Status)
+	}
+	if r, _ = sm.GetRun("run3"); r.Status != StatusStopped || r.InstanceID != "i-1" || r.CPU == nil || *r.CPU != 256 {
+		t.Errorf("Expected update of run3 to be stored, got %v", r)
+	}
+
+	if _, err = sm.UpdateRun("run9", Run{Status: StatusRunning}); err != nil {
+		t.Errorf("Expected update of a missing run to change nothing, got %v", err)
+	}
+	if _, err = sm.GetRun("run9"); !isMissing(err) {
+		t.Errorf("Expected update of a missing run not to create it, got %v", err)
+	}
+}
+
+func testConformanceClaimRun(t *testing.T, sm Manager) {
+	if claimed, err := sm.ClaimRun("run2"); err != nil || !claimed {
+		t.Fatalf("Expected queued run2 to be claimed, got %v %v", claimed, err)
+	}
+	if r, _ := sm.GetRun("run2"); r.Status != StatusPending || r.QueuedAt == nil || r.ClaimedAt == nil {
+		t.Errorf("Expected claimed run2 to be pending, keep when it was queued and record when it was claimed, got %v", r)
+	} else if time.Since(*r.ClaimedAt) > time.Minute {
+		t.Errorf("Expected run2 to be claimed just now, was at %v", r.ClaimedAt)
+	}
+
+	// Only one claim of a run succeeds, and only queued runs are claimed
+	for _, runID := range []string{"run2", "run0", "run9"} {
+		if claimed, err := sm.ClaimRun(runID); err != nil || claimed {
+			t.Errorf("Expected %s not to be claimed, got %v %v", runID, claimed, err)
+		}
+	}
+
+	if released, err := sm.ReleaseRun("run2"); err != nil || !released {
+		t.Fatalf("Expected claimed run2 to be released, got %v %v", released, err)
+	}
+	if r, _ := sm.GetRun("run2"); r.Status != StatusQueued {
+		t.Errorf("Expected released run2 to be queued, was %s", r.Status)
+	}
+
+	// Claims outlive updates to the run
+	sm.ClaimRun("run2")
+	if r, _ := sm.UpdateRun("run2", Run{ExitCode: nil}); r.ClaimedAt == nil {
+		t.Errorf("Expected updated run2 to keep when it was claimed")
+	}
+
+	// Claimed runs are stopped before they are submitted
+	if stopped, err := sm.StopClaimedRun("run2"); err != nil || !stopped {
+		t.Fatalf("Expected claimed run2 to be stopped, got %v %v", stopped, err)
+	}
+	if r, _ := sm.GetRun("run2"); r.Status != StatusStopped {
+		t.Errorf("Expected stopped run2 to be stopped, was %s", r.Status)
+	}
+
+	// Runs that were submitted are neither released nor stopped that way
+	sm.UpdateRun("run2", Run{Status: StatusNeedsRetry})
+	sm.UpdateRun("run2", Run{Status: StatusQueued, Attempt: 2})
+	sm.ClaimRun("run2")
+	sm.UpdateRun("run2", Run{TaskArn: "arn:task/2"})
+	for _, runID := range []string{"run2", "run0", "run9"} {
+		if released, err := sm.ReleaseRun(runID); err != nil || released {
+			t.Errorf("Expected %s not to be released, got %v %v", runID, released, err)
+		}
+		if stopped, err := sm.StopClaimedRun(runID); err != nil || stopped {
+			t.Errorf("Expected %s not to be stopped, got %v %v", runID, stopped, err)
+		}
+	}
+}
+
+func testConformanceListRuns(t *testing.T, sm Manager) {
+	rl, err := sm.ListRuns(2, 0, "started_at", "desc", nil, nil)
+	if err != nil {
+		t.Fatalf("Expected runs, got %v", err)
+	}
+	if rl.Total != 4 || !sameStrings(runIDs(rl), []string{"run3", "run1"}) {
+		t.Errorf("Expected first page of 4 runs by start time descending, got %v of %d", runIDs(rl), rl.Total)
+	}
+	rl, _ = sm.ListRuns(10, 0, "started_at", "asc", nil, nil)
+	if !sameStrings(runIDs(rl), []string{"run0", "run1", "run3", "run2"}) {
+		t.Errorf("Expected runs that have not started last, got %v", runIDs(rl))
+	}
+
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{
+		"status": {StatusQueued, StatusPending, StatusRunning}}, nil)
+	if !sameStrings(runIDs(rl), []string{"run0", "run2", "run3"}) {
+		t.Errorf("Expected unfinished runs, got %v", runIDs(rl))
+	}
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{
+		"started_at_since": {conformanceStart.Add(5 * time.Minute).Format(time.RFC3339)},
+		"started_at_until": {conformanceStart.Add(40 * time.Minute).Format(time.RFC3339)}}, nil)
+	if !sameStrings(runIDs(rl), []string{"run1"}) {
+		t.Errorf("Expected runs started between the bounds, got %v", runIDs(rl))
+	}
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{"group_name": {"group"}}, nil)
+	if rl.Total != 4 {
+		t.Errorf("Expected a single group name to match as a substring, got %v", runIDs(rl))
+	}
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{"cluster_name": {"clust"}}, nil)
+	if rl.Total != 0 {
+		t.Errorf("Expected cluster names to match exactly, got %v", runIDs(rl))
+	}
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{"exit_code": {"0"}}, nil)
+	if !sameStrings(runIDs(rl), []string{"run1"}) {
+		t.Errorf("Expected runs with exit code 0, got %v", runIDs(rl))
+	}
+
+	rl, _ = sm.ListRuns(10, 0, "run_id", "asc", nil, map[string]string{"E0": "V0"})
+	if !sameStrings(runIDs(rl), []string{"run0", "run2"}) {
+		t.Errorf("Expected runs with env var E0, got %v", runIDs(rl))
+	}
+
+	rl, _ = sm.ListRuns(10, 10, "run_id", "asc", nil, nil)
+	if rl.Total != 4 || len(rl.Runs) != 0 {
+		t.Errorf("Expected no runs past the last, got %v of %d", runIDs(rl), rl.Total)
+	}
+
+	if _, err = sm.ListRuns(10, 0, "image", "asc", nil, nil); err == nil {
+		t.Errorf("Expected error sorting by an invalid field")
+	}
+	if _, err = sm.ListRuns(10, 0, "run_id", "up", nil, nil); err == nil {
+		t.Errorf("Expected error sorting in an invalid order")
+	}
+	if _, err = sm.ListRuns(10, 0, "run_id", "asc", map[string][]string{"exit_code": {"zero"}}, nil); err == nil {
+		t.Errorf("Expected error filtering by a value of the wrong type")
+	}
+}
+
+func testConformanceGroupsAndTags(t *testing.T, sm Manager) {
+	groups, err := sm.ListGroups(10, 0, nil)
+	if err != nil {
+		t.Fatalf("Expected groups, got %v", err)
+	}
+	if groups.Total != 3 || !sameStrings(groups.Groups, []string{"groupX", "groupY", "groupZ"}) {
+		t.Errorf("Expected distinct groups in order, got %v of %d", groups.Groups, groups.Total)
+	}
+	name := "Y"
+	if groups, _ = sm.ListGroups(10, 0, &name); !sameStrings(groups.Groups, []string{"groupY"}) {
+		t.Errorf("Expected groups containing Y, got %v", groups.Groups)
+	}
+
+	// Tags are kept after the definitions they were given to change
+	sm.UpdateDefinition("C", Definition{Tags: &Tags{"tagB"}})
+	tags, err := sm.ListTags(1, 1, nil)
+	if err != nil {
+		t.Fatalf("Expected tags, got %v", err)
+	}
+	if tags.Total != 3 || !sameStrings(tags.Tags, []string{"tagB"}) {
+		t.Errorf("Expected second of 3 tags, got %v of %d", tags.Tags, tags.Total)
+	}
+}
+
+func testConformanceSchedules(t *testing.T, sm Manager) {
+	tick := conformanceStart.Add(time.Hour)
+	later := conformanceStart.Add(2 * time.Hour)
+	disabled := false
+	schedules := []Schedule{
+		{ScheduleID: "s1", DefinitionID: "A", CronExpression: "0 * * * *", Timezone: "UTC",
+			ClusterName: "clusta", MissedPolicy: ScheduleMissedSkip, NextRunAt: &tick},
+		{ScheduleID: "s2", Alias: "aliasB", CronExpression: "0 */2 * * *", Timezone: "UTC",
+			ClusterName: "clustb", MissedPolicy: ScheduleMissedSkip, NextRunAt: &later},
+		{ScheduleID: "s3", Alias: "aliasC", CronExpression: "0 * * * *", Timezone: "UTC",
+			ClusterName: "clustb", MissedPolicy: ScheduleMissedSkip, NextRunAt: &tick, Enabled: &disabled},
+	}
+	for _, s := range schedules {
+		if err := sm.CreateSchedule(s); err != nil {
+			t.Fatalf("Expected schedule %s to be created, got %v", s.ScheduleID, err)
+		}
+	}
+	if err := sm.CreateSchedule(Schedule{
+		ScheduleID: "s4", DefinitionID: "Z", CronExpression: "0 * * * *", Timezone: "UTC",
+		ClusterName: "clusta", MissedPolicy: ScheduleMissedSkip}); err == nil {
+		t.Errorf("Expected schedule of a missing definition not to be created")
+	}
+
+	s, err := sm.GetSchedule("s1")
+	if err != nil {
+		t.Fatalf("Expected schedule s1, got %v", err)
+	}
+	if s.Enabled == nil || !*s.Enabled || s.CreatedAt == nil || !s.NextRunAt.Equal(tick) {
+		t.Errorf("Expected enabled schedule s1 as created, got %v", s)
+	}
+	if _, err = sm.GetSchedule("s9"); !isMissing(err) {
+		t.Errorf("Expected missing schedule to be a missing resource, got %v", err)
+	}
+
+	sl, err := sm.ListSchedules(10, 0, map[string][]string{"cluster_name": {"clustb"}})
+	if err != nil || sl.Total != 2 || len(sl.Schedules) != 2 {
+		t.Errorf("Expected the 2 schedules on clustb, got %v %v", sl, err)
+	}
+	if sl, _ = sm.ListSchedules(10, 0, map[string][]string{"enabled": {"false"}}); sl.Total != 1 {
+		t.Errorf("Expected 1 disabled schedule, got %v", sl)
+	}
+
+	due, err := sm.ListDueSchedules(tick, 10)
+	if err != nil || len(due) != 1 || due[0].ScheduleID != "s1" {
+		t.Errorf("Expected only enabled schedule s1 to be due, got %v %v", due, err)
+	}
+	if due, _ = sm.ListDueSchedules(later, 10); len(due) != 2 || due[0].ScheduleID != "s1" {
+		t.Errorf("Expected 2 due schedules, oldest tick first, got %v", due)
+	}
+
+	claimed, err := sm.ClaimScheduleTick("s1", tick, later)
+	if err != nil || !claimed {
+		t.Errorf("Expected tick of schedule s1 to be claimed, got %v %v", claimed, err)
+	}
+	if claimed, _ = sm.ClaimScheduleTick("s1", tick, later); claimed {
+		t.Errorf("Expected tick of schedule s1 to be claimed once")
+	}
+	if claimed, _ = sm.ClaimScheduleTick("s3", tick, later); claimed {
+		t.Errorf("Expected tick of disabled schedule not to be claimed")
+	}
+	if s, _ = sm.GetSchedule("s1"); !s.NextRunAt.Equal(later) || !s.LastRunAt.Equal(tick) {
+		t.Errorf("Expected claimed schedule to be advanced, got %v %v", s.NextRunAt, s.LastRunAt)
+	}
+
+	updated, err := sm.UpdateSchedule("s2", Schedule{DefinitionID: "B", Enabled: &disabled})
+	if err != nil || updated.DefinitionID != "B" || len(updated.Alias) != 0 || updated.IsEnabled() {
+		t.Errorf("Expected schedule s2 to be disabled and moved to definition B, got %v %v", updated, err)
+	}
+	if _, err = sm.UpdateSchedule("s9", Schedule{Timezone: "UTC"}); !isMissing(err) {
+		t.Errorf("Expected update of missing schedule to be a missing resource, got %v", err)
+	}
+
+	if err = sm.DeleteSchedule("s2"); err != nil {
+		t.Errorf("Expected schedule s2 to be deleted, got %v", err)
+	}
+	if _, err = sm.GetSchedule("s2"); !isMissing(err) {
+		t.Errorf("Expected deleted schedule to be missing, got %v", err)
+	}
+}
+
+func testConformanceWebhooks(t *testing.T, sm Manager) {
+	if err := sm.CreateWebhook(Webhook{
+		WebhookID: "w1", URL: "https://example.com/1", Statuses: &StatusList{StatusStopped}}); err != nil {
+		t.Fatalf("Expected webhook w1 to be created, got %v", err)
+	}
+	if err := sm.CreateWebhook(Webhook{WebhookID: "w2", URL: "https://example.com/2", GroupName: "groupZ"}); err != nil {
+		t.Fatalf("Expected webhook w2 to be created, got %v", err)
+	}
+
+	w, err := sm.GetWebhook("w1")
+	if err != nil || w.FailedOnly == nil || *w.FailedOnly || w.CreatedAt == nil || (*w.Statuses)[0] != StatusStopped {
+		t.Errorf("Expected webhook w1 as created, got %v %v", w, err)
+	}
+	if _, err = sm.GetWebhook("w9"); !isMissing(err) {
+		t.Errorf("Expected missing webhook to be a missing resource, got %v", err)
+	}
+
+	wl, err := sm.ListWebhooks(10, 0, map[string][]string{"group_name": {"Z"}})
+	if err != nil || wl.Total != 1 || wl.Webhooks[0].WebhookID != "w2" {
+		t.Errorf("Expected webhook w2 by group, got %v %v", wl, err)
+	}
+
+	failedOnly := true
+	updated, err := sm.UpdateWebhook("w1", Webhook{DefinitionID: "A", FailedOnly: &failedOnly})
+	if err != nil || updated.DefinitionID != "A" || !updated.IsFailedOnly() || updated.URL != "https://example.com/1" {
+		t.Errorf("Expected partial update of webhook w1, got %v %v", updated, err)
+	}
+	if _, err = sm.UpdateWebhook("w9", Webhook{URL: "https://example.com/9"}); !isMissing(err) {
+		t.Errorf("Expected update of missing webhook to be a missing resource, got %v", err)
+	}
+
+	for _, id := range []string{"d1", "d2"} {
+		if err = sm.CreateWebhookDelivery(WebhookDelivery{
+			DeliveryID: id, WebhookID: "w1", RunID: "run1", RunStatus: StatusStopped, Attempts: 1}); err != nil {
+			t.Fatalf("Expected delivery %s to be created, got %v", id, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err = sm.CreateWebhookDelivery(WebhookDelivery{
+		DeliveryID: "d3", WebhookID: "w9", RunID: "run1", RunStatus: StatusStopped}); err == nil {
+		t.Errorf("Expected delivery of a missing webhook not to be created")
+	}
+
+	deliveries, err := sm.ListWebhookDeliveries("w1", 1, 0)
+	if err != nil || deliveries.Total != 2 || deliveries.Deliveries[0].DeliveryID != "d2" {
+		t.Errorf("Expected newest of 2 deliveries, got %v %v", deliveries, err)
+	}
+
+	if err = sm.DeleteWebhook("w1"); err != nil {
+		t.Errorf("Expected webhook w1 to be deleted, got %v", err)
+	}
+	if deliveries, _ = sm.ListWebhookDeliveries("w1", 10, 0); deliveries.Total != 0 {
+		t.Errorf("Expected deliveries of deleted webhook to be deleted, got %v", deliveries)
+	}
+}
+
+func testConformanceTokens(t *testing.T, sm Manager) {
+	if err := sm.CreateToken(Token{
+		TokenID: "t1", Name: "ci", Principal: "ci-bot", Scopes: &ScopeList{ScopeRunsExecute}, Hash: "h1"}); err != nil {
+		t.Fatalf("Expected token t1 to be created, got %v", err)
+	}
+	if err := sm.CreateToken(Token{
+		TokenID: "t2", Name: "ci", Principal: "ci-bot", Scopes: &ScopeList{}, Hash: "h1"}); err == nil {
+		t.Errorf("Expected token with a taken hash not to be created")
+	}
+
+	tok, err := sm.GetTokenByHash("h1")
+	if err != nil || tok.TokenID != "t1" || tok.CreatedAt == nil || tok.RevokedAt != nil {
+		t.Errorf("Expected token t1 by hash, got %v %v", tok, err)
+	}
+	if _, err = sm.GetTokenByHash("h9"); !isMissing(err) {
+		t.Errorf("Expected missing hash to be a missing resource, got %v", err)
+	}
+
+	revoked, err := sm.RevokeToken("t1")
+	if err != nil || revoked.RevokedAt == nil {
+		t.Fatalf("Expected token t1 to be revoked, got %v %v", revoked, err)
+	}
+	time.Sleep(time.Millisecond)
+	if again, _ := sm.RevokeToken("t1"); again.RevokedAt == nil || !again.RevokedAt.Equal(*revoked.RevokedAt) {
+		t.Errorf("Expected revoking again to keep the first revocation, got %v", again.RevokedAt)
+	}
+	if _, err = sm.RevokeToken("t9"); !isMissing(err) {
+		t.Errorf("Expected revoking a missing token to be a missing resource, got %v", err)
+	}
+
+	tl, err := sm.ListTokens(10, 0, map[string][]string{"principal": {"ci-bot"}})
+	if err != nil || tl.Total != 1 || tl.Tokens[0].TokenID != "t1" {
+		t.Errorf("Expected token t1 by principal, got %v %v", tl, err)
+	}
+}
+
+func testConformanceRoleBindings(t *testing.T, sm Manager) {
+	first, err := sm.PutRoleBinding(RoleBinding{GroupName: "groupY", Principal: "bob", Role: RoleViewer})
+	if err != nil || first.CreatedAt == nil {
+		t.Fatalf("Expected role binding to be put, got %v %v", first, err)
+	}
+	sm.PutRoleBinding(RoleBinding{GroupName: "groupX", Principal: "carol", Role: RoleAdmin})
+	sm.PutRoleBinding(RoleBinding{GroupName: "groupY", Principal: "alice", Role: RoleEditor})
+
+	time.Sleep(time.Millisecond)
+	replaced, err := sm.PutRoleBinding(RoleBinding{GroupName: "groupY", Principal: "bob", Role: RoleRunner})
+	if err != nil || replaced.Role != RoleRunner || !replaced.CreatedAt.Equal(*first.CreatedAt) {
+		t.Errorf("Expected role to be replaced keeping when it was first granted, got %v %v", replaced, err)
+	}
+
+	bl, err := sm.ListRoleBindings(10, 0, nil)
+	if err != nil || bl.Total != 3 {
+		t.Fatalf("Expected 3 role bindings, got %v %v", bl, err)
+	}
+	var order []string
+	for _, b := range bl.RoleBindings {
+		order = append(order, b.GroupName+"/"+b.Principal)
+	}
+	if !sameStrings(order, []string{"groupX/carol", "groupY/alice", "groupY/bob"}) {
+		t.Errorf("Expected role bindings by group then principal, got %v", order)
+	}
+
+	if err = sm.DeleteRoleBinding("groupY", "bob"); err != nil {
+		t.Errorf("Expected role binding to be deleted, got %v", err)
+	}
+	if bl, _ = sm.ListRoleBindings(10, 0, map[string][]string{"principal": {"bob"}}); bl.Total != 0 {
+		t.Errorf("Expected deleted role binding to be gone, got %v", bl)
+	}
+}
+
+func testConformanceIdempotencyKeys(t *testing.T, sm Manager) {
+	k := IdempotencyKey{OwnerID: "o", Key: "k", RunID: "run1", RequestHash: "h", CreatedAt: conformanceStart}
+	if claim, claimed, err := sm.ClaimIdempotencyKey(k, conformanceStart.Add(-time.Hour)); err != nil || !claimed {
+		t.Fatalf("Expected key to be claimed, got %v %v %v", claim, claimed, err)
+	}
+
+	other := IdempotencyKey{
+		OwnerID: "o", Key: "k", RunID: "run2", RequestHash: "h2", CreatedAt: conformanceStart.Add(time.Minute)}
+	claim, claimed, err := sm.ClaimIdempotencyKey(other, conformanceStart.Add(-time.Hour))
+	if err != nil || claimed || claim.RunID != "run1" || claim.RequestHash != "h" {
+		t.Errorf("Expected the first claim to hold the key, got %v %v %v", claim, claimed, err)
+	}
+
+	// Claims made before since have expired
+	if _, claimed, _ = sm.ClaimIdempotencyKey(other, conformanceStart); !claimed {
+		t.Errorf("Expected an expired claim to be replaced")
+	}
+
+	sm.ReleaseIdempotencyKey("o", "k", "run1")
+	if claim, claimed, _ = sm.ClaimIdempotencyKey(k, conformanceStart.Add(-time.Hour)); claimed {
+		t.Errorf("Expected releasing another run's claim to change nothing, got %v", claim)
+	}
+	sm.ReleaseIdempotencyKey("o", "k", "run2")
+	if _, claimed, _ = sm.ClaimIdempotencyKey(k, conformanceStart.Add(-time.Hour)); !claimed {
+		t.Errorf("Expected a released key to be claimed")
+	}
+}
@@ -0,0 +1,206 @@
+package state
+
+import (
+	"github.com/pkg/errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// CronSchedule is a parsed five field cron expression
+// (minute, hour, day of month, month, day of week)
+// - each field is a bit set of the values it matches
+// - as with vixie cron, when both day of month and day of week
+//   are restricted a day matches if -either- matches
+//
+type CronSchedule struct {
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dowField = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+//
+// ParseCron parses a standard five field cron expression
+// - fields support `*`, values, ranges (`1-5`), steps (`*/15`, `0-30/5`),
+//   lists (`1,15`) and, for month and day of week, three letter names
+// - the macros @yearly, @annually, @monthly, @weekly, @daily, @midnight
+//   and @hourly are also accepted
+//
+func ParseCron(expr string) (CronSchedule, error) {
+	var (
+		cs  CronSchedule
+		err error
+	)
+
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = macro
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return cs, errors.Errorf("cron expression [%s] must have exactly 5 fields", expr)
+	}
+
+	if cs.minute, err = minuteField.parse(fields[0]); err != nil {
+		return cs, errors.Wrapf(err, "invalid minute field in cron expression [%s]", expr)
+	}
+	if cs.hour, err = hourField.parse(fields[1]); err != nil {
+		return cs, errors.Wrapf(err, "invalid hour field in cron expression [%s]", expr)
+	}
+	if cs.dom, err = domField.parse(fields[2]); err != nil {
+		return cs, errors.Wrapf(err, "invalid day of month field in cron expression [%s]", expr)
+	}
+	if cs.month, err = monthField.parse(fields[3]); err != nil {
+		return cs, errors.Wrapf(err, "invalid month field in cron expression [%s]", expr)
+	}
+	if cs.dow, err = dowField.parse(fields[4]); err != nil {
+		return cs, errors.Wrapf(err, "invalid day of week field in cron expression [%s]", expr)
+	}
+
+	// 7 is an alias for sunday
+	if cs.dow&(1<<7) != 0 {
+		cs.dow |= 1
+	}
+	cs.domStar = strings.HasPrefix(fields[2], "*")
+	cs.dowStar = strings.HasPrefix(fields[4], "*")
+	return cs, nil
+}
+
+func (f cronField) parse(field string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		lo, hi, step := f.min, f.max, 1
+
+		rangeAndStep := strings.SplitN(part, "/", 2)
+		if len(rangeAndStep) == 2 {
+			var err error
+			if step, err = strconv.Atoi(rangeAndStep[1]); err != nil || step <= 0 {
+				return 0, errors.Errorf("invalid step [%s]", rangeAndStep[1])
+			}
+		}
+
+		if rng := rangeAndStep[0]; rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = f.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if len(bounds) == 2 {
+				if hi, err = f.value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if len(rangeAndStep) == 1 {
+				hi = lo
+			}
+		}
+
+		if lo > hi {
+			return 0, errors.Errorf("invalid range [%s]", part)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("invalid value [%s]", s)
+	}
+	if v < f.min || v > f.max {
+		return 0, errors.Errorf("value [%d] out of range [%d-%d]", v, f.min, f.max)
+	}
+	return v, nil
+}
+
+//
+// Next returns the first time strictly after `after` that matches the
+// schedule, evaluated in the location of `after`. The zero time is
+// returned if nothing matches within five years (eg. "0 0 30 2 *")
+//
+func (cs CronSchedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + 5
+
+	for t.Year() <= limit {
+		if cs.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !cs.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if cs.hour&(1<<uint(t.Hour())) == 0 {
+			next := time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			if !next.After(t) {
+				// Daylight savings transitions can map the next
+				// wall clock hour back onto the current one
+				next = t.Truncate(time.Hour).Add(time.Hour)
+			}
+			t = next
+			continue
+		}
+
+		if cs.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+func (cs CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := cs.dom&(1<<uint(t.Day())) != 0
+	dowMatch := cs.dow&(1<<uint(t.Weekday())) != 0
+	if cs.domStar || cs.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
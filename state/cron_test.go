@@ -0,0 +1,91 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron_Invalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"* * * nope *",
+	}
+
+	for _, expr := range invalid {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("Expected error parsing [%s]", expr)
+		}
+	}
+}
+
+func TestCronSchedule_Next(t *testing.T) {
+	from := time.Date(2017, 7, 4, 10, 17, 30, 0, time.UTC) // a tuesday
+
+	cases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2017, 7, 4, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2017, 7, 4, 10, 30, 0, 0, time.UTC)},
+		{"0 9-17 * * *", time.Date(2017, 7, 4, 11, 0, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2017, 7, 5, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * mon-fri", time.Date(2017, 7, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2017, 7, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2017, 7, 9, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2017, 7, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 5", time.Date(2017, 7, 7, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2017, 8, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 2 * jan-mar,dec *", time.Date(2017, 12, 1, 2, 30, 0, 0, time.UTC)},
+	}
+
+	for _, c := range cases {
+		cs, err := ParseCron(c.expr)
+		if err != nil {
+			t.Errorf("Unexpected error parsing [%s]: %s", c.expr, err)
+			continue
+		}
+
+		if next := cs.Next(from); !next.Equal(c.expected) {
+			t.Errorf("Expected next tick of [%s] to be %v but was %v", c.expr, c.expected, next)
+		}
+	}
+
+	cs, _ := ParseCron("0 0 30 2 *")
+	if next := cs.Next(from); !next.IsZero() {
+		t.Errorf("Expected zero time for schedule that never matches, got %v", next)
+	}
+}
+
+func TestCronSchedule_NextInLocation(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone data unavailable")
+	}
+
+	cs, _ := ParseCron("0 9 * * *")
+
+	// 09:00 in New York is 13:00 UTC in summer
+	next := cs.Next(time.Date(2017, 7, 4, 12, 0, 0, 0, time.UTC).In(loc))
+	if expected := time.Date(2017, 7, 4, 13, 0, 0, 0, time.UTC); !next.Equal(expected) {
+		t.Errorf("Expected %v but was %v", expected, next)
+	}
+
+	// 02:30 does not exist on the day clocks spring forward
+	cs, _ = ParseCron("30 2 * * *")
+	next = cs.Next(time.Date(2017, 3, 12, 0, 0, 0, 0, loc))
+	if expected := time.Date(2017, 3, 13, 2, 30, 0, 0, loc); !next.Equal(expected) {
+		t.Errorf("Expected %v but was %v", expected, next)
+	}
+}
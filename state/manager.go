@@ -1,8 +1,10 @@
 package state
 
 import (
+	"database/sql"
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
+	"time"
 )
 
 //
@@ -20,9 +22,13 @@ type Manager interface {
 	GetDefinition(definitionID string) (Definition, error)
 	GetDefinitionByAlias(alias string) (Definition, error)
 	UpdateDefinition(definitionID string, updates Definition) (Definition, error)
+	ReplaceDefinition(definitionID string, d Definition) (Definition, error)
 	CreateDefinition(d Definition) error
 	DeleteDefinition(definitionID string) error
 
+	ListDefinitionRevisions(definitionID string, limit int, offset int) (DefinitionRevisionList, error)
+	GetDefinitionRevision(definitionID string, revision int64) (DefinitionRevision, error)
+
 	ListRuns(limit int, offset int, sortBy string,
 		order string, filters map[string][]string,
 		envFilters map[string]string) (RunList, error)
@@ -30,14 +36,102 @@ type Manager interface {
 	GetRun(runID string) (Run, error)
 	CreateRun(r Run) error
 	UpdateRun(runID string, updates Run) (Run, error)
+	ClaimRun(runID string) (bool, error)
+	ReleaseRun(runID string) (bool, error)
+	StopClaimedRun(runID string) (bool, error)
+
+	ListSchedules(limit int, offset int, filters map[string][]string) (ScheduleList, error)
+	GetSchedule(scheduleID string) (Schedule, error)
+	CreateSchedule(s Schedule) error
+	UpdateSchedule(scheduleID string, updates Schedule) (Schedule, error)
+	DeleteSchedule(scheduleID string) error
+	ListDueSchedules(now time.Time, limit int) ([]Schedule, error)
+	ClaimScheduleTick(scheduleID string, tick time.Time, next time.Time) (bool, error)
+
+	ListWebhooks(limit int, offset int, filters map[string][]string) (WebhookList, error)
+	GetWebhook(webhookID string) (Webhook, error)
+	CreateWebhook(w Webhook) error
+	UpdateWebhook(webhookID string, updates Webhook) (Webhook, error)
+	DeleteWebhook(webhookID string) error
+	ListWebhookDeliveries(webhookID string, limit int, offset int) (WebhookDeliveryList, error)
+	CreateWebhookDelivery(d WebhookDelivery) error
+
+	ListTokens(limit int, offset int, filters map[string][]string) (TokenList, error)
+	GetToken(tokenID string) (Token, error)
+	GetTokenByHash(hash string) (Token, error)
+	CreateToken(t Token) error
+	RevokeToken(tokenID string) (Token, error)
+
+	ListRoleBindings(limit int, offset int, filters map[string][]string) (RoleBindingList, error)
+	PutRoleBinding(b RoleBinding) (RoleBinding, error)
+	DeleteRoleBinding(groupName string, principal string) error
+
+	ClaimIdempotencyKey(k IdempotencyKey, since time.Time) (IdempotencyKey, bool, error)
+	ReleaseIdempotencyKey(ownerID string, key string, runID string) error
 
 	ListGroups(limit int, offset int, name *string) (GroupsList, error)
 	ListTags(limit int, offset int, name *string) (TagsList, error)
 }
 
+//
+// TxRunCreator is implemented by state managers that can perform
+// additional work, such as queueing, in the same transaction that
+// creates a run; if within returns an error the run is not created
+//
+type TxRunCreator interface {
+	CreateRunWithin(r Run, within func(tx *sql.Tx) error) error
+}
+
+//
+// Leaser is implemented by state managers that can elect one of several
+// flotilla replicas to do something, by giving it a lease on a name
+// * AcquireLease does not wait; it returns a nil Lease if another
+//   replica holds the lease
+// * leases end when released, or when their holder dies
+//
+type Leaser interface {
+	AcquireLease(name string) (Lease, error)
+}
+
+//
+// Lease is held by the one replica it was acquired by
+// * Check returns an error once the lease has been lost
+//
+type Lease interface {
+	Check() error
+	Release() error
+}
+
+//
+// RunWatcher is implemented by state managers that can tell every flotilla
+// replica when a run changes status, so that waiting on a run does not
+// mean polling for it
+// * NotifyStatusChange is called by whoever changed the run's status
+// * the channel of WatchRun receives whenever the run may have changed
+//   status, until stop is called; it is not a record of every change,
+//   the run is to be read again
+//
+type RunWatcher interface {
+	NotifyStatusChange(run Run) error
+	WatchRun(runID string) (changed <-chan struct{}, stop func(), err error)
+}
+
+//
+// NotifyStatusChange tells those watching the run that its status changed,
+// if the state manager can
+//
+func NotifyStatusChange(sm Manager, run Run) error {
+	if watcher, ok := sm.(RunWatcher); ok {
+		return watcher.NotifyStatusChange(run)
+	}
+	return nil
+}
+
 //
 // NewStateManager sets up and configures a new statemanager
 // - if no `state_manager` is configured, will use postgres
+// - the memory state manager keeps state for the life of the process
+// - the sqlite state manager keeps state in the `database_url` file
 //
 func NewStateManager(conf config.Config) (Manager, error) {
 	name := "postgres"
@@ -53,6 +147,20 @@ func NewStateManager(conf config.Config) (Manager, error) {
 			return nil, errors.Wrap(err, "problem initializing SQLStateManager")
 		}
 		return pgm, nil
+	case "memory":
+		msm := &MemoryStateManager{}
+		err := msm.Initialize(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem initializing MemoryStateManager")
+		}
+		return msm, nil
+	case "sqlite":
+		ssm := &SQLiteStateManager{}
+		err := ssm.Initialize(conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "problem initializing SQLiteStateManager")
+		}
+		return ssm, nil
 	default:
 		return nil, errors.Errorf("state.Manager named [%s] not found", name)
 	}
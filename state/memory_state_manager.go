@@ -0,0 +1,1702 @@
+package state
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// MemoryStateManager keeps state in memory, for tests and for running
+// flotilla as a single process without a database; state is lost when
+// the process exits
+// * it behaves as SQLStateManager does, down to how lists are filtered,
+//   sorted and paged and which fields are kept
+// * strings are compared byte by byte, where postgres may use the
+//   collation of the database
+//
+type MemoryStateManager struct {
+	mu              sync.RWMutex
+	definitions     map[string]Definition
+	revisions       map[string][]DefinitionRevision
+	tags            map[string]bool
+	runs            map[string]Run
+	schedules       map[string]Schedule
+	webhooks        map[string]Webhook
+	deliveries      map[string]WebhookDelivery
+	tokens          map[string]Token
+	roleBindings    map[[2]string]RoleBinding
+	idempotencyKeys map[[2]string]IdempotencyKey
+
+	watchMu  sync.Mutex
+	watching map[string]map[chan struct{}]bool
+}
+
+//
+// Name is the name of the state manager - matches value in configuration
+//
+func (sm *MemoryStateManager) Name() string {
+	return "memory"
+}
+
+//
+// Initialize starts from empty state
+//
+func (sm *MemoryStateManager) Initialize(conf config.Config) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.definitions = make(map[string]Definition)
+	sm.revisions = make(map[string][]DefinitionRevision)
+	sm.tags = make(map[string]bool)
+	sm.runs = make(map[string]Run)
+	sm.schedules = make(map[string]Schedule)
+	sm.webhooks = make(map[string]Webhook)
+	sm.deliveries = make(map[string]WebhookDelivery)
+	sm.tokens = make(map[string]Token)
+	sm.roleBindings = make(map[[2]string]RoleBinding)
+	sm.idempotencyKeys = make(map[[2]string]IdempotencyKey)
+
+	sm.watchMu.Lock()
+	sm.watching = make(map[string]map[chan struct{}]bool)
+	sm.watchMu.Unlock()
+	return nil
+}
+
+//
+// Cleanup has nothing to close
+//
+func (sm *MemoryStateManager) Cleanup() error {
+	return nil
+}
+
+//
+// ListDefinitions returns a DefinitionList
+// limit: limit the result to this many definitions
+// offset: start the results at this offset
+// sortBy: sort by this field
+// order: 'asc' or 'desc'
+// filters: map of field filters on Definition - joined with AND
+// envFilters: map of environment variable filters - joined with AND
+//
+func (sm *MemoryStateManager) ListDefinitions(
+	limit int, offset int, sortBy string,
+	order string, filters map[string][]string,
+	envFilters map[string]string) (DefinitionList, error) {
+
+	var result DefinitionList
+	ordering, err := memoryOrderBy(&Definition{}, sortBy, order)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.definitions))
+	for id, d := range sm.definitions {
+		rows = append(rows, memoryRow{key: id, columns: definitionColumns(d), env: d.Env, value: d})
+	}
+
+	rows, result.Total, err = selectRows(rows, filters, envFilters, limit, offset, ordering)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list definitions")
+	}
+	for _, row := range rows {
+		result.Definitions = append(result.Definitions, copyDefinition(row.value.(Definition)))
+	}
+	return result, nil
+}
+
+//
+// GetDefinition returns a single definition by id
+//
+func (sm *MemoryStateManager) GetDefinition(definitionID string) (Definition, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	d, ok := sm.definitions[definitionID]
+	if !ok {
+		return Definition{}, exceptions.MissingResource{
+			fmt.Sprintf("Definition with ID %s not found", definitionID)}
+	}
+	return copyDefinition(d), nil
+}
+
+//
+// GetDefinitionByAlias returns a single definition by alias
+//
+func (sm *MemoryStateManager) GetDefinitionByAlias(alias string) (Definition, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	for _, d := range sm.definitions {
+		if d.Alias == alias {
+			return copyDefinition(d), nil
+		}
+	}
+	return Definition{}, exceptions.MissingResource{
+		fmt.Sprintf("Definition with alias %s not found", alias)}
+}
+
+//
+// UpdateDefinition updates a definition
+// - updates can be partial
+//
+func (sm *MemoryStateManager) UpdateDefinition(definitionID string, updates Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.UpdateWith(updates)
+	})
+}
+
+//
+// ReplaceDefinition stores d as the definition's new revision, keeping
+// only its identity; see Definition.Restore
+//
+func (sm *MemoryStateManager) ReplaceDefinition(definitionID string, d Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.Restore(copyDefinition(d))
+	})
+}
+
+//
+// updateDefinition stores the definition, as changed by apply, as its new revision
+//
+func (sm *MemoryStateManager) updateDefinition(definitionID string, apply func(existing *Definition)) (Definition, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stored, ok := sm.definitions[definitionID]
+	if !ok {
+		return Definition{}, errors.WithStack(exceptions.MissingResource{
+			fmt.Sprintf("Definition with ID %s not found", definitionID)})
+	}
+
+	existing := copyDefinition(stored)
+	previous := copyDefinition(stored)
+	apply(&existing)
+
+	if other, taken := sm.aliasTaken(existing.Alias, definitionID); taken {
+		return existing, errors.Errorf(
+			"issue updating definition [%s]: alias [%s] is taken by definition [%s]",
+			definitionID, existing.Alias, other)
+	}
+	if err := checkPorts(existing); err != nil {
+		return existing, errors.Wrapf(err, "issue updating definition [%s]", definitionID)
+	}
+
+	//
+	// Definitions created before revisions were recorded have no history;
+	// keep their pre-update state as the first revision
+	//
+	latest := int64(len(sm.revisions[definitionID]))
+	if latest == 0 {
+		previous.Revision = 1
+		sm.addRevision(definitionID, previous)
+		latest = previous.Revision
+	}
+	existing.Revision = latest + 1
+
+	sm.definitions[definitionID] = sm.storedDefinition(definitionID, existing)
+	sm.addRevision(definitionID, existing)
+	return existing, nil
+}
+
+//
+// CreateDefinition creates the passed in definition object
+// - error if definition already exists
+//
+func (sm *MemoryStateManager) CreateDefinition(d Definition) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	// New definitions always start at their first revision
+	d.Revision = 1
+
+	if _, exists := sm.definitions[d.DefinitionID]; exists {
+		return errors.Errorf(
+			"issue creating new task definition with alias [%s] and id [%s]: id is taken", d.Alias, d.DefinitionID)
+	}
+	if other, taken := sm.aliasTaken(d.Alias, d.DefinitionID); taken {
+		return errors.Errorf(
+			"issue creating new task definition with alias [%s] and id [%s]: alias is taken by definition [%s]",
+			d.Alias, d.DefinitionID, other)
+	}
+	if err := checkPorts(d); err != nil {
+		return errors.Wrapf(
+			err, "issue creating new task definition with alias [%s] and id [%s]", d.Alias, d.DefinitionID)
+	}
+
+	sm.definitions[d.DefinitionID] = sm.storedDefinition(d.DefinitionID, d)
+	sm.addRevision(d.DefinitionID, d)
+	return nil
+}
+
+func (sm *MemoryStateManager) aliasTaken(alias string, definitionID string) (string, bool) {
+	for id, d := range sm.definitions {
+		if id != definitionID && d.Alias == alias {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func checkPorts(d Definition) error {
+	if d.Ports == nil {
+		return nil
+	}
+	seen := make(map[int]bool)
+	for _, p := range *d.Ports {
+		if seen[p] {
+			return errors.Errorf("port [%d] is repeated", p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+//
+// storedDefinition is the definition as it is read back; its tags are
+// recorded, and empty ports and tags are not kept
+//
+func (sm *MemoryStateManager) storedDefinition(definitionID string, d Definition) Definition {
+	stored := copyDefinition(d)
+	stored.DefinitionID = definitionID
+	stored.TaskType = ""
+	if stored.Ports != nil && len(*stored.Ports) == 0 {
+		stored.Ports = nil
+	}
+	if stored.Tags != nil {
+		for _, t := range *stored.Tags {
+			sm.tags[t] = true
+		}
+		if len(*stored.Tags) == 0 {
+			stored.Tags = nil
+		}
+	}
+	return stored
+}
+
+func (sm *MemoryStateManager) addRevision(definitionID string, d Definition) {
+	now := copyTime(timePtr(time.Now()))
+	dr := DefinitionRevision{Definition: copyDefinition(d), CreatedAt: now}
+	dr.TaskType = ""
+	sm.revisions[definitionID] = append(sm.revisions[definitionID], dr)
+}
+
+//
+// ListDefinitionRevisions returns the revisions of a definition, newest first
+//
+func (sm *MemoryStateManager) ListDefinitionRevisions(
+	definitionID string, limit int, offset int) (DefinitionRevisionList, error) {
+	var result DefinitionRevisionList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	revisions := sm.revisions[definitionID]
+	start, end, err := pageBounds(len(revisions), limit, offset)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing revisions of definition [%s]", definitionID)
+	}
+	for i := start; i < end; i++ {
+		result.Revisions = append(result.Revisions, copyRevision(revisions[len(revisions)-1-i]))
+	}
+	result.Total = len(revisions)
+	return result, nil
+}
+
+//
+// GetDefinitionRevision returns a single revision of a definition
+//
+func (sm *MemoryStateManager) GetDefinitionRevision(definitionID string, revision int64) (DefinitionRevision, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	for _, dr := range sm.revisions[definitionID] {
+		if dr.Revision == revision {
+			return copyRevision(dr), nil
+		}
+	}
+	return DefinitionRevision{}, exceptions.MissingResource{
+		fmt.Sprintf("Revision %d of definition with ID %s not found", revision, definitionID)}
+}
+
+//
+// DeleteDefinition deletes definition and associated runs and environment variables
+//
+func (sm *MemoryStateManager) DeleteDefinition(definitionID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.revisions, definitionID)
+	for id, s := range sm.schedules {
+		if s.DefinitionID == definitionID {
+			delete(sm.schedules, id)
+		}
+	}
+	for id, r := range sm.runs {
+		if r.DefinitionID == definitionID {
+			delete(sm.runs, id)
+		}
+	}
+	delete(sm.definitions, definitionID)
+	return nil
+}
+
+//
+// ListRuns returns a RunList
+// limit: limit the result to this many runs
+// offset: start the results at this offset
+// sortBy: sort by this field
+// order: 'asc' or 'desc'
+// filters: map of field filters on Run - joined with AND
+// envFilters: map of environment variable filters - joined with AND
+//
+func (sm *MemoryStateManager) ListRuns(
+	limit int, offset int, sortBy string,
+	order string, filters map[string][]string,
+	envFilters map[string]string) (RunList, error) {
+
+	var result RunList
+	ordering, err := memoryOrderBy(&Run{}, sortBy, order)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.runs))
+	for id, r := range sm.runs {
+		rows = append(rows, memoryRow{key: id, columns: runColumns(r), env: r.Env, value: r})
+	}
+
+	rows, result.Total, err = selectRows(rows, filters, envFilters, limit, offset, ordering)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list runs")
+	}
+	for _, row := range rows {
+		result.Runs = append(result.Runs, copyRun(row.value.(Run)))
+	}
+	return result, nil
+}
+
+//
+// GetRun gets run by id
+//
+func (sm *MemoryStateManager) GetRun(runID string) (Run, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	r, ok := sm.runs[runID]
+	if !ok {
+		return Run{}, exceptions.MissingResource{
+			fmt.Sprintf("Run with id %s not found", runID)}
+	}
+	return copyRun(r), nil
+}
+
+//
+// UpdateRun updates run with updates - can be partial; updating a run
+// that does not exist changes nothing
+//
+func (sm *MemoryStateManager) UpdateRun(runID string, updates Run) (Run, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stored, ok := sm.runs[runID]
+	existing := copyRun(stored)
+	existing.UpdateWith(updates)
+	if !ok {
+		return existing, nil
+	}
+
+	if _, exists := sm.definitions[existing.DefinitionID]; !exists {
+		return existing, errors.Errorf(
+			"issue updating run [%s]: definition [%s] does not exist", runID, existing.DefinitionID)
+	}
+
+	// The run's user and task type are only set when it is created
+	updated := copyRun(existing)
+	updated.RunID = runID
+	updated.User = stored.User
+	updated.TaskType = stored.TaskType
+	sm.runs[runID] = updated
+	return existing, nil
+}
+
+//
+// ClaimRun atomically moves the run from QUEUED to PENDING and records
+// when in its ClaimedAt, returning false if it was not QUEUED (eg. another
+// worker claimed it from a duplicate message); a run is only submitted by
+// whoever claimed it
+//
+func (sm *MemoryStateManager) ClaimRun(runID string) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	r, ok := sm.runs[runID]
+	if !ok || r.Status != StatusQueued {
+		return false, nil
+	}
+	now := time.Now()
+	r.Status = StatusPending
+	r.ClaimedAt = &now
+	sm.runs[runID] = r
+	return true, nil
+}
+
+//
+// ReleaseRun atomically moves a claimed run, one that is PENDING without
+// a task, back to QUEUED, eg. when it could not be submitted yet; returns
+// false if it was not such a run
+//
+func (sm *MemoryStateManager) ReleaseRun(runID string) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	r, ok := sm.runs[runID]
+	if !ok || r.Status != StatusPending || len(r.TaskArn) > 0 {
+		return false, nil
+	}
+	r.Status = StatusQueued
+	sm.runs[runID] = r
+	return true, nil
+}
+
+//
+// StopClaimedRun atomically moves a claimed run, one that is PENDING
+// without a task, to STOPPED, eg. when it is terminated while being
+// submitted; returns false if it was not such a run
+//
+func (sm *MemoryStateManager) StopClaimedRun(runID string) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	r, ok := sm.runs[runID]
+	if !ok || r.Status != StatusPending || len(r.TaskArn) > 0 {
+		return false, nil
+	}
+	r.Status = StatusStopped
+	sm.runs[runID] = r
+	return true, nil
+}
+
+//
+// CreateRun creates the passed in run
+//
+func (sm *MemoryStateManager) CreateRun(r Run) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.runs[r.RunID]; exists {
+		return errors.Errorf("issue creating new task run with id [%s]: id is taken", r.RunID)
+	}
+	if _, exists := sm.definitions[r.DefinitionID]; !exists {
+		return errors.Errorf(
+			"issue creating new task run with id [%s]: definition [%s] does not exist", r.RunID, r.DefinitionID)
+	}
+
+	stored := copyRun(r)
+	stored.User = ""
+	stored.TaskType = "task"
+	sm.runs[r.RunID] = stored
+	return nil
+}
+
+//
+// ListGroups returns the groups of definitions, by name
+//
+func (sm *MemoryStateManager) ListGroups(limit int, offset int, name *string) (GroupsList, error) {
+	var result GroupsList
+
+	sm.mu.RLock()
+	groups := make(map[string]bool)
+	for _, d := range sm.definitions {
+		groups[d.GroupName] = true
+	}
+	sm.mu.RUnlock()
+
+	var err error
+	result.Groups, result.Total, err = selectNames(groups, "group_name", name, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list groups")
+	}
+	return result, nil
+}
+
+//
+// ListTags returns the tags definitions were ever given, by name
+//
+func (sm *MemoryStateManager) ListTags(limit int, offset int, name *string) (TagsList, error) {
+	var result TagsList
+
+	sm.mu.RLock()
+	tags := make(map[string]bool)
+	for t := range sm.tags {
+		tags[t] = true
+	}
+	sm.mu.RUnlock()
+
+	var err error
+	result.Tags, result.Total, err = selectNames(tags, "text", name, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list tags")
+	}
+	return result, nil
+}
+
+func selectNames(names map[string]bool, column string, name *string, limit int, offset int) ([]string, int, error) {
+	var filters map[string][]string
+	if name != nil && len(*name) > 0 {
+		filters = map[string][]string{column: {*name}}
+	}
+
+	rows := make([]memoryRow, 0, len(names))
+	for n := range names {
+		rows = append(rows, memoryRow{key: n, columns: map[string]interface{}{column: n}})
+	}
+
+	rows, total, err := selectRows(rows, filters, nil, limit, offset, []memoryOrder{{field: column}})
+	if err != nil {
+		return nil, total, err
+	}
+
+	var selected []string
+	for _, row := range rows {
+		selected = append(selected, row.key)
+	}
+	return selected, total, nil
+}
+
+//
+// ListSchedules returns a ScheduleList, oldest first
+// limit: limit the result to this many schedules
+// offset: start the results at this offset
+// filters: map of field filters on Schedule - joined with AND
+//
+func (sm *MemoryStateManager) ListSchedules(
+	limit int, offset int, filters map[string][]string) (ScheduleList, error) {
+
+	var result ScheduleList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.schedules))
+	for id, s := range sm.schedules {
+		rows = append(rows, memoryRow{key: id, columns: scheduleColumns(s), value: s})
+	}
+
+	rows, total, err := selectRows(rows, filters, nil, limit, offset, []memoryOrder{{field: "created_at"}})
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list schedules")
+	}
+	result.Total = total
+	for _, row := range rows {
+		result.Schedules = append(result.Schedules, copySchedule(row.value.(Schedule)))
+	}
+	return result, nil
+}
+
+//
+// GetSchedule returns a single schedule by id
+//
+func (sm *MemoryStateManager) GetSchedule(scheduleID string) (Schedule, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	s, ok := sm.schedules[scheduleID]
+	if !ok {
+		return s, exceptions.MissingResource{
+			fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+	}
+	return copySchedule(s), nil
+}
+
+//
+// CreateSchedule creates the passed in schedule
+//
+func (sm *MemoryStateManager) CreateSchedule(s Schedule) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.schedules[s.ScheduleID]; exists {
+		return errors.Errorf("issue creating new schedule with id [%s]: id is taken", s.ScheduleID)
+	}
+	if err := sm.checkScheduleDefinition(s); err != nil {
+		return errors.Wrapf(err, "issue creating new schedule with id [%s]", s.ScheduleID)
+	}
+
+	stored := copySchedule(s)
+	stored.Enabled = boolPtr(s.IsEnabled())
+	stored.CreatedAt = copyTime(timePtr(time.Now()))
+	sm.schedules[s.ScheduleID] = stored
+	return nil
+}
+
+func (sm *MemoryStateManager) checkScheduleDefinition(s Schedule) error {
+	if len(s.DefinitionID) == 0 {
+		return nil
+	}
+	if _, exists := sm.definitions[s.DefinitionID]; !exists {
+		return errors.Errorf("definition [%s] does not exist", s.DefinitionID)
+	}
+	return nil
+}
+
+//
+// UpdateSchedule updates schedule with updates - can be partial
+//
+func (sm *MemoryStateManager) UpdateSchedule(scheduleID string, updates Schedule) (Schedule, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stored, ok := sm.schedules[scheduleID]
+	if !ok {
+		return Schedule{}, exceptions.MissingResource{
+			fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+	}
+
+	existing := copySchedule(stored)
+	existing.UpdateWith(updates)
+	if err := sm.checkScheduleDefinition(existing); err != nil {
+		return existing, errors.Wrapf(err, "issue updating schedule with id [%s]", scheduleID)
+	}
+
+	updated := copySchedule(existing)
+	updated.ScheduleID = scheduleID
+	updated.Enabled = boolPtr(existing.IsEnabled())
+	sm.schedules[scheduleID] = updated
+	return existing, nil
+}
+
+//
+// DeleteSchedule deletes a schedule; runs it created are kept
+//
+func (sm *MemoryStateManager) DeleteSchedule(scheduleID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.schedules, scheduleID)
+	return nil
+}
+
+//
+// ListDueSchedules returns -at most- limit enabled schedules
+// whose next tick is at or before now, oldest tick first
+//
+func (sm *MemoryStateManager) ListDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	var due []Schedule
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := []memoryRow{}
+	for id, s := range sm.schedules {
+		if s.IsEnabled() && s.NextRunAt != nil && !s.NextRunAt.After(now) {
+			rows = append(rows, memoryRow{key: id, columns: scheduleColumns(s), value: s})
+		}
+	}
+
+	rows, _, err := selectRows(rows, nil, nil, limit, 0, []memoryOrder{{field: "next_run_at"}})
+	if err != nil {
+		return due, errors.Wrap(err, "issue running list due schedules")
+	}
+	for _, row := range rows {
+		due = append(due, copySchedule(row.value.(Schedule)))
+	}
+	return due, nil
+}
+
+//
+// ClaimScheduleTick atomically advances the schedule from tick to next,
+// returning false if tick was already claimed (eg. by another worker)
+// or the schedule was changed or disabled in the meantime
+//
+func (sm *MemoryStateManager) ClaimScheduleTick(scheduleID string, tick time.Time, next time.Time) (bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	s, ok := sm.schedules[scheduleID]
+	if !ok || !s.IsEnabled() || s.NextRunAt == nil || !s.NextRunAt.Equal(*copyTime(&tick)) {
+		return false, nil
+	}
+	s.NextRunAt = copyTime(&next)
+	s.LastRunAt = copyTime(&tick)
+	sm.schedules[scheduleID] = s
+	return true, nil
+}
+
+//
+// ListWebhooks returns a WebhookList, oldest first
+// limit: limit the result to this many webhooks
+// offset: start the results at this offset
+// filters: map of field filters on Webhook - joined with AND
+//
+func (sm *MemoryStateManager) ListWebhooks(
+	limit int, offset int, filters map[string][]string) (WebhookList, error) {
+
+	var result WebhookList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.webhooks))
+	for id, w := range sm.webhooks {
+		rows = append(rows, memoryRow{key: id, columns: webhookColumns(w), value: w})
+	}
+
+	rows, total, err := selectRows(rows, filters, nil, limit, offset, []memoryOrder{{field: "created_at"}})
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list webhooks")
+	}
+	result.Total = total
+	for _, row := range rows {
+		result.Webhooks = append(result.Webhooks, copyWebhook(row.value.(Webhook)))
+	}
+	return result, nil
+}
+
+//
+// GetWebhook returns a single webhook by id
+//
+func (sm *MemoryStateManager) GetWebhook(webhookID string) (Webhook, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	w, ok := sm.webhooks[webhookID]
+	if !ok {
+		return w, exceptions.MissingResource{
+			fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+	}
+	return copyWebhook(w), nil
+}
+
+//
+// CreateWebhook creates the passed in webhook
+//
+func (sm *MemoryStateManager) CreateWebhook(w Webhook) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.webhooks[w.WebhookID]; exists {
+		return errors.Errorf("issue creating new webhook with id [%s]: id is taken", w.WebhookID)
+	}
+
+	stored := copyWebhook(w)
+	stored.FailedOnly = boolPtr(w.IsFailedOnly())
+	stored.CreatedAt = copyTime(timePtr(time.Now()))
+	sm.webhooks[w.WebhookID] = stored
+	return nil
+}
+
+//
+// UpdateWebhook updates webhook with updates - can be partial
+//
+func (sm *MemoryStateManager) UpdateWebhook(webhookID string, updates Webhook) (Webhook, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	stored, ok := sm.webhooks[webhookID]
+	if !ok {
+		return Webhook{}, exceptions.MissingResource{
+			fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+	}
+
+	existing := copyWebhook(stored)
+	existing.UpdateWith(updates)
+
+	updated := copyWebhook(existing)
+	updated.WebhookID = webhookID
+	updated.FailedOnly = boolPtr(existing.IsFailedOnly())
+	sm.webhooks[webhookID] = updated
+	return existing, nil
+}
+
+//
+// DeleteWebhook deletes a webhook along with its deliveries
+//
+func (sm *MemoryStateManager) DeleteWebhook(webhookID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	for id, d := range sm.deliveries {
+		if d.WebhookID == webhookID {
+			delete(sm.deliveries, id)
+		}
+	}
+	delete(sm.webhooks, webhookID)
+	return nil
+}
+
+//
+// ListWebhookDeliveries returns the deliveries of a webhook, newest first
+//
+func (sm *MemoryStateManager) ListWebhookDeliveries(
+	webhookID string, limit int, offset int) (WebhookDeliveryList, error) {
+
+	var result WebhookDeliveryList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := []memoryRow{}
+	for id, d := range sm.deliveries {
+		if d.WebhookID == webhookID {
+			rows = append(rows, memoryRow{
+				key: id, columns: map[string]interface{}{"created_at": timeColumn(d.CreatedAt)}, value: d})
+		}
+	}
+
+	rows, total, err := selectRows(rows, nil, nil, limit, offset, []memoryOrder{{field: "created_at", desc: true}})
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing deliveries of webhook with id [%s]", webhookID)
+	}
+	result.Total = total
+	for _, row := range rows {
+		d := row.value.(WebhookDelivery)
+		d.CreatedAt = copyTime(d.CreatedAt)
+		result.Deliveries = append(result.Deliveries, d)
+	}
+	return result, nil
+}
+
+//
+// CreateWebhookDelivery records the passed in delivery
+//
+func (sm *MemoryStateManager) CreateWebhookDelivery(d WebhookDelivery) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.deliveries[d.DeliveryID]; exists {
+		return errors.Errorf("issue creating webhook delivery with id [%s]: id is taken", d.DeliveryID)
+	}
+	if _, exists := sm.webhooks[d.WebhookID]; !exists {
+		return errors.Errorf(
+			"issue creating webhook delivery with id [%s]: webhook [%s] does not exist", d.DeliveryID, d.WebhookID)
+	}
+
+	d.CreatedAt = copyTime(timePtr(time.Now()))
+	sm.deliveries[d.DeliveryID] = d
+	return nil
+}
+
+//
+// ListTokens returns a TokenList, oldest first
+// limit: limit the result to this many tokens
+// offset: start the results at this offset
+// filters: map of field filters on Token - joined with AND
+//
+func (sm *MemoryStateManager) ListTokens(
+	limit int, offset int, filters map[string][]string) (TokenList, error) {
+
+	var result TokenList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.tokens))
+	for id, t := range sm.tokens {
+		rows = append(rows, memoryRow{key: id, columns: tokenColumns(t), value: t})
+	}
+
+	rows, total, err := selectRows(rows, filters, nil, limit, offset, []memoryOrder{{field: "created_at"}})
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list tokens")
+	}
+	result.Total = total
+	for _, row := range rows {
+		result.Tokens = append(result.Tokens, copyToken(row.value.(Token)))
+	}
+	return result, nil
+}
+
+//
+// GetToken returns a single api token by id
+//
+func (sm *MemoryStateManager) GetToken(tokenID string) (Token, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	t, ok := sm.tokens[tokenID]
+	if !ok {
+		return t, exceptions.MissingResource{
+			fmt.Sprintf("Token with ID %s not found", tokenID)}
+	}
+	return copyToken(t), nil
+}
+
+//
+// GetTokenByHash returns the api token with the given hash
+//
+func (sm *MemoryStateManager) GetTokenByHash(hash string) (Token, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	for _, t := range sm.tokens {
+		if t.Hash == hash {
+			return copyToken(t), nil
+		}
+	}
+	return Token{}, exceptions.MissingResource{"Token not found"}
+}
+
+//
+// CreateToken creates the passed in api token
+//
+func (sm *MemoryStateManager) CreateToken(t Token) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if _, exists := sm.tokens[t.TokenID]; exists {
+		return errors.Errorf("issue creating new token with id [%s]: id is taken", t.TokenID)
+	}
+	if t.Scopes == nil {
+		return errors.Errorf("issue creating new token with id [%s]: scopes are required", t.TokenID)
+	}
+	for _, other := range sm.tokens {
+		if other.Hash == t.Hash {
+			return errors.Errorf("issue creating new token with id [%s]: hash is taken", t.TokenID)
+		}
+	}
+
+	stored := copyToken(t)
+	stored.CreatedAt = copyTime(timePtr(time.Now()))
+	stored.RevokedAt = nil
+	sm.tokens[t.TokenID] = stored
+	return nil
+}
+
+//
+// RevokeToken revokes an api token; revoking a revoked token keeps
+// the time it was first revoked
+//
+func (sm *MemoryStateManager) RevokeToken(tokenID string) (Token, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	t, ok := sm.tokens[tokenID]
+	if !ok {
+		return Token{}, exceptions.MissingResource{
+			fmt.Sprintf("Token with ID %s not found", tokenID)}
+	}
+	if t.RevokedAt == nil {
+		t.RevokedAt = copyTime(timePtr(time.Now()))
+		sm.tokens[tokenID] = t
+	}
+	return copyToken(t), nil
+}
+
+//
+// ListRoleBindings returns a RoleBindingList, by group then principal
+// limit: limit the result to this many role bindings
+// offset: start the results at this offset
+// filters: map of field filters on RoleBinding - joined with AND
+//
+func (sm *MemoryStateManager) ListRoleBindings(
+	limit int, offset int, filters map[string][]string) (RoleBindingList, error) {
+
+	var result RoleBindingList
+
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	rows := make([]memoryRow, 0, len(sm.roleBindings))
+	for _, b := range sm.roleBindings {
+		rows = append(rows, memoryRow{
+			key: b.GroupName + "/" + b.Principal, columns: roleBindingColumns(b), value: b})
+	}
+
+	rows, total, err := selectRows(rows, filters, nil, limit, offset,
+		[]memoryOrder{{field: "group_name"}, {field: "principal"}})
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list role bindings")
+	}
+	result.Total = total
+	for _, row := range rows {
+		b := row.value.(RoleBinding)
+		b.CreatedAt = copyTime(b.CreatedAt)
+		result.RoleBindings = append(result.RoleBindings, b)
+	}
+	return result, nil
+}
+
+//
+// PutRoleBinding grants the role binding's principal its role in its
+// group, replacing any role they had there
+//
+func (sm *MemoryStateManager) PutRoleBinding(b RoleBinding) (RoleBinding, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	key := [2]string{b.GroupName, b.Principal}
+	if existing, ok := sm.roleBindings[key]; ok {
+		b.CreatedAt = existing.CreatedAt
+	} else {
+		b.CreatedAt = copyTime(timePtr(time.Now()))
+	}
+	sm.roleBindings[key] = b
+
+	b.CreatedAt = copyTime(b.CreatedAt)
+	return b, nil
+}
+
+//
+// DeleteRoleBinding revokes the principal's role in the group
+//
+func (sm *MemoryStateManager) DeleteRoleBinding(groupName string, principal string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	delete(sm.roleBindings, [2]string{groupName, principal})
+	return nil
+}
+
+//
+// ClaimIdempotencyKey atomically claims the owner's idempotency key for
+// k's run, unless it was claimed after since; returns the claim that
+// holds the key, and whether it is k
+//
+func (sm *MemoryStateManager) ClaimIdempotencyKey(k IdempotencyKey, since time.Time) (IdempotencyKey, bool, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	key := [2]string{k.OwnerID, k.Key}
+	if existing, ok := sm.idempotencyKeys[key]; ok && existing.CreatedAt.After(since) {
+		return existing, false, nil
+	}
+
+	stored := k
+	stored.CreatedAt = *copyTime(&k.CreatedAt)
+	sm.idempotencyKeys[key] = stored
+	return k, true, nil
+}
+
+//
+// ReleaseIdempotencyKey gives up the owner's claim on key for runID, eg.
+// when the run could not be created
+//
+func (sm *MemoryStateManager) ReleaseIdempotencyKey(ownerID string, key string, runID string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if existing, ok := sm.idempotencyKeys[[2]string{ownerID, key}]; ok && existing.RunID == runID {
+		delete(sm.idempotencyKeys, [2]string{ownerID, key})
+	}
+	return nil
+}
+
+//
+// NotifyStatusChange wakes up those watching the run
+//
+func (sm *MemoryStateManager) NotifyStatusChange(run Run) error {
+	sm.watchMu.Lock()
+	defer sm.watchMu.Unlock()
+
+	wake(sm.watching[run.RunID])
+	return nil
+}
+
+//
+// WatchRun returns a channel that receives when the run's status changes
+//
+func (sm *MemoryStateManager) WatchRun(runID string) (<-chan struct{}, func(), error) {
+	sm.watchMu.Lock()
+	defer sm.watchMu.Unlock()
+
+	changed := make(chan struct{}, 1)
+	if sm.watching[runID] == nil {
+		sm.watching[runID] = make(map[chan struct{}]bool)
+	}
+	sm.watching[runID][changed] = true
+
+	stop := func() {
+		sm.watchMu.Lock()
+		defer sm.watchMu.Unlock()
+		delete(sm.watching[runID], changed)
+		if len(sm.watching[runID]) == 0 {
+			delete(sm.watching, runID)
+		}
+	}
+	return changed, stop, nil
+}
+
+//
+// memoryRow is a record as postgres sees it when filtering and sorting:
+// its columns hold a string, int64, bool, time.Time or nil for NULL
+//
+type memoryRow struct {
+	key     string
+	columns map[string]interface{}
+	env     *EnvList
+	value   interface{}
+}
+
+type memoryOrder struct {
+	field string
+	desc  bool
+}
+
+func memoryOrderBy(obj orderable, field string, order string) ([]memoryOrder, error) {
+	if order == "asc" || order == "desc" {
+		if obj.validOrderField(field) {
+			return []memoryOrder{{field: field, desc: order == "desc"}}, nil
+		}
+		return nil, errors.Errorf("Invalid field to order by [%s], must be one of [%s]",
+			field,
+			strings.Join(obj.validOrderFields(), ", "))
+	}
+	return nil, errors.Errorf("Invalid order string, must be one of ('asc', 'desc'), was %s", order)
+}
+
+//
+// selectRows filters, sorts and pages rows as SQLStateManager's queries
+// do; returns the page of rows and the number of rows that matched
+// * ordering puts NULLs last; rows that sort equal are ordered by key
+//
+func selectRows(
+	rows []memoryRow, filters map[string][]string, envFilters map[string]string,
+	limit int, offset int, ordering []memoryOrder) ([]memoryRow, int, error) {
+
+	conditions, err := makeMemoryConditions(filters)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	matched := []memoryRow{}
+	for _, row := range rows {
+		ok, err := row.matches(conditions, envFilters)
+		if err != nil {
+			return nil, 0, err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		for _, o := range ordering {
+			a, b := matched[i].columns[o.field], matched[j].columns[o.field]
+			if a == nil || b == nil {
+				if (a == nil) != (b == nil) {
+					return b == nil
+				}
+				continue
+			}
+			if c := compareColumns(a, b); c != 0 {
+				if o.desc {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return matched[i].key < matched[j].key
+	})
+
+	start, end, err := pageBounds(len(matched), limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return matched[start:end], len(matched), nil
+}
+
+func pageBounds(n int, limit int, offset int) (int, int, error) {
+	if limit < 0 {
+		return 0, 0, errors.New("LIMIT must not be negative")
+	}
+	if offset < 0 {
+		return 0, 0, errors.New("OFFSET must not be negative")
+	}
+	start := offset
+	if start > n {
+		start = n
+	}
+	end := start + limit
+	if end > n {
+		end = n
+	}
+	return start, end, nil
+}
+
+//
+// memoryCondition is one of the conditions SQLStateManager.makeWhereClause
+// would make of filters
+//
+type memoryCondition struct {
+	column string
+	op     string
+	values []string
+	like   *regexp.Regexp
+}
+
+func makeMemoryConditions(filters map[string][]string) ([]memoryCondition, error) {
+	conditions := []memoryCondition{}
+	for k, v := range filters {
+		if len(v) > 1 {
+			conditions = append(conditions, memoryCondition{column: k, op: "in", values: v})
+		} else if len(v) == 1 {
+			c := memoryCondition{column: k, op: "=", values: v}
+			if k == "image" || k == "alias" || k == "group_name" || k == "command" || k == "text" {
+				c.op = "like"
+				pattern, err := likePattern("%" + v[0] + "%")
+				if err != nil {
+					return nil, err
+				}
+				c.like = regexp.MustCompile(pattern)
+			} else if strings.HasSuffix(k, "_since") {
+				c.column = strings.Replace(k, "_since", "", -1)
+				c.op = ">"
+			} else if strings.HasSuffix(k, "_until") {
+				c.column = strings.Replace(k, "_until", "", -1)
+				c.op = "<"
+			}
+			conditions = append(conditions, c)
+		}
+	}
+	return conditions, nil
+}
+
+func (row memoryRow) matches(conditions []memoryCondition, envFilters map[string]string) (bool, error) {
+	for _, c := range conditions {
+		value, ok := row.columns[c.column]
+		if !ok {
+			return false, errors.Errorf("column \"%s\" does not exist", c.column)
+		}
+		if value == nil {
+			return false, nil
+		}
+
+		if c.op == "like" {
+			s, ok := value.(string)
+			if !ok {
+				return false, errors.Errorf("operator does not exist: like on column \"%s\"", c.column)
+			}
+			if !c.like.MatchString(s) {
+				return false, nil
+			}
+			continue
+		}
+
+		matched := false
+		for _, v := range c.values {
+			literal, err := parseLiteral(value, v)
+			if err != nil {
+				return false, errors.Wrapf(err, "invalid value for column \"%s\"", c.column)
+			}
+			cmp := compareColumns(value, literal)
+			switch c.op {
+			case ">":
+				matched = matched || cmp > 0
+			case "<":
+				matched = matched || cmp < 0
+			default:
+				matched = matched || cmp == 0
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	for name, value := range envFilters {
+		if row.env == nil {
+			return false, nil
+		}
+		found := false
+		for _, e := range *row.env {
+			found = found || (e.Name == name && e.Value == value)
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+//
+// likePattern turns a pattern of sql's like into a regular expression;
+// backslash escapes the next character
+//
+func likePattern(pattern string) (string, error) {
+	var re []string
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			re = append(re, regexp.QuoteMeta(string(c)))
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '%':
+			re = append(re, ".*")
+		case c == '_':
+			re = append(re, ".")
+		default:
+			re = append(re, regexp.QuoteMeta(string(c)))
+		}
+	}
+	if escaped {
+		return "", errors.New("LIKE pattern must not end with escape character")
+	}
+	return "(?s)^" + strings.Join(re, "") + "$", nil
+}
+
+// Layouts postgres accepts timestamps in, without a zone meaning UTC
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+//
+// parseLiteral reads a filter's value as the type of the column it is
+// compared with
+//
+func parseLiteral(column interface{}, literal string) (interface{}, error) {
+	switch column.(type) {
+	case int64:
+		return strconv.ParseInt(strings.TrimSpace(literal), 10, 64)
+	case bool:
+		switch strings.ToLower(strings.TrimSpace(literal)) {
+		case "t", "true", "y", "yes", "on", "1":
+			return true, nil
+		case "f", "false", "n", "no", "off", "0":
+			return false, nil
+		}
+		return nil, errors.Errorf("invalid input syntax for type boolean: \"%s\"", literal)
+	case time.Time:
+		for _, layout := range timestampLayouts {
+			if t, err := time.ParseInLocation(layout, strings.TrimSpace(literal), time.UTC); err == nil {
+				return t, nil
+			}
+		}
+		return nil, errors.Errorf("invalid input syntax for type timestamp with time zone: \"%s\"", literal)
+	}
+	return literal, nil
+}
+
+func compareColumns(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		return strings.Compare(a, b.(string))
+	case int64:
+		b := b.(int64)
+		if a < b {
+			return -1
+		} else if a > b {
+			return 1
+		}
+	case bool:
+		b := b.(bool)
+		if !a && b {
+			return -1
+		} else if a && !b {
+			return 1
+		}
+	case time.Time:
+		b := b.(time.Time)
+		if a.Before(b) {
+			return -1
+		} else if a.After(b) {
+			return 1
+		}
+	}
+	return 0
+}
+
+func definitionColumns(d Definition) map[string]interface{} {
+	return map[string]interface{}{
+		"definition_id":      d.DefinitionID,
+		"alias":              d.Alias,
+		"image":              d.Image,
+		"group_name":         d.GroupName,
+		"memory":             int64Column(d.Memory),
+		"cpu":                int64Column(d.CPU),
+		"memory_reservation": int64Column(d.MemoryReserved),
+		"command":            d.Command,
+		"user":               d.User,
+		"arn":                d.Arn,
+		"container_name":     d.ContainerName,
+		"task_type":          nil,
+		"revision":           d.Revision,
+		"timeout_seconds":    int64Column(d.TimeoutSeconds),
+	}
+}
+
+func runColumns(r Run) map[string]interface{} {
+	return map[string]interface{}{
+		"run_id":              r.RunID,
+		"definition_id":       r.DefinitionID,
+		"alias":               r.Alias,
+		"image":               r.Image,
+		"cluster_name":        r.ClusterName,
+		"exit_code":           int64Column(r.ExitCode),
+		"status":              r.Status,
+		"started_at":          timeColumn(r.StartedAt),
+		"finished_at":         timeColumn(r.FinishedAt),
+		"instance_id":         r.InstanceID,
+		"instance_dns_name":   r.InstanceDNSName,
+		"group_name":          r.GroupName,
+		"task_arn":            r.TaskArn,
+		"docker_id":           nil,
+		"user":                nil,
+		"task_type":           r.TaskType,
+		"command":             r.Command,
+		"memory":              int64Column(r.Memory),
+		"cpu":                 int64Column(r.CPU),
+		"memory_reservation":  int64Column(r.MemoryReserved),
+		"definition_arn":      r.DefinitionArn,
+		"container_name":      r.ContainerName,
+		"definition_revision": r.DefinitionRevision,
+		"attempt":             r.Attempt,
+		"failure_reason":      r.FailureReason,
+		"retry_at":            timeColumn(r.RetryAt),
+		"timeout_seconds":     int64Column(r.TimeoutSeconds),
+		"queued_at":           timeColumn(r.QueuedAt),
+	}
+}
+
+func scheduleColumns(s Schedule) map[string]interface{} {
+	return map[string]interface{}{
+		"schedule_id":   s.ScheduleID,
+		"definition_id": nullIfEmpty(s.DefinitionID),
+		"alias":         nullIfEmpty(s.Alias),
+		"cron":          s.CronExpression,
+		"timezone":      s.Timezone,
+		"cluster_name":  s.ClusterName,
+		"owner_id":      s.OwnerID,
+		"missed_policy": s.MissedPolicy,
+		"enabled":       s.IsEnabled(),
+		"next_run_at":   timeColumn(s.NextRunAt),
+		"last_run_at":   timeColumn(s.LastRunAt),
+		"created_at":    timeColumn(s.CreatedAt),
+	}
+}
+
+func webhookColumns(w Webhook) map[string]interface{} {
+	return map[string]interface{}{
+		"webhook_id":    w.WebhookID,
+		"url":           w.URL,
+		"secret":        nullIfEmpty(w.Secret),
+		"definition_id": nullIfEmpty(w.DefinitionID),
+		"group_name":    nullIfEmpty(w.GroupName),
+		"failed_only":   w.IsFailedOnly(),
+		"created_at":    timeColumn(w.CreatedAt),
+	}
+}
+
+func tokenColumns(t Token) map[string]interface{} {
+	return map[string]interface{}{
+		"token_id":   t.TokenID,
+		"name":       t.Name,
+		"principal":  t.Principal,
+		"token_hash": t.Hash,
+		"created_at": timeColumn(t.CreatedAt),
+		"revoked_at": timeColumn(t.RevokedAt),
+	}
+}
+
+func roleBindingColumns(b RoleBinding) map[string]interface{} {
+	return map[string]interface{}{
+		"group_name": b.GroupName,
+		"principal":  b.Principal,
+		"role":       b.Role,
+		"created_at": timeColumn(b.CreatedAt),
+	}
+}
+
+func int64Column(v *int64) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func timeColumn(v *time.Time) interface{} {
+	if v == nil {
+		return nil
+	}
+	return *v
+}
+
+func nullIfEmpty(s string) interface{} {
+	if len(s) == 0 {
+		return nil
+	}
+	return s
+}
+
+//
+// Copies, so that what is stored is not changed through what was passed
+// in or handed out
+//
+
+func copyDefinition(d Definition) Definition {
+	d.Memory = copyInt64(d.Memory)
+	d.CPU = copyInt64(d.CPU)
+	d.MemoryReserved = copyInt64(d.MemoryReserved)
+	d.Env = copyEnv(d.Env)
+	if d.Ports != nil {
+		ports := append(PortsList(nil), (*d.Ports)...)
+		if *d.Ports != nil && ports == nil {
+			ports = PortsList{}
+		}
+		d.Ports = &ports
+	}
+	if d.Tags != nil {
+		tags := append(Tags(nil), (*d.Tags)...)
+		if *d.Tags != nil && tags == nil {
+			tags = Tags{}
+		}
+		d.Tags = &tags
+	}
+	d.RetryPolicy = copyRetryPolicy(d.RetryPolicy)
+	d.TimeoutSeconds = copyInt64(d.TimeoutSeconds)
+	return d
+}
+
+func copyRevision(dr DefinitionRevision) DefinitionRevision {
+	dr.Definition = copyDefinition(dr.Definition)
+	dr.CreatedAt = copyTime(dr.CreatedAt)
+	return dr
+}
+
+func copyRun(r Run) Run {
+	r.ExitCode = copyInt64(r.ExitCode)
+	r.StartedAt = copyTime(r.StartedAt)
+	r.FinishedAt = copyTime(r.FinishedAt)
+	r.Env = copyEnv(r.Env)
+	r.Memory = copyInt64(r.Memory)
+	r.CPU = copyInt64(r.CPU)
+	r.MemoryReserved = copyInt64(r.MemoryReserved)
+	if r.Ports != nil {
+		ports := append(PortsList(nil), (*r.Ports)...)
+		if *r.Ports != nil && ports == nil {
+			ports = PortsList{}
+		}
+		r.Ports = &ports
+	}
+	r.RetryPolicy = copyRetryPolicy(r.RetryPolicy)
+	if r.Attempts != nil {
+		var attempts RunAttempts
+		if *r.Attempts != nil {
+			attempts = make(RunAttempts, len(*r.Attempts))
+		}
+		for i, a := range *r.Attempts {
+			a.StartedAt = copyTime(a.StartedAt)
+			a.FinishedAt = copyTime(a.FinishedAt)
+			attempts[i] = a
+		}
+		r.Attempts = &attempts
+	}
+	r.RetryAt = copyTime(r.RetryAt)
+	r.TimeoutSeconds = copyInt64(r.TimeoutSeconds)
+	r.QueuedAt = copyTime(r.QueuedAt)
+	r.ClaimedAt = copyTime(r.ClaimedAt)
+	return r
+}
+
+func copySchedule(s Schedule) Schedule {
+	s.Env = copyEnv(s.Env)
+	if s.Enabled != nil {
+		s.Enabled = boolPtr(*s.Enabled)
+	}
+	s.NextRunAt = copyTime(s.NextRunAt)
+	s.LastRunAt = copyTime(s.LastRunAt)
+	s.CreatedAt = copyTime(s.CreatedAt)
+	return s
+}
+
+func copyWebhook(w Webhook) Webhook {
+	if w.Statuses != nil {
+		statuses := append(StatusList(nil), (*w.Statuses)...)
+		if *w.Statuses != nil && statuses == nil {
+			statuses = StatusList{}
+		}
+		w.Statuses = &statuses
+	}
+	if w.FailedOnly != nil {
+		w.FailedOnly = boolPtr(*w.FailedOnly)
+	}
+	w.CreatedAt = copyTime(w.CreatedAt)
+	return w
+}
+
+func copyToken(t Token) Token {
+	if t.Scopes != nil {
+		scopes := append(ScopeList(nil), (*t.Scopes)...)
+		if *t.Scopes != nil && scopes == nil {
+			scopes = ScopeList{}
+		}
+		t.Scopes = &scopes
+	}
+	t.CreatedAt = copyTime(t.CreatedAt)
+	t.RevokedAt = copyTime(t.RevokedAt)
+	return t
+}
+
+func copyEnv(env *EnvList) *EnvList {
+	if env == nil {
+		return nil
+	}
+	copied := append(EnvList(nil), (*env)...)
+	if *env != nil && copied == nil {
+		copied = EnvList{}
+	}
+	return &copied
+}
+
+//
+// copyRetryPolicy drops empty retriable reasons, as storing the policy
+// as json does
+//
+func copyRetryPolicy(rp *RetryPolicy) *RetryPolicy {
+	if rp == nil {
+		return nil
+	}
+	copied := *rp
+	copied.RetriableReasons = nil
+	if len(rp.RetriableReasons) > 0 {
+		copied.RetriableReasons = append([]string(nil), rp.RetriableReasons...)
+	}
+	return &copied
+}
+
+func copyInt64(v *int64) *int64 {
+	if v == nil {
+		return nil
+	}
+	copied := *v
+	return &copied
+}
+
+//
+// copyTime rounds to the microsecond, the precision postgres keeps
+//
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	copied := t.Round(time.Microsecond)
+	return &copied
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -0,0 +1,55 @@
+package state
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stitchfix/flotilla-os/config"
+)
+
+func newMemoryStateManager() Manager {
+	sm := &MemoryStateManager{}
+	sm.Initialize(nil)
+	return sm
+}
+
+func TestMemoryStateManager_Conformance(t *testing.T) {
+	testManagerConformance(t, newMemoryStateManager)
+}
+
+func TestMemoryStateManager_WatchRun(t *testing.T) {
+	sm := newMemoryStateManager().(*MemoryStateManager)
+
+	changed, stop, err := sm.WatchRun("run0")
+	if err != nil {
+		t.Fatalf("Expected to watch run0, got %v", err)
+	}
+
+	sm.NotifyStatusChange(Run{RunID: "run1"})
+	sm.NotifyStatusChange(Run{RunID: "run0"})
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected watcher of run0 to be woken up")
+	}
+
+	stop()
+	sm.NotifyStatusChange(Run{RunID: "run0"})
+	select {
+	case <-changed:
+		t.Errorf("Expected stopped watcher not to be woken up")
+	default:
+	}
+}
+
+func TestMemoryStateManager_NewStateManager(t *testing.T) {
+	conf, _ := config.NewConfig(nil)
+	os.Setenv("STATE_MANAGER", "memory")
+	defer os.Unsetenv("STATE_MANAGER")
+
+	sm, err := NewStateManager(conf)
+	if err != nil || sm.Name() != "memory" {
+		t.Errorf("Expected memory state manager, got %v %v", sm, err)
+	}
+}
@@ -0,0 +1,412 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"sort"
+	"time"
+)
+
+//
+// Migration is one version of a state manager's database schema
+// * Up changes the schema from the previous version to this one, and
+//   Down changes it back
+// * once released a migration must not change; its checksum is recorded
+//   when it is applied, and a changed migration is refused. Change the
+//   schema by adding a migration instead
+//
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+//
+// Checksum identifies what the migration's Up does
+//
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up))
+	return hex.EncodeToString(sum[:])
+}
+
+//
+// MigrationStatus is whether a migration was applied to the database
+// * AppliedAt is nil for migrations waiting to be applied
+// * Unknown migrations were applied by a newer version of flotilla
+// * Modified migrations were applied with a different checksum
+//
+type MigrationStatus struct {
+	Version   int64      `json:"version"`
+	Name      string     `json:"name"`
+	Checksum  string     `json:"checksum"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+	Unknown   bool       `json:"unknown"`
+	Modified  bool       `json:"modified"`
+}
+
+//
+// Migrator moves a state manager's database schema between versions
+// * Up applies steps pending migrations, oldest first; all of them if
+//   steps is 0
+// * Down reverts the last steps applied migrations, newest first
+// * both return the migrations they applied or reverted
+//
+type Migrator interface {
+	Status() ([]MigrationStatus, error)
+	Up(steps int) ([]Migration, error)
+	Down(steps int) ([]Migration, error)
+	Close() error
+}
+
+//
+// NewMigrator opens the database of the configured `state_manager`
+// to migrate its schema; the memory state manager has none
+//
+func NewMigrator(conf config.Config) (Migrator, error) {
+	name := "postgres"
+	if conf.IsSet("state_manager") {
+		name = conf.GetString("state_manager")
+	}
+
+	switch name {
+	case "postgres":
+		db, err := sqlx.Open("postgres", conf.GetString("database_url"))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open postgres db")
+		}
+		return &sqlMigrator{db: db, dialect: postgresMigrations}, nil
+	case "sqlite":
+		db, err := sqlx.Open("sqlite3", sqliteDSN(conf.GetString("database_url")))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to open sqlite db")
+		}
+		db.SetMaxOpenConns(1)
+		return &sqlMigrator{db: db, dialect: sqliteMigrations}, nil
+	default:
+		return nil, errors.Errorf("state.Manager named [%s] has no database schema to migrate", name)
+	}
+}
+
+//
+// migrationDialect is what migrating differs in between databases
+// * lockSQL is run first by each migration's transaction, so that
+//   flotillas starting together apply it once
+//
+type migrationDialect struct {
+	migrations     []Migration
+	createTableSQL string
+	tableExistsSQL string
+	lockSQL        string
+}
+
+var postgresMigrations = migrationDialect{
+	migrations: []Migration{
+		{Version: 1, Name: "initial schema", Up: CreateTablesSQL, Down: DropTablesSQL},
+		{Version: 2, Name: "definition and run resources", Up: AddResourcesSQL, Down: DropResourcesSQL},
+		{Version: 3, Name: "run claimed at", Up: AddClaimedAtSQL, Down: DropClaimedAtSQL},
+	},
+	createTableSQL: `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+      version integer PRIMARY KEY,
+      name text NOT NULL,
+      checksum text NOT NULL,
+      applied_at timestamp with time zone NOT NULL
+    );
+    `,
+	tableExistsSQL: `
+    SELECT COUNT(*) FROM information_schema.tables
+    WHERE table_schema = current_schema() AND table_name = 'schema_migrations'
+    `,
+	lockSQL: fmt.Sprintf("SELECT pg_advisory_xact_lock(%d)", leaseKey("schema_migrations")),
+}
+
+var sqliteMigrations = migrationDialect{
+	migrations: []Migration{
+		{Version: 1, Name: "initial schema", Up: SQLiteCreateTablesSQL, Down: SQLiteDropTablesSQL},
+		{Version: 2, Name: "definition and run resources", Up: SQLiteAddResourcesSQL, Down: SQLiteDropResourcesSQL},
+		{Version: 3, Name: "run claimed at", Up: SQLiteAddClaimedAtSQL, Down: SQLiteDropClaimedAtSQL},
+	},
+	createTableSQL: `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+      version integer PRIMARY KEY,
+      name text NOT NULL,
+      checksum text NOT NULL,
+      applied_at timestamp NOT NULL
+    );
+    `,
+	tableExistsSQL: `
+    SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'
+    `,
+}
+
+//
+// sqlMigrator records applied migrations in the schema_migrations table
+//
+type sqlMigrator struct {
+	db      *sqlx.DB
+	dialect migrationDialect
+}
+
+type appliedMigration struct {
+	Version   int64     `db:"version"`
+	Name      string    `db:"name"`
+	Checksum  string    `db:"checksum"`
+	AppliedAt time.Time `db:"applied_at"`
+}
+
+//
+// applied returns the migrations applied to the database by version;
+// none if migrations were never recorded
+//
+func (m *sqlMigrator) applied() (map[int64]appliedMigration, error) {
+	applied := make(map[int64]appliedMigration)
+
+	var exists int
+	if err := m.db.Get(&exists, m.dialect.tableExistsSQL); err != nil {
+		return applied, errors.Wrap(err, "issue looking for schema_migrations table")
+	}
+	if exists == 0 {
+		return applied, nil
+	}
+
+	var rows []appliedMigration
+	if err := m.db.Select(&rows, "SELECT version, name, checksum, applied_at FROM schema_migrations"); err != nil {
+		return applied, errors.Wrap(err, "issue listing applied migrations")
+	}
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
+}
+
+func (m *sqlMigrator) latest() int64 {
+	return m.dialect.migrations[len(m.dialect.migrations)-1].Version
+}
+
+//
+// checkNewer refuses a database migrated by a newer version of flotilla,
+// whose schema this version does not know
+//
+func (m *sqlMigrator) checkNewer(applied map[int64]appliedMigration) error {
+	known := make(map[int64]bool)
+	for _, migration := range m.dialect.migrations {
+		known[migration.Version] = true
+	}
+	for version, row := range applied {
+		if !known[version] {
+			return errors.Errorf(
+				"database schema has migration [%d] (%s), unknown to this flotilla whose latest is [%d]; "+
+					"upgrade flotilla, or migrate down with the flotilla that applied it",
+				version, row.Name, m.latest())
+		}
+	}
+	return nil
+}
+
+//
+// checkApplied refuses to migrate a database that is newer, or whose
+// migrations were applied with different checksums
+//
+func (m *sqlMigrator) checkApplied(applied map[int64]appliedMigration) error {
+	if err := m.checkNewer(applied); err != nil {
+		return err
+	}
+	for _, migration := range m.dialect.migrations {
+		if row, ok := applied[migration.Version]; ok && row.Checksum != migration.Checksum() {
+			return errors.Errorf(
+				"migration [%d] (%s) changed since it was applied; its checksum was [%s], is [%s]",
+				migration.Version, migration.Name, row.Checksum, migration.Checksum())
+		}
+	}
+	return nil
+}
+
+//
+// Check refuses a database whose schema is newer than this flotilla's
+//
+func (m *sqlMigrator) Check() error {
+	applied, err := m.applied()
+	if err != nil {
+		return err
+	}
+	return m.checkNewer(applied)
+}
+
+//
+// Status lists the known migrations, and any unknown ones applied by a
+// newer flotilla, by version
+//
+func (m *sqlMigrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range m.dialect.migrations {
+		status := MigrationStatus{
+			Version:  migration.Version,
+			Name:     migration.Name,
+			Checksum: migration.Checksum(),
+		}
+		if row, ok := applied[migration.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.AppliedAt = &appliedAt
+			status.Modified = row.Checksum != status.Checksum
+			delete(applied, migration.Version)
+		}
+		statuses = append(statuses, status)
+	}
+	for _, row := range applied {
+		appliedAt := row.AppliedAt
+		statuses = append(statuses, MigrationStatus{
+			Version:   row.Version,
+			Name:      row.Name,
+			Checksum:  row.Checksum,
+			AppliedAt: &appliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+//
+// Up applies pending migrations; databases created before migrations
+// were recorded take the first, whose tables they already have
+//
+func (m *sqlMigrator) Up(steps int) ([]Migration, error) {
+	var done []Migration
+	if _, err := m.db.Exec(m.dialect.createTableSQL); err != nil {
+		return done, errors.Wrap(err, "issue creating schema_migrations table")
+	}
+
+	applied, err := m.applied()
+	if err != nil {
+		return done, err
+	}
+	if err = m.checkApplied(applied); err != nil {
+		return done, err
+	}
+
+	for _, migration := range m.dialect.migrations {
+		if steps > 0 && len(done) == steps {
+			break
+		}
+		if _, ok := applied[migration.Version]; ok {
+			continue
+		}
+
+		migrated, err := m.migrate(migration, true)
+		if err != nil {
+			return done, err
+		}
+		if migrated {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+//
+// Down reverts applied migrations, newest first
+//
+func (m *sqlMigrator) Down(steps int) ([]Migration, error) {
+	var done []Migration
+	applied, err := m.applied()
+	if err != nil {
+		return done, err
+	}
+	if err = m.checkApplied(applied); err != nil {
+		return done, err
+	}
+
+	for i := len(m.dialect.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		migration := m.dialect.migrations[i]
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+
+		migrated, err := m.migrate(migration, false)
+		if err != nil {
+			return done, err
+		}
+		if migrated {
+			done = append(done, migration)
+		}
+	}
+	return done, nil
+}
+
+//
+// migrate applies the migration, or reverts it, in one transaction along
+// with recording it; returns false if it already was, eg. by another
+// flotilla starting at the same time
+//
+func (m *sqlMigrator) migrate(migration Migration, up bool) (bool, error) {
+	tx, err := m.db.Beginx()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+
+	if len(m.dialect.lockSQL) > 0 {
+		if _, err = tx.Exec(m.dialect.lockSQL); err != nil {
+			tx.Rollback()
+			return false, errors.Wrap(err, "issue locking schema_migrations")
+		}
+	}
+
+	var recorded int
+	err = tx.Get(&recorded, tx.Rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), migration.Version)
+	if err != nil || (recorded > 0) == up {
+		tx.Rollback()
+		return false, errors.WithStack(err)
+	}
+
+	if up {
+		if _, err = tx.Exec(migration.Up); err == nil {
+			_, err = tx.Exec(
+				tx.Rebind("INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (?, ?, ?, ?)"),
+				migration.Version, migration.Name, migration.Checksum(), time.Now().UTC().Round(time.Microsecond))
+		}
+	} else {
+		if _, err = tx.Exec(migration.Down); err == nil {
+			_, err = tx.Exec(tx.Rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return false, errors.Wrapf(err, "issue migrating to version [%d] (%s)", migration.Version, migration.Name)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+//
+// Close closes the database
+//
+func (m *sqlMigrator) Close() error {
+	return m.db.Close()
+}
+
+//
+// migrateOrCheck is how state managers start: applying pending
+// migrations when they create the schema, and otherwise only checking
+// that the schema is not newer than they know
+//
+func migrateOrCheck(db *sqlx.DB, dialect migrationDialect, createSchema bool) error {
+	m := &sqlMigrator{db: db, dialect: dialect}
+	if createSchema {
+		_, err := m.Up(0)
+		return err
+	}
+	return m.Check()
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/stitchfix/flotilla-os/config"
+)
+
+//
+// newTestMigrator migrates a sqlite database in dir with migrations
+//
+func newTestMigrator(t *testing.T, dir string, migrations []Migration) *sqlMigrator {
+	db, err := sqlx.Open("sqlite3", sqliteDSN(filepath.Join(dir, "migrations.db")))
+	if err != nil {
+		t.Fatalf("Expected to open database, got %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	dialect := sqliteMigrations
+	dialect.migrations = migrations
+	return &sqlMigrator{db: db, dialect: dialect}
+}
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "a", Up: "CREATE TABLE a (id text);", Down: "DROP TABLE a;"},
+	{Version: 2, Name: "b", Up: "CREATE TABLE b (id text);", Down: "DROP TABLE b;"},
+}
+
+func tableExists(m *sqlMigrator, table string) bool {
+	var n int
+	m.db.Get(&n, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+	return n == 1
+}
+
+func TestMigrator_UpAndDown(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "flotilla-migrations")
+	defer os.RemoveAll(dir)
+	m := newTestMigrator(t, dir, testMigrations)
+	defer m.Close()
+
+	statuses, err := m.Status()
+	if err != nil || len(statuses) != 2 || statuses[0].AppliedAt != nil || statuses[1].AppliedAt != nil {
+		t.Fatalf("Expected 2 pending migrations, got %v %v", statuses, err)
+	}
+
+	applied, err := m.Up(1)
+	if err != nil || len(applied) != 1 || applied[0].Version != 1 || !tableExists(m, "a") || tableExists(m, "b") {
+		t.Fatalf("Expected to apply migration 1 only, got %v %v", applied, err)
+	}
+	if applied, err = m.Up(0); err != nil || len(applied) != 1 || applied[0].Version != 2 || !tableExists(m, "b") {
+		t.Fatalf("Expected to apply migration 2, got %v %v", applied, err)
+	}
+	if applied, err = m.Up(0); err != nil || len(applied) != 0 {
+		t.Errorf("Expected nothing left to apply, got %v %v", applied, err)
+	}
+
+	statuses, _ = m.Status()
+	for _, status := range statuses {
+		if status.AppliedAt == nil || status.Unknown || status.Modified {
+			t.Errorf("Expected migration %d to be applied, got %v", status.Version, status)
+		}
+	}
+
+	reverted, err := m.Down(1)
+	if err != nil || len(reverted) != 1 || reverted[0].Version != 2 || tableExists(m, "b") || !tableExists(m, "a") {
+		t.Fatalf("Expected to revert migration 2 only, got %v %v", reverted, err)
+	}
+	if reverted, err = m.Down(5); err != nil || len(reverted) != 1 || tableExists(m, "a") {
+		t.Errorf("Expected to revert migration 1, got %v %v", reverted, err)
+	}
+}
+
+func TestMigrator_RefusesNewerSchema(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "flotilla-migrations")
+	defer os.RemoveAll(dir)
+	newer := newTestMigrator(t, dir, testMigrations)
+	if _, err := newer.Up(0); err != nil {
+		t.Fatalf("Expected to migrate, got %v", err)
+	}
+	newer.Close()
+
+	older := newTestMigrator(t, dir, testMigrations[:1])
+	defer older.Close()
+
+	if err := older.Check(); err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Errorf("Expected newer schema to be refused, got %v", err)
+	}
+	if _, err := older.Up(0); err == nil {
+		t.Errorf("Expected not to migrate newer schema")
+	}
+	if _, err := older.Down(1); err == nil {
+		t.Errorf("Expected not to revert newer schema")
+	}
+
+	statuses, err := older.Status()
+	if err != nil || len(statuses) != 2 || !statuses[1].Unknown || statuses[1].Name != "b" {
+		t.Errorf("Expected migration 2 to be unknown, got %v %v", statuses, err)
+	}
+}
+
+func TestMigrator_RefusesModifiedMigration(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "flotilla-migrations")
+	defer os.RemoveAll(dir)
+	m := newTestMigrator(t, dir, testMigrations[:1])
+	if _, err := m.Up(0); err != nil {
+		t.Fatalf("Expected to migrate, got %v", err)
+	}
+	m.Close()
+
+	modified := []Migration{testMigrations[0], testMigrations[1]}
+	modified[0].Up = "CREATE TABLE a (id text, name text);"
+	m = newTestMigrator(t, dir, modified)
+	defer m.Close()
+
+	if _, err := m.Up(0); err == nil || !strings.Contains(err.Error(), "changed") || tableExists(m, "b") {
+		t.Errorf("Expected modified migration to be refused, got %v", err)
+	}
+	if err := m.Check(); err != nil {
+		t.Errorf("Expected modified migration not to stop flotilla starting, got %v", err)
+	}
+
+	statuses, _ := m.Status()
+	if !statuses[0].Modified || statuses[1].Modified {
+		t.Errorf("Expected migration 1 to be modified, got %v", statuses)
+	}
+}
+
+func TestMigrator_AdoptsUnrecordedSchema(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "flotilla-migrations")
+	defer os.RemoveAll(dir)
+	m := newTestMigrator(t, dir, sqliteMigrations.migrations)
+	defer m.Close()
+
+	// As created before migrations were recorded
+	m.db.MustExec(SQLiteCreateTablesSQL)
+	m.db.MustExec("INSERT INTO tags(text) VALUES ('kept')")
+
+	if applied, err := m.Up(0); err != nil || len(applied) != len(sqliteMigrations.migrations) {
+		t.Fatalf("Expected the first migration to be recorded and the rest applied, got %v %v", applied, err)
+	}
+	var n int
+	if m.db.Get(&n, "SELECT COUNT(*) FROM tags"); n != 1 {
+		t.Errorf("Expected existing rows to be kept, got %d", n)
+	}
+
+	if _, err := m.Down(len(sqliteMigrations.migrations)); err != nil || tableExists(m, "task_def") || tableExists(m, "task") {
+		t.Errorf("Expected reverting every migration to drop the tables, got %v", err)
+	}
+}
+
+func TestMigrator_StateManagerRefusesNewerSchema(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "flotilla-migrations")
+	defer os.RemoveAll(dir)
+
+	conf, _ := config.NewConfig(nil)
+	os.Setenv("STATE_MANAGER", "sqlite")
+	os.Setenv("DATABASE_URL", filepath.Join(dir, "migrations.db"))
+	defer os.Unsetenv("STATE_MANAGER")
+	defer os.Unsetenv("DATABASE_URL")
+	defer os.Unsetenv("CREATE_DATABASE_SCHEMA")
+
+	m, err := NewMigrator(conf)
+	if err != nil {
+		t.Fatalf("Expected sqlite migrator, got %v", err)
+	}
+	if _, err = m.Up(0); err != nil {
+		t.Fatalf("Expected to migrate, got %v", err)
+	}
+	m.(*sqlMigrator).db.MustExec(
+		"INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES (999, 'future', '', '2017-07-04 12:00:00+00:00')")
+	m.Close()
+
+	for _, createSchema := range []string{"true", "false"} {
+		os.Setenv("CREATE_DATABASE_SCHEMA", createSchema)
+		if sm, err := NewStateManager(conf); err == nil {
+			sm.Cleanup()
+			t.Errorf("Expected newer schema to be refused with create_database_schema %s", createSchema)
+		}
+	}
+}
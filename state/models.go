@@ -5,7 +5,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/nu7hatch/gouuid"
+	"net/url"
+	"reflect"
 	"regexp"
+	"strings"
 	"text/template"
 	"time"
 )
@@ -93,19 +96,24 @@ type Tags []string
 // - roughly 1-1 with an AWS ECS task definition
 //
 type Definition struct {
-	Arn           string     `json:"arn"`
-	DefinitionID  string     `json:"definition_id"`
-	Image         string     `json:"image"`
-	GroupName     string     `json:"group_name"`
-	ContainerName string     `json:"container_name"`
-	User          string     `json:"user,omitempty"`
-	Alias         string     `json:"alias"`
-	Memory        *int64     `json:"memory"`
-	Command       string     `json:"command,omitempty"`
-	TaskType      string     `json:"-"`
-	Env           *EnvList   `json:"env"`
-	Ports         *PortsList `json:"ports,omitempty"`
-	Tags          *Tags      `json:"tags,omitempty"`
+	Arn            string       `json:"arn"`
+	DefinitionID   string       `json:"definition_id"`
+	Image          string       `json:"image"`
+	GroupName      string       `json:"group_name"`
+	ContainerName  string       `json:"container_name"`
+	User           string       `json:"user,omitempty"`
+	Alias          string       `json:"alias"`
+	Memory         *int64       `json:"memory"`
+	CPU            *int64       `json:"cpu,omitempty"`
+	MemoryReserved *int64       `json:"memory_reservation,omitempty"`
+	Command        string       `json:"command,omitempty"`
+	TaskType       string       `json:"-"`
+	Env            *EnvList     `json:"env"`
+	Ports          *PortsList   `json:"ports,omitempty"`
+	Tags           *Tags        `json:"tags,omitempty"`
+	Revision       int64        `json:"revision"`
+	RetryPolicy    *RetryPolicy `json:"retry_policy,omitempty"`
+	TimeoutSeconds *int64       `json:"timeout,omitempty"`
 }
 
 var commandWrapper = `
@@ -148,6 +156,47 @@ func (d *Definition) IsValid() (bool, []string) {
 		{len(d.Alias) == 0, "string [alias] must be specified"},
 		{d.Memory == nil, "int [memory] must be specified"},
 		{len(d.Command) == 0, "string [command] must be specified"},
+		{d.TimeoutSeconds != nil && *d.TimeoutSeconds <= 0, "int [timeout] must be a positive number of seconds"},
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+
+	if ok, resourceReasons := d.ResourcesAreValid(); !ok {
+		valid = false
+		reasons = append(reasons, resourceReasons...)
+	}
+
+	if d.RetryPolicy != nil {
+		if ok, policyReasons := d.RetryPolicy.IsValid(); !ok {
+			valid = false
+			reasons = append(reasons, policyReasons...)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// ResourcesAreValid returns true only if the resources the definition
+// asks for are positive, and it reserves no more memory than its limit
+// * memory (MiB) is the hard limit the container is killed beyond, and
+//   memory_reservation (MiB) what it is placed by; cpu is in cpu units,
+//   1024 to a cpu
+//
+func (d *Definition) ResourcesAreValid() (bool, []string) {
+	conditions := []validationCondition{
+		{d.Memory != nil && *d.Memory <= 0, "int [memory] must be a positive number of MiB"},
+		{d.CPU != nil && *d.CPU <= 0, "int [cpu] must be a positive number of cpu units"},
+		{d.MemoryReserved != nil && *d.MemoryReserved <= 0,
+			"int [memory_reservation] must be a positive number of MiB"},
+		{d.MemoryReserved != nil && d.Memory != nil && *d.MemoryReserved > *d.Memory,
+			"int [memory_reservation] must be at most [memory]"},
 	}
 
 	valid := true
@@ -189,6 +238,12 @@ func (d *Definition) UpdateWith(other Definition) {
 	if other.Memory != nil {
 		d.Memory = other.Memory
 	}
+	if other.CPU != nil {
+		d.CPU = other.CPU
+	}
+	if other.MemoryReserved != nil {
+		d.MemoryReserved = other.MemoryReserved
+	}
 	if len(other.Command) > 0 {
 		d.Command = other.Command
 	}
@@ -204,7 +259,30 @@ func (d *Definition) UpdateWith(other Definition) {
 	if other.Tags != nil {
 		d.Tags = other.Tags
 	}
+	if other.Revision > 0 {
+		d.Revision = other.Revision
+	}
+	if other.RetryPolicy != nil {
+		d.RetryPolicy = other.RetryPolicy
+	}
+	if other.TimeoutSeconds != nil {
+		d.TimeoutSeconds = other.TimeoutSeconds
+	}
+}
 
+//
+// Restore overwrites this definition with another, eg. one of its earlier
+// revisions; unlike UpdateWith, fields the other leaves empty are cleared
+// * the definition keeps its identity (id, alias and group name), task
+//   type and revision
+//
+func (d *Definition) Restore(other Definition) {
+	other.DefinitionID = d.DefinitionID
+	other.Alias = d.Alias
+	other.GroupName = d.GroupName
+	other.TaskType = d.TaskType
+	other.Revision = d.Revision
+	*d = other
 }
 
 func (d Definition) MarshalJSON() ([]byte, error) {
@@ -224,6 +302,105 @@ func (d Definition) MarshalJSON() ([]byte, error) {
 	})
 }
 
+//
+// FieldChange represents the change in a single field between
+// two versions of a definition
+//
+type FieldChange struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+//
+// Diff returns the fields that differ between this definition
+// and other, keyed by their json name
+//
+func (d *Definition) Diff(other Definition) map[string]FieldChange {
+	deref := func(v interface{}) interface{} {
+		rv := reflect.ValueOf(v)
+		if rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				return nil
+			}
+			return rv.Elem().Interface()
+		}
+		return v
+	}
+
+	fields := []struct {
+		name string
+		from interface{}
+		to   interface{}
+	}{
+		{"arn", d.Arn, other.Arn},
+		{"image", d.Image, other.Image},
+		{"group_name", d.GroupName, other.GroupName},
+		{"container_name", d.ContainerName, other.ContainerName},
+		{"user", d.User, other.User},
+		{"alias", d.Alias, other.Alias},
+		{"memory", d.Memory, other.Memory},
+		{"cpu", d.CPU, other.CPU},
+		{"memory_reservation", d.MemoryReserved, other.MemoryReserved},
+		{"command", d.Command, other.Command},
+		{"env", d.Env, other.Env},
+		{"ports", d.Ports, other.Ports},
+		{"tags", d.Tags, other.Tags},
+		{"retry_policy", d.RetryPolicy, other.RetryPolicy},
+		{"timeout", d.TimeoutSeconds, other.TimeoutSeconds},
+	}
+
+	changes := make(map[string]FieldChange)
+	for _, f := range fields {
+		from, to := deref(f.from), deref(f.to)
+		if !reflect.DeepEqual(from, to) {
+			changes[f.name] = FieldChange{From: from, To: to}
+		}
+	}
+	return changes
+}
+
+//
+// DefinitionRevision is an immutable copy of a definition as
+// it was at a given revision
+//
+type DefinitionRevision struct {
+	Definition
+	CreatedAt *time.Time             `json:"created_at,omitempty"`
+	DiffFrom  *int64                 `json:"diff_from,omitempty"`
+	Diff      map[string]FieldChange `json:"diff,omitempty"`
+}
+
+func (dr DefinitionRevision) MarshalJSON() ([]byte, error) {
+	type Alias Definition
+
+	env := dr.Env
+	if env == nil {
+		env = &EnvList{}
+	}
+
+	return json.Marshal(&struct {
+		Env       *EnvList               `json:"env"`
+		CreatedAt *time.Time             `json:"created_at,omitempty"`
+		DiffFrom  *int64                 `json:"diff_from,omitempty"`
+		Diff      map[string]FieldChange `json:"diff,omitempty"`
+		Alias
+	}{
+		Env:       env,
+		CreatedAt: dr.CreatedAt,
+		DiffFrom:  dr.DiffFrom,
+		Diff:      dr.Diff,
+		Alias:     (Alias)(dr.Definition),
+	})
+}
+
+//
+// DefinitionRevisionList wraps a list of DefinitionRevisions
+//
+type DefinitionRevisionList struct {
+	Total     int                  `json:"total"`
+	Revisions []DefinitionRevision `json:"revisions"`
+}
+
 //
 // DefinitionList wraps a list of Definitions
 //
@@ -248,39 +425,293 @@ func (dl *DefinitionList) MarshalJSON() ([]byte, error) {
 }
 
 //
-// Run represents a single run of a Definition
+// RetryPolicy controls how runs that fail for infrastructure reasons,
+// rather than by exiting, are retried
+// - MaxAttempts counts every attempt at the run, including the first
+// - the wait before each retry starts at BackoffSeconds and doubles
+//   with every attempt, up to MaxBackoffSeconds (a day, if unset)
+// - RetriableReasons are failure reasons that make a run retriable in
+//   addition to the ones the execution engine already retries;
+//   a reason matches if the run's failure reason contains it
+//
+type RetryPolicy struct {
+	MaxAttempts       int64    `json:"max_attempts"`
+	BackoffSeconds    int64    `json:"backoff_seconds"`
+	MaxBackoffSeconds int64    `json:"max_backoff_seconds"`
+	RetriableReasons  []string `json:"retriable_reasons,omitempty"`
+}
+
+// DefaultRetryPolicy applies to runs whose definition has no retry policy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:       5,
+	BackoffSeconds:    30,
+	MaxBackoffSeconds: 3600,
+}
+
+//
+// IsValid returns true only if the policy allows at least one
+// attempt and its backoff is not negative
+//
+func (rp *RetryPolicy) IsValid() (bool, []string) {
+	conditions := []validationCondition{
+		{rp.MaxAttempts < 1, "int [retry_policy.max_attempts] must be at least 1"},
+		{rp.BackoffSeconds < 0, "int [retry_policy.backoff_seconds] must not be negative"},
+		{rp.MaxBackoffSeconds != 0 && rp.MaxBackoffSeconds < rp.BackoffSeconds,
+			"int [retry_policy.max_backoff_seconds] must be at least [retry_policy.backoff_seconds]"},
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// Backoff returns how long to wait before retrying the given,
+// failed, attempt
+//
+func (rp *RetryPolicy) Backoff(attempt int64) time.Duration {
+	maxBackoff := rp.MaxBackoffSeconds
+	if maxBackoff == 0 {
+		maxBackoff = 24 * 60 * 60
+	}
+
+	backoff := rp.BackoffSeconds
+	for i := int64(1); i < attempt && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	return time.Duration(backoff) * time.Second
+}
+
+//
+// IsRetriable returns true if the failure reason matches one of
+// the policy's retriable reasons
+//
+func (rp *RetryPolicy) IsRetriable(failureReason string) bool {
+	for _, reason := range rp.RetriableReasons {
+		if len(reason) > 0 && strings.Contains(failureReason, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// RunAttempt records the outcome of a single failed attempt at a run
+//
+type RunAttempt struct {
+	Attempt       int64      `json:"attempt"`
+	TaskArn       string     `json:"task_arn,omitempty"`
+	StartedAt     *time.Time `json:"started_at,omitempty"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty"`
+	FailureReason string     `json:"failure_reason,omitempty"`
+}
+
+//
+// RunAttempts wraps a list of RunAttempt
+// - abstraction to make it easier to read
+//   and write to db
 //
-// TODO:
-//   Runs need to -copy- the run relevant information
-//   from their associated definition when they are
-//   created so they always have correct info. Currently
-//   the definition can change during or after the run
-//   is created and launched meaning the run is acting
-//   on information that is no longer accessible.
+type RunAttempts []RunAttempt
+
+//
+// Run represents a single run of a Definition
+// - the run relevant fields of the definition (image, command,
+//   memory, ports, env, registered arn, retry policy, and timeout) are
+//   copied onto the run when it is created so that later changes to the
+//   definition do not change what the run launches
+// - Attempt counts from 1; each retry of the run is a new attempt,
+//   and Attempts records how the earlier ones failed
+// - QueuedAt is when the latest attempt was queued, and ClaimedAt when a
+//   submit worker last claimed it for submission; ClaimedAt is only set
+//   by the state manager's ClaimRun
 //
 type Run struct {
-	TaskArn         string     `json:"task_arn"`
-	RunID           string     `json:"run_id"`
-	DefinitionID    string     `json:"definition_id"`
-	Alias           string     `json:"alias"`
-	Image           string     `json:"image"`
-	ClusterName     string     `json:"cluster"`
-	ExitCode        *int64     `json:"exit_code,omitempty"`
-	Status          string     `json:"status"`
-	StartedAt       *time.Time `json:"started_at,omitempty"`
-	FinishedAt      *time.Time `json:"finished_at,omitempty"`
-	InstanceID      string     `json:"-"`
-	InstanceDNSName string     `json:"-"`
-	GroupName       string     `json:"group_name"`
-	User            string     `json:"user,omitempty"`
-	TaskType        string     `json:"-"`
-	Env             *EnvList   `json:"env,omitempty"`
+	TaskArn            string       `json:"task_arn"`
+	RunID              string       `json:"run_id"`
+	DefinitionID       string       `json:"definition_id"`
+	Alias              string       `json:"alias"`
+	Image              string       `json:"image"`
+	ClusterName        string       `json:"cluster"`
+	ExitCode           *int64       `json:"exit_code,omitempty"`
+	Status             string       `json:"status"`
+	StartedAt          *time.Time   `json:"started_at,omitempty"`
+	FinishedAt         *time.Time   `json:"finished_at,omitempty"`
+	InstanceID         string       `json:"-"`
+	InstanceDNSName    string       `json:"-"`
+	GroupName          string       `json:"group_name"`
+	User               string       `json:"user,omitempty"`
+	TaskType           string       `json:"-"`
+	Env                *EnvList     `json:"env,omitempty"`
+	Command            string       `json:"command,omitempty"`
+	Memory             *int64       `json:"memory,omitempty"`
+	CPU                *int64       `json:"cpu,omitempty"`
+	MemoryReserved     *int64       `json:"memory_reservation,omitempty"`
+	Ports              *PortsList   `json:"ports,omitempty"`
+	DefinitionArn      string       `json:"definition_arn,omitempty"`
+	ContainerName      string       `json:"container_name,omitempty"`
+	DefinitionRevision int64        `json:"definition_revision,omitempty"`
+	RetryPolicy        *RetryPolicy `json:"retry_policy,omitempty"`
+	Attempt            int64        `json:"attempt,omitempty"`
+	Attempts           *RunAttempts `json:"attempts,omitempty"`
+	FailureReason      string       `json:"failure_reason,omitempty"`
+	RetryAt            *time.Time   `json:"retry_at,omitempty"`
+	TimeoutSeconds     *int64       `json:"timeout,omitempty"`
+	QueuedAt           *time.Time   `json:"queued_at,omitempty"`
+	ClaimedAt          *time.Time   `json:"-"`
+}
+
+//
+// HasSnapshot returns true if the run carries its own copy of
+// the definition fields required to launch it
+// - runs created before snapshotting was introduced will not
+//
+func (r *Run) HasSnapshot() bool {
+	return len(r.Command) > 0 && len(r.DefinitionArn) > 0
+}
+
+//
+// SnapshotDefinition copies the run relevant fields of the
+// definition onto the run
+// - definition env is merged under the run env; run env
+//   takes precedence for variables set in both
+//
+func (r *Run) SnapshotDefinition(d Definition) {
+	r.DefinitionID = d.DefinitionID
+	r.Alias = d.Alias
+	r.Image = d.Image
+	r.GroupName = d.GroupName
+	r.Command = d.Command
+	r.Memory = d.Memory
+	r.CPU = d.CPU
+	r.MemoryReserved = d.MemoryReserved
+	r.Ports = d.Ports
+	r.DefinitionArn = d.Arn
+	r.ContainerName = d.ContainerName
+	r.DefinitionRevision = d.Revision
+	r.RetryPolicy = d.RetryPolicy
+	r.TimeoutSeconds = d.TimeoutSeconds
+
+	var runEnv EnvList
+	if r.Env != nil {
+		runEnv = *r.Env
+	}
+	overridden := make(map[string]bool, len(runEnv))
+	for _, e := range runEnv {
+		overridden[e.Name] = true
+	}
+
+	env := EnvList{}
+	if d.Env != nil {
+		for _, e := range *d.Env {
+			if !overridden[e.Name] {
+				env = append(env, e)
+			}
+		}
+	}
+	env = append(env, runEnv...)
+	r.Env = &env
+}
+
+//
+// Deadline returns the time by which a run with a timeout must finish;
+// nil if it has no timeout or has not started
+//
+func (r *Run) Deadline() *time.Time {
+	if r.TimeoutSeconds == nil || r.StartedAt == nil {
+		return nil
+	}
+	deadline := r.StartedAt.Add(time.Duration(*r.TimeoutSeconds) * time.Second)
+	return &deadline
+}
+
+//
+// RetryPolicyOrDefault returns the retry policy copied from the
+// definition, or the default policy if there is none
+//
+func (r *Run) RetryPolicyOrDefault() RetryPolicy {
+	if r.RetryPolicy != nil {
+		return *r.RetryPolicy
+	}
+	return DefaultRetryPolicy
+}
+
+//
+// WrappedCommand returns the wrapped command for the run
+// * wrapping ensures lines are logged and exit code is set
+//
+func (r *Run) WrappedCommand() (string, error) {
+	var result bytes.Buffer
+	if err := commandTemplate.Execute(&result, r); err != nil {
+		return "", err
+	}
+	return result.String(), nil
+}
+
+//
+// Runs have a deterministic lifecycle
+//
+// QUEUED --> PENDING --> RUNNING --> STOPPED
+// QUEUED --> PENDING --> NEEDS_RETRY --> QUEUED ...
+// QUEUED --> PENDING --> NEEDS_RETRY --> STOPPED (attempts exhausted)
+// QUEUED --> PENDING --> STOPPED ...
+//
+var statusPrecedence = map[string]int{
+	StatusNeedsRetry: -1,
+	StatusQueued:     0,
+	StatusPending:    1,
+	StatusRunning:    2,
+	StatusStopped:    3,
+}
+
+//
+// HasReached is true if the run's status is status, or comes after it in
+// the run lifecycle; a run only reaches NEEDS_RETRY by being in it
+//
+func (r *Run) HasReached(status string) bool {
+	if r.Status == status {
+		return true
+	}
+	if status == StatusNeedsRetry {
+		return false
+	}
+	current, ok := statusPrecedence[r.Status]
+	if !ok {
+		return false
+	}
+	wanted, ok := statusPrecedence[status]
+	return ok && current >= wanted
 }
 
 //
 // UpdateWith updates this run with information from another
 //
 func (d *Run) UpdateWith(other Run) {
+	//
+	// A new attempt starts without the outcome of the previous one;
+	// that is kept in Attempts
+	//
+	if other.Attempt > d.Attempt {
+		d.Attempt = other.Attempt
+		d.TaskArn = ""
+		d.ExitCode = nil
+		d.StartedAt = nil
+		d.FinishedAt = nil
+		d.InstanceID = ""
+		d.InstanceDNSName = ""
+		d.FailureReason = ""
+		d.RetryAt = nil
+		d.QueuedAt = nil
+	}
+
 	if len(other.TaskArn) > 0 {
 		d.TaskArn = other.TaskArn
 	}
@@ -327,20 +758,48 @@ func (d *Run) UpdateWith(other Run) {
 	if other.Env != nil {
 		d.Env = other.Env
 	}
-
-	//
-	// Runs have a deterministic lifecycle
-	//
-	// QUEUED --> PENDING --> RUNNING --> STOPPED
-	// QUEUED --> PENDING --> NEEDS_RETRY --> QUEUED ...
-	// QUEUED --> PENDING --> STOPPED ...
-	//
-	statusPrecedence := map[string]int{
-		StatusNeedsRetry: -1,
-		StatusQueued:     0,
-		StatusPending:    1,
-		StatusRunning:    2,
-		StatusStopped:    3,
+	if len(other.Command) > 0 {
+		d.Command = other.Command
+	}
+	if other.Memory != nil {
+		d.Memory = other.Memory
+	}
+	if other.CPU != nil {
+		d.CPU = other.CPU
+	}
+	if other.MemoryReserved != nil {
+		d.MemoryReserved = other.MemoryReserved
+	}
+	if other.Ports != nil {
+		d.Ports = other.Ports
+	}
+	if len(other.DefinitionArn) > 0 {
+		d.DefinitionArn = other.DefinitionArn
+	}
+	if len(other.ContainerName) > 0 {
+		d.ContainerName = other.ContainerName
+	}
+	if other.DefinitionRevision > 0 {
+		d.DefinitionRevision = other.DefinitionRevision
+	}
+	if other.RetryPolicy != nil {
+		d.RetryPolicy = other.RetryPolicy
+	}
+	if other.Attempts != nil {
+		d.Attempts = other.Attempts
+	}
+	// The reason a run stopped is not replaced by later updates
+	if len(other.FailureReason) > 0 && d.Status != StatusStopped {
+		d.FailureReason = other.FailureReason
+	}
+	if other.RetryAt != nil {
+		d.RetryAt = other.RetryAt
+	}
+	if other.TimeoutSeconds != nil {
+		d.TimeoutSeconds = other.TimeoutSeconds
+	}
+	if other.QueuedAt != nil {
+		d.QueuedAt = other.QueuedAt
 	}
 
 	if other.Status == StatusNeedsRetry {
@@ -364,9 +823,11 @@ func (r Run) MarshalJSON() ([]byte, error) {
 	}
 	return json.Marshal(&struct {
 		Instance map[string]string `json:"instance"`
+		Deadline *time.Time        `json:"deadline,omitempty"`
 		Alias
 	}{
 		Instance: instance,
+		Deadline: r.Deadline(),
 		Alias:    (Alias)(r),
 	})
 }
@@ -394,3 +855,563 @@ type TagsList struct {
 	Tags  []string
 	Total int
 }
+
+// ScheduleMissedSkip runs only the most recent missed tick of a schedule
+var ScheduleMissedSkip = "skip"
+
+// ScheduleMissedCatchUp runs every missed tick of a schedule, oldest first
+var ScheduleMissedCatchUp = "catch_up"
+
+// NewScheduleID returns a new uuid for a Schedule
+func NewScheduleID() (string, error) {
+	return newUUIDv4()
+}
+
+//
+// Schedule represents a recurring run of a Definition
+// - exactly one of DefinitionID or Alias identifies what to run;
+//   alias schedules follow the alias if it is moved to a new definition
+// - NextRunAt is the next tick that has not yet been claimed by a worker
+//
+type Schedule struct {
+	ScheduleID     string     `json:"schedule_id"`
+	DefinitionID   string     `json:"definition_id,omitempty"`
+	Alias          string     `json:"alias,omitempty"`
+	CronExpression string     `json:"cron"`
+	Timezone       string     `json:"timezone"`
+	ClusterName    string     `json:"cluster"`
+	Env            *EnvList   `json:"env"`
+	OwnerID        string     `json:"owner_id"`
+	MissedPolicy   string     `json:"missed_policy"`
+	Enabled        *bool      `json:"enabled"`
+	NextRunAt      *time.Time `json:"next_run_at,omitempty"`
+	LastRunAt      *time.Time `json:"last_run_at,omitempty"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+}
+
+//
+// IsValid returns true only if this is a valid schedule with all
+// required information
+//
+func (s *Schedule) IsValid() (bool, []string) {
+	conditions := []validationCondition{
+		{(len(s.DefinitionID) == 0) == (len(s.Alias) == 0), "exactly one of [definition_id] or [alias] must be specified"},
+		{len(s.ClusterName) == 0, "string [cluster] must be specified"},
+		{s.MissedPolicy != ScheduleMissedSkip && s.MissedPolicy != ScheduleMissedCatchUp,
+			fmt.Sprintf("missed_policy must be one of [%s, %s]", ScheduleMissedSkip, ScheduleMissedCatchUp)},
+	}
+	if _, err := ParseCron(s.CronExpression); err != nil {
+		conditions = append(conditions, validationCondition{true, err.Error()})
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		conditions = append(conditions, validationCondition{true, fmt.Sprintf("unknown timezone [%s]", s.Timezone)})
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// IsEnabled returns whether the schedule should create runs; schedules
+// are enabled unless explicitly disabled
+//
+func (s *Schedule) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+//
+// NextAfter returns the first tick of the schedule strictly after t
+//
+func (s *Schedule) NextAfter(t time.Time) (time.Time, error) {
+	cs, err := ParseCron(s.CronExpression)
+	if err != nil {
+		return t, err
+	}
+
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return t, err
+	}
+
+	next := cs.Next(t.In(loc))
+	if next.IsZero() {
+		return t, fmt.Errorf("cron expression [%s] never matches", s.CronExpression)
+	}
+	return next, nil
+}
+
+//
+// UpdateWith updates this schedule with information from another
+//
+func (s *Schedule) UpdateWith(other Schedule) {
+	if len(other.DefinitionID) > 0 {
+		s.DefinitionID = other.DefinitionID
+		s.Alias = ""
+	}
+	if len(other.Alias) > 0 {
+		s.Alias = other.Alias
+		s.DefinitionID = ""
+	}
+	if len(other.CronExpression) > 0 {
+		s.CronExpression = other.CronExpression
+	}
+	if len(other.Timezone) > 0 {
+		s.Timezone = other.Timezone
+	}
+	if len(other.ClusterName) > 0 {
+		s.ClusterName = other.ClusterName
+	}
+	if other.Env != nil {
+		s.Env = other.Env
+	}
+	if len(other.OwnerID) > 0 {
+		s.OwnerID = other.OwnerID
+	}
+	if len(other.MissedPolicy) > 0 {
+		s.MissedPolicy = other.MissedPolicy
+	}
+	if other.Enabled != nil {
+		s.Enabled = other.Enabled
+	}
+	if other.NextRunAt != nil {
+		s.NextRunAt = other.NextRunAt
+	}
+	if other.LastRunAt != nil {
+		s.LastRunAt = other.LastRunAt
+	}
+}
+
+func (s Schedule) MarshalJSON() ([]byte, error) {
+	type Alias Schedule
+
+	env := s.Env
+	if env == nil {
+		env = &EnvList{}
+	}
+	enabled := s.IsEnabled()
+
+	return json.Marshal(&struct {
+		Env     *EnvList `json:"env"`
+		Enabled bool     `json:"enabled"`
+		Alias
+	}{
+		Env:     env,
+		Enabled: enabled,
+		Alias:   (Alias)(s),
+	})
+}
+
+//
+// ScheduleList wraps a list of Schedules
+//
+type ScheduleList struct {
+	Total     int        `json:"total"`
+	Schedules []Schedule `json:"schedules"`
+}
+
+// NewWebhookID returns a new uuid for a Webhook
+func NewWebhookID() (string, error) {
+	return newUUIDv4()
+}
+
+// NewWebhookDeliveryID returns a new uuid for a WebhookDelivery
+func NewWebhookDeliveryID() (string, error) {
+	return newUUIDv4()
+}
+
+//
+// StatusList is a list of run statuses
+//
+type StatusList []string
+
+//
+// Webhook is a subscription to run status transitions; each transition
+// of a matching run is POSTed to URL
+// - runs of DefinitionID, runs in GroupName, or, with neither, all runs
+// - only transitions to one of Statuses, if any are given
+// - with FailedOnly, only runs that stopped without a zero exit code
+// - requests are signed with Secret, if it is set
+//
+type Webhook struct {
+	WebhookID    string      `json:"webhook_id"`
+	URL          string      `json:"url"`
+	Secret       string      `json:"secret,omitempty"`
+	DefinitionID string      `json:"definition_id,omitempty"`
+	GroupName    string      `json:"group_name,omitempty"`
+	Statuses     *StatusList `json:"statuses"`
+	FailedOnly   *bool       `json:"failed_only"`
+	CreatedAt    *time.Time  `json:"created_at,omitempty"`
+}
+
+//
+// IsValid returns true only if this is a valid webhook with all
+// required information
+//
+func (w *Webhook) IsValid() (bool, []string) {
+	u, err := url.Parse(w.URL)
+	conditions := []validationCondition{
+		{err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0,
+			"string [url] must be an absolute http or https url"},
+		{len(w.DefinitionID) > 0 && len(w.GroupName) > 0,
+			"at most one of [definition_id] or [group_name] may be specified"},
+	}
+	if w.Statuses != nil {
+		for _, status := range *w.Statuses {
+			known := false
+			for _, s := range []string{StatusQueued, StatusPending, StatusRunning, StatusStopped, StatusNeedsRetry} {
+				known = known || s == status
+			}
+			conditions = append(conditions, validationCondition{!known, fmt.Sprintf("unknown status [%s]", status)})
+		}
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// IsFailedOnly returns whether the webhook only fires for failed runs
+//
+func (w *Webhook) IsFailedOnly() bool {
+	return w.FailedOnly != nil && *w.FailedOnly
+}
+
+//
+// Matches returns whether the run's current status should be sent to
+// the webhook
+//
+func (w *Webhook) Matches(run Run) bool {
+	if len(w.DefinitionID) > 0 && w.DefinitionID != run.DefinitionID {
+		return false
+	}
+	if len(w.GroupName) > 0 && w.GroupName != run.GroupName {
+		return false
+	}
+
+	if w.Statuses != nil && len(*w.Statuses) > 0 {
+		matched := false
+		for _, status := range *w.Statuses {
+			matched = matched || status == run.Status
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if w.IsFailedOnly() {
+		return run.Status == StatusStopped && (run.ExitCode == nil || *run.ExitCode != 0)
+	}
+	return true
+}
+
+//
+// UpdateWith updates this webhook with information from another
+//
+func (w *Webhook) UpdateWith(other Webhook) {
+	if len(other.URL) > 0 {
+		w.URL = other.URL
+	}
+	if len(other.Secret) > 0 {
+		w.Secret = other.Secret
+	}
+	if len(other.DefinitionID) > 0 {
+		w.DefinitionID = other.DefinitionID
+		w.GroupName = ""
+	}
+	if len(other.GroupName) > 0 {
+		w.GroupName = other.GroupName
+		w.DefinitionID = ""
+	}
+	if other.Statuses != nil {
+		w.Statuses = other.Statuses
+	}
+	if other.FailedOnly != nil {
+		w.FailedOnly = other.FailedOnly
+	}
+}
+
+//
+// MarshalJSON never includes the secret
+//
+func (w Webhook) MarshalJSON() ([]byte, error) {
+	type Alias Webhook
+
+	statuses := w.Statuses
+	if statuses == nil {
+		statuses = &StatusList{}
+	}
+
+	return json.Marshal(&struct {
+		Secret     string      `json:"secret,omitempty"`
+		HasSecret  bool        `json:"has_secret"`
+		Statuses   *StatusList `json:"statuses"`
+		FailedOnly bool        `json:"failed_only"`
+		Alias
+	}{
+		HasSecret:  len(w.Secret) > 0,
+		Statuses:   statuses,
+		FailedOnly: w.IsFailedOnly(),
+		Alias:      (Alias)(w),
+	})
+}
+
+//
+// WebhookList wraps a list of Webhooks
+//
+type WebhookList struct {
+	Total    int       `json:"total"`
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+//
+// WebhookDelivery records the outcome of sending one run status
+// transition to a webhook, after all of its attempts
+//
+type WebhookDelivery struct {
+	DeliveryID   string     `json:"delivery_id"`
+	WebhookID    string     `json:"webhook_id"`
+	RunID        string     `json:"run_id"`
+	RunStatus    string     `json:"run_status"`
+	Attempts     int64      `json:"attempts"`
+	ResponseCode int64      `json:"response_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Succeeded    bool       `json:"succeeded"`
+	CreatedAt    *time.Time `json:"created_at,omitempty"`
+}
+
+//
+// WebhookDeliveryList wraps a list of WebhookDeliveries
+//
+type WebhookDeliveryList struct {
+	Total      int               `json:"total"`
+	Deliveries []WebhookDelivery `json:"deliveries"`
+}
+
+// ScopeDefinitionsWrite allows creating, updating and deleting definitions
+var ScopeDefinitionsWrite = "definitions:write"
+
+// ScopeRunsExecute allows launching runs
+var ScopeRunsExecute = "runs:execute"
+
+// ScopeRunsStop allows stopping runs
+var ScopeRunsStop = "runs:stop"
+
+// ScopeRunsUpdate allows reporting the status of runs
+var ScopeRunsUpdate = "runs:update"
+
+// ScopeSchedulesWrite allows creating, updating and deleting schedules
+var ScopeSchedulesWrite = "schedules:write"
+
+// ScopeWebhooksWrite allows creating, updating and deleting webhooks
+var ScopeWebhooksWrite = "webhooks:write"
+
+// ScopeTokensAdmin allows creating, listing and revoking api tokens
+var ScopeTokensAdmin = "tokens:admin"
+
+//
+// IsValidScope checks that the given scope
+// string is one of the valid scopes
+//
+func IsValidScope(scope string) bool {
+	return scope == ScopeDefinitionsWrite ||
+		scope == ScopeRunsExecute ||
+		scope == ScopeRunsStop ||
+		scope == ScopeRunsUpdate ||
+		scope == ScopeSchedulesWrite ||
+		scope == ScopeWebhooksWrite ||
+		scope == ScopeTokensAdmin
+}
+
+// NewTokenID returns a new uuid for a Token
+func NewTokenID() (string, error) {
+	return newUUIDv4()
+}
+
+//
+// ScopeList is a list of token scopes
+//
+type ScopeList []string
+
+//
+// Token is an api token; requests bearing it act as Principal, and may
+// read anything but only change what its Scopes allow
+// - only a hash of the token is stored; the token itself is shown once,
+//   when it is created
+// - revoked tokens are kept, with RevokedAt set, but no longer authenticate
+//
+type Token struct {
+	TokenID   string     `json:"token_id"`
+	Name      string     `json:"name"`
+	Principal string     `json:"principal"`
+	Scopes    *ScopeList `json:"scopes"`
+	Hash      string     `json:"-"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+//
+// IsValid returns true only if this is a valid token with all
+// required information
+//
+func (t *Token) IsValid() (bool, []string) {
+	conditions := []validationCondition{
+		{len(t.Name) == 0, "string [name] must be specified"},
+		{len(t.Principal) == 0, "string [principal] must be specified"},
+		{t.Scopes == nil || len(*t.Scopes) == 0, "list [scopes] must contain at least one scope"},
+	}
+	if t.Scopes != nil {
+		for _, scope := range *t.Scopes {
+			conditions = append(conditions, validationCondition{!IsValidScope(scope), fmt.Sprintf("unknown scope [%s]", scope)})
+		}
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// HasScope returns whether the token grants scope
+//
+func (t *Token) HasScope(scope string) bool {
+	if t.Scopes == nil {
+		return false
+	}
+	for _, s := range *t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// IsRevoked returns whether the token was revoked
+//
+func (t *Token) IsRevoked() bool {
+	return t.RevokedAt != nil
+}
+
+//
+// TokenList wraps a list of Tokens
+//
+type TokenList struct {
+	Total  int     `json:"total"`
+	Tokens []Token `json:"tokens"`
+}
+
+// RoleViewer may read definitions and runs of a group
+var RoleViewer = "viewer"
+
+// RoleRunner may also launch and stop runs of a group
+var RoleRunner = "runner"
+
+// RoleEditor may also create, update and delete definitions of a group
+var RoleEditor = "editor"
+
+// RoleAdmin may also grant and revoke roles in a group
+var RoleAdmin = "admin"
+
+// Roles, each allowing everything the ones before it do
+var roles = []string{RoleViewer, RoleRunner, RoleEditor, RoleAdmin}
+
+// AllGroups as a RoleBinding's GroupName grants the role in every group
+var AllGroups = "*"
+
+//
+// IsValidRole checks that the given role
+// string is one of the valid roles
+//
+func IsValidRole(role string) bool {
+	return roleRank(role) >= 0
+}
+
+//
+// RoleAllows returns whether role allows everything required does
+//
+func RoleAllows(role string, required string) bool {
+	return roleRank(role) >= 0 && roleRank(role) >= roleRank(required)
+}
+
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+//
+// RoleBinding grants Principal a Role in the group GroupName, or
+// in every group if GroupName is AllGroups
+//
+type RoleBinding struct {
+	Principal string     `json:"principal"`
+	GroupName string     `json:"group_name"`
+	Role      string     `json:"role"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+}
+
+//
+// IsValid returns true only if this is a valid role binding with all
+// required information
+//
+func (b *RoleBinding) IsValid() (bool, []string) {
+	conditions := []validationCondition{
+		{len(b.Principal) == 0, "string [principal] must be specified"},
+		{len(b.GroupName) == 0, "string [group_name] must be specified"},
+		{!IsValidRole(b.Role), fmt.Sprintf("role must be one of [%s]", strings.Join(roles, ", "))},
+	}
+
+	valid := true
+	var reasons []string
+	for _, cond := range conditions {
+		if cond.condition {
+			valid = false
+			reasons = append(reasons, cond.reason)
+		}
+	}
+	return valid, reasons
+}
+
+//
+// RoleBindingList wraps a list of RoleBindings
+//
+type RoleBindingList struct {
+	Total        int           `json:"total"`
+	RoleBindings []RoleBinding `json:"role_bindings"`
+}
+
+//
+// IdempotencyKey records the run an owner created with an idempotency
+// key, and a hash of the request that created it, so that repeating
+// the request returns that run rather than creating another
+//
+type IdempotencyKey struct {
+	OwnerID     string    `json:"owner_id"`
+	Key         string    `json:"idempotency_key"`
+	RunID       string    `json:"run_id"`
+	RequestHash string    `json:"request_hash"`
+	CreatedAt   time.Time `json:"created_at"`
+}
@@ -0,0 +1,189 @@
+package state
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy_Backoff(t *testing.T) {
+	rp := RetryPolicy{MaxAttempts: 10, BackoffSeconds: 30, MaxBackoffSeconds: 300}
+	expected := []time.Duration{30, 60, 120, 240, 300, 300}
+	for i, e := range expected {
+		if backoff := rp.Backoff(int64(i + 1)); backoff != e*time.Second {
+			t.Errorf("Expected backoff after attempt %v to be %v, was %v", i+1, e*time.Second, backoff)
+		}
+	}
+
+	rp = RetryPolicy{MaxAttempts: 100, BackoffSeconds: 1}
+	if backoff := rp.Backoff(100); backoff != 24*time.Hour {
+		t.Errorf("Expected unset max backoff to cap at a day, was %v", backoff)
+	}
+}
+
+func TestRetryPolicy_IsValid(t *testing.T) {
+	invalid := []RetryPolicy{
+		{MaxAttempts: 0},
+		{MaxAttempts: 1, BackoffSeconds: -1},
+		{MaxAttempts: 1, BackoffSeconds: 60, MaxBackoffSeconds: 30},
+	}
+	for _, rp := range invalid {
+		if valid, _ := rp.IsValid(); valid {
+			t.Errorf("Expected retry policy %v to be invalid", rp)
+		}
+	}
+
+	memory := int64(512)
+	d := Definition{
+		Image: "image", GroupName: "group", Alias: "alias", Memory: &memory, Command: "echo hi",
+		RetryPolicy: &RetryPolicy{MaxAttempts: 0},
+	}
+	if valid, reasons := d.IsValid(); valid || len(reasons) != 1 {
+		t.Errorf("Expected definition with invalid retry policy to be invalid, got %v", reasons)
+	}
+}
+
+func TestRun_UpdateWithNewAttempt(t *testing.T) {
+	exitCode := int64(1)
+	now := time.Now()
+	r := Run{
+		RunID: "run", Status: StatusNeedsRetry, Attempt: 1, TaskArn: "arn:task/1", ExitCode: &exitCode,
+		StartedAt: &now, FinishedAt: &now, InstanceID: "i-1",
+		FailureReason: "CannotPullContainerError", RetryAt: &now,
+		Attempts: &RunAttempts{{Attempt: 1}},
+	}
+
+	r.UpdateWith(Run{Status: StatusQueued, Attempt: 2})
+	if r.Status != StatusQueued || r.Attempt != 2 {
+		t.Errorf("Expected queued second attempt, was %s attempt %v", r.Status, r.Attempt)
+	}
+
+	if len(r.TaskArn) != 0 || r.ExitCode != nil || r.StartedAt != nil || r.FinishedAt != nil ||
+		len(r.InstanceID) != 0 || len(r.FailureReason) != 0 || r.RetryAt != nil {
+		t.Errorf("Expected outcome of the previous attempt to be cleared, got %v", r)
+	}
+
+	if r.Attempts == nil || len(*r.Attempts) != 1 {
+		t.Errorf("Expected attempt history to be kept")
+	}
+}
+
+func TestRun_Deadline(t *testing.T) {
+	startedAt := time.Date(2017, 7, 4, 0, 0, 0, 0, time.UTC)
+	timeout := int64(90)
+
+	r := Run{TimeoutSeconds: &timeout}
+	if r.Deadline() != nil {
+		t.Errorf("Expected no deadline for a run that has not started")
+	}
+
+	r.StartedAt = &startedAt
+	deadline := r.Deadline()
+	if deadline == nil || !deadline.Equal(startedAt.Add(90*time.Second)) {
+		t.Errorf("Expected deadline 90 seconds after start, got %v", deadline)
+	}
+
+	r.TimeoutSeconds = nil
+	if r.Deadline() != nil {
+		t.Errorf("Expected no deadline for a run without a timeout")
+	}
+}
+
+func TestRun_HasReached(t *testing.T) {
+	cases := []struct {
+		status  string
+		wanted  string
+		reached bool
+	}{
+		{StatusQueued, StatusQueued, true},
+		{StatusQueued, StatusRunning, false},
+		{StatusRunning, StatusPending, true},
+		{StatusStopped, StatusRunning, true},
+		{StatusRunning, StatusStopped, false},
+		{StatusNeedsRetry, StatusStopped, false},
+		{StatusNeedsRetry, StatusQueued, false},
+		{StatusStopped, StatusNeedsRetry, false},
+		{StatusNeedsRetry, StatusNeedsRetry, true},
+	}
+	for _, c := range cases {
+		r := Run{Status: c.status}
+		if r.HasReached(c.wanted) != c.reached {
+			t.Errorf("Expected %s reaching %s to be %v", c.status, c.wanted, c.reached)
+		}
+	}
+}
+
+func TestWebhook_Matches(t *testing.T) {
+	exitZero := int64(0)
+	exitOne := int64(1)
+	failedOnly := true
+
+	global := Webhook{}
+	byGroup := Webhook{GroupName: "g1", Statuses: &StatusList{StatusRunning}}
+	failures := Webhook{DefinitionID: "A", FailedOnly: &failedOnly}
+
+	cases := []struct {
+		hook     Webhook
+		run      Run
+		expected bool
+	}{
+		{global, Run{Status: StatusQueued}, true},
+		{byGroup, Run{GroupName: "g1", Status: StatusRunning}, true},
+		{byGroup, Run{GroupName: "g1", Status: StatusStopped}, false},
+		{byGroup, Run{GroupName: "g2", Status: StatusRunning}, false},
+		{failures, Run{DefinitionID: "A", Status: StatusStopped, ExitCode: &exitOne}, true},
+		{failures, Run{DefinitionID: "A", Status: StatusStopped}, true},
+		{failures, Run{DefinitionID: "A", Status: StatusStopped, ExitCode: &exitZero}, false},
+		{failures, Run{DefinitionID: "A", Status: StatusRunning}, false},
+		{failures, Run{DefinitionID: "B", Status: StatusStopped, ExitCode: &exitOne}, false},
+	}
+	for i, c := range cases {
+		if matched := c.hook.Matches(c.run); matched != c.expected {
+			t.Errorf("Case %d: expected match %v but was %v", i, c.expected, matched)
+		}
+	}
+}
+
+func TestWebhook_IsValid(t *testing.T) {
+	valid := Webhook{URL: "https://example.com/hook", Statuses: &StatusList{StatusStopped}}
+	if ok, reasons := valid.IsValid(); !ok {
+		t.Errorf("Expected webhook to be valid, got %v", reasons)
+	}
+
+	invalid := Webhook{URL: "example.com", DefinitionID: "A", GroupName: "g1", Statuses: &StatusList{"DONE"}}
+	if ok, reasons := invalid.IsValid(); ok || len(reasons) != 3 {
+		t.Errorf("Expected 3 reasons webhook is invalid, got %v", reasons)
+	}
+}
+
+func TestToken_IsValid(t *testing.T) {
+	tok := Token{Name: "ci", Principal: "ci-bot", Scopes: &ScopeList{ScopeRunsExecute}}
+	if valid, reasons := tok.IsValid(); !valid {
+		t.Errorf("Expected token to be valid, got %v", reasons)
+	}
+	if !tok.HasScope(ScopeRunsExecute) || tok.HasScope(ScopeRunsStop) {
+		t.Errorf("Expected token to have only the runs:execute scope")
+	}
+
+	tok.Scopes = &ScopeList{"runs:everything"}
+	if valid, _ := tok.IsValid(); valid {
+		t.Errorf("Expected token with unknown scope to be invalid")
+	}
+
+	if valid, reasons := (&Token{}).IsValid(); valid || len(reasons) != 3 {
+		t.Errorf("Expected empty token to be invalid for 3 reasons, got %v", reasons)
+	}
+}
+
+func TestRoleAllows(t *testing.T) {
+	if !RoleAllows(RoleAdmin, RoleRunner) || !RoleAllows(RoleRunner, RoleRunner) {
+		t.Errorf("Expected roles to allow themselves and the roles before them")
+	}
+	if RoleAllows(RoleRunner, RoleEditor) || RoleAllows("owner", RoleViewer) {
+		t.Errorf("Expected roles not to allow later or unknown roles")
+	}
+
+	b := RoleBinding{Principal: "ci-bot", GroupName: "g1", Role: "owner"}
+	if valid, reasons := b.IsValid(); valid || len(reasons) != 1 {
+		t.Errorf("Expected role binding with an unknown role to be invalid, got %v", reasons)
+	}
+}
@@ -2,7 +2,8 @@ package state
 
 //
 // CreateTablesSQL postgres specific query for creating task
-// definition, run, and related tables
+// definition, run, and related tables; the first migration, which
+// databases created before migrations were recorded already have
 //
 const CreateTablesSQL = `
 --
@@ -23,9 +24,16 @@ CREATE TABLE IF NOT EXISTS task_def (
   container_name character varying NOT NULL,
   task_type character varying,
   -- Refactor these
+  revision integer,
+  retry_policy jsonb,
+  timeout_seconds integer,
   CONSTRAINT task_def_alias UNIQUE(alias)
 );
 
+ALTER TABLE task_def ADD COLUMN IF NOT EXISTS revision integer;
+ALTER TABLE task_def ADD COLUMN IF NOT EXISTS retry_policy jsonb;
+ALTER TABLE task_def ADD COLUMN IF NOT EXISTS timeout_seconds integer;
+
 CREATE TABLE IF NOT EXISTS task_def_ports (
   task_def_id character varying NOT NULL REFERENCES task_def(definition_id),
   port integer NOT NULL,
@@ -36,6 +44,34 @@ CREATE INDEX IF NOT EXISTS ix_task_def_alias ON task_def(alias);
 CREATE INDEX IF NOT EXISTS ix_task_def_group_name ON task_def(group_name);
 CREATE INDEX IF NOT EXISTS ix_task_def_image ON task_def(image);
 CREATE INDEX IF NOT EXISTS ix_task_def_env ON task_def USING gin (env jsonb_path_ops);
+
+--
+-- Definition revisions; an immutable copy of the definition is
+-- stored each time it is created or updated
+--
+
+CREATE TABLE IF NOT EXISTS task_def_revision (
+  definition_id character varying NOT NULL REFERENCES task_def(definition_id),
+  revision integer NOT NULL,
+  arn character varying,
+  image character varying NOT NULL,
+  group_name character varying NOT NULL,
+  container_name character varying NOT NULL,
+  "user" character varying,
+  alias character varying,
+  memory integer,
+  command text,
+  env jsonb,
+  ports jsonb,
+  tags jsonb,
+  retry_policy jsonb,
+  timeout_seconds integer,
+  created_at timestamp with time zone DEFAULT now(),
+  CONSTRAINT task_def_revision_pkey PRIMARY KEY(definition_id, revision)
+);
+
+ALTER TABLE task_def_revision ADD COLUMN IF NOT EXISTS retry_policy jsonb;
+ALTER TABLE task_def_revision ADD COLUMN IF NOT EXISTS timeout_seconds integer;
 --
 -- Runs
 --
@@ -58,10 +94,49 @@ CREATE TABLE IF NOT EXISTS task (
   task_arn character varying,
   docker_id character varying,
   "user" character varying,
-  task_type character varying
+  task_type character varying,
   -- Refactor these --
+  command text,
+  memory integer,
+  ports jsonb,
+  definition_arn character varying,
+  container_name character varying,
+  definition_revision integer,
+  retry_policy jsonb,
+  attempt integer,
+  attempts jsonb,
+  failure_reason text,
+  retry_at timestamp with time zone,
+  timeout_seconds integer,
+  queued_at timestamp with time zone
 );
 
+--
+-- Definition snapshot columns for tables created before runs copied
+-- their definition at creation time
+--
+ALTER TABLE task ADD COLUMN IF NOT EXISTS command text;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS memory integer;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS ports jsonb;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS definition_arn character varying;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS container_name character varying;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS definition_revision integer;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS retry_policy jsonb;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS timeout_seconds integer;
+
+--
+-- Retry columns for tables created before attempts were counted
+--
+ALTER TABLE task ADD COLUMN IF NOT EXISTS attempt integer;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS attempts jsonb;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS failure_reason text;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS retry_at timestamp with time zone;
+
+--
+-- When runs were (re)queued, for measuring how long they wait to run
+--
+ALTER TABLE task ADD COLUMN IF NOT EXISTS queued_at timestamp with time zone;
+
 CREATE INDEX IF NOT EXISTS ix_task_definition_id ON task(definition_id);
 CREATE INDEX IF NOT EXISTS ix_task_cluster_name ON task(cluster_name);
 CREATE INDEX IF NOT EXISTS ix_task_status ON task(status);
@@ -103,6 +178,146 @@ CREATE TABLE IF NOT EXISTS task_def_tags (
   tag_id character varying NOT NULL REFERENCES tags(text),
   task_def_id character varying NOT NULL REFERENCES task_def(definition_id)
 );
+
+--
+-- Schedules
+--
+CREATE TABLE IF NOT EXISTS schedules (
+  schedule_id character varying NOT NULL PRIMARY KEY,
+  definition_id character varying REFERENCES task_def(definition_id),
+  alias character varying,
+  cron character varying NOT NULL,
+  timezone character varying NOT NULL DEFAULT 'UTC',
+  cluster_name character varying NOT NULL,
+  env jsonb,
+  owner_id character varying,
+  missed_policy character varying NOT NULL DEFAULT 'skip',
+  enabled boolean NOT NULL DEFAULT true,
+  next_run_at timestamp with time zone,
+  last_run_at timestamp with time zone,
+  created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_schedules_next_run_at ON schedules(next_run_at) WHERE enabled;
+CREATE INDEX IF NOT EXISTS ix_schedules_definition_id ON schedules(definition_id);
+
+--
+-- Webhooks
+--
+CREATE TABLE IF NOT EXISTS webhooks (
+  webhook_id character varying NOT NULL PRIMARY KEY,
+  url character varying NOT NULL,
+  secret character varying,
+  definition_id character varying,
+  group_name character varying,
+  statuses jsonb,
+  failed_only boolean NOT NULL DEFAULT false,
+  created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  delivery_id character varying NOT NULL PRIMARY KEY,
+  webhook_id character varying NOT NULL REFERENCES webhooks(webhook_id) ON DELETE CASCADE,
+  run_id character varying NOT NULL,
+  run_status character varying NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  response_code integer,
+  error character varying,
+  succeeded boolean NOT NULL DEFAULT false,
+  created_at timestamp with time zone DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS ix_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+
+--
+-- API tokens; only hashes of the tokens are stored
+--
+CREATE TABLE IF NOT EXISTS api_tokens (
+  token_id character varying NOT NULL PRIMARY KEY,
+  name character varying NOT NULL,
+  principal character varying NOT NULL,
+  scopes jsonb NOT NULL,
+  token_hash character varying NOT NULL UNIQUE,
+  created_at timestamp with time zone DEFAULT now(),
+  revoked_at timestamp with time zone
+);
+
+CREATE INDEX IF NOT EXISTS ix_api_tokens_principal ON api_tokens(principal);
+
+--
+-- Roles of principals in groups
+--
+CREATE TABLE IF NOT EXISTS role_bindings (
+  group_name character varying NOT NULL,
+  principal character varying NOT NULL,
+  role character varying NOT NULL,
+  created_at timestamp with time zone DEFAULT now(),
+  PRIMARY KEY (group_name, principal)
+);
+
+CREATE INDEX IF NOT EXISTS ix_role_bindings_principal ON role_bindings(principal);
+
+--
+-- Runs created with idempotency keys, by owner
+--
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  owner_id character varying NOT NULL,
+  idempotency_key character varying NOT NULL,
+  run_id character varying NOT NULL,
+  request_hash character varying NOT NULL,
+  created_at timestamp with time zone NOT NULL,
+  PRIMARY KEY (owner_id, idempotency_key)
+);
+`
+
+//
+// DropTablesSQL postgres specific query reverting CreateTablesSQL
+//
+const DropTablesSQL = `
+DROP TABLE IF EXISTS
+  idempotency_keys, role_bindings, api_tokens, webhook_deliveries, webhooks, schedules,
+  task_def_tags, tags, task_status, task, task_def_revision, task_def_ports, task_def;
+DROP SEQUENCE IF EXISTS task_status_status_id_seq;
+`
+
+//
+// AddResourcesSQL postgres specific query adding the cpu and memory
+// reservation of definitions, their revisions and runs
+//
+const AddResourcesSQL = `
+ALTER TABLE task_def ADD COLUMN IF NOT EXISTS cpu integer;
+ALTER TABLE task_def ADD COLUMN IF NOT EXISTS memory_reservation integer;
+ALTER TABLE task_def_revision ADD COLUMN IF NOT EXISTS cpu integer;
+ALTER TABLE task_def_revision ADD COLUMN IF NOT EXISTS memory_reservation integer;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS cpu integer;
+ALTER TABLE task ADD COLUMN IF NOT EXISTS memory_reservation integer;
+`
+
+//
+// DropResourcesSQL postgres specific query reverting AddResourcesSQL
+//
+const DropResourcesSQL = `
+ALTER TABLE task DROP COLUMN IF EXISTS memory_reservation;
+ALTER TABLE task DROP COLUMN IF EXISTS cpu;
+ALTER TABLE task_def_revision DROP COLUMN IF EXISTS memory_reservation;
+ALTER TABLE task_def_revision DROP COLUMN IF EXISTS cpu;
+ALTER TABLE task_def DROP COLUMN IF EXISTS memory_reservation;
+ALTER TABLE task_def DROP COLUMN IF EXISTS cpu;
+`
+
+//
+// AddClaimedAtSQL postgres specific query adding when runs were last
+// claimed for submission
+//
+const AddClaimedAtSQL = `
+ALTER TABLE task ADD COLUMN IF NOT EXISTS claimed_at timestamp with time zone;
+`
+
+//
+// DropClaimedAtSQL postgres specific query reverting AddClaimedAtSQL
+//
+const DropClaimedAtSQL = `
+ALTER TABLE task DROP COLUMN IF EXISTS claimed_at;
 `
 
 //
@@ -118,11 +333,16 @@ select
   coalesce(td.user,'')      as "user",
   td.alias                  as alias,
   td.memory                 as memory,
+  td.cpu                    as cpu,
+  td.memory_reservation     as memoryreserved,
   coalesce(td.command,'')   as command,
   coalesce(td.task_type,'') as tasktype,
   env::TEXT                 as env,
   ports                     as ports,
-  tags                      as tags
+  tags                      as tags,
+  coalesce(td.revision,0)   as revision,
+  td.retry_policy::TEXT     as retrypolicy,
+  td.timeout_seconds        as timeoutseconds
   from (select * from task_def) td left outer join
     (select task_def_id,
       array_to_json(array_agg(port))::TEXT as ports
@@ -151,6 +371,42 @@ const GetDefinitionSQL = DefinitionSelect + "\nwhere definition_id = $1"
 //
 const GetDefinitionByAliasSQL = DefinitionSelect + "\nwhere alias = $1"
 
+//
+// DefinitionRevisionSelect postgres specific query for definition revisions
+//
+const DefinitionRevisionSelect = `
+select
+  coalesce(r.arn,'')        as arn,
+  r.definition_id           as definitionid,
+  r.image                   as image,
+  r.group_name              as groupname,
+  r.container_name          as containername,
+  coalesce(r.user,'')       as "user",
+  coalesce(r.alias,'')      as alias,
+  r.memory                  as memory,
+  r.cpu                     as cpu,
+  r.memory_reservation      as memoryreserved,
+  coalesce(r.command,'')    as command,
+  r.env::TEXT               as env,
+  r.ports::TEXT             as ports,
+  r.tags::TEXT              as tags,
+  r.revision                as revision,
+  r.retry_policy::TEXT      as retrypolicy,
+  r.timeout_seconds         as timeoutseconds,
+  r.created_at              as createdat
+from task_def_revision r
+`
+
+//
+// ListDefinitionRevisionsSQL postgres specific query for listing a definition's revisions, newest first
+//
+const ListDefinitionRevisionsSQL = DefinitionRevisionSelect + "\nwhere definition_id = $1 order by revision desc limit $2 offset $3"
+
+//
+// GetDefinitionRevisionSQL postgres specific query for getting a single definition revision
+//
+const GetDefinitionRevisionSQL = DefinitionRevisionSelect + "\nwhere definition_id = $1 and revision = $2"
+
 //
 // RunSelect postgres specific query for runs
 //
@@ -171,7 +427,23 @@ select
   coalesce(t.group_name,'')                  as groupname,
   coalesce(t.user,'')                        as "user",
   coalesce(t.task_type,'')                   as tasktype,
-  env::TEXT                                  as env
+  env::TEXT                                  as env,
+  coalesce(t.command,'')                     as command,
+  t.memory                                   as memory,
+  t.ports::TEXT                              as ports,
+  coalesce(t.definition_arn,'')              as definitionarn,
+  coalesce(t.container_name,'')              as containername,
+  coalesce(t.definition_revision,0)          as definitionrevision,
+  t.retry_policy::TEXT                       as retrypolicy,
+  coalesce(t.attempt,1)                      as attempt,
+  t.attempts::TEXT                           as attempts,
+  coalesce(t.failure_reason,'')              as failurereason,
+  t.retry_at                                 as retryat,
+  t.timeout_seconds                          as timeoutseconds,
+  t.queued_at                                as queuedat,
+  t.cpu                                      as cpu,
+  t.memory_reservation                       as memoryreserved,
+  t.claimed_at                               as claimedat
 from task t
 `
 
@@ -200,3 +472,162 @@ select distinct text from tags
 
 const ListGroupsSQL = GroupsSelect + "\n%s order by group_name asc limit $1 offset $2"
 const ListTagsSQL = TagsSelect + "\n%s order by text asc limit $1 offset $2"
+
+//
+// ScheduleSelect postgres specific query for schedules
+//
+const ScheduleSelect = `
+select
+  s.schedule_id                 as scheduleid,
+  coalesce(s.definition_id,'')  as definitionid,
+  coalesce(s.alias,'')          as alias,
+  s.cron                        as cronexpression,
+  s.timezone                    as timezone,
+  s.cluster_name                as clustername,
+  s.env::TEXT                   as env,
+  coalesce(s.owner_id,'')       as ownerid,
+  s.missed_policy               as missedpolicy,
+  s.enabled                     as enabled,
+  s.next_run_at                 as nextrunat,
+  s.last_run_at                 as lastrunat,
+  s.created_at                  as createdat
+from schedules s
+`
+
+//
+// ListSchedulesSQL postgres specific query for listing schedules
+//
+const ListSchedulesSQL = ScheduleSelect + "\n%s order by created_at asc limit $1 offset $2"
+
+//
+// GetScheduleSQL postgres specific query for getting a single schedule
+//
+const GetScheduleSQL = ScheduleSelect + "\nwhere schedule_id = $1"
+
+//
+// ListDueSchedulesSQL postgres specific query for enabled schedules whose next tick has passed
+//
+const ListDueSchedulesSQL = ScheduleSelect + "\nwhere enabled and next_run_at <= $1 order by next_run_at asc limit $2"
+
+//
+// WebhookSelect postgres specific query for webhooks
+//
+const WebhookSelect = `
+select
+  w.webhook_id                  as webhookid,
+  w.url                         as url,
+  coalesce(w.secret,'')         as secret,
+  coalesce(w.definition_id,'')  as definitionid,
+  coalesce(w.group_name,'')     as groupname,
+  w.statuses::TEXT              as statuses,
+  w.failed_only                 as failedonly,
+  w.created_at                  as createdat
+from webhooks w
+`
+
+//
+// ListWebhooksSQL postgres specific query for listing webhooks
+//
+const ListWebhooksSQL = WebhookSelect + "\n%s order by created_at asc limit $1 offset $2"
+
+//
+// GetWebhookSQL postgres specific query for getting a single webhook
+//
+const GetWebhookSQL = WebhookSelect + "\nwhere webhook_id = $1"
+
+//
+// ListWebhookDeliveriesSQL postgres specific query for the deliveries of a webhook, newest first
+//
+const ListWebhookDeliveriesSQL = `
+select
+  d.delivery_id                 as deliveryid,
+  d.webhook_id                  as webhookid,
+  d.run_id                      as runid,
+  d.run_status                  as runstatus,
+  d.attempts                    as attempts,
+  coalesce(d.response_code,0)   as responsecode,
+  coalesce(d.error,'')          as error,
+  d.succeeded                   as succeeded,
+  d.created_at                  as createdat
+from webhook_deliveries d
+where webhook_id = $1 order by created_at desc limit $2 offset $3
+`
+
+//
+// TokenSelect postgres specific query for api tokens
+//
+const TokenSelect = `
+select
+  t.token_id                    as tokenid,
+  t.name                        as name,
+  t.principal                   as principal,
+  t.scopes::TEXT                as scopes,
+  t.token_hash                  as hash,
+  t.created_at                  as createdat,
+  t.revoked_at                  as revokedat
+from api_tokens t
+`
+
+//
+// ListTokensSQL postgres specific query for listing api tokens
+//
+const ListTokensSQL = TokenSelect + "\n%s order by created_at asc limit $1 offset $2"
+
+//
+// GetTokenSQL postgres specific query for getting a single api token
+//
+const GetTokenSQL = TokenSelect + "\nwhere token_id = $1"
+
+//
+// GetTokenByHashSQL postgres specific query for getting the api token with a hash
+//
+const GetTokenByHashSQL = TokenSelect + "\nwhere token_hash = $1"
+
+//
+// RoleBindingSelect postgres specific query for role bindings
+//
+const RoleBindingSelect = `
+select
+  b.principal                   as principal,
+  b.group_name                  as groupname,
+  b.role                        as role,
+  b.created_at                  as createdat
+from role_bindings b
+`
+
+//
+// ListRoleBindingsSQL postgres specific query for listing role bindings
+//
+const ListRoleBindingsSQL = RoleBindingSelect + "\n%s order by group_name asc, principal asc limit $1 offset $2"
+
+//
+// GetIdempotencyKeySQL postgres specific query for getting an owner's idempotency key
+//
+const GetIdempotencyKeySQL = `
+select
+  k.owner_id                    as ownerid,
+  k.idempotency_key             as key,
+  k.run_id                      as runid,
+  k.request_hash                as requesthash,
+  k.created_at                  as createdat
+from idempotency_keys k
+where k.owner_id = $1 and k.idempotency_key = $2
+`
+
+//
+// AcquireLeaseSQL takes an advisory lock, held until the end of the
+// transaction, if no one else holds it
+//
+const AcquireLeaseSQL = `SELECT pg_try_advisory_xact_lock($1)`
+
+//
+// runStatusChannel is the channel postgres notifies run status changes on,
+// with the run's id as payload
+//
+const runStatusChannel = "flotilla_run_status"
+
+//
+// NotifyRunStatusSQL notifies listeners of runStatusChannel that a run
+// changed status
+//
+const NotifyRunStatusSQL = `SELECT pg_notify('` + runStatusChannel + `', $1)`
@@ -7,12 +7,14 @@ import (
 	"github.com/jmoiron/sqlx"
 	// Pull in postgres specific drivers
 	"database/sql"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/exceptions"
+	"hash/fnv"
 	"math"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,7 +22,13 @@ import (
 // SQLStateManager uses postgresql to manage state
 //
 type SQLStateManager struct {
-	db *sqlx.DB
+	db    *sqlx.DB
+	dburl string
+
+	// Listens for run status changes once a run is watched
+	watchMu  sync.Mutex
+	listener *pq.Listener
+	watching map[string]map[chan struct{}]bool
 }
 
 //
@@ -31,11 +39,12 @@ func (sm *SQLStateManager) Name() string {
 }
 
 //
-// Initialize creates tables if they do not exist
+// Initialize applies pending schema migrations if `create_database_schema`
 //
 func (sm *SQLStateManager) Initialize(conf config.Config) error {
 	dburl := conf.GetString("database_url")
 	createSchema := conf.GetBool("create_database_schema")
+	sm.dburl = dburl
 
 	var err error
 	if sm.db, err = sqlx.Open("postgres", dburl); err != nil {
@@ -57,19 +66,15 @@ func (sm *SQLStateManager) Initialize(conf config.Config) error {
 				return errors.Wrap(err, "error trying to connect to postgres db, retries exhausted")
 			}
 		}
+	}
 
-		if err = sm.createTables(); err != nil {
-			return errors.Wrap(err, "problem executing create tables sql")
-		}
+	// Otherwise only refuses a schema migrated by a newer flotilla
+	if err = migrateOrCheck(sm.db, postgresMigrations, createSchema); err != nil {
+		return errors.Wrap(err, "problem migrating database schema")
 	}
 	return nil
 }
 
-func (sm *SQLStateManager) createTables() error {
-	_, err := sm.db.Exec(CreateTablesSQL)
-	return err
-}
-
 func (sm *SQLStateManager) makeWhereClause(filters map[string][]string) []string {
 
 	// These will be joined with "AND"
@@ -207,6 +212,25 @@ func (sm *SQLStateManager) GetDefinitionByAlias(alias string) (Definition, error
 // - updates can be partial
 //
 func (sm *SQLStateManager) UpdateDefinition(definitionID string, updates Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.UpdateWith(updates)
+	})
+}
+
+//
+// ReplaceDefinition stores d as the definition's new revision, keeping
+// only its identity; see Definition.Restore
+//
+func (sm *SQLStateManager) ReplaceDefinition(definitionID string, d Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.Restore(d)
+	})
+}
+
+//
+// updateDefinition stores the definition, as changed by apply, as its new revision
+//
+func (sm *SQLStateManager) updateDefinition(definitionID string, apply func(existing *Definition)) (Definition, error) {
 	var (
 		err      error
 		existing Definition
@@ -216,17 +240,22 @@ func (sm *SQLStateManager) UpdateDefinition(definitionID string, updates Definit
 		return existing, errors.WithStack(err)
 	}
 
-	existing.UpdateWith(updates)
+	previous := existing
+	apply(&existing)
 
 	selectForUpdate := `SELECT * FROM task_def WHERE definition_id = $1 FOR UPDATE;`
 	deletePorts := `DELETE FROM task_def_ports WHERE task_def_id = $1;`
 	deleteTags := `DELETE FROM task_def_tags WHERE task_def_id = $1`
+	latestRevision := `SELECT coalesce(max(revision), 0) FROM task_def_revision WHERE definition_id = $1;`
 	update := `
     UPDATE task_def SET
       arn = $2, image = $3,
       container_name = $4, "user" = $5,
       alias = $6, memory = $7,
-      command = $8, env = $9
+      command = $8, env = $9,
+      revision = $10, retry_policy = $11,
+      timeout_seconds = $12, cpu = $13,
+      memory_reservation = $14
     WHERE definition_id = $1;
     `
 
@@ -255,6 +284,26 @@ func (sm *SQLStateManager) UpdateDefinition(definitionID string, updates Definit
 		return existing, errors.WithStack(err)
 	}
 
+	var latest int64
+	if err = tx.QueryRow(latestRevision, definitionID).Scan(&latest); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	//
+	// Definitions created before revisions were recorded have no history;
+	// keep their pre-update state as the first revision
+	//
+	if latest == 0 {
+		previous.Revision = 1
+		if err = sm.insertDefinitionRevision(tx, previous); err != nil {
+			tx.Rollback()
+			return existing, errors.WithStack(err)
+		}
+		latest = previous.Revision
+	}
+	existing.Revision = latest + 1
+
 	if _, err = tx.Exec(deletePorts, definitionID); err != nil {
 		return existing, errors.WithStack(err)
 	}
@@ -267,7 +316,8 @@ func (sm *SQLStateManager) UpdateDefinition(definitionID string, updates Definit
 		update, definitionID,
 		existing.Arn, existing.Image, existing.ContainerName,
 		existing.User, existing.Alias, existing.Memory,
-		existing.Command, existing.Env); err != nil {
+		existing.Command, existing.Env, existing.Revision, existing.RetryPolicy,
+		existing.TimeoutSeconds, existing.CPU, existing.MemoryReserved); err != nil {
 		return existing, errors.Wrapf(err, "issue updating definition [%s]", definitionID)
 	}
 
@@ -292,6 +342,12 @@ func (sm *SQLStateManager) UpdateDefinition(definitionID string, updates Definit
 			}
 		}
 	}
+
+	if err = sm.insertDefinitionRevision(tx, existing); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return existing, errors.WithStack(err)
@@ -308,9 +364,10 @@ func (sm *SQLStateManager) CreateDefinition(d Definition) error {
 	insert := `
     INSERT INTO task_def(
       arn, definition_id, image, group_name,
-      container_name, "user", alias, memory, command, env
+      container_name, "user", alias, memory, command, env, revision,
+      retry_policy, timeout_seconds, cpu, memory_reservation
     )
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15);
     `
 
 	insertPorts := `
@@ -329,6 +386,9 @@ func (sm *SQLStateManager) CreateDefinition(d Definition) error {
 	INSERT INTO tags(text) SELECT $1 WHERE NOT EXISTS (SELECT text from tags where text = $2)
 	`
 
+	// New definitions always start at their first revision
+	d.Revision = 1
+
 	tx, err := sm.db.Begin()
 	if err != nil {
 		return errors.WithStack(err)
@@ -336,7 +396,8 @@ func (sm *SQLStateManager) CreateDefinition(d Definition) error {
 
 	if _, err = tx.Exec(insert,
 		d.Arn, d.DefinitionID, d.Image, d.GroupName, d.ContainerName,
-		d.User, d.Alias, d.Memory, d.Command, d.Env); err != nil {
+		d.User, d.Alias, d.Memory, d.Command, d.Env, d.Revision, d.RetryPolicy,
+		d.TimeoutSeconds, d.CPU, d.MemoryReserved); err != nil {
 		tx.Rollback()
 		return errors.Wrapf(
 			err, "issue creating new task definition with alias [%s] and id [%s]", d.DefinitionID, d.Alias)
@@ -363,6 +424,12 @@ func (sm *SQLStateManager) CreateDefinition(d Definition) error {
 			}
 		}
 	}
+
+	if err = sm.insertDefinitionRevision(tx, d); err != nil {
+		tx.Rollback()
+		return errors.WithStack(err)
+	}
+
 	err = tx.Commit()
 	if err != nil {
 		return errors.WithStack(err)
@@ -370,6 +437,68 @@ func (sm *SQLStateManager) CreateDefinition(d Definition) error {
 	return nil
 }
 
+//
+// insertDefinitionRevision stores an immutable copy of the definition
+// at its current revision as part of the given transaction
+//
+func (sm *SQLStateManager) insertDefinitionRevision(tx *sql.Tx, d Definition) error {
+	insert := `
+    INSERT INTO task_def_revision(
+      definition_id, revision, arn, image, group_name, container_name,
+      "user", alias, memory, command, env, ports, tags, retry_policy,
+      timeout_seconds, cpu, memory_reservation
+    )
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17);
+    `
+	if _, err := tx.Exec(insert,
+		d.DefinitionID, d.Revision, d.Arn, d.Image, d.GroupName, d.ContainerName,
+		d.User, d.Alias, d.Memory, d.Command, d.Env, d.Ports, d.Tags, d.RetryPolicy,
+		d.TimeoutSeconds, d.CPU, d.MemoryReserved); err != nil {
+		return errors.Wrapf(
+			err, "issue storing revision [%d] of definition [%s]", d.Revision, d.DefinitionID)
+	}
+	return nil
+}
+
+//
+// ListDefinitionRevisions returns the revisions of a definition, newest first
+//
+func (sm *SQLStateManager) ListDefinitionRevisions(
+	definitionID string, limit int, offset int) (DefinitionRevisionList, error) {
+	var err error
+	var result DefinitionRevisionList
+
+	err = sm.db.Select(&result.Revisions, ListDefinitionRevisionsSQL, definitionID, limit, offset)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing revisions of definition [%s]", definitionID)
+	}
+
+	countSQL := "select COUNT(*) from task_def_revision where definition_id = $1"
+	err = sm.db.Get(&result.Total, countSQL, definitionID)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue counting revisions of definition [%s]", definitionID)
+	}
+	return result, nil
+}
+
+//
+// GetDefinitionRevision returns a single revision of a definition
+//
+func (sm *SQLStateManager) GetDefinitionRevision(definitionID string, revision int64) (DefinitionRevision, error) {
+	var err error
+	var dr DefinitionRevision
+	err = sm.db.Get(&dr, GetDefinitionRevisionSQL, definitionID, revision)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dr, exceptions.MissingResource{
+				fmt.Sprintf("Revision %d of definition with ID %s not found", revision, definitionID)}
+		}
+		return dr, errors.Wrapf(
+			err, "issue getting revision [%d] of definition with id [%s]", revision, definitionID)
+	}
+	return dr, nil
+}
+
 //
 // DeleteDefinition deletes definition and associated runs and environment variables
 //
@@ -379,6 +508,8 @@ func (sm *SQLStateManager) DeleteDefinition(definitionID string) error {
 	statements := []string{
 		"DELETE FROM task_def_ports WHERE task_def_id = $1",
 		"DELETE FROM task_def_tags WHERE task_def_id = $1",
+		"DELETE FROM task_def_revision WHERE definition_id = $1",
+		"DELETE FROM schedules WHERE definition_id = $1",
 		"DELETE FROM task WHERE definition_id = $1",
 		"DELETE FROM task_def WHERE definition_id = $1",
 	}
@@ -486,7 +617,11 @@ func (sm *SQLStateManager) UpdateRun(runID string, updates Run) (Run, error) {
 			&existing.TaskArn, &existing.RunID, &existing.DefinitionID, &existing.Alias, &existing.Image,
 			&existing.ClusterName, &existing.ExitCode, &existing.Status, &existing.StartedAt,
 			&existing.FinishedAt, &existing.InstanceID, &existing.InstanceDNSName, &existing.GroupName,
-			&existing.User, &existing.TaskType, &existing.Env)
+			&existing.User, &existing.TaskType, &existing.Env, &existing.Command, &existing.Memory,
+			&existing.Ports, &existing.DefinitionArn, &existing.ContainerName, &existing.DefinitionRevision,
+			&existing.RetryPolicy, &existing.Attempt, &existing.Attempts, &existing.FailureReason,
+			&existing.RetryAt, &existing.TimeoutSeconds, &existing.QueuedAt, &existing.CPU,
+			&existing.MemoryReserved, &existing.ClaimedAt)
 	}
 	if err != nil {
 		return existing, errors.WithStack(err)
@@ -502,7 +637,15 @@ func (sm *SQLStateManager) UpdateRun(runID string, updates Run) (Run, error) {
       status = $8, started_at = $9,
       finished_at = $10, instance_id = $11,
       instance_dns_name = $12,
-      group_name = $13, env = $14
+      group_name = $13, env = $14,
+      command = $15, memory = $16,
+      ports = $17, definition_arn = $18,
+      container_name = $19, definition_revision = $20,
+      retry_policy = $21, attempt = $22,
+      attempts = $23, failure_reason = $24,
+      retry_at = $25, timeout_seconds = $26,
+      queued_at = $27, cpu = $28,
+      memory_reservation = $29
     WHERE run_id = $1;
     `
 
@@ -514,7 +657,13 @@ func (sm *SQLStateManager) UpdateRun(runID string, updates Run) (Run, error) {
 		existing.Status, existing.StartedAt,
 		existing.FinishedAt, existing.InstanceID,
 		existing.InstanceDNSName, existing.GroupName,
-		existing.Env); err != nil {
+		existing.Env, existing.Command, existing.Memory,
+		existing.Ports, existing.DefinitionArn,
+		existing.ContainerName, existing.DefinitionRevision,
+		existing.RetryPolicy, existing.Attempt,
+		existing.Attempts, existing.FailureReason,
+		existing.RetryAt, existing.TimeoutSeconds,
+		existing.QueuedAt, existing.CPU, existing.MemoryReserved); err != nil {
 		tx.Rollback()
 		return existing, errors.WithStack(err)
 	}
@@ -526,18 +675,96 @@ func (sm *SQLStateManager) UpdateRun(runID string, updates Run) (Run, error) {
 	return existing, nil
 }
 
+//
+// ClaimRun atomically moves the run from QUEUED to PENDING and records
+// when in its ClaimedAt, returning false if it was not QUEUED (eg. another
+// worker claimed it from a duplicate message); a run is only submitted by
+// whoever claimed it
+//
+func (sm *SQLStateManager) ClaimRun(runID string) (bool, error) {
+	claim := `
+    UPDATE task SET status = $2, claimed_at = $4
+    WHERE run_id = $1 AND status = $3;
+    `
+	res, err := sm.db.Exec(claim, runID, StatusPending, StatusQueued, time.Now())
+	if err != nil {
+		return false, errors.Wrapf(err, "issue claiming run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// ReleaseRun atomically moves a claimed run, one that is PENDING without
+// a task, back to QUEUED, eg. when it could not be submitted yet; returns
+// false if it was not such a run
+//
+func (sm *SQLStateManager) ReleaseRun(runID string) (bool, error) {
+	release := `
+    UPDATE task SET status = $2
+    WHERE run_id = $1 AND status = $3 AND COALESCE(task_arn, '') = '';
+    `
+	res, err := sm.db.Exec(release, runID, StatusQueued, StatusPending)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue releasing run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// StopClaimedRun atomically moves a claimed run, one that is PENDING
+// without a task, to STOPPED, eg. when it is terminated while being
+// submitted; returns false if it was not such a run
+//
+func (sm *SQLStateManager) StopClaimedRun(runID string) (bool, error) {
+	stop := `
+    UPDATE task SET status = $2
+    WHERE run_id = $1 AND status = $3 AND COALESCE(task_arn, '') = '';
+    `
+	res, err := sm.db.Exec(stop, runID, StatusStopped, StatusPending)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue stopping run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
 //
 // CreateRun creates the passed in run
 //
 func (sm *SQLStateManager) CreateRun(r Run) error {
+	return sm.CreateRunWithin(r, nil)
+}
+
+//
+// CreateRunWithin creates the run and calls within, if non-nil, in the
+// same transaction; the run is only committed if within succeeds
+//
+func (sm *SQLStateManager) CreateRunWithin(r Run, within func(tx *sql.Tx) error) error {
 	var err error
 	insert := `
 	INSERT INTO task (
       task_arn, run_id, definition_id, alias, image, cluster_name, exit_code, status,
       started_at, finished_at, instance_id, instance_dns_name, group_name,
-      env, task_type
+      env, task_type, command, memory, ports, definition_arn, container_name,
+      definition_revision, retry_policy, attempt, attempts, failure_reason,
+      retry_at, timeout_seconds, queued_at, cpu, memory_reservation
     ) VALUES (
-      $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, 'task'
+      $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, 'task',
+      $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29
     );
     `
 
@@ -551,11 +778,22 @@ func (sm *SQLStateManager) CreateRun(r Run) error {
 		r.Alias, r.Image, r.ClusterName,
 		r.ExitCode, r.Status, r.StartedAt,
 		r.FinishedAt, r.InstanceID,
-		r.InstanceDNSName, r.GroupName, r.Env); err != nil {
+		r.InstanceDNSName, r.GroupName, r.Env,
+		r.Command, r.Memory, r.Ports,
+		r.DefinitionArn, r.ContainerName, r.DefinitionRevision,
+		r.RetryPolicy, r.Attempt, r.Attempts, r.FailureReason,
+		r.RetryAt, r.TimeoutSeconds, r.QueuedAt, r.CPU, r.MemoryReserved); err != nil {
 		tx.Rollback()
 		return errors.Wrapf(err, "issue creating new task run with id [%s]", r.RunID)
 	}
 
+	if within != nil {
+		if err = within(tx); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "issue completing creation of task run with id [%s]", r.RunID)
+		}
+	}
+
 	if err = tx.Commit(); err != nil {
 		return errors.WithStack(err)
 	}
@@ -618,10 +856,682 @@ func (sm *SQLStateManager) ListTags(limit int, offset int, name *string) (TagsLi
 	return result, nil
 }
 
+//
+// ListSchedules returns a ScheduleList
+// limit: limit the result to this many schedules
+// offset: start the results at this offset
+// filters: map of field filters on Schedule - joined with AND
+//
+func (sm *SQLStateManager) ListSchedules(
+	limit int, offset int, filters map[string][]string) (ScheduleList, error) {
+
+	var err error
+	var result ScheduleList
+	var whereClause string
+	where := sm.makeWhereClause(filters)
+	if len(where) > 0 {
+		whereClause = fmt.Sprintf("where %s", strings.Join(where, " and "))
+	}
+
+	sql := fmt.Sprintf(ListSchedulesSQL, whereClause)
+	countSQL := fmt.Sprintf("select COUNT(*) from (%s) as sq", sql)
+
+	err = sm.db.Select(&result.Schedules, sql, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list schedules sql")
+	}
+	err = sm.db.Get(&result.Total, countSQL, nil, 0)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list schedules count sql")
+	}
+
+	return result, nil
+}
+
+//
+// GetSchedule returns a single schedule by id
+//
+func (sm *SQLStateManager) GetSchedule(scheduleID string) (Schedule, error) {
+	var s Schedule
+	err := sm.db.Get(&s, GetScheduleSQL, scheduleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return s, exceptions.MissingResource{
+				fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+		}
+		return s, errors.Wrapf(err, "issue getting schedule with id [%s]", scheduleID)
+	}
+	return s, nil
+}
+
+//
+// CreateSchedule creates the passed in schedule
+//
+func (sm *SQLStateManager) CreateSchedule(s Schedule) error {
+	insert := `
+    INSERT INTO schedules (
+      schedule_id, definition_id, alias, cron, timezone, cluster_name,
+      env, owner_id, missed_policy, enabled, next_run_at, last_run_at
+    ) VALUES (
+      $1, NULLIF($2,''), NULLIF($3,''), $4, $5, $6, $7, $8, $9, $10, $11, $12
+    );
+    `
+	if _, err := sm.db.Exec(insert,
+		s.ScheduleID, s.DefinitionID, s.Alias, s.CronExpression, s.Timezone, s.ClusterName,
+		s.Env, s.OwnerID, s.MissedPolicy, s.IsEnabled(), s.NextRunAt, s.LastRunAt); err != nil {
+		return errors.Wrapf(err, "issue creating new schedule with id [%s]", s.ScheduleID)
+	}
+	return nil
+}
+
+//
+// UpdateSchedule updates schedule with updates - can be partial
+//
+func (sm *SQLStateManager) UpdateSchedule(scheduleID string, updates Schedule) (Schedule, error) {
+	var existing Schedule
+
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Get(&existing, GetScheduleSQL+" for update", scheduleID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return existing, exceptions.MissingResource{
+				fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+		}
+		return existing, errors.Wrapf(err, "issue getting schedule with id [%s]", scheduleID)
+	}
+
+	existing.UpdateWith(updates)
+
+	update := `
+    UPDATE schedules SET
+      definition_id = NULLIF($2,''), alias = NULLIF($3,''),
+      cron = $4, timezone = $5,
+      cluster_name = $6, env = $7,
+      owner_id = $8, missed_policy = $9,
+      enabled = $10, next_run_at = $11,
+      last_run_at = $12
+    WHERE schedule_id = $1;
+    `
+
+	if _, err = tx.Exec(
+		update, scheduleID,
+		existing.DefinitionID, existing.Alias,
+		existing.CronExpression, existing.Timezone,
+		existing.ClusterName, existing.Env,
+		existing.OwnerID, existing.MissedPolicy,
+		existing.IsEnabled(), existing.NextRunAt,
+		existing.LastRunAt); err != nil {
+		tx.Rollback()
+		return existing, errors.Wrapf(err, "issue updating schedule with id [%s]", scheduleID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// DeleteSchedule deletes a schedule; runs it created are kept
+//
+func (sm *SQLStateManager) DeleteSchedule(scheduleID string) error {
+	if _, err := sm.db.Exec("DELETE FROM schedules WHERE schedule_id = $1", scheduleID); err != nil {
+		return errors.Wrapf(err, "issue deleting schedule with id [%s]", scheduleID)
+	}
+	return nil
+}
+
+//
+// ListDueSchedules returns -at most- limit enabled schedules
+// whose next tick is at or before now, oldest tick first
+//
+func (sm *SQLStateManager) ListDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	var due []Schedule
+	if err := sm.db.Select(&due, ListDueSchedulesSQL, now, limit); err != nil {
+		return due, errors.Wrap(err, "issue running list due schedules sql")
+	}
+	return due, nil
+}
+
+//
+// ClaimScheduleTick atomically advances the schedule from tick to next,
+// returning false if tick was already claimed (eg. by another worker)
+// or the schedule was changed or disabled in the meantime
+//
+func (sm *SQLStateManager) ClaimScheduleTick(scheduleID string, tick time.Time, next time.Time) (bool, error) {
+	claim := `
+    UPDATE schedules SET next_run_at = $3, last_run_at = $2
+    WHERE schedule_id = $1 AND next_run_at = $2 AND enabled;
+    `
+	res, err := sm.db.Exec(claim, scheduleID, tick, next)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue claiming tick [%s] of schedule with id [%s]", tick, scheduleID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// ListWebhooks returns a WebhookList
+// limit: limit the result to this many webhooks
+// offset: start the results at this offset
+// filters: map of field filters on Webhook - joined with AND
+//
+func (sm *SQLStateManager) ListWebhooks(
+	limit int, offset int, filters map[string][]string) (WebhookList, error) {
+
+	var err error
+	var result WebhookList
+	var whereClause string
+	where := sm.makeWhereClause(filters)
+	if len(where) > 0 {
+		whereClause = fmt.Sprintf("where %s", strings.Join(where, " and "))
+	}
+
+	sql := fmt.Sprintf(ListWebhooksSQL, whereClause)
+	countSQL := fmt.Sprintf("select COUNT(*) from (%s) as sq", sql)
+
+	err = sm.db.Select(&result.Webhooks, sql, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list webhooks sql")
+	}
+	err = sm.db.Get(&result.Total, countSQL, nil, 0)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list webhooks count sql")
+	}
+
+	return result, nil
+}
+
+//
+// GetWebhook returns a single webhook by id
+//
+func (sm *SQLStateManager) GetWebhook(webhookID string) (Webhook, error) {
+	var w Webhook
+	err := sm.db.Get(&w, GetWebhookSQL, webhookID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return w, exceptions.MissingResource{
+				fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+		}
+		return w, errors.Wrapf(err, "issue getting webhook with id [%s]", webhookID)
+	}
+	return w, nil
+}
+
+//
+// CreateWebhook creates the passed in webhook
+//
+func (sm *SQLStateManager) CreateWebhook(w Webhook) error {
+	insert := `
+    INSERT INTO webhooks (
+      webhook_id, url, secret, definition_id, group_name, statuses, failed_only
+    ) VALUES (
+      $1, $2, NULLIF($3,''), NULLIF($4,''), NULLIF($5,''), $6, $7
+    );
+    `
+	if _, err := sm.db.Exec(insert,
+		w.WebhookID, w.URL, w.Secret, w.DefinitionID, w.GroupName,
+		w.Statuses, w.IsFailedOnly()); err != nil {
+		return errors.Wrapf(err, "issue creating new webhook with id [%s]", w.WebhookID)
+	}
+	return nil
+}
+
+//
+// UpdateWebhook updates webhook with updates - can be partial
+//
+func (sm *SQLStateManager) UpdateWebhook(webhookID string, updates Webhook) (Webhook, error) {
+	var existing Webhook
+
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Get(&existing, GetWebhookSQL+" for update", webhookID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return existing, exceptions.MissingResource{
+				fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+		}
+		return existing, errors.Wrapf(err, "issue getting webhook with id [%s]", webhookID)
+	}
+
+	existing.UpdateWith(updates)
+
+	update := `
+    UPDATE webhooks SET
+      url = $2, secret = NULLIF($3,''),
+      definition_id = NULLIF($4,''), group_name = NULLIF($5,''),
+      statuses = $6, failed_only = $7
+    WHERE webhook_id = $1;
+    `
+
+	if _, err = tx.Exec(
+		update, webhookID,
+		existing.URL, existing.Secret,
+		existing.DefinitionID, existing.GroupName,
+		existing.Statuses, existing.IsFailedOnly()); err != nil {
+		tx.Rollback()
+		return existing, errors.Wrapf(err, "issue updating webhook with id [%s]", webhookID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// DeleteWebhook deletes a webhook along with its deliveries
+//
+func (sm *SQLStateManager) DeleteWebhook(webhookID string) error {
+	if _, err := sm.db.Exec("DELETE FROM webhooks WHERE webhook_id = $1", webhookID); err != nil {
+		return errors.Wrapf(err, "issue deleting webhook with id [%s]", webhookID)
+	}
+	return nil
+}
+
+//
+// ListWebhookDeliveries returns the deliveries of a webhook, newest first
+//
+func (sm *SQLStateManager) ListWebhookDeliveries(
+	webhookID string, limit int, offset int) (WebhookDeliveryList, error) {
+
+	var err error
+	var result WebhookDeliveryList
+
+	err = sm.db.Select(&result.Deliveries, ListWebhookDeliveriesSQL, webhookID, limit, offset)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing deliveries of webhook with id [%s]", webhookID)
+	}
+	err = sm.db.Get(&result.Total,
+		"select COUNT(*) from webhook_deliveries where webhook_id = $1", webhookID)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue counting deliveries of webhook with id [%s]", webhookID)
+	}
+
+	return result, nil
+}
+
+//
+// CreateWebhookDelivery records the passed in delivery
+//
+func (sm *SQLStateManager) CreateWebhookDelivery(d WebhookDelivery) error {
+	insert := `
+    INSERT INTO webhook_deliveries (
+      delivery_id, webhook_id, run_id, run_status,
+      attempts, response_code, error, succeeded
+    ) VALUES (
+      $1, $2, $3, $4, $5, NULLIF($6,0), NULLIF($7,''), $8
+    );
+    `
+	if _, err := sm.db.Exec(insert,
+		d.DeliveryID, d.WebhookID, d.RunID, d.RunStatus,
+		d.Attempts, d.ResponseCode, d.Error, d.Succeeded); err != nil {
+		return errors.Wrapf(err, "issue creating webhook delivery with id [%s]", d.DeliveryID)
+	}
+	return nil
+}
+
+//
+// ListTokens returns a TokenList
+// limit: limit the result to this many tokens
+// offset: start the results at this offset
+// filters: map of field filters on Token - joined with AND
+//
+func (sm *SQLStateManager) ListTokens(
+	limit int, offset int, filters map[string][]string) (TokenList, error) {
+
+	var err error
+	var result TokenList
+	var whereClause string
+	where := sm.makeWhereClause(filters)
+	if len(where) > 0 {
+		whereClause = fmt.Sprintf("where %s", strings.Join(where, " and "))
+	}
+
+	sql := fmt.Sprintf(ListTokensSQL, whereClause)
+	countSQL := fmt.Sprintf("select COUNT(*) from (%s) as sq", sql)
+
+	err = sm.db.Select(&result.Tokens, sql, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list tokens sql")
+	}
+	err = sm.db.Get(&result.Total, countSQL, nil, 0)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list tokens count sql")
+	}
+
+	return result, nil
+}
+
+//
+// GetToken returns a single api token by id
+//
+func (sm *SQLStateManager) GetToken(tokenID string) (Token, error) {
+	var t Token
+	err := sm.db.Get(&t, GetTokenSQL, tokenID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, exceptions.MissingResource{
+				fmt.Sprintf("Token with ID %s not found", tokenID)}
+		}
+		return t, errors.Wrapf(err, "issue getting token with id [%s]", tokenID)
+	}
+	return t, nil
+}
+
+//
+// GetTokenByHash returns the api token with the given hash
+//
+func (sm *SQLStateManager) GetTokenByHash(hash string) (Token, error) {
+	var t Token
+	err := sm.db.Get(&t, GetTokenByHashSQL, hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, exceptions.MissingResource{"Token not found"}
+		}
+		return t, errors.Wrap(err, "issue getting token by hash")
+	}
+	return t, nil
+}
+
+//
+// CreateToken creates the passed in api token
+//
+func (sm *SQLStateManager) CreateToken(t Token) error {
+	insert := `
+    INSERT INTO api_tokens (
+      token_id, name, principal, scopes, token_hash
+    ) VALUES (
+      $1, $2, $3, $4, $5
+    );
+    `
+	if _, err := sm.db.Exec(insert,
+		t.TokenID, t.Name, t.Principal, t.Scopes, t.Hash); err != nil {
+		return errors.Wrapf(err, "issue creating new token with id [%s]", t.TokenID)
+	}
+	return nil
+}
+
+//
+// RevokeToken revokes an api token; revoking a revoked token keeps
+// the time it was first revoked
+//
+func (sm *SQLStateManager) RevokeToken(tokenID string) (Token, error) {
+	revoke := `
+    UPDATE api_tokens SET revoked_at = coalesce(revoked_at, now())
+    WHERE token_id = $1;
+    `
+	res, err := sm.db.Exec(revoke, tokenID)
+	if err != nil {
+		return Token{}, errors.Wrapf(err, "issue revoking token with id [%s]", tokenID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Token{}, errors.WithStack(err)
+	}
+	if n == 0 {
+		return Token{}, exceptions.MissingResource{
+			fmt.Sprintf("Token with ID %s not found", tokenID)}
+	}
+	return sm.GetToken(tokenID)
+}
+
+//
+// ListRoleBindings returns a RoleBindingList
+// limit: limit the result to this many role bindings
+// offset: start the results at this offset
+// filters: map of field filters on RoleBinding - joined with AND
+//
+func (sm *SQLStateManager) ListRoleBindings(
+	limit int, offset int, filters map[string][]string) (RoleBindingList, error) {
+
+	var err error
+	var result RoleBindingList
+	var whereClause string
+	where := sm.makeWhereClause(filters)
+	if len(where) > 0 {
+		whereClause = fmt.Sprintf("where %s", strings.Join(where, " and "))
+	}
+
+	sql := fmt.Sprintf(ListRoleBindingsSQL, whereClause)
+	countSQL := fmt.Sprintf("select COUNT(*) from (%s) as sq", sql)
+
+	err = sm.db.Select(&result.RoleBindings, sql, limit, offset)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list role bindings sql")
+	}
+	err = sm.db.Get(&result.Total, countSQL, nil, 0)
+	if err != nil {
+		return result, errors.Wrap(err, "issue running list role bindings count sql")
+	}
+
+	return result, nil
+}
+
+//
+// PutRoleBinding grants the role binding's principal its role in its
+// group, replacing any role they had there
+//
+func (sm *SQLStateManager) PutRoleBinding(b RoleBinding) (RoleBinding, error) {
+	upsert := `
+    INSERT INTO role_bindings (group_name, principal, role) VALUES ($1, $2, $3)
+    ON CONFLICT (group_name, principal) DO UPDATE SET role = $3
+    RETURNING created_at;
+    `
+	if err := sm.db.Get(&b.CreatedAt, upsert, b.GroupName, b.Principal, b.Role); err != nil {
+		return b, errors.Wrapf(err,
+			"issue granting role [%s] in group [%s] to [%s]", b.Role, b.GroupName, b.Principal)
+	}
+	return b, nil
+}
+
+//
+// DeleteRoleBinding revokes the principal's role in the group
+//
+func (sm *SQLStateManager) DeleteRoleBinding(groupName string, principal string) error {
+	if _, err := sm.db.Exec(
+		"DELETE FROM role_bindings WHERE group_name = $1 AND principal = $2", groupName, principal); err != nil {
+		return errors.Wrapf(err, "issue revoking role in group [%s] from [%s]", groupName, principal)
+	}
+	return nil
+}
+
+//
+// ClaimIdempotencyKey atomically claims the owner's idempotency key for
+// k's run, unless it was claimed after since; returns the claim that
+// holds the key, and whether it is k
+//
+func (sm *SQLStateManager) ClaimIdempotencyKey(k IdempotencyKey, since time.Time) (IdempotencyKey, bool, error) {
+	claim := `
+    INSERT INTO idempotency_keys (owner_id, idempotency_key, run_id, request_hash, created_at)
+    VALUES ($1, $2, $3, $4, $5)
+    ON CONFLICT (owner_id, idempotency_key) DO UPDATE
+    SET run_id = $3, request_hash = $4, created_at = $5
+    WHERE idempotency_keys.created_at <= $6
+    RETURNING run_id;
+    `
+	var runID string
+	err := sm.db.Get(&runID, claim, k.OwnerID, k.Key, k.RunID, k.RequestHash, k.CreatedAt, since)
+	if err == nil {
+		return k, true, nil
+	}
+	if err != sql.ErrNoRows {
+		return k, false, errors.Wrapf(err, "issue claiming idempotency key [%s] of [%s]", k.Key, k.OwnerID)
+	}
+
+	var existing IdempotencyKey
+	err = sm.db.Get(&existing, GetIdempotencyKeySQL, k.OwnerID, k.Key)
+	if err != nil {
+		return existing, false, errors.Wrapf(err, "issue getting idempotency key [%s] of [%s]", k.Key, k.OwnerID)
+	}
+	return existing, false, nil
+}
+
+//
+// ReleaseIdempotencyKey gives up the owner's claim on key for runID, eg.
+// when the run could not be created
+//
+func (sm *SQLStateManager) ReleaseIdempotencyKey(ownerID string, key string, runID string) error {
+	if _, err := sm.db.Exec(
+		"DELETE FROM idempotency_keys WHERE owner_id = $1 AND idempotency_key = $2 AND run_id = $3",
+		ownerID, key, runID); err != nil {
+		return errors.Wrapf(err, "issue releasing idempotency key [%s] of [%s]", key, ownerID)
+	}
+	return nil
+}
+
+//
+// AcquireLease tries to take a postgres advisory lock for name
+// * the lock is held by a transaction that is kept open, so that the
+//   connection holding it is not returned to the pool; the lock, and so
+//   the lease, ends when the transaction does, including when the
+//   connection of a replica that died is closed
+//
+func (sm *SQLStateManager) AcquireLease(name string) (Lease, error) {
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var acquired bool
+	if err = tx.QueryRow(AcquireLeaseSQL, leaseKey(name)).Scan(&acquired); err != nil {
+		tx.Rollback()
+		return nil, errors.Wrapf(err, "issue acquiring lease [%s]", name)
+	}
+	if !acquired {
+		tx.Rollback()
+		return nil, nil
+	}
+	return &pgLease{tx: tx}, nil
+}
+
+//
+// leaseKey maps lease names onto the 64 bit keys of advisory locks
+//
+func leaseKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("flotilla:" + name))
+	return int64(h.Sum64())
+}
+
+type pgLease struct {
+	tx *sql.Tx
+}
+
+//
+// Check fails if the connection holding the lease was lost
+//
+func (l *pgLease) Check() error {
+	_, err := l.tx.Exec("SELECT 1")
+	return errors.Wrap(err, "lease lost")
+}
+
+//
+// Release ends the transaction holding the lease
+//
+func (l *pgLease) Release() error {
+	return l.tx.Rollback()
+}
+
+//
+// NotifyStatusChange notifies every replica watching the run, through
+// postgres, that its status changed
+//
+func (sm *SQLStateManager) NotifyStatusChange(run Run) error {
+	_, err := sm.db.Exec(NotifyRunStatusSQL, run.RunID)
+	return errors.Wrapf(err, "issue notifying status change of run [%s]", run.RunID)
+}
+
+//
+// WatchRun returns a channel that receives when the run's status changes
+// * the replica listens for status changes once the first run is watched,
+//   on a connection of its own
+// * changes notified while reconnecting are missed, so every watched run
+//   is woken up on reconnecting
+//
+func (sm *SQLStateManager) WatchRun(runID string) (<-chan struct{}, func(), error) {
+	sm.watchMu.Lock()
+	defer sm.watchMu.Unlock()
+
+	if sm.listener == nil {
+		listener := pq.NewListener(sm.dburl, time.Second, time.Minute, nil)
+		if err := listener.Listen(runStatusChannel); err != nil {
+			listener.Close()
+			return nil, nil, errors.Wrap(err, "issue listening for run status changes")
+		}
+		sm.listener = listener
+		sm.watching = make(map[string]map[chan struct{}]bool)
+		go sm.dispatchStatusChanges(listener)
+	}
+
+	changed := make(chan struct{}, 1)
+	if sm.watching[runID] == nil {
+		sm.watching[runID] = make(map[chan struct{}]bool)
+	}
+	sm.watching[runID][changed] = true
+
+	stop := func() {
+		sm.watchMu.Lock()
+		defer sm.watchMu.Unlock()
+		delete(sm.watching[runID], changed)
+		if len(sm.watching[runID]) == 0 {
+			delete(sm.watching, runID)
+		}
+	}
+	return changed, stop, nil
+}
+
+//
+// dispatchStatusChanges wakes up the watchers of each run notified; the
+// listener sends nil after reconnecting
+//
+func (sm *SQLStateManager) dispatchStatusChanges(listener *pq.Listener) {
+	for n := range listener.Notify {
+		sm.watchMu.Lock()
+		if n != nil {
+			wake(sm.watching[n.Extra])
+		} else {
+			for _, watchers := range sm.watching {
+				wake(watchers)
+			}
+		}
+		sm.watchMu.Unlock()
+	}
+}
+
+func wake(watchers map[chan struct{}]bool) {
+	for changed := range watchers {
+		select {
+		case changed <- struct{}{}:
+		default:
+			// Already woken up and yet to read the run
+		}
+	}
+}
+
 //
 // Cleanup close any open resources
 //
 func (sm *SQLStateManager) Cleanup() error {
+	sm.watchMu.Lock()
+	if sm.listener != nil {
+		sm.listener.Close()
+		sm.listener = nil
+	}
+	sm.watchMu.Unlock()
 	return sm.db.Close()
 }
 
@@ -700,3 +1610,63 @@ func (e Tags) Value() (driver.Value, error) {
 	res, _ := json.Marshal(e)
 	return res, nil
 }
+
+// Scan from db
+func (e *RetryPolicy) Scan(value interface{}) error {
+	if value != nil {
+		s := []byte(value.(string))
+		json.Unmarshal(s, &e)
+	}
+	return nil
+}
+
+// Value to db
+func (e RetryPolicy) Value() (driver.Value, error) {
+	res, _ := json.Marshal(e)
+	return res, nil
+}
+
+// Scan from db
+func (e *RunAttempts) Scan(value interface{}) error {
+	if value != nil {
+		s := []byte(value.(string))
+		json.Unmarshal(s, &e)
+	}
+	return nil
+}
+
+// Value to db
+func (e RunAttempts) Value() (driver.Value, error) {
+	res, _ := json.Marshal(e)
+	return res, nil
+}
+
+// Scan from db
+func (e *StatusList) Scan(value interface{}) error {
+	if value != nil {
+		s := []byte(value.(string))
+		json.Unmarshal(s, &e)
+	}
+	return nil
+}
+
+// Value to db
+func (e StatusList) Value() (driver.Value, error) {
+	res, _ := json.Marshal(e)
+	return res, nil
+}
+
+// Scan from db
+func (e *ScopeList) Scan(value interface{}) error {
+	if value != nil {
+		s := []byte(value.(string))
+		json.Unmarshal(s, &e)
+	}
+	return nil
+}
+
+// Value to db
+func (e ScopeList) Value() (driver.Value, error) {
+	res, _ := json.Marshal(e)
+	return res, nil
+}
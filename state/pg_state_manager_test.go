@@ -1,6 +1,9 @@
 package state
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"os"
 	"testing"
@@ -23,17 +26,23 @@ func setUp() Manager {
 	conf, _ := config.NewConfig(nil)
 
 	db := getDB(conf)
+	sm := newSQLStateManager()
+	insertDefinitions(db)
+
+	return sm
+}
+
+//
+// newSQLStateManager returns a state manager with empty tables
+//
+func newSQLStateManager() Manager {
+	conf, _ := config.NewConfig(nil)
 	//
 	// Implicit testing - this will create tables
 	//
 	os.Setenv("STATE_MANAGER", "postgres")
 	os.Setenv("CREATE_DATABASE_SCHEMA", "true")
 	sm, _ := NewStateManager(conf)
-	//
-	//
-	//
-	insertDefinitions(db)
-
 	return sm
 }
 
@@ -112,12 +121,21 @@ func tearDown() {
 	db := getDB(conf)
 	db.MustExec(`
     drop table if exists
-      task, task_def, task_def_ports, task_status, task_def_tags, tags
+      task, task_def, task_def_ports, task_status, task_def_tags, tags, task_def_revision, schedules,
+      webhooks, webhook_deliveries, api_tokens, role_bindings, idempotency_keys, schema_migrations
     cascade;
     drop sequence if exists task_status_status_id_seq;
     `)
 }
 
+func TestSQLStateManager_Conformance(t *testing.T) {
+	defer tearDown()
+	testManagerConformance(t, func() Manager {
+		tearDown()
+		return newSQLStateManager()
+	})
+}
+
 func TestSQLStateManager_ListDefinitions(t *testing.T) {
 	defer tearDown()
 	sm := setUp()
@@ -340,6 +358,76 @@ func TestSQLStateManager_UpdateDefinition(t *testing.T) {
 	}
 }
 
+func TestSQLStateManager_DefinitionRevisions(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	// "A" was created before revisions were recorded
+	updated, err := sm.UpdateDefinition("A", Definition{Image: "updated"})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if updated.Revision != 2 {
+		t.Errorf("Expected update of definition without history to be revision 2, was %v", updated.Revision)
+	}
+
+	d, _ := sm.GetDefinition("A")
+	if d.Revision != 2 {
+		t.Errorf("Expected stored definition to be at revision 2, was %v", d.Revision)
+	}
+
+	drl, err := sm.ListDefinitionRevisions("A", 10, 0)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if drl.Total != 2 || len(drl.Revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %v", drl.Total)
+	}
+
+	if drl.Revisions[0].Revision != 2 || drl.Revisions[0].Image != "updated" {
+		t.Errorf("Expected newest revision first, got revision %v with image [%s]",
+			drl.Revisions[0].Revision, drl.Revisions[0].Image)
+	}
+
+	first, err := sm.GetDefinitionRevision("A", 1)
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if first.Image != "imageA" || first.Ports == nil || len(*first.Ports) != 1 {
+		t.Errorf("Expected revision 1 to keep the pre-update definition, got image [%s] and ports %v",
+			first.Image, first.Ports)
+	}
+
+	if first.CreatedAt == nil {
+		t.Errorf("Expected revision to have non-nil created_at")
+	}
+
+	if _, err = sm.GetDefinitionRevision("A", 3); err == nil {
+		t.Errorf("Expected error getting non-existent revision")
+	}
+
+	memory := int64(512)
+	if err = sm.CreateDefinition(Definition{
+		DefinitionID:  "F",
+		Image:         "imageF",
+		GroupName:     "groupF",
+		ContainerName: "containerF",
+		Alias:         "aliasF",
+		Memory:        &memory,
+		Command:       "echo 'hi'",
+	}); err != nil {
+		t.Errorf(err.Error())
+	}
+
+	created, _ := sm.GetDefinitionRevision("F", 1)
+	if created.Image != "imageF" {
+		t.Errorf("Expected new definition to be stored as revision 1")
+	}
+}
+
 func TestSQLStateManager_DeleteDefinition(t *testing.T) {
 	defer tearDown()
 	sm := setUp()
@@ -518,6 +606,7 @@ func TestSQLStateManager_CreateRun(t *testing.T) {
 	}
 
 	ec := int64(137)
+	mem := int64(512)
 	t1, _ := time.Parse(time.RFC3339, "2017-07-04T00:01:00+00:00")
 	t2, _ := time.Parse(time.RFC3339, "2017-07-04T00:02:00+00:00")
 	t1 = t1.UTC()
@@ -537,6 +626,11 @@ func TestSQLStateManager_CreateRun(t *testing.T) {
 		Env: &EnvList{
 			{Name: "RUN_PARAM", Value: "VAL"},
 		},
+		Command:       "echo hi",
+		Memory:        &mem,
+		Ports:         &PortsList{8080},
+		DefinitionArn: "arn:A",
+		ContainerName: "A",
 	}
 	sm.CreateRun(r1)
 	sm.CreateRun(r2)
@@ -576,6 +670,54 @@ func TestSQLStateManager_CreateRun(t *testing.T) {
 	if f2.Image != r2.Image {
 		t.Errorf("Expected image: [%s] but was [%s]", r2.Image, f2.Image)
 	}
+
+	// Check definition snapshot
+	if f1.HasSnapshot() || f1.Memory != nil || f1.Ports != nil {
+		t.Errorf("Expected run:17 to have no definition snapshot")
+	}
+
+	if !f2.HasSnapshot() || f2.Command != r2.Command || f2.DefinitionArn != r2.DefinitionArn {
+		t.Errorf("Expected run:18 to have definition snapshot, got command [%s] and arn [%s]",
+			f2.Command, f2.DefinitionArn)
+	}
+
+	if f2.Memory == nil || *f2.Memory != mem {
+		t.Errorf("Expected memory %v but was %v", mem, f2.Memory)
+	}
+
+	if f2.Ports == nil || len(*f2.Ports) != 1 || (*f2.Ports)[0] != 8080 {
+		t.Errorf("Expected ports [8080] but was %v", f2.Ports)
+	}
+}
+
+func TestSQLStateManager_CreateRunWithin(t *testing.T) {
+	defer tearDown()
+	sm := setUp().(*SQLStateManager)
+
+	r := Run{RunID: "run:within", DefinitionID: "A", ClusterName: "clusta", Status: StatusQueued}
+	err := sm.CreateRunWithin(r, func(tx *sql.Tx) error {
+		return errors.New("nope")
+	})
+	if err == nil {
+		t.Errorf("Expected error from within to be returned")
+	}
+
+	if _, err = sm.GetRun("run:within"); err == nil {
+		t.Errorf("Expected run:within not to be created when within fails")
+	}
+
+	called := false
+	err = sm.CreateRunWithin(r, func(tx *sql.Tx) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Errorf(err.Error())
+	}
+
+	if _, err = sm.GetRun("run:within"); !called || err != nil {
+		t.Errorf("Expected run:within to be created when within succeeds")
+	}
 }
 
 func TestSQLStateManager_UpdateRun(t *testing.T) {
@@ -653,3 +795,421 @@ func TestSQLStateManager_UpdateRun(t *testing.T) {
 		t.Errorf("Expected to update status to %s but was %s", u2.Status, r.Status)
 	}
 }
+
+func TestSQLStateManager_Schedules(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	tick := time.Date(2017, 7, 4, 1, 0, 0, 0, time.UTC)
+	s := Schedule{
+		ScheduleID:     "s1",
+		DefinitionID:   "A",
+		CronExpression: "0 * * * *",
+		Timezone:       "UTC",
+		ClusterName:    "clusta",
+		Env:            &EnvList{{Name: "K1", Value: "V1"}},
+		OwnerID:        "somebody",
+		MissedPolicy:   ScheduleMissedSkip,
+		NextRunAt:      &tick,
+	}
+	if err := sm.CreateSchedule(s); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	other := s
+	other.ScheduleID = "s2"
+	other.DefinitionID = ""
+	other.Alias = "aliasB"
+	if err := sm.CreateSchedule(other); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	sl, _ := sm.ListSchedules(10, 0, map[string][]string{"definition_id": {"A"}})
+	if sl.Total != 1 || sl.Schedules[0].ScheduleID != "s1" {
+		t.Errorf("Expected only schedule [s1] for definition [A], got %v", sl)
+	}
+
+	fetched, err := sm.GetSchedule("s1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !fetched.IsEnabled() || len(*fetched.Env) != 1 || !fetched.NextRunAt.Equal(tick) {
+		t.Errorf("Expected enabled schedule with env and next run at %v, got %v", tick, fetched)
+	}
+
+	due, _ := sm.ListDueSchedules(tick.Add(-time.Minute), 10)
+	if len(due) != 0 {
+		t.Errorf("Expected no schedules due before %v, got %v", tick, len(due))
+	}
+
+	due, _ = sm.ListDueSchedules(tick, 10)
+	if len(due) != 2 {
+		t.Errorf("Expected 2 schedules due at %v, got %v", tick, len(due))
+	}
+
+	next := tick.Add(time.Hour)
+	claimed, err := sm.ClaimScheduleTick("s1", tick, next)
+	if err != nil || !claimed {
+		t.Errorf("Expected to claim tick %v, got %v %v", tick, claimed, err)
+	}
+
+	// The same tick can only be claimed once
+	claimed, _ = sm.ClaimScheduleTick("s1", tick, next)
+	if claimed {
+		t.Errorf("Expected second claim of tick %v to fail", tick)
+	}
+
+	fetched, _ = sm.GetSchedule("s1")
+	if !fetched.NextRunAt.Equal(next) || !fetched.LastRunAt.Equal(tick) {
+		t.Errorf("Expected next run at %v and last run at %v, got %v and %v",
+			next, tick, fetched.NextRunAt, fetched.LastRunAt)
+	}
+
+	disabled := false
+	if _, err = sm.UpdateSchedule("s2", Schedule{Enabled: &disabled}); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Disabled schedules are never due or claimable
+	due, _ = sm.ListDueSchedules(next, 10)
+	if len(due) != 1 || due[0].ScheduleID != "s1" {
+		t.Errorf("Expected only schedule [s1] to be due, got %v", due)
+	}
+	if claimed, _ = sm.ClaimScheduleTick("s2", tick, next); claimed {
+		t.Errorf("Expected claim on disabled schedule to fail")
+	}
+
+	sm.DeleteSchedule("s2")
+	if _, err = sm.GetSchedule("s2"); err == nil {
+		t.Errorf("Expected deleted schedule to be missing")
+	}
+}
+
+func TestSQLStateManager_RunAttempts(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	policy := &RetryPolicy{MaxAttempts: 3, BackoffSeconds: 30, RetriableReasons: []string{"OutOfMemoryError"}}
+	r := Run{
+		RunID: "run:attempts", DefinitionID: "A", ClusterName: "clusta",
+		Status: StatusQueued, Attempt: 1, RetryPolicy: policy,
+	}
+	if err := sm.CreateRun(r); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	retryAt := time.Date(2017, 7, 4, 0, 5, 0, 0, time.UTC)
+	sm.UpdateRun(r.RunID, Run{
+		Status:        StatusNeedsRetry,
+		FailureReason: "OutOfMemoryError",
+		RetryAt:       &retryAt,
+		Attempts:      &RunAttempts{{Attempt: 1, FailureReason: "OutOfMemoryError"}},
+	})
+
+	fetched, _ := sm.GetRun(r.RunID)
+	if fetched.RetryPolicy == nil || fetched.RetryPolicy.MaxAttempts != 3 ||
+		len(fetched.RetryPolicy.RetriableReasons) != 1 {
+		t.Errorf("Expected retry policy to be saved with the run, got %v", fetched.RetryPolicy)
+	}
+
+	if fetched.FailureReason != "OutOfMemoryError" || fetched.RetryAt == nil || !fetched.RetryAt.Equal(retryAt) {
+		t.Errorf("Expected failure reason and retry time to be saved, got [%s] %v",
+			fetched.FailureReason, fetched.RetryAt)
+	}
+
+	sm.UpdateRun(r.RunID, Run{Status: StatusQueued, Attempt: 2})
+	fetched, _ = sm.GetRun(r.RunID)
+	if fetched.Attempt != 2 || fetched.RetryAt != nil || len(fetched.FailureReason) != 0 {
+		t.Errorf("Expected a clean second attempt, got %v", fetched)
+	}
+
+	if fetched.Attempts == nil || len(*fetched.Attempts) != 1 {
+		t.Errorf("Expected attempt history to be kept, got %v", fetched.Attempts)
+	}
+
+	// Runs created before attempts were counted are on their first
+	legacy, _ := sm.GetRun("run0")
+	if legacy.Attempt != 1 {
+		t.Errorf("Expected existing run to be on attempt 1, was %v", legacy.Attempt)
+	}
+}
+
+func TestSQLStateManager_Timeout(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	timeout := int64(600)
+	if _, err := sm.UpdateDefinition("A", Definition{TimeoutSeconds: &timeout}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	d, _ := sm.GetDefinition("A")
+	if d.TimeoutSeconds == nil || *d.TimeoutSeconds != timeout {
+		t.Errorf("Expected definition timeout of %v, got %v", timeout, d.TimeoutSeconds)
+	}
+
+	startedAt := time.Date(2017, 7, 4, 0, 0, 0, 0, time.UTC)
+	r := Run{RunID: "run:timeout", DefinitionID: "A", ClusterName: "clusta", Status: StatusRunning, StartedAt: &startedAt}
+	r.SnapshotDefinition(d)
+	if err := sm.CreateRun(r); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	fetched, _ := sm.GetRun(r.RunID)
+	deadline := fetched.Deadline()
+	if deadline == nil || !deadline.Equal(startedAt.Add(10*time.Minute)) {
+		t.Errorf("Expected run deadline 10 minutes after it started, got %v", deadline)
+	}
+}
+
+func TestSQLStateManager_Webhooks(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	failedOnly := true
+	w := Webhook{
+		WebhookID: "w1", URL: "https://example.com/hook", Secret: "s3cret",
+		GroupName: "g1", Statuses: &StatusList{StatusStopped}, FailedOnly: &failedOnly,
+	}
+	if err := sm.CreateWebhook(w); err != nil {
+		t.Fatalf(err.Error())
+	}
+	sm.CreateWebhook(Webhook{WebhookID: "w2", URL: "https://example.com/global"})
+
+	fetched, err := sm.GetWebhook("w1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fetched.Secret != "s3cret" || fetched.GroupName != "g1" || !fetched.IsFailedOnly() ||
+		fetched.Statuses == nil || len(*fetched.Statuses) != 1 {
+		t.Errorf("Expected webhook to round trip, got %v", fetched)
+	}
+
+	wl, _ := sm.ListWebhooks(10, 0, map[string][]string{"group_name": {"g1"}})
+	if wl.Total != 1 || len(wl.Webhooks) != 1 {
+		t.Errorf("Expected 1 webhook in group g1, got %v", wl.Total)
+	}
+
+	updated, err := sm.UpdateWebhook("w1", Webhook{DefinitionID: "A"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if updated.DefinitionID != "A" || len(updated.GroupName) != 0 || updated.Secret != "s3cret" {
+		t.Errorf("Expected webhook to move to definition A, got %v", updated)
+	}
+
+	for i, code := range []int64{500, 200} {
+		err = sm.CreateWebhookDelivery(WebhookDelivery{
+			DeliveryID: fmt.Sprintf("d%d", i), WebhookID: "w1", RunID: "run0",
+			RunStatus: StatusStopped, Attempts: int64(i + 1), ResponseCode: code, Succeeded: code == 200,
+		})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	dl, err := sm.ListWebhookDeliveries("w1", 10, 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if dl.Total != 2 || len(dl.Deliveries) != 2 {
+		t.Errorf("Expected 2 deliveries, got %v", dl.Total)
+	}
+
+	sm.DeleteWebhook("w1")
+	if _, err = sm.GetWebhook("w1"); err == nil {
+		t.Errorf("Expected deleted webhook to be missing")
+	}
+	if dl, _ = sm.ListWebhookDeliveries("w1", 10, 0); dl.Total != 0 {
+		t.Errorf("Expected deliveries of deleted webhook to be deleted, got %v", dl.Total)
+	}
+}
+
+func TestSQLStateManager_Tokens(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	tok := Token{
+		TokenID: "t1", Name: "ci", Principal: "ci-bot",
+		Scopes: &ScopeList{ScopeRunsExecute, ScopeRunsStop}, Hash: "abc",
+	}
+	if err := sm.CreateToken(tok); err != nil {
+		t.Fatalf(err.Error())
+	}
+	sm.CreateToken(Token{TokenID: "t2", Name: "admin", Principal: "root", Scopes: &ScopeList{ScopeTokensAdmin}, Hash: "def"})
+
+	// Hashes are unique
+	if err := sm.CreateToken(Token{TokenID: "t3", Name: "dup", Principal: "x", Scopes: &ScopeList{}, Hash: "abc"}); err == nil {
+		t.Errorf("Expected token with a duplicate hash to be rejected")
+	}
+
+	fetched, err := sm.GetTokenByHash("abc")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if fetched.TokenID != "t1" || fetched.Principal != "ci-bot" || !fetched.HasScope(ScopeRunsStop) ||
+		fetched.IsRevoked() || fetched.CreatedAt == nil {
+		t.Errorf("Expected token to round trip, got %v", fetched)
+	}
+
+	tl, _ := sm.ListTokens(10, 0, map[string][]string{"principal": {"ci-bot"}})
+	if tl.Total != 1 || len(tl.Tokens) != 1 {
+		t.Errorf("Expected 1 token for ci-bot, got %v", tl.Total)
+	}
+
+	revoked, err := sm.RevokeToken("t1")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !revoked.IsRevoked() {
+		t.Errorf("Expected token to be revoked")
+	}
+	again, _ := sm.RevokeToken("t1")
+	if again.RevokedAt == nil || !again.RevokedAt.Equal(*revoked.RevokedAt) {
+		t.Errorf("Expected revoking again to keep the revocation time")
+	}
+
+	if _, err = sm.RevokeToken("nope"); err == nil {
+		t.Errorf("Expected revoking a missing token to fail")
+	}
+	if _, err = sm.GetTokenByHash("nope"); err == nil {
+		t.Errorf("Expected a missing hash to fail")
+	}
+}
+
+func TestSQLStateManager_RoleBindings(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	for _, b := range []RoleBinding{
+		{Principal: "ci-bot", GroupName: "g1", Role: RoleRunner},
+		{Principal: "ci-bot", GroupName: "g2", Role: RoleViewer},
+		{Principal: "alice", GroupName: "g1", Role: RoleAdmin},
+	} {
+		if _, err := sm.PutRoleBinding(b); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	// Granting again replaces the role
+	put, err := sm.PutRoleBinding(RoleBinding{Principal: "ci-bot", GroupName: "g1", Role: RoleEditor})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if put.CreatedAt == nil {
+		t.Errorf("Expected role binding to have a creation time")
+	}
+
+	bl, err := sm.ListRoleBindings(10, 0, map[string][]string{"principal": {"ci-bot"}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if bl.Total != 2 || bl.RoleBindings[0].GroupName != "g1" || bl.RoleBindings[0].Role != RoleEditor {
+		t.Errorf("Expected ci-bot to be an editor of g1 and a viewer of g2, got %v", bl.RoleBindings)
+	}
+
+	sm.DeleteRoleBinding("g1", "ci-bot")
+	if bl, _ = sm.ListRoleBindings(10, 0, map[string][]string{"principal": {"ci-bot"}}); bl.Total != 1 {
+		t.Errorf("Expected 1 role binding for ci-bot after revoking, got %v", bl.Total)
+	}
+}
+
+func TestSQLStateManager_Leases(t *testing.T) {
+	defer tearDown()
+	sm := setUp().(*SQLStateManager)
+
+	lease, err := sm.AcquireLease("worker:retry")
+	if err != nil || lease == nil {
+		t.Fatalf("Expected to acquire lease, got %v", err)
+	}
+	if err = lease.Check(); err != nil {
+		t.Errorf("Expected lease to be held, got %v", err)
+	}
+
+	other, err := sm.AcquireLease("worker:retry")
+	if err != nil || other != nil {
+		t.Errorf("Expected lease to be held by one holder at a time, got %v %v", other, err)
+	}
+	if different, _ := sm.AcquireLease("worker:timeout"); different == nil {
+		t.Errorf("Expected leases on other names to be independent")
+	} else {
+		different.Release()
+	}
+
+	lease.Release()
+	if again, _ := sm.AcquireLease("worker:retry"); again == nil {
+		t.Errorf("Expected released lease to be acquirable")
+	} else {
+		again.Release()
+	}
+}
+
+func TestSQLStateManager_ClaimIdempotencyKey(t *testing.T) {
+	defer tearDown()
+	sm := setUp()
+
+	now := time.Now().Truncate(time.Second)
+	k := IdempotencyKey{OwnerID: "alice", Key: "k1", RunID: "run1", RequestHash: "h1", CreatedAt: now}
+	claimed, ok, err := sm.ClaimIdempotencyKey(k, now.Add(-time.Hour))
+	if err != nil || !ok || claimed.RunID != "run1" {
+		t.Fatalf("Expected to claim unused key, got %v %v %v", claimed, ok, err)
+	}
+
+	repeat := IdempotencyKey{OwnerID: "alice", Key: "k1", RunID: "run2", RequestHash: "h1", CreatedAt: now}
+	claimed, ok, err = sm.ClaimIdempotencyKey(repeat, now.Add(-time.Hour))
+	if err != nil || ok || claimed.RunID != "run1" || claimed.RequestHash != "h1" {
+		t.Errorf("Expected the first claim to hold the key, got %v %v %v", claimed, ok, err)
+	}
+
+	// Keys are per owner
+	other := IdempotencyKey{OwnerID: "bob", Key: "k1", RunID: "run3", RequestHash: "h1", CreatedAt: now}
+	if _, ok, _ = sm.ClaimIdempotencyKey(other, now.Add(-time.Hour)); !ok {
+		t.Errorf("Expected another owner's key to be independent")
+	}
+
+	// Claims made before since have expired
+	if _, ok, _ = sm.ClaimIdempotencyKey(repeat, now.Add(time.Minute)); !ok {
+		t.Errorf("Expected expired key to be claimable")
+	}
+
+	if err = sm.ReleaseIdempotencyKey("alice", "k1", "run2"); err != nil {
+		t.Errorf("Expected no error releasing key, got %v", err)
+	}
+	if _, ok, _ = sm.ClaimIdempotencyKey(k, now.Add(-time.Hour)); !ok {
+		t.Errorf("Expected released key to be claimable")
+	}
+}
+
+func TestSQLStateManager_WatchRun(t *testing.T) {
+	defer tearDown()
+	sm := setUp().(*SQLStateManager)
+	defer sm.Cleanup()
+
+	changed, stop, err := sm.WatchRun("run0")
+	if err != nil {
+		t.Fatalf("Expected to watch run, got %v", err)
+	}
+	other, stopOther, _ := sm.WatchRun("run1")
+	defer stopOther()
+
+	if err = sm.NotifyStatusChange(Run{RunID: "run0", Status: StatusStopped}); err != nil {
+		t.Errorf("Expected no error notifying status change, got %v", err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected watcher of run0 to be woken up")
+	}
+	select {
+	case <-other:
+		t.Errorf("Expected watcher of another run not to be woken up")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	stop()
+	sm.NotifyStatusChange(Run{RunID: "run0", Status: StatusStopped})
+	select {
+	case <-changed:
+		t.Errorf("Expected stopped watcher not to be woken up")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
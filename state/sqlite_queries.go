@@ -0,0 +1,535 @@
+package state
+
+//
+// SQLiteCreateTablesSQL sqlite specific query for creating task
+// definition, run, and related tables; they mirror the postgres tables
+// of the first migration
+// * json is kept as text, and there is no index on env, which sqlite
+//   cannot index as postgres does
+// * timestamps are kept as text in UTC, so that they sort as text
+//
+const SQLiteCreateTablesSQL = `
+--
+-- Definitions
+--
+
+CREATE TABLE IF NOT EXISTS task_def (
+  definition_id text PRIMARY KEY,
+  alias text,
+  image text NOT NULL,
+  group_name text NOT NULL,
+  memory integer,
+  command text,
+  env text,
+  "user" text,
+  arn text,
+  container_name text NOT NULL,
+  task_type text,
+  revision integer,
+  retry_policy text,
+  timeout_seconds integer,
+  CONSTRAINT task_def_alias UNIQUE(alias)
+);
+
+CREATE TABLE IF NOT EXISTS task_def_ports (
+  task_def_id text NOT NULL REFERENCES task_def(definition_id),
+  port integer NOT NULL,
+  CONSTRAINT task_def_ports_pkey PRIMARY KEY(task_def_id, port)
+);
+
+CREATE INDEX IF NOT EXISTS ix_task_def_group_name ON task_def(group_name);
+CREATE INDEX IF NOT EXISTS ix_task_def_image ON task_def(image);
+
+CREATE TABLE IF NOT EXISTS task_def_revision (
+  definition_id text NOT NULL REFERENCES task_def(definition_id),
+  revision integer NOT NULL,
+  arn text,
+  image text NOT NULL,
+  group_name text NOT NULL,
+  container_name text NOT NULL,
+  "user" text,
+  alias text,
+  memory integer,
+  command text,
+  env text,
+  ports text,
+  tags text,
+  retry_policy text,
+  timeout_seconds integer,
+  created_at timestamp,
+  CONSTRAINT task_def_revision_pkey PRIMARY KEY(definition_id, revision)
+);
+
+--
+-- Runs
+--
+
+CREATE TABLE IF NOT EXISTS task (
+  run_id text NOT NULL PRIMARY KEY,
+  definition_id text REFERENCES task_def(definition_id),
+  alias text,
+  image text,
+  cluster_name text,
+  exit_code integer,
+  status text,
+  started_at timestamp,
+  finished_at timestamp,
+  instance_id text,
+  instance_dns_name text,
+  group_name text,
+  env text,
+  task_arn text,
+  docker_id text,
+  "user" text,
+  task_type text,
+  command text,
+  memory integer,
+  ports text,
+  definition_arn text,
+  container_name text,
+  definition_revision integer,
+  retry_policy text,
+  attempt integer,
+  attempts text,
+  failure_reason text,
+  retry_at timestamp,
+  timeout_seconds integer,
+  queued_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS ix_task_definition_id ON task(definition_id);
+CREATE INDEX IF NOT EXISTS ix_task_cluster_name ON task(cluster_name);
+CREATE INDEX IF NOT EXISTS ix_task_status ON task(status);
+CREATE INDEX IF NOT EXISTS ix_task_group_name ON task(group_name);
+CREATE INDEX IF NOT EXISTS ix_task_task_arn ON task(task_arn);
+
+--
+-- Tags
+--
+CREATE TABLE IF NOT EXISTS tags (
+  text text NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS task_def_tags (
+  tag_id text NOT NULL REFERENCES tags(text),
+  task_def_id text NOT NULL REFERENCES task_def(definition_id)
+);
+
+--
+-- Schedules
+--
+CREATE TABLE IF NOT EXISTS schedules (
+  schedule_id text NOT NULL PRIMARY KEY,
+  definition_id text REFERENCES task_def(definition_id),
+  alias text,
+  cron text NOT NULL,
+  timezone text NOT NULL DEFAULT 'UTC',
+  cluster_name text NOT NULL,
+  env text,
+  owner_id text,
+  missed_policy text NOT NULL DEFAULT 'skip',
+  enabled boolean NOT NULL DEFAULT 1,
+  next_run_at timestamp,
+  last_run_at timestamp,
+  created_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS ix_schedules_next_run_at ON schedules(next_run_at) WHERE enabled;
+CREATE INDEX IF NOT EXISTS ix_schedules_definition_id ON schedules(definition_id);
+
+--
+-- Webhooks
+--
+CREATE TABLE IF NOT EXISTS webhooks (
+  webhook_id text NOT NULL PRIMARY KEY,
+  url text NOT NULL,
+  secret text,
+  definition_id text,
+  group_name text,
+  statuses text,
+  failed_only boolean NOT NULL DEFAULT 0,
+  created_at timestamp
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  delivery_id text NOT NULL PRIMARY KEY,
+  webhook_id text NOT NULL REFERENCES webhooks(webhook_id) ON DELETE CASCADE,
+  run_id text NOT NULL,
+  run_status text NOT NULL,
+  attempts integer NOT NULL DEFAULT 0,
+  response_code integer,
+  error text,
+  succeeded boolean NOT NULL DEFAULT 0,
+  created_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS ix_webhook_deliveries_webhook_id ON webhook_deliveries(webhook_id, created_at);
+
+--
+-- API tokens; only hashes of the tokens are stored
+--
+CREATE TABLE IF NOT EXISTS api_tokens (
+  token_id text NOT NULL PRIMARY KEY,
+  name text NOT NULL,
+  principal text NOT NULL,
+  scopes text NOT NULL,
+  token_hash text NOT NULL UNIQUE,
+  created_at timestamp,
+  revoked_at timestamp
+);
+
+CREATE INDEX IF NOT EXISTS ix_api_tokens_principal ON api_tokens(principal);
+
+--
+-- Roles of principals in groups
+--
+CREATE TABLE IF NOT EXISTS role_bindings (
+  group_name text NOT NULL,
+  principal text NOT NULL,
+  role text NOT NULL,
+  created_at timestamp,
+  PRIMARY KEY (group_name, principal)
+);
+
+CREATE INDEX IF NOT EXISTS ix_role_bindings_principal ON role_bindings(principal);
+
+--
+-- Runs created with idempotency keys, by owner
+--
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+  owner_id text NOT NULL,
+  idempotency_key text NOT NULL,
+  run_id text NOT NULL,
+  request_hash text NOT NULL,
+  created_at timestamp NOT NULL,
+  PRIMARY KEY (owner_id, idempotency_key)
+);
+`
+
+//
+// SQLiteDropTablesSQL sqlite specific query reverting SQLiteCreateTablesSQL;
+// tables are dropped before those they reference
+//
+const SQLiteDropTablesSQL = `
+DROP TABLE IF EXISTS idempotency_keys;
+DROP TABLE IF EXISTS role_bindings;
+DROP TABLE IF EXISTS api_tokens;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS schedules;
+DROP TABLE IF EXISTS task_def_tags;
+DROP TABLE IF EXISTS tags;
+DROP TABLE IF EXISTS task;
+DROP TABLE IF EXISTS task_def_revision;
+DROP TABLE IF EXISTS task_def_ports;
+DROP TABLE IF EXISTS task_def;
+`
+
+//
+// SQLiteAddResourcesSQL sqlite specific query adding the cpu and memory
+// reservation of definitions, their revisions and runs
+//
+const SQLiteAddResourcesSQL = `
+ALTER TABLE task_def ADD COLUMN cpu integer;
+ALTER TABLE task_def ADD COLUMN memory_reservation integer;
+ALTER TABLE task_def_revision ADD COLUMN cpu integer;
+ALTER TABLE task_def_revision ADD COLUMN memory_reservation integer;
+ALTER TABLE task ADD COLUMN cpu integer;
+ALTER TABLE task ADD COLUMN memory_reservation integer;
+`
+
+//
+// SQLiteDropResourcesSQL sqlite specific query reverting SQLiteAddResourcesSQL
+//
+const SQLiteDropResourcesSQL = `
+ALTER TABLE task DROP COLUMN memory_reservation;
+ALTER TABLE task DROP COLUMN cpu;
+ALTER TABLE task_def_revision DROP COLUMN memory_reservation;
+ALTER TABLE task_def_revision DROP COLUMN cpu;
+ALTER TABLE task_def DROP COLUMN memory_reservation;
+ALTER TABLE task_def DROP COLUMN cpu;
+`
+
+//
+// SQLiteAddClaimedAtSQL sqlite specific query adding when runs were last
+// claimed for submission
+//
+const SQLiteAddClaimedAtSQL = `
+ALTER TABLE task ADD COLUMN claimed_at timestamp;
+`
+
+//
+// SQLiteDropClaimedAtSQL sqlite specific query reverting SQLiteAddClaimedAtSQL
+//
+const SQLiteDropClaimedAtSQL = `
+ALTER TABLE task DROP COLUMN claimed_at;
+`
+
+//
+// SQLiteDefinitionSelect sqlite specific query for definitions
+//
+const SQLiteDefinitionSelect = `
+select
+  coalesce(td.arn,'')       as arn,
+  td.definition_id          as definitionid,
+  td.image                  as image,
+  td.group_name             as groupname,
+  td.container_name         as containername,
+  coalesce(td."user",'')    as "user",
+  td.alias                  as alias,
+  td.memory                 as memory,
+  td.cpu                    as cpu,
+  td.memory_reservation     as memoryreserved,
+  coalesce(td.command,'')   as command,
+  coalesce(td.task_type,'') as tasktype,
+  td.env                    as env,
+  ports                     as ports,
+  tags                      as tags,
+  coalesce(td.revision,0)   as revision,
+  td.retry_policy           as retrypolicy,
+  td.timeout_seconds        as timeoutseconds
+  from task_def td left outer join
+    (select task_def_id,
+      json_group_array(port) as ports
+        from task_def_ports group by task_def_id
+    ) tdp
+  on td.definition_id = tdp.task_def_id left outer join
+    (select task_def_id,
+      json_group_array(tag_id) as tags
+        from task_def_tags group by task_def_id
+    ) tdt
+  on td.definition_id = tdt.task_def_id
+`
+
+//
+// SQLiteListDefinitionsSQL sqlite specific query for listing definitions
+//
+const SQLiteListDefinitionsSQL = SQLiteDefinitionSelect + "\n%s %s limit ? offset ?"
+
+//
+// SQLiteGetDefinitionSQL sqlite specific query for getting a single definition
+//
+const SQLiteGetDefinitionSQL = SQLiteDefinitionSelect + "\nwhere definition_id = ?"
+
+//
+// SQLiteGetDefinitionByAliasSQL get definition by alias
+//
+const SQLiteGetDefinitionByAliasSQL = SQLiteDefinitionSelect + "\nwhere alias = ?"
+
+//
+// SQLiteDefinitionRevisionSelect sqlite specific query for definition revisions
+//
+const SQLiteDefinitionRevisionSelect = `
+select
+  coalesce(r.arn,'')        as arn,
+  r.definition_id           as definitionid,
+  r.image                   as image,
+  r.group_name              as groupname,
+  r.container_name          as containername,
+  coalesce(r."user",'')     as "user",
+  coalesce(r.alias,'')      as alias,
+  r.memory                  as memory,
+  r.cpu                     as cpu,
+  r.memory_reservation      as memoryreserved,
+  coalesce(r.command,'')    as command,
+  r.env                     as env,
+  r.ports                   as ports,
+  r.tags                    as tags,
+  r.revision                as revision,
+  r.retry_policy            as retrypolicy,
+  r.timeout_seconds         as timeoutseconds,
+  r.created_at              as createdat
+from task_def_revision r
+`
+
+//
+// SQLiteListDefinitionRevisionsSQL sqlite specific query for listing a definition's revisions, newest first
+//
+const SQLiteListDefinitionRevisionsSQL = SQLiteDefinitionRevisionSelect + "\nwhere definition_id = ? order by revision desc limit ? offset ?"
+
+//
+// SQLiteGetDefinitionRevisionSQL sqlite specific query for getting a single definition revision
+//
+const SQLiteGetDefinitionRevisionSQL = SQLiteDefinitionRevisionSelect + "\nwhere definition_id = ? and revision = ?"
+
+//
+// SQLiteRunSelect sqlite specific query for runs
+//
+const SQLiteRunSelect = `
+select
+  coalesce(t.task_arn,'')                    as taskarn,
+  t.run_id                                   as runid,
+  coalesce(t.definition_id,'')               as definitionid,
+  coalesce(t.alias,'')                       as alias,
+  coalesce(t.image,'')                       as image,
+  coalesce(t.cluster_name,'')                as clustername,
+  t.exit_code                                as exitcode,
+  coalesce(t.status,'')                      as status,
+  t.started_at                               as startedat,
+  t.finished_at                              as finishedat,
+  coalesce(t.instance_id,'')                 as instanceid,
+  coalesce(t.instance_dns_name,'')           as instancednsname,
+  coalesce(t.group_name,'')                  as groupname,
+  coalesce(t."user",'')                      as "user",
+  coalesce(t.task_type,'')                   as tasktype,
+  t.env                                      as env,
+  coalesce(t.command,'')                     as command,
+  t.memory                                   as memory,
+  t.ports                                    as ports,
+  coalesce(t.definition_arn,'')              as definitionarn,
+  coalesce(t.container_name,'')              as containername,
+  coalesce(t.definition_revision,0)          as definitionrevision,
+  t.retry_policy                             as retrypolicy,
+  coalesce(t.attempt,1)                      as attempt,
+  t.attempts                                 as attempts,
+  coalesce(t.failure_reason,'')              as failurereason,
+  t.retry_at                                 as retryat,
+  t.timeout_seconds                          as timeoutseconds,
+  t.queued_at                                as queuedat,
+  t.cpu                                      as cpu,
+  t.memory_reservation                       as memoryreserved,
+  t.claimed_at                               as claimedat
+from task t
+`
+
+//
+// SQLiteListRunsSQL sqlite specific query for listing runs
+//
+const SQLiteListRunsSQL = SQLiteRunSelect + "\n%s %s limit ? offset ?"
+
+//
+// SQLiteGetRunSQL sqlite specific query for getting a single run
+//
+const SQLiteGetRunSQL = SQLiteRunSelect + "\nwhere run_id = ?"
+
+const SQLiteListGroupsSQL = GroupsSelect + "\n%s order by group_name asc limit ? offset ?"
+const SQLiteListTagsSQL = TagsSelect + "\n%s order by text asc limit ? offset ?"
+
+//
+// SQLiteScheduleSelect sqlite specific query for schedules
+//
+const SQLiteScheduleSelect = `
+select
+  s.schedule_id                 as scheduleid,
+  coalesce(s.definition_id,'')  as definitionid,
+  coalesce(s.alias,'')          as alias,
+  s.cron                        as cronexpression,
+  s.timezone                    as timezone,
+  s.cluster_name                as clustername,
+  s.env                         as env,
+  coalesce(s.owner_id,'')       as ownerid,
+  s.missed_policy               as missedpolicy,
+  s.enabled                     as enabled,
+  s.next_run_at                 as nextrunat,
+  s.last_run_at                 as lastrunat,
+  s.created_at                  as createdat
+from schedules s
+`
+
+//
+// SQLiteListSchedulesSQL sqlite specific query for listing schedules
+//
+const SQLiteListSchedulesSQL = SQLiteScheduleSelect + "\n%s order by created_at asc limit ? offset ?"
+
+//
+// SQLiteGetScheduleSQL sqlite specific query for getting a single schedule
+//
+const SQLiteGetScheduleSQL = SQLiteScheduleSelect + "\nwhere schedule_id = ?"
+
+//
+// SQLiteListDueSchedulesSQL sqlite specific query for enabled schedules whose next tick has passed
+//
+const SQLiteListDueSchedulesSQL = SQLiteScheduleSelect + "\nwhere enabled and next_run_at <= ? order by next_run_at asc limit ?"
+
+//
+// SQLiteWebhookSelect sqlite specific query for webhooks
+//
+const SQLiteWebhookSelect = `
+select
+  w.webhook_id                  as webhookid,
+  w.url                         as url,
+  coalesce(w.secret,'')         as secret,
+  coalesce(w.definition_id,'')  as definitionid,
+  coalesce(w.group_name,'')     as groupname,
+  w.statuses                    as statuses,
+  w.failed_only                 as failedonly,
+  w.created_at                  as createdat
+from webhooks w
+`
+
+//
+// SQLiteListWebhooksSQL sqlite specific query for listing webhooks
+//
+const SQLiteListWebhooksSQL = SQLiteWebhookSelect + "\n%s order by created_at asc limit ? offset ?"
+
+//
+// SQLiteGetWebhookSQL sqlite specific query for getting a single webhook
+//
+const SQLiteGetWebhookSQL = SQLiteWebhookSelect + "\nwhere webhook_id = ?"
+
+//
+// SQLiteListWebhookDeliveriesSQL sqlite specific query for the deliveries of a webhook, newest first
+//
+const SQLiteListWebhookDeliveriesSQL = `
+select
+  d.delivery_id                 as deliveryid,
+  d.webhook_id                  as webhookid,
+  d.run_id                      as runid,
+  d.run_status                  as runstatus,
+  d.attempts                    as attempts,
+  coalesce(d.response_code,0)   as responsecode,
+  coalesce(d.error,'')          as error,
+  d.succeeded                   as succeeded,
+  d.created_at                  as createdat
+from webhook_deliveries d
+where webhook_id = ? order by created_at desc limit ? offset ?
+`
+
+//
+// SQLiteTokenSelect sqlite specific query for api tokens
+//
+const SQLiteTokenSelect = `
+select
+  t.token_id                    as tokenid,
+  t.name                        as name,
+  t.principal                   as principal,
+  t.scopes                      as scopes,
+  t.token_hash                  as hash,
+  t.created_at                  as createdat,
+  t.revoked_at                  as revokedat
+from api_tokens t
+`
+
+//
+// SQLiteListTokensSQL sqlite specific query for listing api tokens
+//
+const SQLiteListTokensSQL = SQLiteTokenSelect + "\n%s order by created_at asc limit ? offset ?"
+
+//
+// SQLiteGetTokenSQL sqlite specific query for getting a single api token
+//
+const SQLiteGetTokenSQL = SQLiteTokenSelect + "\nwhere token_id = ?"
+
+//
+// SQLiteGetTokenByHashSQL sqlite specific query for getting the api token with a hash
+//
+const SQLiteGetTokenByHashSQL = SQLiteTokenSelect + "\nwhere token_hash = ?"
+
+//
+// SQLiteListRoleBindingsSQL sqlite specific query for listing role bindings
+//
+const SQLiteListRoleBindingsSQL = RoleBindingSelect + "\n%s order by group_name asc, principal asc limit ? offset ?"
+
+//
+// SQLiteGetIdempotencyKeySQL sqlite specific query for getting an owner's idempotency key
+//
+const SQLiteGetIdempotencyKeySQL = `
+select
+  k.owner_id                    as ownerid,
+  k.idempotency_key             as key,
+  k.run_id                      as runid,
+  k.request_hash                as requesthash,
+  k.created_at                  as createdat
+from idempotency_keys k
+where k.owner_id = ? and k.idempotency_key = ?
+`
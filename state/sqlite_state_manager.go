@@ -0,0 +1,1336 @@
+package state
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	// Pull in sqlite specific drivers
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"regexp"
+	"strings"
+	"time"
+)
+
+//
+// SQLiteStateManager uses a sqlite database file to manage state, for
+// running flotilla without a database server; it behaves as
+// SQLStateManager does
+// * `database_url` is the path of the database file
+// * sqlite allows one writer at a time, so one connection is used
+// * runs are not watched, so waiting on a run polls it
+//
+type SQLiteStateManager struct {
+	db *sqlx.DB
+}
+
+//
+// Name is the name of the state manager - matches value in configuration
+//
+func (sm *SQLiteStateManager) Name() string {
+	return "sqlite"
+}
+
+//
+// Initialize applies pending schema migrations if `create_database_schema`
+//
+func (sm *SQLiteStateManager) Initialize(conf config.Config) error {
+	var err error
+	if sm.db, err = sqlx.Open("sqlite3", sqliteDSN(conf.GetString("database_url"))); err != nil {
+		return errors.Wrap(err, "unable to open sqlite db")
+	}
+	sm.db.SetMaxOpenConns(1)
+
+	if err = migrateOrCheck(sm.db, sqliteMigrations, conf.GetBool("create_database_schema")); err != nil {
+		return errors.Wrap(err, "problem migrating database schema")
+	}
+	return nil
+}
+
+//
+// sqliteDSN adds what the state manager relies on to the database url:
+// foreign keys, waiting on locks, and case sensitive like as in postgres
+//
+func sqliteDSN(dburl string) string {
+	sep := "?"
+	if strings.Contains(dburl, "?") {
+		sep = "&"
+	}
+	return dburl + sep + "_foreign_keys=1&_busy_timeout=5000&_cslike=1"
+}
+
+//
+// sqliteTime is how times are stored: in UTC, so that they sort as
+// text, and to the microsecond as in postgres
+//
+func sqliteTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.UTC().Round(time.Microsecond)
+}
+
+// Types of the columns that filters compare with something other than text
+var sqliteColumnTypes = map[string]interface{}{
+	"memory":              int64(0),
+	"cpu":                 int64(0),
+	"memory_reservation":  int64(0),
+	"revision":            int64(0),
+	"timeout_seconds":     int64(0),
+	"exit_code":           int64(0),
+	"definition_revision": int64(0),
+	"attempt":             int64(0),
+	"started_at":          time.Time{},
+	"finished_at":         time.Time{},
+	"retry_at":            time.Time{},
+	"queued_at":           time.Time{},
+	"next_run_at":         time.Time{},
+	"last_run_at":         time.Time{},
+	"created_at":          time.Time{},
+	"revoked_at":          time.Time{},
+	"enabled":             false,
+	"failed_only":         false,
+}
+
+var sqliteColumnName = regexp.MustCompile(`^[a-z_]+$`)
+
+//
+// sqliteFilterValue reads a filter's value as the type of its column
+//
+func sqliteFilterValue(column string, v string) (interface{}, error) {
+	columnType, ok := sqliteColumnTypes[column]
+	if !ok {
+		return v, nil
+	}
+	value, err := parseLiteral(columnType, v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value for column [%s]", column)
+	}
+	if t, ok := value.(time.Time); ok {
+		return sqliteTime(&t), nil
+	}
+	return value, nil
+}
+
+//
+// makeWhereClause makes the same conditions of filters as
+// SQLStateManager.makeWhereClause, with their values as arguments
+//
+func (sm *SQLiteStateManager) makeWhereClause(filters map[string][]string) ([]string, []interface{}, error) {
+
+	// These will be joined with "AND"
+	wc := []string{}
+	args := []interface{}{}
+	for k, v := range filters {
+		if !sqliteColumnName.MatchString(k) {
+			return nil, nil, errors.Errorf("Invalid field to filter by [%s]", k)
+		}
+		if len(v) > 1 {
+			// No like queries for multiple filters with same key
+			placeholders := make([]string, len(v))
+			for i, filterVal := range v {
+				value, err := sqliteFilterValue(k, filterVal)
+				if err != nil {
+					return nil, nil, err
+				}
+				placeholders[i] = "?"
+				args = append(args, value)
+			}
+			wc = append(wc, fmt.Sprintf("%s in (%s)", k, strings.Join(placeholders, ",")))
+		} else if len(v) == 1 {
+			fmtString := "%s = ?"
+			fieldName := k
+			if k == "image" || k == "alias" || k == "group_name" || k == "command" || k == "text" {
+				fmtString = `%s like ? escape '\'`
+				args = append(args, "%"+v[0]+"%")
+				wc = append(wc, fmt.Sprintf(fmtString, fieldName))
+				continue
+			} else if strings.HasSuffix(k, "_since") {
+				fieldName = strings.Replace(k, "_since", "", -1)
+				fmtString = "%s > ?"
+			} else if strings.HasSuffix(k, "_until") {
+				fieldName = strings.Replace(k, "_until", "", -1)
+				fmtString = "%s < ?"
+			}
+			value, err := sqliteFilterValue(fieldName, v[0])
+			if err != nil {
+				return nil, nil, err
+			}
+			args = append(args, value)
+			wc = append(wc, fmt.Sprintf(fmtString, fieldName))
+		}
+	}
+	return wc, args, nil
+}
+
+//
+// makeEnvWhereClause matches env vars by name and value, as the jsonb
+// containment of SQLStateManager.makeEnvWhereClause does
+//
+func (sm *SQLiteStateManager) makeEnvWhereClause(filters map[string]string) ([]string, []interface{}) {
+	wc := []string{}
+	args := []interface{}{}
+	for k, v := range filters {
+		wc = append(wc, `exists (
+      select 1 from json_each(env) e
+      where json_extract(e.value, '$.name') = ? and json_extract(e.value, '$.value') = ?)`)
+		args = append(args, k, v)
+	}
+	return wc, args
+}
+
+func (sm *SQLiteStateManager) orderBy(obj orderable, field string, order string) (string, error) {
+	if order == "asc" || order == "desc" {
+		if obj.validOrderField(field) {
+			return fmt.Sprintf("order by %s %s NULLS LAST", field, order), nil
+		}
+		return "", errors.Errorf("Invalid field to order by [%s], must be one of [%s]",
+			field,
+			strings.Join(obj.validOrderFields(), ", "))
+	}
+	return "", errors.Errorf("Invalid order string, must be one of ('asc', 'desc'), was %s", order)
+}
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("where %s", strings.Join(where, " and "))
+}
+
+//
+// selectPage selects a page of the query's rows into dest, and counts
+// all of them into total; the query's last arguments are the limit and
+// offset
+//
+func (sm *SQLiteStateManager) selectPage(
+	dest interface{}, total *int, query string, args []interface{}, limit int, offset int) error {
+	// As postgres, rather than sqlite, which takes these as no limit and offset
+	if limit < 0 {
+		return errors.New("LIMIT must not be negative")
+	}
+	if offset < 0 {
+		return errors.New("OFFSET must not be negative")
+	}
+
+	page := append(append([]interface{}{}, args...), limit, offset)
+	if err := sm.db.Select(dest, query, page...); err != nil {
+		return err
+	}
+
+	// A negative limit is no limit
+	all := append(append([]interface{}{}, args...), -1, 0)
+	return sm.db.Get(total, fmt.Sprintf("select COUNT(*) from (%s) as sq", query), all...)
+}
+
+//
+// ListDefinitions returns a DefinitionList
+// limit: limit the result to this many definitions
+// offset: start the results at this offset
+// sortBy: sort by this field
+// order: 'asc' or 'desc'
+// filters: map of field filters on Definition - joined with AND
+// envFilters: map of environment variable filters - joined with AND
+//
+func (sm *SQLiteStateManager) ListDefinitions(
+	limit int, offset int, sortBy string,
+	order string, filters map[string][]string,
+	envFilters map[string]string) (DefinitionList, error) {
+
+	var result DefinitionList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+	envWhere, envArgs := sm.makeEnvWhereClause(envFilters)
+	where, args = append(where, envWhere...), append(args, envArgs...)
+
+	orderQuery, err := sm.orderBy(&Definition{}, sortBy, order)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListDefinitionsSQL, whereClause(where), orderQuery)
+	if err = sm.selectPage(&result.Definitions, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list definitions sql")
+	}
+	return result, nil
+}
+
+//
+// GetDefinition returns a single definition by id
+//
+func (sm *SQLiteStateManager) GetDefinition(definitionID string) (Definition, error) {
+	var definition Definition
+	err := sm.db.Get(&definition, SQLiteGetDefinitionSQL, definitionID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return definition, exceptions.MissingResource{
+				fmt.Sprintf("Definition with ID %s not found", definitionID)}
+		}
+		return definition, errors.Wrapf(err, "issue getting definition with id [%s]", definitionID)
+	}
+	return definition, nil
+}
+
+//
+// GetDefinitionByAlias returns a single definition by alias
+//
+func (sm *SQLiteStateManager) GetDefinitionByAlias(alias string) (Definition, error) {
+	var definition Definition
+	err := sm.db.Get(&definition, SQLiteGetDefinitionByAliasSQL, alias)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return definition, exceptions.MissingResource{
+				fmt.Sprintf("Definition with alias %s not found", alias)}
+		}
+		return definition, errors.Wrapf(err, "issue getting definition with alias [%s]", alias)
+	}
+	return definition, nil
+}
+
+//
+// UpdateDefinition updates a definition
+// - updates can be partial
+//
+func (sm *SQLiteStateManager) UpdateDefinition(definitionID string, updates Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.UpdateWith(updates)
+	})
+}
+
+//
+// ReplaceDefinition stores d as the definition's new revision, keeping
+// only its identity; see Definition.Restore
+//
+func (sm *SQLiteStateManager) ReplaceDefinition(definitionID string, d Definition) (Definition, error) {
+	return sm.updateDefinition(definitionID, func(existing *Definition) {
+		existing.Restore(d)
+	})
+}
+
+//
+// updateDefinition stores the definition, as changed by apply, as its new revision
+//
+func (sm *SQLiteStateManager) updateDefinition(definitionID string, apply func(existing *Definition)) (Definition, error) {
+	existing, err := sm.GetDefinition(definitionID)
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	previous := existing
+	apply(&existing)
+
+	update := `
+    UPDATE task_def SET
+      arn = ?, image = ?,
+      container_name = ?, "user" = ?,
+      alias = ?, memory = ?,
+      command = ?, env = CAST(? AS TEXT),
+      revision = ?, retry_policy = CAST(? AS TEXT),
+      timeout_seconds = ?, cpu = ?,
+      memory_reservation = ?
+    WHERE definition_id = ?;
+    `
+
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	var latest int64
+	if err = tx.QueryRow(
+		"SELECT coalesce(max(revision), 0) FROM task_def_revision WHERE definition_id = ?",
+		definitionID).Scan(&latest); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	//
+	// Definitions created before revisions were recorded have no history;
+	// keep their pre-update state as the first revision
+	//
+	if latest == 0 {
+		previous.Revision = 1
+		if err = sm.insertDefinitionRevision(tx, previous); err != nil {
+			tx.Rollback()
+			return existing, errors.WithStack(err)
+		}
+		latest = previous.Revision
+	}
+	existing.Revision = latest + 1
+
+	for _, stmt := range []string{
+		"DELETE FROM task_def_ports WHERE task_def_id = ?",
+		"DELETE FROM task_def_tags WHERE task_def_id = ?",
+	} {
+		if _, err = tx.Exec(stmt, definitionID); err != nil {
+			tx.Rollback()
+			return existing, errors.WithStack(err)
+		}
+	}
+
+	if _, err = tx.Exec(
+		update,
+		existing.Arn, existing.Image, existing.ContainerName,
+		existing.User, existing.Alias, existing.Memory,
+		existing.Command, existing.Env, existing.Revision, existing.RetryPolicy,
+		existing.TimeoutSeconds, existing.CPU, existing.MemoryReserved, definitionID); err != nil {
+		tx.Rollback()
+		return existing, errors.Wrapf(err, "issue updating definition [%s]", definitionID)
+	}
+
+	if err = sm.insertPortsAndTags(tx, definitionID, existing); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	if err = sm.insertDefinitionRevision(tx, existing); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// CreateDefinition creates the passed in definition object
+// - error if definition already exists
+//
+func (sm *SQLiteStateManager) CreateDefinition(d Definition) error {
+	insert := `
+    INSERT INTO task_def(
+      arn, definition_id, image, group_name,
+      container_name, "user", alias, memory, command, env, revision,
+      retry_policy, timeout_seconds, cpu, memory_reservation
+    )
+    VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, CAST(? AS TEXT), ?, CAST(? AS TEXT), ?, ?, ?);
+    `
+
+	// New definitions always start at their first revision
+	d.Revision = 1
+
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	if _, err = tx.Exec(insert,
+		d.Arn, d.DefinitionID, d.Image, d.GroupName, d.ContainerName,
+		d.User, d.Alias, d.Memory, d.Command, d.Env, d.Revision, d.RetryPolicy,
+		d.TimeoutSeconds, d.CPU, d.MemoryReserved); err != nil {
+		tx.Rollback()
+		return errors.Wrapf(
+			err, "issue creating new task definition with alias [%s] and id [%s]", d.Alias, d.DefinitionID)
+	}
+
+	if err = sm.insertPortsAndTags(tx, d.DefinitionID, d); err != nil {
+		tx.Rollback()
+		return errors.WithStack(err)
+	}
+
+	if err = sm.insertDefinitionRevision(tx, d); err != nil {
+		tx.Rollback()
+		return errors.WithStack(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+func (sm *SQLiteStateManager) insertPortsAndTags(tx *sql.Tx, definitionID string, d Definition) error {
+	if d.Ports != nil {
+		for _, p := range *d.Ports {
+			if _, err := tx.Exec(
+				"INSERT INTO task_def_ports(task_def_id, port) VALUES (?, ?)", definitionID, p); err != nil {
+				return errors.Wrapf(err, "issue storing port [%d] of definition [%s]", p, definitionID)
+			}
+		}
+	}
+
+	if d.Tags != nil {
+		for _, t := range *d.Tags {
+			if _, err := tx.Exec("INSERT OR IGNORE INTO tags(text) VALUES (?)", t); err != nil {
+				return errors.Wrapf(err, "issue storing tag [%s]", t)
+			}
+			if _, err := tx.Exec(
+				"INSERT INTO task_def_tags(task_def_id, tag_id) VALUES (?, ?)", definitionID, t); err != nil {
+				return errors.Wrapf(err, "issue storing tag [%s] of definition [%s]", t, definitionID)
+			}
+		}
+	}
+	return nil
+}
+
+//
+// insertDefinitionRevision stores an immutable copy of the definition
+// at its current revision as part of the given transaction
+//
+func (sm *SQLiteStateManager) insertDefinitionRevision(tx *sql.Tx, d Definition) error {
+	insert := `
+    INSERT INTO task_def_revision(
+      definition_id, revision, arn, image, group_name, container_name,
+      "user", alias, memory, command, env, ports, tags, retry_policy,
+      timeout_seconds, cpu, memory_reservation, created_at
+    )
+    VALUES (
+      ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), CAST(? AS TEXT), ?, ?, ?, ?
+    );
+    `
+	now := time.Now()
+	if _, err := tx.Exec(insert,
+		d.DefinitionID, d.Revision, d.Arn, d.Image, d.GroupName, d.ContainerName,
+		d.User, d.Alias, d.Memory, d.Command, d.Env, d.Ports, d.Tags, d.RetryPolicy,
+		d.TimeoutSeconds, d.CPU, d.MemoryReserved, sqliteTime(&now)); err != nil {
+		return errors.Wrapf(
+			err, "issue storing revision [%d] of definition [%s]", d.Revision, d.DefinitionID)
+	}
+	return nil
+}
+
+//
+// ListDefinitionRevisions returns the revisions of a definition, newest first
+//
+func (sm *SQLiteStateManager) ListDefinitionRevisions(
+	definitionID string, limit int, offset int) (DefinitionRevisionList, error) {
+	var result DefinitionRevisionList
+
+	err := sm.db.Select(&result.Revisions, SQLiteListDefinitionRevisionsSQL, definitionID, limit, offset)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing revisions of definition [%s]", definitionID)
+	}
+
+	countSQL := "select COUNT(*) from task_def_revision where definition_id = ?"
+	err = sm.db.Get(&result.Total, countSQL, definitionID)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue counting revisions of definition [%s]", definitionID)
+	}
+	return result, nil
+}
+
+//
+// GetDefinitionRevision returns a single revision of a definition
+//
+func (sm *SQLiteStateManager) GetDefinitionRevision(definitionID string, revision int64) (DefinitionRevision, error) {
+	var dr DefinitionRevision
+	err := sm.db.Get(&dr, SQLiteGetDefinitionRevisionSQL, definitionID, revision)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return dr, exceptions.MissingResource{
+				fmt.Sprintf("Revision %d of definition with ID %s not found", revision, definitionID)}
+		}
+		return dr, errors.Wrapf(
+			err, "issue getting revision [%d] of definition with id [%s]", revision, definitionID)
+	}
+	return dr, nil
+}
+
+//
+// DeleteDefinition deletes definition and associated runs and environment variables
+//
+func (sm *SQLiteStateManager) DeleteDefinition(definitionID string) error {
+	statements := []string{
+		"DELETE FROM task_def_ports WHERE task_def_id = ?",
+		"DELETE FROM task_def_tags WHERE task_def_id = ?",
+		"DELETE FROM task_def_revision WHERE definition_id = ?",
+		"DELETE FROM schedules WHERE definition_id = ?",
+		"DELETE FROM task WHERE definition_id = ?",
+		"DELETE FROM task_def WHERE definition_id = ?",
+	}
+	tx, err := sm.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	for _, stmt := range statements {
+		if _, err = tx.Exec(stmt, definitionID); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "issue deleting definition with id [%s]", definitionID)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+//
+// ListRuns returns a RunList
+// limit: limit the result to this many runs
+// offset: start the results at this offset
+// sortBy: sort by this field
+// order: 'asc' or 'desc'
+// filters: map of field filters on Run - joined with AND
+// envFilters: map of environment variable filters - joined with AND
+//
+func (sm *SQLiteStateManager) ListRuns(
+	limit int, offset int, sortBy string,
+	order string, filters map[string][]string,
+	envFilters map[string]string) (RunList, error) {
+
+	var result RunList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+	envWhere, envArgs := sm.makeEnvWhereClause(envFilters)
+	where, args = append(where, envWhere...), append(args, envArgs...)
+
+	orderQuery, err := sm.orderBy(&Run{}, sortBy, order)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListRunsSQL, whereClause(where), orderQuery)
+	if err = sm.selectPage(&result.Runs, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list runs sql")
+	}
+	return result, nil
+}
+
+//
+// GetRun gets run by id
+//
+func (sm *SQLiteStateManager) GetRun(runID string) (Run, error) {
+	var r Run
+	err := sm.db.Get(&r, SQLiteGetRunSQL, runID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return r, exceptions.MissingResource{
+				fmt.Sprintf("Run with id %s not found", runID)}
+		}
+		return r, errors.Wrapf(err, "issue getting run with id [%s]", runID)
+	}
+	return r, nil
+}
+
+//
+// UpdateRun updates run with updates - can be partial
+//
+func (sm *SQLiteStateManager) UpdateRun(runID string, updates Run) (Run, error) {
+	var existing Run
+
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	// Updating a run that does not exist changes nothing
+	if err = tx.Get(&existing, SQLiteGetRunSQL, runID); err != nil && err != sql.ErrNoRows {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	existing.UpdateWith(updates)
+
+	update := `
+    UPDATE task SET
+      task_arn = ?, definition_id = ?,
+      alias = ?, image = ?,
+      cluster_name = ?, exit_code = ?,
+      status = ?, started_at = ?,
+      finished_at = ?, instance_id = ?,
+      instance_dns_name = ?,
+      group_name = ?, env = CAST(? AS TEXT),
+      command = ?, memory = ?,
+      ports = CAST(? AS TEXT), definition_arn = ?,
+      container_name = ?, definition_revision = ?,
+      retry_policy = CAST(? AS TEXT), attempt = ?,
+      attempts = CAST(? AS TEXT), failure_reason = ?,
+      retry_at = ?, timeout_seconds = ?,
+      queued_at = ?, cpu = ?,
+      memory_reservation = ?
+    WHERE run_id = ?;
+    `
+
+	if _, err = tx.Exec(
+		update,
+		existing.TaskArn, existing.DefinitionID,
+		existing.Alias, existing.Image,
+		existing.ClusterName, existing.ExitCode,
+		existing.Status, sqliteTime(existing.StartedAt),
+		sqliteTime(existing.FinishedAt), existing.InstanceID,
+		existing.InstanceDNSName, existing.GroupName,
+		existing.Env, existing.Command, existing.Memory,
+		existing.Ports, existing.DefinitionArn,
+		existing.ContainerName, existing.DefinitionRevision,
+		existing.RetryPolicy, existing.Attempt,
+		existing.Attempts, existing.FailureReason,
+		sqliteTime(existing.RetryAt), existing.TimeoutSeconds,
+		sqliteTime(existing.QueuedAt), existing.CPU,
+		existing.MemoryReserved, runID); err != nil {
+		tx.Rollback()
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// ClaimRun atomically moves the run from QUEUED to PENDING and records
+// when in its ClaimedAt, returning false if it was not QUEUED (eg. another
+// worker claimed it from a duplicate message); a run is only submitted by
+// whoever claimed it
+//
+func (sm *SQLiteStateManager) ClaimRun(runID string) (bool, error) {
+	claim := `
+    UPDATE task SET status = ?, claimed_at = ?
+    WHERE run_id = ? AND status = ?;
+    `
+	now := time.Now()
+	res, err := sm.db.Exec(claim, StatusPending, sqliteTime(&now), runID, StatusQueued)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue claiming run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// ReleaseRun atomically moves a claimed run, one that is PENDING without
+// a task, back to QUEUED, eg. when it could not be submitted yet; returns
+// false if it was not such a run
+//
+func (sm *SQLiteStateManager) ReleaseRun(runID string) (bool, error) {
+	release := `
+    UPDATE task SET status = ?
+    WHERE run_id = ? AND status = ? AND COALESCE(task_arn, '') = '';
+    `
+	res, err := sm.db.Exec(release, StatusQueued, runID, StatusPending)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue releasing run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// StopClaimedRun atomically moves a claimed run, one that is PENDING
+// without a task, to STOPPED, eg. when it is terminated while being
+// submitted; returns false if it was not such a run
+//
+func (sm *SQLiteStateManager) StopClaimedRun(runID string) (bool, error) {
+	stop := `
+    UPDATE task SET status = ?
+    WHERE run_id = ? AND status = ? AND COALESCE(task_arn, '') = '';
+    `
+	res, err := sm.db.Exec(stop, StatusStopped, runID, StatusPending)
+	if err != nil {
+		return false, errors.Wrapf(err, "issue stopping run with id [%s]", runID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// CreateRun creates the passed in run
+//
+func (sm *SQLiteStateManager) CreateRun(r Run) error {
+	insert := `
+	INSERT INTO task (
+      task_arn, run_id, definition_id, alias, image, cluster_name, exit_code, status,
+      started_at, finished_at, instance_id, instance_dns_name, group_name,
+      env, task_type, command, memory, ports, definition_arn, container_name,
+      definition_revision, retry_policy, attempt, attempts, failure_reason,
+      retry_at, timeout_seconds, queued_at, cpu, memory_reservation
+    ) VALUES (
+      ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, CAST(? AS TEXT), 'task',
+      ?, ?, CAST(? AS TEXT), ?, ?, ?, CAST(? AS TEXT), ?, CAST(? AS TEXT), ?, ?, ?, ?, ?, ?
+    );
+    `
+
+	if _, err := sm.db.Exec(insert,
+		r.TaskArn, r.RunID, r.DefinitionID,
+		r.Alias, r.Image, r.ClusterName,
+		r.ExitCode, r.Status, sqliteTime(r.StartedAt),
+		sqliteTime(r.FinishedAt), r.InstanceID,
+		r.InstanceDNSName, r.GroupName, r.Env,
+		r.Command, r.Memory, r.Ports,
+		r.DefinitionArn, r.ContainerName, r.DefinitionRevision,
+		r.RetryPolicy, r.Attempt, r.Attempts, r.FailureReason,
+		sqliteTime(r.RetryAt), r.TimeoutSeconds, sqliteTime(r.QueuedAt), r.CPU, r.MemoryReserved); err != nil {
+		return errors.Wrapf(err, "issue creating new task run with id [%s]", r.RunID)
+	}
+	return nil
+}
+
+//
+// Metadata
+//
+func (sm *SQLiteStateManager) ListGroups(limit int, offset int, name *string) (GroupsList, error) {
+	var result GroupsList
+	where, args := []string{}, []interface{}{}
+	if name != nil && len(*name) > 0 {
+		where, args, _ = sm.makeWhereClause(map[string][]string{"group_name": {*name}})
+	}
+
+	sql := fmt.Sprintf(SQLiteListGroupsSQL, whereClause(where))
+	if err := sm.selectPage(&result.Groups, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list groups sql")
+	}
+	return result, nil
+}
+
+func (sm *SQLiteStateManager) ListTags(limit int, offset int, name *string) (TagsList, error) {
+	var result TagsList
+	where, args := []string{}, []interface{}{}
+	if name != nil && len(*name) > 0 {
+		where, args, _ = sm.makeWhereClause(map[string][]string{"text": {*name}})
+	}
+
+	sql := fmt.Sprintf(SQLiteListTagsSQL, whereClause(where))
+	if err := sm.selectPage(&result.Tags, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list tags sql")
+	}
+	return result, nil
+}
+
+//
+// ListSchedules returns a ScheduleList
+// limit: limit the result to this many schedules
+// offset: start the results at this offset
+// filters: map of field filters on Schedule - joined with AND
+//
+func (sm *SQLiteStateManager) ListSchedules(
+	limit int, offset int, filters map[string][]string) (ScheduleList, error) {
+
+	var result ScheduleList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListSchedulesSQL, whereClause(where))
+	if err = sm.selectPage(&result.Schedules, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list schedules sql")
+	}
+	return result, nil
+}
+
+//
+// GetSchedule returns a single schedule by id
+//
+func (sm *SQLiteStateManager) GetSchedule(scheduleID string) (Schedule, error) {
+	var s Schedule
+	err := sm.db.Get(&s, SQLiteGetScheduleSQL, scheduleID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return s, exceptions.MissingResource{
+				fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+		}
+		return s, errors.Wrapf(err, "issue getting schedule with id [%s]", scheduleID)
+	}
+	return s, nil
+}
+
+//
+// CreateSchedule creates the passed in schedule
+//
+func (sm *SQLiteStateManager) CreateSchedule(s Schedule) error {
+	insert := `
+    INSERT INTO schedules (
+      schedule_id, definition_id, alias, cron, timezone, cluster_name,
+      env, owner_id, missed_policy, enabled, next_run_at, last_run_at, created_at
+    ) VALUES (
+      ?, NULLIF(?,''), NULLIF(?,''), ?, ?, ?, CAST(? AS TEXT), ?, ?, ?, ?, ?, ?
+    );
+    `
+	now := time.Now()
+	if _, err := sm.db.Exec(insert,
+		s.ScheduleID, s.DefinitionID, s.Alias, s.CronExpression, s.Timezone, s.ClusterName,
+		s.Env, s.OwnerID, s.MissedPolicy, s.IsEnabled(), sqliteTime(s.NextRunAt), sqliteTime(s.LastRunAt),
+		sqliteTime(&now)); err != nil {
+		return errors.Wrapf(err, "issue creating new schedule with id [%s]", s.ScheduleID)
+	}
+	return nil
+}
+
+//
+// UpdateSchedule updates schedule with updates - can be partial
+//
+func (sm *SQLiteStateManager) UpdateSchedule(scheduleID string, updates Schedule) (Schedule, error) {
+	var existing Schedule
+
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Get(&existing, SQLiteGetScheduleSQL, scheduleID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return existing, exceptions.MissingResource{
+				fmt.Sprintf("Schedule with ID %s not found", scheduleID)}
+		}
+		return existing, errors.Wrapf(err, "issue getting schedule with id [%s]", scheduleID)
+	}
+
+	existing.UpdateWith(updates)
+
+	update := `
+    UPDATE schedules SET
+      definition_id = NULLIF(?,''), alias = NULLIF(?,''),
+      cron = ?, timezone = ?,
+      cluster_name = ?, env = CAST(? AS TEXT),
+      owner_id = ?, missed_policy = ?,
+      enabled = ?, next_run_at = ?,
+      last_run_at = ?
+    WHERE schedule_id = ?;
+    `
+
+	if _, err = tx.Exec(
+		update,
+		existing.DefinitionID, existing.Alias,
+		existing.CronExpression, existing.Timezone,
+		existing.ClusterName, existing.Env,
+		existing.OwnerID, existing.MissedPolicy,
+		existing.IsEnabled(), sqliteTime(existing.NextRunAt),
+		sqliteTime(existing.LastRunAt), scheduleID); err != nil {
+		tx.Rollback()
+		return existing, errors.Wrapf(err, "issue updating schedule with id [%s]", scheduleID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// DeleteSchedule deletes a schedule; runs it created are kept
+//
+func (sm *SQLiteStateManager) DeleteSchedule(scheduleID string) error {
+	if _, err := sm.db.Exec("DELETE FROM schedules WHERE schedule_id = ?", scheduleID); err != nil {
+		return errors.Wrapf(err, "issue deleting schedule with id [%s]", scheduleID)
+	}
+	return nil
+}
+
+//
+// ListDueSchedules returns -at most- limit enabled schedules
+// whose next tick is at or before now, oldest tick first
+//
+func (sm *SQLiteStateManager) ListDueSchedules(now time.Time, limit int) ([]Schedule, error) {
+	var due []Schedule
+	if err := sm.db.Select(&due, SQLiteListDueSchedulesSQL, sqliteTime(&now), limit); err != nil {
+		return due, errors.Wrap(err, "issue running list due schedules sql")
+	}
+	return due, nil
+}
+
+//
+// ClaimScheduleTick atomically advances the schedule from tick to next,
+// returning false if tick was already claimed (eg. by another worker)
+// or the schedule was changed or disabled in the meantime
+//
+func (sm *SQLiteStateManager) ClaimScheduleTick(scheduleID string, tick time.Time, next time.Time) (bool, error) {
+	claim := `
+    UPDATE schedules SET next_run_at = ?, last_run_at = ?
+    WHERE schedule_id = ? AND next_run_at = ? AND enabled;
+    `
+	res, err := sm.db.Exec(claim, sqliteTime(&next), sqliteTime(&tick), scheduleID, sqliteTime(&tick))
+	if err != nil {
+		return false, errors.Wrapf(err, "issue claiming tick [%s] of schedule with id [%s]", tick, scheduleID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return n == 1, nil
+}
+
+//
+// ListWebhooks returns a WebhookList
+// limit: limit the result to this many webhooks
+// offset: start the results at this offset
+// filters: map of field filters on Webhook - joined with AND
+//
+func (sm *SQLiteStateManager) ListWebhooks(
+	limit int, offset int, filters map[string][]string) (WebhookList, error) {
+
+	var result WebhookList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListWebhooksSQL, whereClause(where))
+	if err = sm.selectPage(&result.Webhooks, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list webhooks sql")
+	}
+	return result, nil
+}
+
+//
+// GetWebhook returns a single webhook by id
+//
+func (sm *SQLiteStateManager) GetWebhook(webhookID string) (Webhook, error) {
+	var w Webhook
+	err := sm.db.Get(&w, SQLiteGetWebhookSQL, webhookID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return w, exceptions.MissingResource{
+				fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+		}
+		return w, errors.Wrapf(err, "issue getting webhook with id [%s]", webhookID)
+	}
+	return w, nil
+}
+
+//
+// CreateWebhook creates the passed in webhook
+//
+func (sm *SQLiteStateManager) CreateWebhook(w Webhook) error {
+	insert := `
+    INSERT INTO webhooks (
+      webhook_id, url, secret, definition_id, group_name, statuses, failed_only, created_at
+    ) VALUES (
+      ?, ?, NULLIF(?,''), NULLIF(?,''), NULLIF(?,''), CAST(? AS TEXT), ?, ?
+    );
+    `
+	now := time.Now()
+	if _, err := sm.db.Exec(insert,
+		w.WebhookID, w.URL, w.Secret, w.DefinitionID, w.GroupName,
+		w.Statuses, w.IsFailedOnly(), sqliteTime(&now)); err != nil {
+		return errors.Wrapf(err, "issue creating new webhook with id [%s]", w.WebhookID)
+	}
+	return nil
+}
+
+//
+// UpdateWebhook updates webhook with updates - can be partial
+//
+func (sm *SQLiteStateManager) UpdateWebhook(webhookID string, updates Webhook) (Webhook, error) {
+	var existing Webhook
+
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return existing, errors.WithStack(err)
+	}
+
+	if err = tx.Get(&existing, SQLiteGetWebhookSQL, webhookID); err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return existing, exceptions.MissingResource{
+				fmt.Sprintf("Webhook with ID %s not found", webhookID)}
+		}
+		return existing, errors.Wrapf(err, "issue getting webhook with id [%s]", webhookID)
+	}
+
+	existing.UpdateWith(updates)
+
+	update := `
+    UPDATE webhooks SET
+      url = ?, secret = NULLIF(?,''),
+      definition_id = NULLIF(?,''), group_name = NULLIF(?,''),
+      statuses = CAST(? AS TEXT), failed_only = ?
+    WHERE webhook_id = ?;
+    `
+
+	if _, err = tx.Exec(
+		update,
+		existing.URL, existing.Secret,
+		existing.DefinitionID, existing.GroupName,
+		existing.Statuses, existing.IsFailedOnly(), webhookID); err != nil {
+		tx.Rollback()
+		return existing, errors.Wrapf(err, "issue updating webhook with id [%s]", webhookID)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return existing, errors.WithStack(err)
+	}
+	return existing, nil
+}
+
+//
+// DeleteWebhook deletes a webhook along with its deliveries
+//
+func (sm *SQLiteStateManager) DeleteWebhook(webhookID string) error {
+	if _, err := sm.db.Exec("DELETE FROM webhooks WHERE webhook_id = ?", webhookID); err != nil {
+		return errors.Wrapf(err, "issue deleting webhook with id [%s]", webhookID)
+	}
+	return nil
+}
+
+//
+// ListWebhookDeliveries returns the deliveries of a webhook, newest first
+//
+func (sm *SQLiteStateManager) ListWebhookDeliveries(
+	webhookID string, limit int, offset int) (WebhookDeliveryList, error) {
+
+	var result WebhookDeliveryList
+
+	err := sm.db.Select(&result.Deliveries, SQLiteListWebhookDeliveriesSQL, webhookID, limit, offset)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue listing deliveries of webhook with id [%s]", webhookID)
+	}
+	err = sm.db.Get(&result.Total,
+		"select COUNT(*) from webhook_deliveries where webhook_id = ?", webhookID)
+	if err != nil {
+		return result, errors.Wrapf(err, "issue counting deliveries of webhook with id [%s]", webhookID)
+	}
+
+	return result, nil
+}
+
+//
+// CreateWebhookDelivery records the passed in delivery
+//
+func (sm *SQLiteStateManager) CreateWebhookDelivery(d WebhookDelivery) error {
+	insert := `
+    INSERT INTO webhook_deliveries (
+      delivery_id, webhook_id, run_id, run_status,
+      attempts, response_code, error, succeeded, created_at
+    ) VALUES (
+      ?, ?, ?, ?, ?, NULLIF(?,0), NULLIF(?,''), ?, ?
+    );
+    `
+	now := time.Now()
+	if _, err := sm.db.Exec(insert,
+		d.DeliveryID, d.WebhookID, d.RunID, d.RunStatus,
+		d.Attempts, d.ResponseCode, d.Error, d.Succeeded, sqliteTime(&now)); err != nil {
+		return errors.Wrapf(err, "issue creating webhook delivery with id [%s]", d.DeliveryID)
+	}
+	return nil
+}
+
+//
+// ListTokens returns a TokenList
+// limit: limit the result to this many tokens
+// offset: start the results at this offset
+// filters: map of field filters on Token - joined with AND
+//
+func (sm *SQLiteStateManager) ListTokens(
+	limit int, offset int, filters map[string][]string) (TokenList, error) {
+
+	var result TokenList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListTokensSQL, whereClause(where))
+	if err = sm.selectPage(&result.Tokens, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list tokens sql")
+	}
+	return result, nil
+}
+
+//
+// GetToken returns a single api token by id
+//
+func (sm *SQLiteStateManager) GetToken(tokenID string) (Token, error) {
+	var t Token
+	err := sm.db.Get(&t, SQLiteGetTokenSQL, tokenID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, exceptions.MissingResource{
+				fmt.Sprintf("Token with ID %s not found", tokenID)}
+		}
+		return t, errors.Wrapf(err, "issue getting token with id [%s]", tokenID)
+	}
+	return t, nil
+}
+
+//
+// GetTokenByHash returns the api token with the given hash
+//
+func (sm *SQLiteStateManager) GetTokenByHash(hash string) (Token, error) {
+	var t Token
+	err := sm.db.Get(&t, SQLiteGetTokenByHashSQL, hash)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return t, exceptions.MissingResource{"Token not found"}
+		}
+		return t, errors.Wrap(err, "issue getting token by hash")
+	}
+	return t, nil
+}
+
+//
+// CreateToken creates the passed in api token
+//
+func (sm *SQLiteStateManager) CreateToken(t Token) error {
+	insert := `
+    INSERT INTO api_tokens (
+      token_id, name, principal, scopes, token_hash, created_at
+    ) VALUES (
+      ?, ?, ?, CAST(? AS TEXT), ?, ?
+    );
+    `
+	now := time.Now()
+	if _, err := sm.db.Exec(insert,
+		t.TokenID, t.Name, t.Principal, t.Scopes, t.Hash, sqliteTime(&now)); err != nil {
+		return errors.Wrapf(err, "issue creating new token with id [%s]", t.TokenID)
+	}
+	return nil
+}
+
+//
+// RevokeToken revokes an api token; revoking a revoked token keeps
+// the time it was first revoked
+//
+func (sm *SQLiteStateManager) RevokeToken(tokenID string) (Token, error) {
+	revoke := `
+    UPDATE api_tokens SET revoked_at = coalesce(revoked_at, ?)
+    WHERE token_id = ?;
+    `
+	now := time.Now()
+	res, err := sm.db.Exec(revoke, sqliteTime(&now), tokenID)
+	if err != nil {
+		return Token{}, errors.Wrapf(err, "issue revoking token with id [%s]", tokenID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return Token{}, errors.WithStack(err)
+	}
+	if n == 0 {
+		return Token{}, exceptions.MissingResource{
+			fmt.Sprintf("Token with ID %s not found", tokenID)}
+	}
+	return sm.GetToken(tokenID)
+}
+
+//
+// ListRoleBindings returns a RoleBindingList
+// limit: limit the result to this many role bindings
+// offset: start the results at this offset
+// filters: map of field filters on RoleBinding - joined with AND
+//
+func (sm *SQLiteStateManager) ListRoleBindings(
+	limit int, offset int, filters map[string][]string) (RoleBindingList, error) {
+
+	var result RoleBindingList
+	where, args, err := sm.makeWhereClause(filters)
+	if err != nil {
+		return result, errors.WithStack(err)
+	}
+
+	sql := fmt.Sprintf(SQLiteListRoleBindingsSQL, whereClause(where))
+	if err = sm.selectPage(&result.RoleBindings, &result.Total, sql, args, limit, offset); err != nil {
+		return result, errors.Wrap(err, "issue running list role bindings sql")
+	}
+	return result, nil
+}
+
+//
+// PutRoleBinding grants the role binding's principal its role in its
+// group, replacing any role they had there
+//
+func (sm *SQLiteStateManager) PutRoleBinding(b RoleBinding) (RoleBinding, error) {
+	upsert := `
+    INSERT INTO role_bindings (group_name, principal, role, created_at) VALUES (?, ?, ?, ?)
+    ON CONFLICT (group_name, principal) DO UPDATE SET role = excluded.role;
+    `
+	tx, err := sm.db.Beginx()
+	if err != nil {
+		return b, errors.WithStack(err)
+	}
+
+	now := time.Now()
+	if _, err = tx.Exec(upsert, b.GroupName, b.Principal, b.Role, sqliteTime(&now)); err == nil {
+		err = tx.Get(&b.CreatedAt,
+			"SELECT created_at FROM role_bindings WHERE group_name = ? AND principal = ?", b.GroupName, b.Principal)
+	}
+	if err != nil {
+		tx.Rollback()
+		return b, errors.Wrapf(err,
+			"issue granting role [%s] in group [%s] to [%s]", b.Role, b.GroupName, b.Principal)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return b, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+//
+// DeleteRoleBinding revokes the principal's role in the group
+//
+func (sm *SQLiteStateManager) DeleteRoleBinding(groupName string, principal string) error {
+	if _, err := sm.db.Exec(
+		"DELETE FROM role_bindings WHERE group_name = ? AND principal = ?", groupName, principal); err != nil {
+		return errors.Wrapf(err, "issue revoking role in group [%s] from [%s]", groupName, principal)
+	}
+	return nil
+}
+
+//
+// ClaimIdempotencyKey atomically claims the owner's idempotency key for
+// k's run, unless it was claimed after since; returns the claim that
+// holds the key, and whether it is k
+//
+func (sm *SQLiteStateManager) ClaimIdempotencyKey(k IdempotencyKey, since time.Time) (IdempotencyKey, bool, error) {
+	claim := `
+    INSERT INTO idempotency_keys (owner_id, idempotency_key, run_id, request_hash, created_at)
+    VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (owner_id, idempotency_key) DO UPDATE
+    SET run_id = excluded.run_id, request_hash = excluded.request_hash, created_at = excluded.created_at
+    WHERE idempotency_keys.created_at <= ?;
+    `
+	res, err := sm.db.Exec(claim,
+		k.OwnerID, k.Key, k.RunID, k.RequestHash, sqliteTime(&k.CreatedAt), sqliteTime(&since))
+	if err != nil {
+		return k, false, errors.Wrapf(err, "issue claiming idempotency key [%s] of [%s]", k.Key, k.OwnerID)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return k, false, errors.WithStack(err)
+	}
+	if n == 1 {
+		return k, true, nil
+	}
+
+	var existing IdempotencyKey
+	err = sm.db.Get(&existing, SQLiteGetIdempotencyKeySQL, k.OwnerID, k.Key)
+	if err != nil {
+		return existing, false, errors.Wrapf(err, "issue getting idempotency key [%s] of [%s]", k.Key, k.OwnerID)
+	}
+	return existing, false, nil
+}
+
+//
+// ReleaseIdempotencyKey gives up the owner's claim on key for runID, eg.
+// when the run could not be created
+//
+func (sm *SQLiteStateManager) ReleaseIdempotencyKey(ownerID string, key string, runID string) error {
+	if _, err := sm.db.Exec(
+		"DELETE FROM idempotency_keys WHERE owner_id = ? AND idempotency_key = ? AND run_id = ?",
+		ownerID, key, runID); err != nil {
+		return errors.Wrapf(err, "issue releasing idempotency key [%s] of [%s]", key, ownerID)
+	}
+	return nil
+}
+
+//
+// Cleanup close any open resources
+//
+func (sm *SQLiteStateManager) Cleanup() error {
+	return sm.db.Close()
+}
@@ -0,0 +1,89 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stitchfix/flotilla-os/config"
+)
+
+//
+// newSQLiteStateManager makes a state manager with its own database file
+// in dir, through NewStateManager
+//
+func newSQLiteStateManager(t *testing.T, dir string) Manager {
+	conf, _ := config.NewConfig(nil)
+	os.Setenv("STATE_MANAGER", "sqlite")
+	os.Setenv("CREATE_DATABASE_SCHEMA", "true")
+	f, err := ioutil.TempFile(dir, "flotilla")
+	if err != nil {
+		t.Fatalf("Expected a database file, got %v", err)
+	}
+	f.Close()
+	os.Setenv("DATABASE_URL", f.Name())
+	defer os.Unsetenv("DATABASE_URL")
+	defer os.Unsetenv("STATE_MANAGER")
+
+	sm, err := NewStateManager(conf)
+	if err != nil {
+		t.Fatalf("Expected sqlite state manager, got %v", err)
+	}
+	return sm
+}
+
+func TestSQLiteStateManager_Conformance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flotilla-sqlite")
+	if err != nil {
+		t.Fatalf("Expected a temporary directory, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var sm Manager
+	defer func() {
+		if sm != nil {
+			sm.Cleanup()
+		}
+	}()
+	testManagerConformance(t, func() Manager {
+		if sm != nil {
+			sm.Cleanup()
+		}
+		sm = newSQLiteStateManager(t, dir)
+		return sm
+	})
+}
+
+func TestSQLiteStateManager_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flotilla-sqlite")
+	if err != nil {
+		t.Fatalf("Expected a temporary directory, got %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf, _ := config.NewConfig(nil)
+	os.Setenv("CREATE_DATABASE_SCHEMA", "true")
+	os.Setenv("DATABASE_URL", filepath.Join(dir, "flotilla.db"))
+	defer os.Unsetenv("DATABASE_URL")
+
+	sm := &SQLiteStateManager{}
+	if err = sm.Initialize(conf); err != nil {
+		t.Fatalf("Expected to open database, got %v", err)
+	}
+	if err = sm.CreateDefinition(Definition{DefinitionID: "A", Alias: "aliasA", GroupName: "groupA"}); err != nil {
+		t.Fatalf("Expected to create definition, got %v", err)
+	}
+	sm.Cleanup()
+
+	// Creating the schema again keeps what is stored
+	reopened := &SQLiteStateManager{}
+	if err = reopened.Initialize(conf); err != nil {
+		t.Fatalf("Expected to reopen database, got %v", err)
+	}
+	defer reopened.Cleanup()
+
+	if d, err := reopened.GetDefinitionByAlias("aliasA"); err != nil || d.DefinitionID != "A" {
+		t.Errorf("Expected definition A to outlive the process, got %v %v", d, err)
+	}
+}
@@ -2,9 +2,14 @@ package testutils
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/stitchfix/flotilla-os/clients/cluster"
 	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	"github.com/stitchfix/flotilla-os/queue"
 	"github.com/stitchfix/flotilla-os/state"
@@ -16,16 +21,28 @@ import (
 //
 type ImplementsAllTheThings struct {
 	T                       *testing.T
-	Calls                   []string                    // Collects calls
-	Definitions             map[string]state.Definition // Definitions stored in "state"
-	Runs                    map[string]state.Run        // Runs stored in "state"
-	Qurls                   map[string]string           // Urls returned by Queue Manager
-	Defined                 []string                    // List of defined definitions (Execution Engine)
-	Queued                  []string                    // List of queued runs (Queue Manager)
-	StatusUpdates           []string                    // List of queued status updates (Queue Manager)
-	StatusUpdatesAsRuns     []state.Run                 // List of queued status updates (Execution Engine)
-	ExecuteError            error                       // Execution Engine - error to return
-	ExecuteErrorIsRetryable bool                        // Execution Engine - is the run retryable?
+	Calls                   []string                              // Collects calls
+	Definitions             map[string]state.Definition           // Definitions stored in "state"
+	Revisions               map[string][]state.DefinitionRevision // Definition revisions stored in "state"
+	Runs                    map[string]state.Run                  // Runs stored in "state"
+	Schedules               map[string]state.Schedule             // Schedules stored in "state"
+	Webhooks                map[string]state.Webhook              // Webhooks stored in "state"
+	WebhookDeliveries       []state.WebhookDelivery               // Webhook deliveries stored in "state"
+	Notified                []state.Run                           // Runs sent to webhooks (Webhook Notifier)
+	Tokens                  map[string]state.Token                // Api tokens stored in "state"
+	RoleBindings            []state.RoleBinding                   // Role bindings stored in "state"
+	IdempotencyKeys         map[string]state.IdempotencyKey       // Idempotency keys stored in "state", by owner and key
+	LogChunks               []string                              // Logs returned a chunk at a time (Logs Client)
+	Qurls                   map[string]string                     // Urls returned by Queue Manager
+	Defined                 []string                              // List of defined definitions (Execution Engine)
+	Queued                  []string                              // List of queued runs (Queue Manager)
+	StatusUpdates           []string                              // List of queued status updates (Queue Manager)
+	StatusUpdatesAsRuns     []state.Run                           // List of queued status updates (Execution Engine)
+	Executed                []state.Run                           // List of executed runs (Execution Engine)
+	Described               map[string]state.Run                  // Engine's view of runs, by run id (Execution Engine)
+	ExecuteError            error                                 // Execution Engine - error to return
+	ExecuteErrorIsRetryable bool                                  // Execution Engine - is the run retryable?
+	Executing               func(run state.Run)                   // Execution Engine - called while executing
 	Groups                  []string
 	Tags                    []string
 }
@@ -88,17 +105,65 @@ func (iatt *ImplementsAllTheThings) UpdateDefinition(definitionID string, update
 	iatt.Calls = append(iatt.Calls, "UpdateDefinition")
 	defn := iatt.Definitions[definitionID]
 	defn.UpdateWith(updates)
+	defn.Revision++
 	iatt.Definitions[definitionID] = defn
+	iatt.storeRevision(defn)
+	return defn, nil
+}
+
+// ReplaceDefinition - StateManager
+func (iatt *ImplementsAllTheThings) ReplaceDefinition(definitionID string, d state.Definition) (state.Definition, error) {
+	iatt.Calls = append(iatt.Calls, "ReplaceDefinition")
+	defn := iatt.Definitions[definitionID]
+	defn.Restore(d)
+	defn.Revision++
+	iatt.Definitions[definitionID] = defn
+	iatt.storeRevision(defn)
 	return defn, nil
 }
 
 // CreateDefinition - StateManager
 func (iatt *ImplementsAllTheThings) CreateDefinition(d state.Definition) error {
 	iatt.Calls = append(iatt.Calls, "CreateDefinition")
+	d.Revision = 1
 	iatt.Definitions[d.DefinitionID] = d
+	iatt.storeRevision(d)
 	return nil
 }
 
+func (iatt *ImplementsAllTheThings) storeRevision(d state.Definition) {
+	if iatt.Revisions == nil {
+		iatt.Revisions = make(map[string][]state.DefinitionRevision)
+	}
+	iatt.Revisions[d.DefinitionID] = append(
+		iatt.Revisions[d.DefinitionID], state.DefinitionRevision{Definition: d})
+}
+
+// ListDefinitionRevisions - StateManager
+func (iatt *ImplementsAllTheThings) ListDefinitionRevisions(
+	definitionID string, limit int, offset int) (state.DefinitionRevisionList, error) {
+	iatt.Calls = append(iatt.Calls, "ListDefinitionRevisions")
+	revisions := iatt.Revisions[definitionID]
+	drl := state.DefinitionRevisionList{Total: len(revisions)}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		drl.Revisions = append(drl.Revisions, revisions[i])
+	}
+	return drl, nil
+}
+
+// GetDefinitionRevision - StateManager
+func (iatt *ImplementsAllTheThings) GetDefinitionRevision(
+	definitionID string, revision int64) (state.DefinitionRevision, error) {
+	iatt.Calls = append(iatt.Calls, "GetDefinitionRevision")
+	for _, dr := range iatt.Revisions[definitionID] {
+		if dr.Revision == revision {
+			return dr, nil
+		}
+	}
+	return state.DefinitionRevision{}, exceptions.MissingResource{
+		ErrorString: fmt.Sprintf("No revision %v of definition %s", revision, definitionID)}
+}
+
 // DeleteDefinition - StateManager
 func (iatt *ImplementsAllTheThings) DeleteDefinition(definitionID string) error {
 	iatt.Calls = append(iatt.Calls, "DeleteDefinition")
@@ -111,9 +176,17 @@ func (iatt *ImplementsAllTheThings) ListRuns(limit int, offset int, sortBy strin
 	order string, filters map[string][]string,
 	envFilters map[string]string) (state.RunList, error) {
 	iatt.Calls = append(iatt.Calls, "ListRuns")
-	rl := state.RunList{Total: len(iatt.Runs)}
-	for _, r := range iatt.Runs {
-		rl.Runs = append(rl.Runs, r)
+	var runIDs []string
+	for runID := range iatt.Runs {
+		runIDs = append(runIDs, runID)
+	}
+	sort.Strings(runIDs)
+
+	rl := state.RunList{Total: len(runIDs), Runs: []state.Run{}}
+	for i, runID := range runIDs {
+		if i >= offset && (limit <= 0 || len(rl.Runs) < limit) {
+			rl.Runs = append(rl.Runs, iatt.Runs[runID])
+		}
 	}
 	return rl, nil
 }
@@ -145,6 +218,351 @@ func (iatt *ImplementsAllTheThings) UpdateRun(runID string, updates state.Run) (
 	return run, nil
 }
 
+// ClaimRun - StateManager
+func (iatt *ImplementsAllTheThings) ClaimRun(runID string) (bool, error) {
+	iatt.Calls = append(iatt.Calls, "ClaimRun")
+	run, ok := iatt.Runs[runID]
+	if !ok || run.Status != state.StatusQueued {
+		return false, nil
+	}
+	now := time.Now()
+	run.Status = state.StatusPending
+	run.ClaimedAt = &now
+	iatt.Runs[runID] = run
+	return true, nil
+}
+
+// ReleaseRun - StateManager
+func (iatt *ImplementsAllTheThings) ReleaseRun(runID string) (bool, error) {
+	iatt.Calls = append(iatt.Calls, "ReleaseRun")
+	run, ok := iatt.Runs[runID]
+	if !ok || run.Status != state.StatusPending || len(run.TaskArn) > 0 {
+		return false, nil
+	}
+	run.Status = state.StatusQueued
+	iatt.Runs[runID] = run
+	return true, nil
+}
+
+// StopClaimedRun - StateManager
+func (iatt *ImplementsAllTheThings) StopClaimedRun(runID string) (bool, error) {
+	iatt.Calls = append(iatt.Calls, "StopClaimedRun")
+	run, ok := iatt.Runs[runID]
+	if !ok || run.Status != state.StatusPending || len(run.TaskArn) > 0 {
+		return false, nil
+	}
+	run.Status = state.StatusStopped
+	iatt.Runs[runID] = run
+	return true, nil
+}
+
+// ListSchedules - StateManager
+func (iatt *ImplementsAllTheThings) ListSchedules(
+	limit int, offset int, filters map[string][]string) (state.ScheduleList, error) {
+	iatt.Calls = append(iatt.Calls, "ListSchedules")
+	sl := state.ScheduleList{Total: len(iatt.Schedules)}
+	for _, s := range iatt.Schedules {
+		sl.Schedules = append(sl.Schedules, s)
+	}
+	return sl, nil
+}
+
+// GetSchedule - StateManager
+func (iatt *ImplementsAllTheThings) GetSchedule(scheduleID string) (state.Schedule, error) {
+	iatt.Calls = append(iatt.Calls, "GetSchedule")
+	s, ok := iatt.Schedules[scheduleID]
+	if !ok {
+		return s, exceptions.MissingResource{ErrorString: fmt.Sprintf("No schedule %s", scheduleID)}
+	}
+	return s, nil
+}
+
+// CreateSchedule - StateManager
+func (iatt *ImplementsAllTheThings) CreateSchedule(s state.Schedule) error {
+	iatt.Calls = append(iatt.Calls, "CreateSchedule")
+	if iatt.Schedules == nil {
+		iatt.Schedules = make(map[string]state.Schedule)
+	}
+	iatt.Schedules[s.ScheduleID] = s
+	return nil
+}
+
+// UpdateSchedule - StateManager
+func (iatt *ImplementsAllTheThings) UpdateSchedule(scheduleID string, updates state.Schedule) (state.Schedule, error) {
+	iatt.Calls = append(iatt.Calls, "UpdateSchedule")
+	s, ok := iatt.Schedules[scheduleID]
+	if !ok {
+		return s, exceptions.MissingResource{ErrorString: fmt.Sprintf("No schedule %s", scheduleID)}
+	}
+	s.UpdateWith(updates)
+	iatt.Schedules[scheduleID] = s
+	return s, nil
+}
+
+// DeleteSchedule - StateManager
+func (iatt *ImplementsAllTheThings) DeleteSchedule(scheduleID string) error {
+	iatt.Calls = append(iatt.Calls, "DeleteSchedule")
+	delete(iatt.Schedules, scheduleID)
+	return nil
+}
+
+// ListDueSchedules - StateManager
+func (iatt *ImplementsAllTheThings) ListDueSchedules(now time.Time, limit int) ([]state.Schedule, error) {
+	iatt.Calls = append(iatt.Calls, "ListDueSchedules")
+	var due []state.Schedule
+	for _, s := range iatt.Schedules {
+		if s.IsEnabled() && s.NextRunAt != nil && !s.NextRunAt.After(now) {
+			due = append(due, s)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRunAt.Before(*due[j].NextRunAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+// ClaimScheduleTick - StateManager
+func (iatt *ImplementsAllTheThings) ClaimScheduleTick(scheduleID string, tick time.Time, next time.Time) (bool, error) {
+	iatt.Calls = append(iatt.Calls, "ClaimScheduleTick")
+	s, ok := iatt.Schedules[scheduleID]
+	if !ok || !s.IsEnabled() || s.NextRunAt == nil || !s.NextRunAt.Equal(tick) {
+		return false, nil
+	}
+	s.NextRunAt = &next
+	s.LastRunAt = &tick
+	iatt.Schedules[scheduleID] = s
+	return true, nil
+}
+
+// ListWebhooks - StateManager
+func (iatt *ImplementsAllTheThings) ListWebhooks(
+	limit int, offset int, filters map[string][]string) (state.WebhookList, error) {
+	iatt.Calls = append(iatt.Calls, "ListWebhooks")
+	var webhookIDs []string
+	for webhookID := range iatt.Webhooks {
+		webhookIDs = append(webhookIDs, webhookID)
+	}
+	sort.Strings(webhookIDs)
+
+	wl := state.WebhookList{Total: len(webhookIDs), Webhooks: []state.Webhook{}}
+	for i, webhookID := range webhookIDs {
+		if i >= offset && (limit <= 0 || len(wl.Webhooks) < limit) {
+			wl.Webhooks = append(wl.Webhooks, iatt.Webhooks[webhookID])
+		}
+	}
+	return wl, nil
+}
+
+// GetWebhook - StateManager
+func (iatt *ImplementsAllTheThings) GetWebhook(webhookID string) (state.Webhook, error) {
+	iatt.Calls = append(iatt.Calls, "GetWebhook")
+	w, ok := iatt.Webhooks[webhookID]
+	if !ok {
+		return w, exceptions.MissingResource{ErrorString: fmt.Sprintf("No webhook %s", webhookID)}
+	}
+	return w, nil
+}
+
+// CreateWebhook - StateManager
+func (iatt *ImplementsAllTheThings) CreateWebhook(w state.Webhook) error {
+	iatt.Calls = append(iatt.Calls, "CreateWebhook")
+	if iatt.Webhooks == nil {
+		iatt.Webhooks = make(map[string]state.Webhook)
+	}
+	iatt.Webhooks[w.WebhookID] = w
+	return nil
+}
+
+// UpdateWebhook - StateManager
+func (iatt *ImplementsAllTheThings) UpdateWebhook(webhookID string, updates state.Webhook) (state.Webhook, error) {
+	iatt.Calls = append(iatt.Calls, "UpdateWebhook")
+	w, ok := iatt.Webhooks[webhookID]
+	if !ok {
+		return w, exceptions.MissingResource{ErrorString: fmt.Sprintf("No webhook %s", webhookID)}
+	}
+	w.UpdateWith(updates)
+	iatt.Webhooks[webhookID] = w
+	return w, nil
+}
+
+// DeleteWebhook - StateManager
+func (iatt *ImplementsAllTheThings) DeleteWebhook(webhookID string) error {
+	iatt.Calls = append(iatt.Calls, "DeleteWebhook")
+	delete(iatt.Webhooks, webhookID)
+	return nil
+}
+
+// ListWebhookDeliveries - StateManager
+func (iatt *ImplementsAllTheThings) ListWebhookDeliveries(
+	webhookID string, limit int, offset int) (state.WebhookDeliveryList, error) {
+	iatt.Calls = append(iatt.Calls, "ListWebhookDeliveries")
+	dl := state.WebhookDeliveryList{Deliveries: []state.WebhookDelivery{}}
+	for _, d := range iatt.WebhookDeliveries {
+		if d.WebhookID == webhookID {
+			if dl.Total >= offset && (limit <= 0 || len(dl.Deliveries) < limit) {
+				dl.Deliveries = append(dl.Deliveries, d)
+			}
+			dl.Total++
+		}
+	}
+	return dl, nil
+}
+
+// CreateWebhookDelivery - StateManager
+func (iatt *ImplementsAllTheThings) CreateWebhookDelivery(d state.WebhookDelivery) error {
+	iatt.Calls = append(iatt.Calls, "CreateWebhookDelivery")
+	iatt.WebhookDeliveries = append(iatt.WebhookDeliveries, d)
+	return nil
+}
+
+// ListTokens - StateManager
+func (iatt *ImplementsAllTheThings) ListTokens(
+	limit int, offset int, filters map[string][]string) (state.TokenList, error) {
+	iatt.Calls = append(iatt.Calls, "ListTokens")
+	var tokenIDs []string
+	for tokenID, t := range iatt.Tokens {
+		if principals, ok := filters["principal"]; ok && len(principals) > 0 && principals[0] != t.Principal {
+			continue
+		}
+		tokenIDs = append(tokenIDs, tokenID)
+	}
+	sort.Strings(tokenIDs)
+
+	tl := state.TokenList{Total: len(tokenIDs), Tokens: []state.Token{}}
+	for i, tokenID := range tokenIDs {
+		if i >= offset && (limit <= 0 || len(tl.Tokens) < limit) {
+			tl.Tokens = append(tl.Tokens, iatt.Tokens[tokenID])
+		}
+	}
+	return tl, nil
+}
+
+// GetToken - StateManager
+func (iatt *ImplementsAllTheThings) GetToken(tokenID string) (state.Token, error) {
+	iatt.Calls = append(iatt.Calls, "GetToken")
+	t, ok := iatt.Tokens[tokenID]
+	if !ok {
+		return t, exceptions.MissingResource{ErrorString: fmt.Sprintf("No token %s", tokenID)}
+	}
+	return t, nil
+}
+
+// GetTokenByHash - StateManager
+func (iatt *ImplementsAllTheThings) GetTokenByHash(hash string) (state.Token, error) {
+	iatt.Calls = append(iatt.Calls, "GetTokenByHash")
+	for _, t := range iatt.Tokens {
+		if t.Hash == hash {
+			return t, nil
+		}
+	}
+	return state.Token{}, exceptions.MissingResource{ErrorString: "No token with hash"}
+}
+
+// CreateToken - StateManager
+func (iatt *ImplementsAllTheThings) CreateToken(t state.Token) error {
+	iatt.Calls = append(iatt.Calls, "CreateToken")
+	if iatt.Tokens == nil {
+		iatt.Tokens = make(map[string]state.Token)
+	}
+	iatt.Tokens[t.TokenID] = t
+	return nil
+}
+
+// RevokeToken - StateManager
+func (iatt *ImplementsAllTheThings) RevokeToken(tokenID string) (state.Token, error) {
+	iatt.Calls = append(iatt.Calls, "RevokeToken")
+	t, ok := iatt.Tokens[tokenID]
+	if !ok {
+		return t, exceptions.MissingResource{ErrorString: fmt.Sprintf("No token %s", tokenID)}
+	}
+	if t.RevokedAt == nil {
+		now := time.Now()
+		t.RevokedAt = &now
+	}
+	iatt.Tokens[tokenID] = t
+	return t, nil
+}
+
+// ListRoleBindings - StateManager
+func (iatt *ImplementsAllTheThings) ListRoleBindings(
+	limit int, offset int, filters map[string][]string) (state.RoleBindingList, error) {
+	iatt.Calls = append(iatt.Calls, "ListRoleBindings")
+	bl := state.RoleBindingList{RoleBindings: []state.RoleBinding{}}
+	for _, b := range iatt.RoleBindings {
+		if principals, ok := filters["principal"]; ok && len(principals) > 0 && principals[0] != b.Principal {
+			continue
+		}
+		if groups, ok := filters["group_name"]; ok && len(groups) > 0 && groups[0] != b.GroupName {
+			continue
+		}
+		if bl.Total >= offset && (limit <= 0 || len(bl.RoleBindings) < limit) {
+			bl.RoleBindings = append(bl.RoleBindings, b)
+		}
+		bl.Total++
+	}
+	return bl, nil
+}
+
+// PutRoleBinding - StateManager
+func (iatt *ImplementsAllTheThings) PutRoleBinding(b state.RoleBinding) (state.RoleBinding, error) {
+	iatt.Calls = append(iatt.Calls, "PutRoleBinding")
+	for i, existing := range iatt.RoleBindings {
+		if existing.GroupName == b.GroupName && existing.Principal == b.Principal {
+			iatt.RoleBindings[i].Role = b.Role
+			return iatt.RoleBindings[i], nil
+		}
+	}
+	now := time.Now()
+	b.CreatedAt = &now
+	iatt.RoleBindings = append(iatt.RoleBindings, b)
+	return b, nil
+}
+
+// DeleteRoleBinding - StateManager
+func (iatt *ImplementsAllTheThings) DeleteRoleBinding(groupName string, principal string) error {
+	iatt.Calls = append(iatt.Calls, "DeleteRoleBinding")
+	var kept []state.RoleBinding
+	for _, b := range iatt.RoleBindings {
+		if b.GroupName != groupName || b.Principal != principal {
+			kept = append(kept, b)
+		}
+	}
+	iatt.RoleBindings = kept
+	return nil
+}
+
+// Notify - Webhook Notifier
+func (iatt *ImplementsAllTheThings) Notify(run state.Run) {
+	iatt.Calls = append(iatt.Calls, "Notify")
+	iatt.Notified = append(iatt.Notified, run)
+}
+
+// ClaimIdempotencyKey - StateManager
+func (iatt *ImplementsAllTheThings) ClaimIdempotencyKey(
+	k state.IdempotencyKey, since time.Time) (state.IdempotencyKey, bool, error) {
+	iatt.Calls = append(iatt.Calls, "ClaimIdempotencyKey")
+	if iatt.IdempotencyKeys == nil {
+		iatt.IdempotencyKeys = make(map[string]state.IdempotencyKey)
+	}
+	id := k.OwnerID + "/" + k.Key
+	if existing, ok := iatt.IdempotencyKeys[id]; ok && existing.CreatedAt.After(since) {
+		return existing, false, nil
+	}
+	iatt.IdempotencyKeys[id] = k
+	return k, true, nil
+}
+
+// ReleaseIdempotencyKey - StateManager
+func (iatt *ImplementsAllTheThings) ReleaseIdempotencyKey(ownerID string, key string, runID string) error {
+	iatt.Calls = append(iatt.Calls, "ReleaseIdempotencyKey")
+	id := ownerID + "/" + key
+	if existing, ok := iatt.IdempotencyKeys[id]; ok && existing.RunID == runID {
+		delete(iatt.IdempotencyKeys, id)
+	}
+	return nil
+}
+
 // ListGroups - StateManager
 func (iatt *ImplementsAllTheThings) ListGroups(limit int, offset int, name *string) (state.GroupsList, error) {
 	iatt.Calls = append(iatt.Calls, "ListGroups")
@@ -237,6 +655,27 @@ func (iatt *ImplementsAllTheThings) ListClusters() ([]string, error) {
 	return []string{"cluster0", "cluster1"}, nil
 }
 
+// DescribeCluster - Cluster Client
+func (iatt *ImplementsAllTheThings) DescribeCluster(clusterName string) (cluster.Capacity, error) {
+	iatt.Calls = append(iatt.Calls, "DescribeCluster")
+	if clusterName != "cluster0" && clusterName != "cluster1" {
+		return cluster.Capacity{}, exceptions.MissingResource{
+			ErrorString: fmt.Sprintf("cluster [%s] was not found", clusterName)}
+	}
+	return cluster.Capacity{
+		Name:          clusterName,
+		InstanceCount: 1,
+		Registered:    cluster.Resources{Memory: 2048, CPU: 1024},
+		Remaining:     cluster.Resources{Memory: 1024, CPU: 1024},
+		Largest:       cluster.Resources{Memory: 2048, CPU: 1024},
+		Utilization:   cluster.Utilization{Memory: 0.5},
+		Instances: []cluster.Instance{{
+			InstanceID: "i-0", Status: "ACTIVE",
+			Registered: cluster.Resources{Memory: 2048, CPU: 1024},
+			Remaining:  cluster.Resources{Memory: 1024, CPU: 1024}}},
+	}, nil
+}
+
 // IsImageValid - Registry Client
 func (iatt *ImplementsAllTheThings) IsImageValid(imageRef string) (bool, error) {
 	iatt.Calls = append(iatt.Calls, "IsImageValid")
@@ -290,9 +729,17 @@ func (iatt *ImplementsAllTheThings) PollStatus() (engine.RunReceipt, error) {
 }
 
 // Execute - Execution Engine
-func (iatt *ImplementsAllTheThings) Execute(definition state.Definition, run state.Run) (state.Run, bool, error) {
+func (iatt *ImplementsAllTheThings) Execute(run state.Run) (state.Run, bool, error) {
 	iatt.Calls = append(iatt.Calls, "Execute")
-	return state.Run{}, iatt.ExecuteErrorIsRetryable, iatt.ExecuteError
+	iatt.Executed = append(iatt.Executed, run)
+	if iatt.Executing != nil {
+		iatt.Executing(run)
+	}
+	var launched state.Run
+	if iatt.ExecuteError == nil {
+		launched.TaskArn = fmt.Sprintf("task:%s", run.RunID)
+	}
+	return launched, iatt.ExecuteErrorIsRetryable, iatt.ExecuteError
 }
 
 // Terminate - Execution Engine
@@ -301,6 +748,16 @@ func (iatt *ImplementsAllTheThings) Terminate(run state.Run) error {
 	return nil
 }
 
+// Describe - Execution Engine
+func (iatt *ImplementsAllTheThings) Describe(run state.Run) (state.Run, error) {
+	iatt.Calls = append(iatt.Calls, "Describe")
+	described, ok := iatt.Described[run.RunID]
+	if !ok {
+		return described, exceptions.MissingResource{ErrorString: fmt.Sprintf("No task %s", run.TaskArn)}
+	}
+	return described, nil
+}
+
 // Define - Execution Engine
 func (iatt *ImplementsAllTheThings) Define(definition state.Definition) (state.Definition, error) {
 	iatt.Calls = append(iatt.Calls, "Define")
@@ -317,5 +774,13 @@ func (iatt *ImplementsAllTheThings) Deregister(definition state.Definition) erro
 // Logs - Logs Client
 func (iatt *ImplementsAllTheThings) Logs(definition state.Definition, run state.Run, lastSeen *string) (string, *string, error) {
 	iatt.Calls = append(iatt.Calls, "Logs")
-	return "", nil, nil
+	next := 0
+	if lastSeen != nil && len(*lastSeen) > 0 {
+		next, _ = strconv.Atoi(*lastSeen)
+	}
+	if next >= len(iatt.LogChunks) {
+		return "", lastSeen, nil
+	}
+	seen := strconv.Itoa(next + 1)
+	return iatt.LogChunks[next], &seen, nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/cluster"
+	"github.com/stitchfix/flotilla-os/clients/logs"
+	"github.com/stitchfix/flotilla-os/clients/registry"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/queue"
+	"github.com/stitchfix/flotilla-os/state"
+)
+
+//
+// wiring initializes the managers and clients flotilla is made of, each
+// at most once and only when asked for, so that every process mode
+// shares how they are put together but only initializes what it uses
+//
+type wiring struct {
+	conf   config.Config
+	logger flotillaLog.Logger
+
+	sm state.Manager
+	qm queue.Manager
+	ee engine.Engine
+	rc registry.Client
+	cc cluster.Client
+	lc logs.Client
+}
+
+//
+// stateManager reads and writes state about definitions and runs
+//
+func (w *wiring) stateManager() (state.Manager, error) {
+	if w.sm == nil {
+		sm, err := state.NewStateManager(w.conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize state manager")
+		}
+		w.sm = sm
+	}
+	return w.sm, nil
+}
+
+//
+// queueManager queues runs
+//
+func (w *wiring) queueManager() (queue.Manager, error) {
+	if w.qm == nil {
+		qm, err := queue.NewQueueManager(w.conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize queue manager")
+		}
+		w.qm = qm
+	}
+	return w.qm, nil
+}
+
+//
+// engine interacts with the backend execution management
+// framework (eg. ECS)
+//
+func (w *wiring) engine() (engine.Engine, error) {
+	if w.ee == nil {
+		qm, err := w.queueManager()
+		if err != nil {
+			return nil, err
+		}
+		ee, err := engine.NewExecutionEngine(w.conf, qm)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize execution engine")
+		}
+		w.ee = ee
+	}
+	return w.ee, nil
+}
+
+//
+// registryClient validates images
+//
+func (w *wiring) registryClient() (registry.Client, error) {
+	if w.rc == nil {
+		rc, err := registry.NewRegistryClient(w.conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize registry client")
+		}
+		w.rc = rc
+	}
+	return w.rc, nil
+}
+
+//
+// clusterClient validates definitions against execution clusters
+//
+func (w *wiring) clusterClient() (cluster.Client, error) {
+	if w.cc == nil {
+		cc, err := cluster.NewClusterClient(w.conf)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize cluster client")
+		}
+		w.cc = cc
+	}
+	return w.cc, nil
+}
+
+//
+// logsClient reads run logs
+//
+func (w *wiring) logsClient() (logs.Client, error) {
+	if w.lc == nil {
+		lc, err := logs.NewLogsClient(w.conf, w.logger)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to initialize logs client")
+		}
+		w.lc = lc
+	}
+	return w.lc, nil
+}
@@ -0,0 +1,81 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"time"
+)
+
+//
+// singletonTypes are the types of worker that must only run on one
+// replica at a time; the schedule worker claims ticks itself, so it
+// may run on several
+//
+var singletonTypes = map[string]bool{
+	"retry":     true,
+	"timeout":   true,
+	"reconcile": true,
+}
+
+//
+// singletonWorker runs its Worker only while it holds the worker type's
+// lease, so that of several replicas only the leader runs it
+// * replicas that are not the leader try to take over every leaseInterval
+// * the leader checks it still holds the lease every leaseInterval, and
+//   stops the worker if it does not
+//
+type singletonWorker struct {
+	Worker
+	workerType    string
+	leaser        state.Leaser
+	log           flotillaLog.Logger
+	leaseInterval time.Duration
+}
+
+//
+// Run leads, whenever it can take the lease, until ctx is done
+//
+func (sw *singletonWorker) Run(ctx context.Context) {
+	for {
+		lease, err := sw.leaser.AcquireLease("worker:" + sw.workerType)
+		if err != nil {
+			sw.log.Log("message", "Error acquiring worker lease", "worker", sw.workerType, "error", fmt.Sprintf("%+v", err))
+		} else if lease != nil {
+			sw.lead(ctx, lease)
+		}
+		if !sleep(ctx, sw.leaseInterval) {
+			return
+		}
+	}
+}
+
+//
+// lead runs the worker until ctx is done or the lease is lost, and
+// then releases the lease once the worker has stopped
+//
+func (sw *singletonWorker) lead(ctx context.Context, lease state.Lease) {
+	sw.log.Log("message", "Leading worker", "worker", sw.workerType)
+
+	leading, stop := context.WithCancel(ctx)
+	defer stop()
+	stopped := make(chan struct{})
+	go func() {
+		sw.Worker.Run(leading)
+		close(stopped)
+	}()
+
+	for sleep(leading, sw.leaseInterval) {
+		if err := lease.Check(); err != nil {
+			sw.log.Log("message", "Lost worker lease", "worker", sw.workerType, "error", fmt.Sprintf("%+v", err))
+			stop()
+		}
+	}
+
+	<-stopped
+	if err := lease.Release(); err != nil {
+		sw.log.Log("message", "Error releasing worker lease", "worker", sw.workerType, "error", fmt.Sprintf("%+v", err))
+	}
+	sw.log.Log("message", "Stopped leading worker", "worker", sw.workerType)
+}
@@ -0,0 +1,191 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaser gives out leases like advisory locks do
+type fakeLeaser struct {
+	mu     sync.Mutex
+	leases map[string]*fakeLease
+}
+
+type fakeLease struct {
+	leaser *fakeLeaser
+	name   string
+	lost   bool
+}
+
+func (fl *fakeLeaser) AcquireLease(name string) (state.Lease, error) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if _, held := fl.leases[name]; held {
+		return nil, nil
+	}
+	lease := &fakeLease{leaser: fl, name: name}
+	fl.leases[name] = lease
+	return lease, nil
+}
+
+// lose ends the lease on name, like the leader's connection dying
+func (fl *fakeLeaser) lose(name string) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if lease, held := fl.leases[name]; held {
+		lease.lost = true
+		delete(fl.leases, name)
+	}
+}
+
+func (l *fakeLease) Check() error {
+	l.leaser.mu.Lock()
+	defer l.leaser.mu.Unlock()
+	if l.lost {
+		return errors.New("lease lost")
+	}
+	return nil
+}
+
+func (l *fakeLease) Release() error {
+	l.leaser.mu.Lock()
+	defer l.leaser.mu.Unlock()
+	if !l.lost {
+		delete(l.leaser.leases, l.name)
+	}
+	return nil
+}
+
+// blockingWorker runs until it is stopped
+type blockingWorker struct {
+	mu      sync.Mutex
+	running bool
+	runs    int
+}
+
+func (bw *blockingWorker) Initialize(
+	conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error {
+	return nil
+}
+
+func (bw *blockingWorker) Run(ctx context.Context) {
+	bw.setRunning(true)
+	<-ctx.Done()
+	bw.setRunning(false)
+}
+
+func (bw *blockingWorker) setRunning(running bool) {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	bw.running = running
+	if running {
+		bw.runs++
+	}
+}
+
+func (bw *blockingWorker) isRunning() bool {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.running
+}
+
+func (bw *blockingWorker) runCount() int {
+	bw.mu.Lock()
+	defer bw.mu.Unlock()
+	return bw.runs
+}
+
+func eventually(condition func() bool) bool {
+	for i := 0; i < 100; i++ {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func TestSingletonWorker_Run(t *testing.T) {
+	logger := flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+	leaser := &fakeLeaser{leases: map[string]*fakeLease{}}
+	a, b := &blockingWorker{}, &blockingWorker{}
+	replica := func(wk Worker) *singletonWorker {
+		return &singletonWorker{
+			Worker: wk, workerType: "retry", leaser: leaser, log: logger, leaseInterval: 10 * time.Millisecond}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		replica(a).Run(ctx)
+	}()
+	if !eventually(a.isRunning) {
+		t.Fatalf("Expected the first replica to lead")
+	}
+	go func() {
+		defer wg.Done()
+		replica(b).Run(ctx)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	if b.isRunning() {
+		t.Errorf("Expected only the leader to run the worker")
+	}
+
+	// When the leader loses its lease it stops, and whichever replica
+	// takes the lease next leads
+	leaser.lose("worker:retry")
+	if !eventually(func() bool {
+		return a.runCount()+b.runCount() == 2 && a.isRunning() != b.isRunning()
+	}) {
+		t.Errorf("Expected the leader to stop and a replica to take over, ran %d and %d times",
+			a.runCount(), b.runCount())
+	}
+
+	cancel()
+	wg.Wait()
+	if a.isRunning() || b.isRunning() {
+		t.Errorf("Expected workers to stop")
+	}
+	if len(leaser.leases) != 0 {
+		t.Errorf("Expected leases to be released, got %v", leaser.leases)
+	}
+}
+
+func TestNewWorker_Singleton(t *testing.T) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	logger := flotillaLog.NewLogger(gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr)), nil)
+	imp := &testutils.ImplementsAllTheThings{T: t}
+	sm := struct {
+		*testutils.ImplementsAllTheThings
+		*fakeLeaser
+	}{imp, &fakeLeaser{leases: map[string]*fakeLease{}}}
+
+	wk, _ := NewWorker("retry", logger, c, imp, sm, nil)
+	if _, ok := wk.(*singletonWorker); !ok {
+		t.Errorf("Expected retry workers to only run on the leader")
+	}
+	wk, _ = NewWorker("submit", logger, c, imp, sm, nil)
+	if _, ok := wk.(*singletonWorker); ok {
+		t.Errorf("Expected submit workers to run on every replica")
+	}
+
+	// State managers that can not give out leases run every worker
+	wk, _ = NewWorker("retry", logger, c, imp, imp, nil)
+	if _, ok := wk.(*singletonWorker); ok {
+		t.Errorf("Expected retry workers to run without leases")
+	}
+}
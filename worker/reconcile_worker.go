@@ -0,0 +1,318 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/exceptions"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
+	"github.com/stitchfix/flotilla-os/state"
+	"time"
+)
+
+// Number of runs fetched at a time
+const reconcileBatchSize = 100
+
+//
+// Stopped runs missing an exit code are only looked up for this long;
+// ecs forgets tasks about an hour after they stop
+//
+const exitCodeWindow = time.Hour
+
+// FailureReason of runs whose task the execution engine no longer knows of
+const vanishedReason = "task vanished from the execution engine without a status update"
+
+//
+// reconcileWorker repairs runs whose state drifted from the execution
+// engine's, eg. when a status update was lost or a queued run's message
+// expired
+// * PENDING and RUNNING runs take the engine's view of their task; those
+//   whose task vanished are stopped
+// * recently STOPPED runs missing an exit code take the engine's
+// * QUEUED runs whose message was not received within requeueAfter are
+//   queued again, and PENDING runs claimed for submission that got no task
+//   within requeueAfter are released back to QUEUED
+//
+type reconcileWorker struct {
+	sm           state.Manager
+	ee           engine.Engine
+	conf         config.Config
+	log          flotillaLog.Logger
+	notifier     webhook.Notifier
+	pollInterval time.Duration
+	requeueAfter time.Duration
+}
+
+func (rw *reconcileWorker) Initialize(
+	conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error {
+	rw.pollInterval = pollInterval
+	rw.conf = conf
+	rw.sm = sm
+	rw.ee = ee
+	rw.log = log
+
+	requeueAfter, err := GetRequeueAfter(conf)
+	if err != nil {
+		return err
+	}
+	rw.requeueAfter = requeueAfter
+
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook notifier")
+	}
+	rw.notifier = notifier
+	return nil
+}
+
+//
+// GetRequeueAfter is how long runs may stay QUEUED before the reconcile
+// worker queues them again; worker.reconcile_requeue_after, or an hour
+//
+func GetRequeueAfter(conf config.Config) (time.Duration, error) {
+	if !conf.IsSet("worker.reconcile_requeue_after") {
+		return time.Hour, nil
+	}
+	requeueAfter, err := time.ParseDuration(conf.GetString("worker.reconcile_requeue_after"))
+	if err != nil {
+		return requeueAfter, errors.Wrap(err, "worker.reconcile_requeue_after must be a duration")
+	}
+	return requeueAfter, nil
+}
+
+//
+// Run periodically compares unfinished runs with the execution engine's
+// view of them, and repairs any drift
+//
+func (rw *reconcileWorker) Run(ctx context.Context) {
+	for {
+		start := time.Now()
+		rw.runOnce(ctx)
+		metrics.WorkerLoopDuration.ObserveSince(start, "reconcile")
+		if !sleep(ctx, rw.pollInterval) {
+			return
+		}
+	}
+}
+
+func (rw *reconcileWorker) runOnce(ctx context.Context) {
+	now := time.Now()
+	rw.reconcileUnfinished(ctx, now)
+	rw.reconcileExitCodes(ctx, now)
+}
+
+//
+// reconcileUnfinished pages through QUEUED, PENDING and RUNNING runs;
+// runs that are repaired to a finished status drop out of the listing
+//
+func (rw *reconcileWorker) reconcileUnfinished(ctx context.Context, now time.Time) {
+	offset := 0
+	for ctx.Err() == nil {
+		runList, err := rw.sm.ListRuns(
+			reconcileBatchSize, offset,
+			"run_id", "asc",
+			map[string][]string{"status": {state.StatusQueued, state.StatusPending, state.StatusRunning}}, nil)
+		if err != nil {
+			rw.log.Log("message", "Error listing runs to reconcile", "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("reconcile")
+			return
+		}
+
+		for _, run := range runList.Runs {
+			listed := true
+			switch run.Status {
+			case state.StatusQueued:
+				listed = rw.requeue(run, now)
+			case state.StatusPending, state.StatusRunning:
+				if len(run.TaskArn) == 0 {
+					listed = rw.release(run, now)
+				} else {
+					listed = rw.reconcile(run, now)
+				}
+			}
+			if listed {
+				offset++
+			}
+		}
+
+		if len(runList.Runs) < reconcileBatchSize {
+			return
+		}
+	}
+}
+
+//
+// reconcileExitCodes fills in the exit codes of runs that stopped within
+// the exitCodeWindow without one
+//
+func (rw *reconcileWorker) reconcileExitCodes(ctx context.Context, now time.Time) {
+	since := now.Add(-exitCodeWindow).UTC().Format(time.RFC3339)
+	offset := 0
+	for ctx.Err() == nil {
+		runList, err := rw.sm.ListRuns(
+			reconcileBatchSize, offset,
+			"run_id", "asc",
+			map[string][]string{
+				"status":            {state.StatusStopped},
+				"finished_at_since": {since},
+			}, nil)
+		if err != nil {
+			rw.log.Log("message", "Error listing stopped runs to reconcile", "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("reconcile")
+			return
+		}
+
+		for _, run := range runList.Runs {
+			if run.Status == state.StatusStopped && run.ExitCode == nil && len(run.TaskArn) > 0 {
+				rw.reconcile(run, now)
+			}
+		}
+
+		offset += len(runList.Runs)
+		if len(runList.Runs) < reconcileBatchSize {
+			return
+		}
+	}
+}
+
+//
+// reconcile brings the run up to date with the execution engine's view
+// of its task; returns true if the run is still unfinished
+//
+func (rw *reconcileWorker) reconcile(run state.Run, now time.Time) bool {
+	if len(run.TaskArn) == 0 {
+		return true
+	}
+
+	var (
+		update state.Run
+		repair string
+	)
+	described, err := rw.ee.Describe(run)
+	if err != nil {
+		if _, vanished := errors.Cause(err).(exceptions.MissingResource); !vanished {
+			rw.log.Log("message", "Error describing run to reconcile", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("reconcile")
+			return true
+		}
+		if run.Status == state.StatusStopped {
+			// Forgotten by the engine since it stopped; nothing to fill in
+			return false
+		}
+		update = state.Run{Status: state.StatusStopped, FinishedAt: &now, FailureReason: vanishedReason}
+		repair = "vanished"
+	} else if run.Status == state.StatusStopped {
+		// Only the exit code; a stopped run is not resurrected for retry
+		if described.ExitCode == nil {
+			return false
+		}
+		update = state.Run{ExitCode: described.ExitCode}
+		repair = "exit_code"
+	} else {
+		applyRetryPolicy(run, &described)
+		if repair = drift(run, described); len(repair) == 0 {
+			return true
+		}
+		update = described
+	}
+
+	updated, err := rw.sm.UpdateRun(run.RunID, update)
+	if err != nil {
+		rw.log.Log("message", "Error repairing run", "run_id", run.RunID, "repair", repair, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("reconcile")
+		return true
+	}
+	if updated.Status != run.Status {
+		notifyStatusChange(rw.sm, rw.notifier, rw.log, updated)
+	}
+	metrics.RunsReconciled.Inc(run.ClusterName, repair)
+	rw.log.Log("message", "Repaired run", "run_id", run.RunID, "repair", repair, "status", updated.Status)
+
+	return updated.Status == state.StatusPending || updated.Status == state.StatusRunning
+}
+
+//
+// drift names what the execution engine knows of the run that its state
+// does not; empty when they agree
+//
+func drift(run state.Run, described state.Run) string {
+	merged := run
+	merged.UpdateWith(described)
+	if merged.Status != run.Status {
+		return "status"
+	}
+	if run.ExitCode == nil && described.ExitCode != nil {
+		return "exit_code"
+	}
+	return ""
+}
+
+//
+// release gives up the claim on a run whose submission did not finish
+// within requeueAfter of it being claimed, eg. because the submit worker
+// died; messages of a run are not acked before it has a task, so it is
+// received and claimed again
+//
+func (rw *reconcileWorker) release(run state.Run, now time.Time) bool {
+	claimedAt := run.ClaimedAt
+	if claimedAt == nil {
+		// Claimed before claims were recorded
+		claimedAt = run.QueuedAt
+	}
+	if claimedAt == nil || now.Sub(*claimedAt) < rw.requeueAfter {
+		return true
+	}
+
+	released, err := rw.sm.ReleaseRun(run.RunID)
+	if err != nil {
+		rw.log.Log("message", "Error releasing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("reconcile")
+		return true
+	}
+	if !released {
+		return true
+	}
+	// Back on its queue as of now
+	if _, err := rw.sm.UpdateRun(run.RunID, state.Run{QueuedAt: &now}); err != nil {
+		rw.log.Log("message", "Error updating released run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("reconcile")
+	}
+	metrics.RunsReconciled.Inc(run.ClusterName, "released")
+	rw.log.Log("message", "Released run whose submission never finished", "run_id", run.RunID, "claimed_at", claimedAt.String())
+	return true
+}
+
+//
+// requeue queues the run again if its message is gone, eg. because it
+// expired: until it is acked a QUEUED run's message is received, and the
+// run claimed, at least every visibility timeout, so one neither queued
+// nor claimed within requeueAfter has lost its message. A run queued
+// twice is only submitted by the submit worker that claims it
+//
+func (rw *reconcileWorker) requeue(run state.Run, now time.Time) bool {
+	seenAt := run.QueuedAt
+	if run.ClaimedAt != nil && (seenAt == nil || run.ClaimedAt.After(*seenAt)) {
+		seenAt = run.ClaimedAt
+	}
+	if seenAt == nil || now.Sub(*seenAt) < rw.requeueAfter {
+		return true
+	}
+
+	if err := rw.ee.Enqueue(run); err != nil {
+		rw.log.Log("message", "Error requeueing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("reconcile")
+		return true
+	}
+	if _, err := rw.sm.UpdateRun(run.RunID, state.Run{QueuedAt: &now}); err != nil {
+		rw.log.Log("message", "Error updating requeued run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("reconcile")
+		return true
+	}
+	metrics.RunsReconciled.Inc(run.ClusterName, "requeued")
+	rw.log.Log("message", "Requeued run that was never submitted", "run_id", run.RunID, "last_seen_at", seenAt.String())
+	return true
+}
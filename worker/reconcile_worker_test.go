@@ -0,0 +1,178 @@
+package worker
+
+import (
+	"context"
+	gklog "github.com/go-kit/kit/log"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"os"
+	"testing"
+	"time"
+)
+
+func setUpReconcileWorkerTest(t *testing.T) (*reconcileWorker, *testutils.ImplementsAllTheThings) {
+	l := gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr))
+	logger := flotillaLog.NewLogger(l, nil)
+
+	zero := int64(0)
+	killed := int64(137)
+	stale := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-5 * time.Minute)
+
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Runs: map[string]state.Run{
+			"vanished": {
+				RunID: "vanished", TaskArn: "arn-vanished", ClusterName: "reconcile", Status: state.StatusRunning},
+			"exited": {
+				RunID: "exited", TaskArn: "arn-exited", ClusterName: "reconcile", Status: state.StatusRunning},
+			"agreed": {
+				RunID: "agreed", TaskArn: "arn-agreed", ClusterName: "reconcile", Status: state.StatusRunning},
+			"nocode": {
+				RunID: "nocode", TaskArn: "arn-nocode", ClusterName: "reconcile", Status: state.StatusStopped,
+				FinishedAt: &recent, FailureReason: "timed out after 1m0s"},
+			"stale": {
+				RunID: "stale", ClusterName: "reconcile", Status: state.StatusQueued, QueuedAt: &stale},
+			"fresh": {
+				RunID: "fresh", ClusterName: "reconcile", Status: state.StatusQueued, QueuedAt: &recent},
+		},
+		Described: map[string]state.Run{
+			"exited": {TaskArn: "arn-exited", Status: state.StatusStopped, ExitCode: &zero},
+			"agreed": {TaskArn: "arn-agreed", Status: state.StatusRunning},
+			"nocode": {TaskArn: "arn-nocode", Status: state.StatusStopped, ExitCode: &killed},
+		},
+	}
+	return &reconcileWorker{
+		sm:           &imp,
+		ee:           &imp,
+		log:          logger,
+		notifier:     &imp,
+		requeueAfter: time.Hour,
+	}, &imp
+}
+
+func TestReconcileWorker_Run(t *testing.T) {
+	worker, imp := setUpReconcileWorkerTest(t)
+	vanishedBefore := metrics.RunsReconciled.Value("reconcile", "vanished")
+	worker.runOnce(context.Background())
+
+	run, _ := imp.GetRun("vanished")
+	if run.Status != state.StatusStopped || run.FinishedAt == nil || run.FailureReason != vanishedReason {
+		t.Errorf("Expected run whose task vanished to be stopped with a reason, was %s [%s]", run.Status, run.FailureReason)
+	}
+
+	run, _ = imp.GetRun("exited")
+	if run.Status != state.StatusStopped || run.ExitCode == nil || *run.ExitCode != 0 {
+		t.Errorf("Expected run whose status update was lost to be stopped with its exit code, was %s %v", run.Status, run.ExitCode)
+	}
+
+	run, _ = imp.GetRun("nocode")
+	if run.ExitCode == nil || *run.ExitCode != 137 {
+		t.Errorf("Expected missing exit code to be filled in, was %v", run.ExitCode)
+	}
+	if run.Status != state.StatusStopped || run.FailureReason != "timed out after 1m0s" {
+		t.Errorf("Expected stopped run to keep its status and reason, was %s [%s]", run.Status, run.FailureReason)
+	}
+
+	if len(imp.Queued) != 1 || imp.Queued[0] != "stale" {
+		t.Errorf("Expected only the run queued too long ago to be queued again, was %v", imp.Queued)
+	}
+	run, _ = imp.GetRun("stale")
+	if run.QueuedAt == nil || time.Since(*run.QueuedAt) > time.Minute {
+		t.Errorf("Expected requeued run's queued_at to be reset, was %v", run.QueuedAt)
+	}
+
+	run, _ = imp.GetRun("agreed")
+	if run.Status != state.StatusRunning {
+		t.Errorf("Expected run agreeing with the engine to be left alone, was %s", run.Status)
+	}
+
+	if len(imp.Notified) != 2 {
+		t.Errorf("Expected webhooks to be notified of the two status changes, were %d", len(imp.Notified))
+	}
+	if metrics.RunsReconciled.Value("reconcile", "vanished") != vanishedBefore+1 {
+		t.Errorf("Expected vanished runs to be counted")
+	}
+}
+
+func TestReconcileWorker_ReleasesClaimed(t *testing.T) {
+	worker, imp := setUpReconcileWorkerTest(t)
+	stale := time.Now().Add(-2 * time.Hour)
+	recent := time.Now().Add(-5 * time.Minute)
+	imp.Runs = map[string]state.Run{
+		"abandoned": {
+			RunID: "abandoned", ClusterName: "reconcile", Status: state.StatusPending,
+			QueuedAt: &stale, ClaimedAt: &stale},
+		"submitting": {
+			RunID: "submitting", ClusterName: "reconcile", Status: state.StatusPending,
+			QueuedAt: &stale, ClaimedAt: &recent},
+	}
+
+	worker.runOnce(context.Background())
+
+	// Claimed runs that never got a task are released once their claim is
+	// old enough; their message was kept, so they are not queued again
+	if run, _ := imp.GetRun("abandoned"); run.Status != state.StatusQueued {
+		t.Errorf("Expected abandoned run to be released, was %s", run.Status)
+	}
+	if run, _ := imp.GetRun("submitting"); run.Status != state.StatusPending {
+		t.Errorf("Expected run being submitted to be left alone, was %s", run.Status)
+	}
+	if len(imp.Queued) != 0 {
+		t.Errorf("Expected no run to be queued again, was %v", imp.Queued)
+	}
+
+	// Nor once released, until its message goes unreceived for requeueAfter
+	worker.runOnce(context.Background())
+	if len(imp.Queued) != 0 {
+		t.Errorf("Expected released run not to be queued again, was %v", imp.Queued)
+	}
+}
+
+func TestReconcileWorker_ClaimedWhileReconciling(t *testing.T) {
+	// Test that a run that waited on its queue longer than requeueAfter is
+	// left to the submit worker that just claimed it
+	worker, imp := setUpReconcileWorkerTest(t)
+	stale := time.Now().Add(-2 * time.Hour)
+	imp.Runs = map[string]state.Run{
+		"backlogged": {
+			RunID: "backlogged", ClusterName: "reconcile", Status: state.StatusQueued, QueuedAt: &stale},
+	}
+
+	if claimed, _ := imp.ClaimRun("backlogged"); !claimed {
+		t.Fatalf("Expected backlogged run to be claimed")
+	}
+	worker.runOnce(context.Background())
+
+	for _, call := range imp.Calls {
+		if call == "ReleaseRun" || call == "Enqueue" {
+			t.Errorf("Expected claimed run to be left alone, got %s", call)
+		}
+	}
+	if run, _ := imp.GetRun("backlogged"); run.Status != state.StatusPending {
+		t.Errorf("Expected claimed run to stay pending, was %s", run.Status)
+	}
+
+	// Released for another try, it is not queued again; its message is
+	// received again
+	imp.ReleaseRun("backlogged")
+	worker.runOnce(context.Background())
+	if len(imp.Queued) != 0 {
+		t.Errorf("Expected released run not to be queued again, was %v", imp.Queued)
+	}
+}
+
+func TestReconcileWorker_NotResurrected(t *testing.T) {
+	worker, imp := setUpReconcileWorkerTest(t)
+
+	// A stopped run the engine would retry stays stopped
+	imp.Described["nocode"] = state.Run{TaskArn: "arn-nocode", Status: state.StatusNeedsRetry}
+	worker.reconcile(imp.Runs["nocode"], time.Now())
+
+	run, _ := imp.GetRun("nocode")
+	if run.Status != state.StatusStopped || run.ExitCode != nil {
+		t.Errorf("Expected stopped run to be left alone, was %s %v", run.Status, run.ExitCode)
+	}
+}
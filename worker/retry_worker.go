@@ -1,19 +1,27 @@
 package worker
 
 import (
+	"context"
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 	"time"
 )
 
+// Number of runs needing retry fetched at a time
+const retryBatchSize = 25
+
 type retryWorker struct {
 	sm           state.Manager
 	ee           engine.Engine
 	conf         config.Config
 	log          flotillaLog.Logger
+	notifier     webhook.Notifier
 	pollInterval time.Duration
 }
 
@@ -24,44 +32,144 @@ func (rw *retryWorker) Initialize(
 	rw.sm = sm
 	rw.ee = ee
 	rw.log = log
+
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook notifier")
+	}
+	rw.notifier = notifier
 	return nil
 }
 
 //
-// Run finds tasks that NEED_RETRY and requeues them
+// Run finds tasks that NEED_RETRY and requeues them according to
+// their retry policy
+// * each failed attempt is recorded on the run
+// * the run is requeued, as its next attempt, once its backoff has passed
+// * when the policy's attempts are exhausted the run is stopped
 //
-func (rw *retryWorker) Run() {
+func (rw *retryWorker) Run(ctx context.Context) {
 	for {
+		start := time.Now()
 		rw.runOnce()
-		time.Sleep(rw.pollInterval)
+		metrics.WorkerLoopDuration.ObserveSince(start, "retry")
+		if !sleep(ctx, rw.pollInterval) {
+			return
+		}
 	}
 }
 
 func (rw *retryWorker) runOnce() {
-	// List runs in the StatusNeedsRetry state and requeue them
-	runList, err := rw.sm.ListRuns(
-		25, 0,
-		"started_at", "asc",
-		map[string][]string{"status": {state.StatusNeedsRetry}}, nil)
+	now := time.Now()
 
-	rw.log.Log("message", fmt.Sprintf("Got %v jobs to retry", runList.Total))
+	// Runs still backing off stay in StatusNeedsRetry; page past them
+	offset := 0
+	for {
+		runList, err := rw.sm.ListRuns(
+			retryBatchSize, offset,
+			"started_at", "asc",
+			map[string][]string{"status": {state.StatusNeedsRetry}}, nil)
 
-	if err != nil {
-		rw.log.Log("message", "Error listing runs for retry", "error", fmt.Sprintf("%+v", err))
-		return
-	}
+		if err != nil {
+			rw.log.Log("message", "Error listing runs for retry", "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("retry")
+			return
+		}
 
-	for _, run := range runList.Runs {
+		if offset == 0 {
+			rw.log.Log("message", fmt.Sprintf("Got %v jobs to retry", runList.Total))
+		}
 
-		if _, err = rw.sm.UpdateRun(run.RunID, state.Run{Status: state.StatusQueued}); err != nil {
-			rw.log.Log("message", "Error updating run status to StatusQueued", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
-			return
+		for _, run := range runList.Runs {
+			if rw.retry(run, now) {
+				offset++
+			}
 		}
 
-		if err = rw.ee.Enqueue(run); err != nil {
-			rw.log.Log("message", "Error enqueuing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		if len(runList.Runs) < retryBatchSize {
 			return
 		}
 	}
-	return
+}
+
+//
+// retry records the run's failed attempt and then either stops it, if its
+// attempts are exhausted, or requeues it once its backoff has passed;
+// returns true if the run is left waiting in StatusNeedsRetry
+//
+func (rw *retryWorker) retry(run state.Run, now time.Time) bool {
+	policy := run.RetryPolicyOrDefault()
+
+	attempt := run.Attempt
+	if attempt == 0 {
+		// Runs created before attempts were counted
+		attempt = 1
+	}
+
+	var attempts state.RunAttempts
+	if run.Attempts != nil {
+		attempts = *run.Attempts
+	}
+
+	update := state.Run{}
+	if len(attempts) == 0 || attempts[len(attempts)-1].Attempt < attempt {
+		attempts = append(attempts, state.RunAttempt{
+			Attempt:       attempt,
+			TaskArn:       run.TaskArn,
+			StartedAt:     run.StartedAt,
+			FinishedAt:    run.FinishedAt,
+			FailureReason: run.FailureReason,
+		})
+		update.Attempts = &attempts
+	}
+
+	if attempt >= policy.MaxAttempts {
+		update.Status = state.StatusStopped
+		update.FailureReason = fmt.Sprintf(
+			"retries exhausted after %d attempts; last failure: %s", attempt, run.FailureReason)
+		stopped, err := rw.sm.UpdateRun(run.RunID, update)
+		if err != nil {
+			rw.log.Log("message", "Error stopping run with exhausted retries", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("retry")
+			return true
+		}
+		notifyStatusChange(rw.sm, rw.notifier, rw.log, stopped)
+		rw.log.Log("message", "Stopped run with exhausted retries", "run_id", run.RunID, "attempts", attempt)
+		return false
+	}
+
+	retryAt := run.RetryAt
+	if retryAt == nil {
+		next := now.Add(policy.Backoff(attempt))
+		retryAt = &next
+	}
+
+	if retryAt.After(now) {
+		if run.RetryAt == nil {
+			update.RetryAt = retryAt
+			if _, err := rw.sm.UpdateRun(run.RunID, update); err != nil {
+				rw.log.Log("message", "Error scheduling run retry", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+				metrics.WorkerErrors.Inc("retry")
+			}
+		}
+		return true
+	}
+
+	update.Status = state.StatusQueued
+	update.Attempt = attempt + 1
+	update.QueuedAt = &now
+	requeued, err := rw.sm.UpdateRun(run.RunID, update)
+	if err != nil {
+		rw.log.Log("message", "Error updating run status to StatusQueued", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("retry")
+		return true
+	}
+
+	if err = rw.ee.Enqueue(requeued); err != nil {
+		rw.log.Log("message", "Error enqueuing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("retry")
+	} else {
+		metrics.RunsRetried.Inc(requeued.ClusterName, requeued.GroupName)
+	}
+	return false
 }
@@ -1,12 +1,16 @@
 package worker
 
 import (
+	"fmt"
 	gklog "github.com/go-kit/kit/log"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/testutils"
 	"os"
+	"strings"
 	"testing"
+	"time"
 )
 
 func setUpRetryWorkerTest(t *testing.T) (*retryWorker, *testutils.ImplementsAllTheThings) {
@@ -23,7 +27,8 @@ func setUpRetryWorkerTest(t *testing.T) (*retryWorker, *testutils.ImplementsAllT
 		Runs: map[string]state.Run{
 			"runA": {
 				DefinitionID: "A", ClusterName: "A",
-				GroupName: "A", RunID: "runA", Status: state.StatusNeedsRetry},
+				GroupName: "A", RunID: "runA", Status: state.StatusNeedsRetry,
+				RetryPolicy: &state.RetryPolicy{MaxAttempts: 3}},
 		},
 		Qurls: map[string]string{
 			"A": "a/",
@@ -31,14 +36,16 @@ func setUpRetryWorkerTest(t *testing.T) (*retryWorker, *testutils.ImplementsAllT
 		},
 	}
 	return &retryWorker{
-		sm:  &imp,
-		ee:  &imp,
-		log: logger,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		notifier: &imp,
 	}, &imp
 }
 
 func TestRetryWorker_Run(t *testing.T) {
 	worker, imp := setUpRetryWorkerTest(t)
+	retried := metrics.RunsRetried.Value("A", "A")
 	worker.runOnce()
 
 	//
@@ -61,4 +68,105 @@ func TestRetryWorker_Run(t *testing.T) {
 	if run.Status != state.StatusQueued {
 		t.Errorf("Expected retry worker to update run status to Queued")
 	}
+	if run.QueuedAt == nil {
+		t.Errorf("Expected requeued run to record when it was queued")
+	}
+	if metrics.RunsRetried.Value("A", "A") != retried+1 {
+		t.Errorf("Expected the retry to be counted")
+	}
+}
+
+func TestRetryWorker_Backoff(t *testing.T) {
+	worker, imp := setUpRetryWorkerTest(t)
+	imp.Runs["runA"] = state.Run{
+		RunID: "runA", Status: state.StatusNeedsRetry, TaskArn: "arn1",
+		Attempt: 1, FailureReason: "CannotPullContainerError",
+		RetryPolicy: &state.RetryPolicy{MaxAttempts: 3, BackoffSeconds: 60},
+	}
+
+	// The failed attempt is recorded and the retry waits out the backoff
+	before := time.Now()
+	worker.runOnce()
+	run, _ := imp.GetRun("runA")
+	if run.Status != state.StatusNeedsRetry || len(imp.Queued) != 0 {
+		t.Errorf("Expected run to wait for backoff before retry, was %s", run.Status)
+	}
+
+	if run.RetryAt == nil || run.RetryAt.Before(before.Add(time.Minute)) {
+		t.Errorf("Expected retry at least a minute from now, was %v", run.RetryAt)
+	}
+
+	if run.Attempts == nil || len(*run.Attempts) != 1 ||
+		(*run.Attempts)[0].TaskArn != "arn1" || (*run.Attempts)[0].FailureReason != "CannotPullContainerError" {
+		t.Errorf("Expected first attempt to be recorded, got %v", run.Attempts)
+	}
+
+	// Once the backoff has passed the run is requeued as its next attempt
+	past := time.Now().Add(-time.Second)
+	imp.UpdateRun("runA", state.Run{RetryAt: &past})
+	worker.runOnce()
+	run, _ = imp.GetRun("runA")
+	if run.Status != state.StatusQueued || len(imp.Queued) != 1 {
+		t.Errorf("Expected run to be requeued, was %s", run.Status)
+	}
+
+	if run.Attempt != 2 || run.RetryAt != nil || len(run.FailureReason) != 0 || len(*run.Attempts) != 1 {
+		t.Errorf("Expected a clean second attempt with one recorded attempt, got %v", run)
+	}
+}
+
+func TestRetryWorker_Exhausted(t *testing.T) {
+	worker, imp := setUpRetryWorkerTest(t)
+	imp.Runs["runA"] = state.Run{
+		RunID: "runA", Status: state.StatusNeedsRetry,
+		Attempt: 2, FailureReason: "CannotStartContainerError",
+		Attempts:    &state.RunAttempts{{Attempt: 1}},
+		RetryPolicy: &state.RetryPolicy{MaxAttempts: 2},
+	}
+	stopped := metrics.RunsStopped.Value("", "")
+
+	worker.runOnce()
+	run, _ := imp.GetRun("runA")
+	if run.Status != state.StatusStopped || len(imp.Queued) != 0 {
+		t.Errorf("Expected run with exhausted retries to be stopped, was %s", run.Status)
+	}
+	if len(imp.Notified) != 1 || imp.Notified[0].Status != state.StatusStopped {
+		t.Errorf("Expected webhooks to be notified of the stopped run, got %v", imp.Notified)
+	}
+	if metrics.RunsStopped.Value("", "") != stopped+1 {
+		t.Errorf("Expected the run with exhausted retries to be counted as stopped")
+	}
+
+	if !strings.Contains(run.FailureReason, "retries exhausted after 2 attempts") ||
+		!strings.Contains(run.FailureReason, "CannotStartContainerError") {
+		t.Errorf("Expected failure reason to explain exhausted retries, was [%s]", run.FailureReason)
+	}
+
+	if len(*run.Attempts) != 2 {
+		t.Errorf("Expected both attempts to be recorded, got %v", len(*run.Attempts))
+	}
+}
+
+func TestRetryWorker_Paging(t *testing.T) {
+	worker, imp := setUpRetryWorkerTest(t)
+	delete(imp.Runs, "runA")
+
+	// More runs waiting on backoff than are fetched at once
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Second)
+	policy := &state.RetryPolicy{MaxAttempts: 3, BackoffSeconds: 60}
+	for i := 0; i < retryBatchSize+5; i++ {
+		runID := fmt.Sprintf("waiting%02d", i)
+		imp.Runs[runID] = state.Run{
+			RunID: runID, Status: state.StatusNeedsRetry, Attempt: 1,
+			Attempts: &state.RunAttempts{{Attempt: 1}}, RetryAt: &future, RetryPolicy: policy}
+	}
+	imp.Runs["zready"] = state.Run{
+		RunID: "zready", Status: state.StatusNeedsRetry, Attempt: 1,
+		Attempts: &state.RunAttempts{{Attempt: 1}}, RetryAt: &past, RetryPolicy: policy}
+
+	worker.runOnce()
+	if len(imp.Queued) != 1 {
+		t.Errorf("Expected the run past its backoff to be requeued, got %v", imp.Queued)
+	}
 }
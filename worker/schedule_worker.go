@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/services"
+	"github.com/stitchfix/flotilla-os/state"
+	"time"
+)
+
+// Maximum number of due schedules handled per poll
+const scheduleBatchSize = 100
+
+type scheduleWorker struct {
+	sm           state.Manager
+	ee           engine.Engine
+	es           services.ExecutionService
+	conf         config.Config
+	log          flotillaLog.Logger
+	pollInterval time.Duration
+}
+
+func (sw *scheduleWorker) Initialize(
+	conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error {
+	if sw.es == nil {
+		return errors.New("schedule worker needs an execution service to create runs")
+	}
+	sw.pollInterval = pollInterval
+	sw.conf = conf
+	sw.sm = sm
+	sw.ee = ee
+	sw.log = log
+	return nil
+}
+
+//
+// Run finds schedules with a due tick and creates a run for each
+// * ticks are claimed with a compare-and-swap on the schedule's next
+//   tick, so with several replicas running this worker each tick
+//   creates -at most- one run
+// * catch_up schedules advance one tick per poll, so missed ticks are
+//   run oldest first; skip schedules jump straight to the next tick
+//   after now, running once for all the ticks they missed
+//
+func (sw *scheduleWorker) Run(ctx context.Context) {
+	for {
+		sw.runOnce()
+		if !sleep(ctx, sw.pollInterval) {
+			return
+		}
+	}
+}
+
+func (sw *scheduleWorker) runOnce() {
+	now := time.Now()
+	due, err := sw.sm.ListDueSchedules(now, scheduleBatchSize)
+	if err != nil {
+		sw.log.Log("message", "Error listing due schedules", "error", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	for _, schedule := range due {
+		sw.runTick(schedule, now)
+	}
+}
+
+func (sw *scheduleWorker) runTick(schedule state.Schedule, now time.Time) {
+	tick := *schedule.NextRunAt
+
+	from := now
+	if schedule.MissedPolicy == state.ScheduleMissedCatchUp {
+		from = tick
+	}
+
+	next, err := schedule.NextAfter(from)
+	if err != nil {
+		sw.log.Log("message", "Error computing next tick", "schedule_id", schedule.ScheduleID, "error", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	claimed, err := sw.sm.ClaimScheduleTick(schedule.ScheduleID, tick, next)
+	if err != nil {
+		sw.log.Log("message", "Error claiming schedule tick", "schedule_id", schedule.ScheduleID, "error", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	if !claimed {
+		// Another worker got here first, or the schedule changed
+		return
+	}
+
+	env := sw.runEnv(schedule, tick)
+
+	var run state.Run
+	if len(schedule.Alias) > 0 {
+		run, err = sw.es.CreateByAlias(schedule.Alias, schedule.ClusterName, env, schedule.OwnerID, services.RunOptions{})
+	} else {
+		run, err = sw.es.Create(schedule.DefinitionID, schedule.ClusterName, env, schedule.OwnerID, services.RunOptions{})
+	}
+
+	if err != nil {
+		// The tick is already claimed; it is not retried
+		sw.log.Log("message", "Error creating scheduled run", "schedule_id", schedule.ScheduleID, "tick", tick.String(), "error", fmt.Sprintf("%+v", err))
+		return
+	}
+
+	sw.log.Log("message", "Created scheduled run", "schedule_id", schedule.ScheduleID, "tick", tick.String(), "run_id", run.RunID)
+}
+
+//
+// runEnv is the schedule's environment plus variables identifying
+// the schedule and the tick the run is for
+//
+func (sw *scheduleWorker) runEnv(schedule state.Schedule, tick time.Time) *state.EnvList {
+	scheduled := map[string]string{
+		"FLOTILLA_SCHEDULE_ID":  schedule.ScheduleID,
+		"FLOTILLA_SCHEDULED_AT": tick.UTC().Format(time.RFC3339),
+	}
+
+	env := state.EnvList{}
+	if schedule.Env != nil {
+		for _, e := range *schedule.Env {
+			if _, ok := scheduled[e.Name]; !ok {
+				env = append(env, e)
+			}
+		}
+	}
+	for _, name := range []string{"FLOTILLA_SCHEDULE_ID", "FLOTILLA_SCHEDULED_AT"} {
+		env = append(env, state.EnvVar{Name: name, Value: scheduled[name]})
+	}
+	return &env
+}
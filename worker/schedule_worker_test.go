@@ -0,0 +1,145 @@
+package worker
+
+import (
+	gklog "github.com/go-kit/kit/log"
+	"github.com/stitchfix/flotilla-os/config"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/services"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"os"
+	"testing"
+	"time"
+)
+
+func setUpScheduleWorkerTest(t *testing.T, missedPolicy string, tick time.Time) (*scheduleWorker, *testutils.ImplementsAllTheThings) {
+	confDir := "../conf"
+	c, _ := config.NewConfig(&confDir)
+	l := gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr))
+	logger := flotillaLog.NewLogger(l, nil)
+
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Definitions: map[string]state.Definition{
+			"A": {DefinitionID: "A", Alias: "aliasA"},
+		},
+		Runs: map[string]state.Run{},
+		Schedules: map[string]state.Schedule{
+			"s1": {
+				ScheduleID:     "s1",
+				DefinitionID:   "A",
+				CronExpression: "0 * * * *",
+				Timezone:       "UTC",
+				ClusterName:    "clusta",
+				OwnerID:        "somebody",
+				Env:            &state.EnvList{{Name: "K1", Value: "V1"}},
+				MissedPolicy:   missedPolicy,
+				NextRunAt:      &tick,
+			},
+		},
+	}
+	es, _ := services.NewExecutionService(c, &imp, &imp, &imp, &imp, logger)
+	return &scheduleWorker{
+		sm:  &imp,
+		ee:  &imp,
+		es:  es,
+		log: logger,
+	}, &imp
+}
+
+func TestScheduleWorker_Run(t *testing.T) {
+	now := time.Now().UTC()
+	tick := now.Truncate(time.Hour)
+	worker, imp := setUpScheduleWorkerTest(t, state.ScheduleMissedSkip, tick)
+	worker.runOnce()
+
+	expected := []string{
+		"ListDueSchedules", "ClaimScheduleTick", "GetDefinition", "IsImageValid", "CanBeRun", "CreateRun", "Enqueue"}
+	if len(imp.Calls) != len(expected) {
+		t.Fatalf("Expected calls %v but was %v", expected, imp.Calls)
+	}
+
+	for i, call := range imp.Calls {
+		if expected[i] != call {
+			t.Errorf("Expected call %v to be %s but was %s", i, expected[i], call)
+		}
+	}
+
+	if len(imp.Runs) != 1 {
+		t.Fatalf("Expected exactly 1 run to be created, got %v", len(imp.Runs))
+	}
+
+	for _, run := range imp.Runs {
+		if run.DefinitionID != "A" || run.ClusterName != "clusta" || run.User != "somebody" {
+			t.Errorf("Expected run of [A] on [clusta] owned by [somebody], got %v", run)
+		}
+
+		env := map[string]string{}
+		for _, e := range *run.Env {
+			env[e.Name] = e.Value
+		}
+		if env["K1"] != "V1" || env["FLOTILLA_SCHEDULE_ID"] != "s1" ||
+			env["FLOTILLA_SCHEDULED_AT"] != tick.Format(time.RFC3339) {
+			t.Errorf("Expected schedule env and identifying variables in run env, got %v", env)
+		}
+	}
+
+	schedule := imp.Schedules["s1"]
+	if !schedule.NextRunAt.Equal(tick.Add(time.Hour)) {
+		t.Errorf("Expected next run at %v but was %v", tick.Add(time.Hour), schedule.NextRunAt)
+	}
+
+	// Nothing is due anymore
+	imp.Calls = []string{}
+	worker.runOnce()
+	if len(imp.Runs) != 1 || len(imp.Calls) != 1 {
+		t.Errorf("Expected no further runs, got calls %v", imp.Calls)
+	}
+}
+
+func TestScheduleWorker_MissedPolicy(t *testing.T) {
+	now := time.Now().UTC()
+	missed := now.Truncate(time.Hour).Add(-3 * time.Hour)
+
+	// skip runs once then jumps past now
+	worker, imp := setUpScheduleWorkerTest(t, state.ScheduleMissedSkip, missed)
+	for i := 0; i < 4; i++ {
+		worker.runOnce()
+	}
+
+	if len(imp.Runs) != 1 {
+		t.Errorf("Expected skip policy to create 1 run for missed ticks, got %v", len(imp.Runs))
+	}
+
+	if next := imp.Schedules["s1"].NextRunAt; !next.After(now) {
+		t.Errorf("Expected skip policy to move next run past now, was %v", next)
+	}
+
+	// catch_up runs every missed tick, one per poll
+	worker, imp = setUpScheduleWorkerTest(t, state.ScheduleMissedCatchUp, missed)
+	for i := 0; i < 6; i++ {
+		worker.runOnce()
+	}
+
+	if len(imp.Runs) != 4 {
+		t.Errorf("Expected catch_up policy to create 4 runs for missed ticks, got %v", len(imp.Runs))
+	}
+
+	if next := imp.Schedules["s1"].NextRunAt; !next.After(now) {
+		t.Errorf("Expected catch_up policy to end with next run after now, was %v", next)
+	}
+}
+
+func TestScheduleWorker_ClaimedElsewhere(t *testing.T) {
+	tick := time.Now().UTC().Truncate(time.Hour)
+	worker, imp := setUpScheduleWorkerTest(t, state.ScheduleMissedSkip, tick)
+
+	// Another replica claims the tick between listing and claiming
+	due, _ := imp.ListDueSchedules(time.Now(), 10)
+	imp.ClaimScheduleTick("s1", tick, tick.Add(time.Hour))
+
+	worker.runTick(due[0], time.Now())
+	if len(imp.Runs) != 0 {
+		t.Errorf("Expected no run to be created for a tick claimed elsewhere")
+	}
+}
@@ -1,11 +1,14 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 	"time"
 )
@@ -15,6 +18,7 @@ type statusWorker struct {
 	ee           engine.Engine
 	conf         config.Config
 	log          flotillaLog.Logger
+	notifier     webhook.Notifier
 	pollInterval time.Duration
 }
 
@@ -25,16 +29,26 @@ func (sw *statusWorker) Initialize(
 	sw.sm = sm
 	sw.ee = ee
 	sw.log = log
+
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook notifier")
+	}
+	sw.notifier = notifier
 	return nil
 }
 
 //
 // Run updates status of tasks
 //
-func (sw *statusWorker) Run() {
+func (sw *statusWorker) Run(ctx context.Context) {
 	for {
+		start := time.Now()
 		sw.runOnce()
-		time.Sleep(sw.pollInterval)
+		metrics.WorkerLoopDuration.ObserveSince(start, "status")
+		if !sleep(ctx, sw.pollInterval) {
+			return
+		}
 	}
 }
 
@@ -42,6 +56,7 @@ func (sw *statusWorker) runOnce() {
 	runReceipt, err := sw.ee.PollStatus()
 	if err != nil {
 		sw.log.Log("message", "unable to receive status message", "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("status")
 		return
 	}
 
@@ -66,15 +81,25 @@ func (sw *statusWorker) runOnce() {
 			run, err := sw.findRun(update.TaskArn)
 			if err != nil {
 				sw.log.Log("message", "unable to find run to apply update to", "error", fmt.Sprintf("%+v", err))
+				metrics.WorkerErrors.Inc("status")
 				return
 			}
 
-			_, err = sw.sm.UpdateRun(run.RunID, *update)
+			applyRetryPolicy(run, update)
+
+			updated, err := sw.sm.UpdateRun(run.RunID, *update)
 			if err != nil {
 				sw.log.Log("message", "error applying status update", "run", run.RunID, "error", fmt.Sprintf("%+v", err))
+				metrics.WorkerErrors.Inc("status")
 				return
 			}
 
+			// Out of order updates leave the status as it was
+			if updated.Status != run.Status {
+				notifyStatusChange(sw.sm, sw.notifier, sw.log, updated)
+				sw.observeStarted(run, updated)
+			}
+
 			// emit status update event
 			sw.logStatusUpdate(*update)
 		}
@@ -86,6 +111,40 @@ func (sw *statusWorker) runOnce() {
 	}
 }
 
+//
+// applyRetryPolicy marks runs that failed for one of the retriable reasons
+// of the run's own retry policy as needing retry, just like the failures
+// the execution engine retries
+//
+func applyRetryPolicy(run state.Run, update *state.Run) {
+	if update.Status != state.StatusStopped || update.ExitCode != nil || run.Status == state.StatusStopped {
+		return
+	}
+
+	policy := run.RetryPolicyOrDefault()
+	if policy.IsRetriable(update.FailureReason) {
+		update.Status = state.StatusNeedsRetry
+		update.InstanceID = ""
+		update.InstanceDNSName = ""
+	}
+}
+
+//
+// observeStarted records how long the run took to start running
+// once it was queued
+//
+func (sw *statusWorker) observeStarted(run state.Run, updated state.Run) {
+	if updated.Status != state.StatusRunning || updated.QueuedAt == nil {
+		return
+	}
+	startedAt := time.Now()
+	if updated.StartedAt != nil {
+		startedAt = *updated.StartedAt
+	}
+	metrics.QueuedToRunning.Observe(
+		startedAt.Sub(*updated.QueuedAt).Seconds(), updated.ClusterName, updated.GroupName)
+}
+
 func (sw *statusWorker) logStatusUpdate(update state.Run) {
 	var err error
 	var startedAt, finishedAt time.Time
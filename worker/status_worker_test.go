@@ -4,10 +4,12 @@ import (
 	gklog "github.com/go-kit/kit/log"
 	"github.com/stitchfix/flotilla-os/config"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 	"github.com/stitchfix/flotilla-os/testutils"
 	"os"
 	"testing"
+	"time"
 )
 
 func setUpStatusWorkerTest(t *testing.T) (*statusWorker, *testutils.ImplementsAllTheThings) {
@@ -62,10 +64,11 @@ func setUpStatusWorkerTest(t *testing.T) (*statusWorker, *testutils.ImplementsAl
 		},
 	}
 	return &statusWorker{
-		sm:   &imp,
-		ee:   &imp,
-		log:  logger,
-		conf: c,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		conf:     c,
+		notifier: &imp,
 	}, &imp
 }
 
@@ -121,10 +124,11 @@ func setUpStatusWorkerTest2(t *testing.T) (*statusWorker, *testutils.ImplementsA
 		},
 	}
 	return &statusWorker{
-		sm:   &imp,
-		ee:   &imp,
-		log:  logger,
-		conf: c,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		conf:     c,
+		notifier: &imp,
 	}, &imp
 }
 func TestStatusWorker_Run(t *testing.T) {
@@ -135,7 +139,7 @@ func TestStatusWorker_Run(t *testing.T) {
 
 	worker.runOnce()
 
-	expected := []string{"PollStatus", "ListRuns", "UpdateRun", "StatusReceipt.Done"}
+	expected := []string{"PollStatus", "ListRuns", "UpdateRun", "Notify", "StatusReceipt.Done"}
 	if len(imp.Calls) != len(expected) {
 		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
 	}
@@ -156,6 +160,33 @@ func TestStatusWorker_Run(t *testing.T) {
 	if run.Status != state.StatusStopped {
 		t.Errorf("Expected run to have updated status: %s, but was %s", state.StatusStopped, run.Status)
 	}
+
+	// Only transitions are sent to webhooks, not the out of order update
+	if len(imp.Notified) != 2 ||
+		imp.Notified[0].Status != state.StatusRunning || imp.Notified[1].Status != state.StatusStopped {
+		t.Errorf("Expected webhooks to be notified of 2 transitions, got %v", imp.Notified)
+	}
+}
+
+func TestStatusWorker_QueuedToRunning(t *testing.T) {
+	worker, imp := setUpStatusWorkerTest(t)
+	queuedAt := time.Now().Add(-time.Minute)
+	run := imp.Runs["somerun"]
+	run.QueuedAt = &queuedAt
+	imp.Runs["somerun"] = run
+
+	observed := metrics.QueuedToRunning.Count("", "")
+	worker.runOnce()
+	if metrics.QueuedToRunning.Count("", "") != observed+1 {
+		t.Errorf("Expected the time taken to start running to be observed")
+	}
+
+	// Later transitions are not observed
+	worker.runOnce()
+	worker.runOnce()
+	if metrics.QueuedToRunning.Count("", "") != observed+1 {
+		t.Errorf("Expected only the transition to running to be observed")
+	}
 }
 
 func TestStatusWorker_Run2(t *testing.T) {
@@ -182,7 +213,7 @@ func TestStatusWorker_Run2(t *testing.T) {
 	}
 
 	imp.Calls = []string{}
-	expected = []string{"ReceiveStatus", "ListRuns", "UpdateRun", "StatusReceipt.Done"}
+	expected = []string{"ReceiveStatus", "ListRuns", "UpdateRun", "Notify", "StatusReceipt.Done"}
 	worker.runOnce()
 	if len(imp.Calls) != len(expected) {
 		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
@@ -193,3 +224,30 @@ func TestStatusWorker_Run2(t *testing.T) {
 		t.Errorf("Expected run to have updated status: %s but was %s", state.StatusRunning, run.Status)
 	}
 }
+
+func TestApplyRetryPolicy(t *testing.T) {
+	run := state.Run{
+		RunID:       "somerun",
+		Status:      state.StatusRunning,
+		RetryPolicy: &state.RetryPolicy{MaxAttempts: 3, RetriableReasons: []string{"OutOfMemoryError"}},
+	}
+
+	update := state.Run{Status: state.StatusStopped, FailureReason: "OutOfMemoryError: killed", InstanceID: "i-1"}
+	applyRetryPolicy(run, &update)
+	if update.Status != state.StatusNeedsRetry || len(update.InstanceID) != 0 {
+		t.Errorf("Expected failure retriable by the run's policy to need retry, was %s", update.Status)
+	}
+
+	update = state.Run{Status: state.StatusStopped, FailureReason: "Essential container in task exited"}
+	applyRetryPolicy(run, &update)
+	if update.Status != state.StatusStopped {
+		t.Errorf("Expected failure not retriable by the run's policy to stay stopped, was %s", update.Status)
+	}
+
+	exitCode := int64(1)
+	update = state.Run{Status: state.StatusStopped, FailureReason: "OutOfMemoryError", ExitCode: &exitCode}
+	applyRetryPolicy(run, &update)
+	if update.Status != state.StatusStopped {
+		t.Errorf("Expected run that exited to stay stopped, was %s", update.Status)
+	}
+}
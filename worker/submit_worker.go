@@ -1,10 +1,14 @@
 package worker
 
 import (
+	"context"
 	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
 	"github.com/stitchfix/flotilla-os/state"
 	"time"
 )
@@ -14,6 +18,7 @@ type submitWorker struct {
 	ee           engine.Engine
 	conf         config.Config
 	log          flotillaLog.Logger
+	notifier     webhook.Notifier
 	pollInterval time.Duration
 }
 
@@ -24,25 +29,42 @@ func (sw *submitWorker) Initialize(
 	sw.sm = sm
 	sw.ee = ee
 	sw.log = log
+
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook notifier")
+	}
+	sw.notifier = notifier
 	return nil
 }
 
 //
 // Run lists queues, consumes runs from them, and executes them using the execution engine
 //
-func (sw *submitWorker) Run() {
+func (sw *submitWorker) Run(ctx context.Context) {
 	for {
-		sw.runOnce()
-		time.Sleep(sw.pollInterval)
+		start := time.Now()
+		sw.runOnce(ctx)
+		metrics.WorkerLoopDuration.ObserveSince(start, "submit")
+		if !sleep(ctx, sw.pollInterval) {
+			return
+		}
 	}
 }
 
-func (sw *submitWorker) runOnce() {
+func (sw *submitWorker) runOnce(ctx context.Context) {
 	receipts, err := sw.ee.PollRuns()
 	if err != nil {
 		sw.log.Log("message", "Error receiving runs", "error", fmt.Sprintf("%+v", err))
+		metrics.WorkerErrors.Inc("submit")
 	}
 	for _, runReceipt := range receipts {
+		// When shutting down, receipts not yet started on are left
+		// unacked, to be received again
+		if ctx.Err() != nil {
+			return
+		}
+
 		if runReceipt.Run == nil {
 			continue
 		}
@@ -53,6 +75,7 @@ func (sw *submitWorker) runOnce() {
 		run, err := sw.sm.GetRun(runReceipt.Run.RunID)
 		if err != nil {
 			sw.log.Log("message", "Error fetching run from state, acking", "run_id", runReceipt.Run.RunID, "error", fmt.Sprintf("%+v", err))
+			metrics.WorkerErrors.Inc("submit")
 			if err = runReceipt.Done(); err != nil {
 				sw.log.Log("message", "Acking run failed", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
 			}
@@ -60,48 +83,72 @@ func (sw *submitWorker) runOnce() {
 		}
 
 		//
-		// Fetch run's definition from state manager
-		//
-		// * Will not be necessary once we copy relevant run information from definition onto the run itself
+		// Runs created before definition information was copied onto them
+		// fall back to their definition's current state
 		//
-		definition, err := sw.sm.GetDefinition(run.DefinitionID)
-		if err != nil {
-			sw.log.Log(
-				"message", "Error fetching definition for run",
-				"run_id", run.RunID,
-				"definition_id", run.DefinitionID,
-				"error", err.Error())
-			if err = runReceipt.Done(); err != nil {
-				sw.log.Log("message", "Acking run failed", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		if !run.HasSnapshot() {
+			definition, err := sw.sm.GetDefinition(run.DefinitionID)
+			if err != nil {
+				sw.log.Log(
+					"message", "Error fetching definition for run",
+					"run_id", run.RunID,
+					"definition_id", run.DefinitionID,
+					"error", err.Error())
+				metrics.WorkerErrors.Inc("submit")
+				if err = runReceipt.Done(); err != nil {
+					sw.log.Log("message", "Acking run failed", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+				}
+				continue
 			}
-			continue
+			run.SnapshotDefinition(definition)
 		}
 
 		//
-		// Only valid to process if it's in the StatusQueued state
+		// Only valid to process if it's in the StatusQueued state, and only
+		// by the worker that claims it; a run can be queued more than once
 		//
+		claimed := false
 		if run.Status == state.StatusQueued {
+			if claimed, err = sw.sm.ClaimRun(run.RunID); err != nil {
+				// Don't ack, it's received again
+				sw.log.Log("message", "Error claiming run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+				metrics.WorkerErrors.Inc("submit")
+				continue
+			}
+		}
+
+		if claimed {
+			if run.QueuedAt != nil {
+				metrics.QueueReceiveLatency.ObserveSince(*run.QueuedAt, run.ClusterName)
+			}
 
 			//
 			// Execute the run using the execution engine
 			//
 			sw.log.Log("message", "Submitting", "run_id", run.RunID)
-			launched, retryable, err := sw.ee.Execute(definition, run)
+			launched, retryable, err := sw.ee.Execute(run)
 			if err != nil {
 				sw.log.Log("message", "Error executing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err), "retryable", retryable)
+				metrics.WorkerErrors.Inc("submit")
 				if !retryable {
 					// Set status to StatusStopped, and ack
 					launched.Status = state.StatusStopped
 				} else {
-					// Don't change status, don't ack
+					// Give up the claim and don't ack, so it's submitted again
+					if _, err = sw.sm.ReleaseRun(run.RunID); err != nil {
+						sw.log.Log("message", "Error releasing run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+						metrics.WorkerErrors.Inc("submit")
+					}
 					continue
 				}
+			} else {
+				metrics.RunsSubmitted.Inc(run.ClusterName, run.GroupName)
 			}
 
 			//
-			// Emit event with current definition
+			// Emit event with the run as submitted
 			//
-			err = sw.log.Event("eventClassName", "FlotillaSubmitTask", "definition", definition, "run_id", run.RunID)
+			err = sw.log.Event("eventClassName", "FlotillaSubmitTask", "run", run, "run_id", run.RunID)
 			if err != nil {
 				sw.log.Log("message", "Failed to emit event", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
 			}
@@ -109,10 +156,32 @@ func (sw *submitWorker) runOnce() {
 			//
 			// Update the status and information of the run;
 			// either the run submitted successfully -or- it did not and is not retryable
+			// * includes the definition information for runs that were just snapshotted
 			//
-			if _, err = sw.sm.UpdateRun(run.RunID, launched); err != nil {
+			run.UpdateWith(launched)
+			if updated, err := sw.sm.UpdateRun(run.RunID, run); err != nil {
 				sw.log.Log("message", "Failed to update run status", "run_id", run.RunID, "status", launched.Status, "error", fmt.Sprintf("%+v", err))
+				metrics.WorkerErrors.Inc("submit")
+			} else if updated.Status == state.StatusStopped && launched.Status != state.StatusStopped {
+				//
+				// Stopped while it was being submitted; it keeps its STOPPED
+				// status, and the task launched for it is terminated
+				//
+				if len(updated.TaskArn) > 0 {
+					sw.log.Log("message", "Terminating run stopped while it was submitted", "run_id", run.RunID)
+					if err = sw.ee.Terminate(updated); err != nil {
+						sw.log.Log("message", "Error terminating run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+						metrics.WorkerErrors.Inc("submit")
+					}
+				}
+			} else {
+				notifyStatusChange(sw.sm, sw.notifier, sw.log, updated)
 			}
+		} else if run.Status == state.StatusQueued || (run.Status == state.StatusPending && len(run.TaskArn) == 0) {
+			// Claimed by another worker that has yet to submit it; don't ack,
+			// so the run keeps a message should that claim be released
+			sw.log.Log("message", "Received run already being submitted", "run_id", run.RunID)
+			continue
 		} else {
 			sw.log.Log("message", "Received run that is not runnable", "run_id", run.RunID, "status", run.Status)
 		}
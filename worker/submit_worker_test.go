@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"context"
 	"errors"
 	gklog "github.com/go-kit/kit/log"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
@@ -36,9 +37,10 @@ func setUpSubmitWorkerTest1(t *testing.T) (*submitWorker, *testutils.ImplementsA
 		Queued: []string{"run:cupcake"},
 	}
 	return &submitWorker{
-		sm:  &imp,
-		ee:  &imp,
-		log: logger,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		notifier: &imp,
 	}, &imp
 }
 
@@ -68,9 +70,10 @@ func setUpSubmitWorkerTest2(t *testing.T) (*submitWorker, *testutils.ImplementsA
 		Queued: []string{"run:shoebox"},
 	}
 	return &submitWorker{
-		sm:  &imp,
-		ee:  &imp,
-		log: logger,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		notifier: &imp,
 	}, &imp
 }
 
@@ -88,9 +91,10 @@ func setUpSubmitWorkerTest3(t *testing.T) (*submitWorker, *testutils.ImplementsA
 		Queued: []string{"run:nope"},
 	}
 	return &submitWorker{
-		sm:  &imp,
-		ee:  &imp,
-		log: logger,
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		notifier: &imp,
 	}, &imp
 }
 
@@ -101,6 +105,7 @@ func setUpSubmitWorkerTest3(t *testing.T) (*submitWorker, *testutils.ImplementsA
 //   (d) we successfully launch
 // we should only NOT ack if
 //   (a) we hit a retryable error
+//   (b) another worker claimed the run and has yet to submit it
 
 func TestSubmitWorker_Run(t *testing.T) {
 	// 1. test that we only run queued runs
@@ -109,9 +114,9 @@ func TestSubmitWorker_Run(t *testing.T) {
 
 	// Test valid run; it's status is queued, it exists in state, its definition exists in state
 	worker, imp := setUpSubmitWorkerTest1(t)
-	worker.runOnce()
+	worker.runOnce(context.Background())
 
-	expected := []string{"PollRuns", "GetRun", "GetDefinition", "Execute", "UpdateRun", "RunReceipt.Done"}
+	expected := []string{"PollRuns", "GetRun", "GetDefinition", "ClaimRun", "Execute", "UpdateRun", "Notify", "RunReceipt.Done"}
 	if len(imp.Calls) != len(expected) {
 		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
 	}
@@ -126,7 +131,7 @@ func TestSubmitWorker_Run(t *testing.T) {
 func TestSubmitWorker_Run2(t *testing.T) {
 	// Test invalid run; it's status is running (this can happen with duplication in queues, which sqs allows)
 	worker, imp := setUpSubmitWorkerTest2(t)
-	worker.runOnce()
+	worker.runOnce(context.Background())
 
 	// Importantly, execute is NOT called and it -is- acked
 	expected := []string{"PollRuns", "GetRun", "GetDefinition", "RunReceipt.Done"}
@@ -145,7 +150,7 @@ func TestSubmitWorker_Run3(t *testing.T) {
 	// Test invalid run; it's queued but does not exist; this should not happen
 	// (run is queued but does not exist in state)
 	worker, imp := setUpSubmitWorkerTest3(t)
-	worker.runOnce()
+	worker.runOnce(context.Background())
 
 	// Importantly, execute is NOT called and it -is- acked
 	expected := []string{"PollRuns", "GetRun", "RunReceipt.Done"}
@@ -167,10 +172,10 @@ func TestSubmitWorker_Run4(t *testing.T) {
 	imp.ExecuteError = errors.New("nope")
 	imp.ExecuteErrorIsRetryable = false
 
-	worker.runOnce()
+	worker.runOnce(context.Background())
 
 	// Importantly, execute is called and it -is- acked
-	expected := []string{"PollRuns", "GetRun", "GetDefinition", "Execute", "UpdateRun", "RunReceipt.Done"}
+	expected := []string{"PollRuns", "GetRun", "GetDefinition", "ClaimRun", "Execute", "UpdateRun", "Notify", "RunReceipt.Done"}
 	if len(imp.Calls) != len(expected) {
 		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
 	}
@@ -195,10 +200,11 @@ func TestSubmitWorker_Run5(t *testing.T) {
 	imp.ExecuteError = errors.New("nope")
 	imp.ExecuteErrorIsRetryable = true
 
-	worker.runOnce()
+	worker.runOnce(context.Background())
 
-	// Importantly, execute it called but it is not updated nor is it acked
-	expected := []string{"PollRuns", "GetRun", "GetDefinition", "Execute"}
+	// Importantly, execute it called but it is not updated nor is it acked,
+	// and the claim on it is given up so it is submitted again
+	expected := []string{"PollRuns", "GetRun", "GetDefinition", "ClaimRun", "Execute", "ReleaseRun"}
 	if len(imp.Calls) != len(expected) {
 		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
 	}
@@ -208,4 +214,164 @@ func TestSubmitWorker_Run5(t *testing.T) {
 			t.Errorf("Expected call %v to be %s but was %s", i, expected[i], call)
 		}
 	}
+	if run, _ := imp.GetRun("run:cupcake"); run.Status != state.StatusQueued {
+		t.Errorf("Expected run to be queued again, was %s", run.Status)
+	}
+}
+
+func TestSubmitWorker_RunQueuedTwice(t *testing.T) {
+	// Test that a run received twice, eg. after the reconcile worker queued
+	// it again, is only submitted once
+	worker, imp := setUpSubmitWorkerTest1(t)
+	imp.Queued = []string{"run:cupcake", "run:cupcake"}
+
+	worker.runOnce(context.Background())
+	worker.runOnce(context.Background())
+
+	if len(imp.Executed) != 1 {
+		t.Errorf("Expected run to be submitted once, was %d times", len(imp.Executed))
+	}
+	acked := 0
+	for _, call := range imp.Calls {
+		if call == "RunReceipt.Done" {
+			acked++
+		}
+	}
+	if acked != 2 {
+		t.Errorf("Expected both receipts to be acked, were %d", acked)
+	}
+}
+
+func TestSubmitWorker_RunBeingSubmitted(t *testing.T) {
+	// Test that a run received while another worker is submitting it keeps
+	// its message, in case that worker never does
+	worker, imp := setUpSubmitWorkerTest1(t)
+	imp.ClaimRun("run:cupcake")
+	imp.Calls = []string{}
+
+	worker.runOnce(context.Background())
+
+	for _, call := range imp.Calls {
+		if call == "Execute" || call == "RunReceipt.Done" {
+			t.Errorf("Expected run being submitted elsewhere to be left alone, got %s", call)
+		}
+	}
+}
+
+func TestSubmitWorker_RunStoppedWhileSubmitting(t *testing.T) {
+	// Test that the task of a run stopped while it was being submitted is
+	// terminated, and the run stays stopped
+	worker, imp := setUpSubmitWorkerTest1(t)
+	imp.Executing = func(run state.Run) {
+		if stopped, _ := imp.StopClaimedRun(run.RunID); !stopped {
+			t.Errorf("Expected run being submitted to be stopped")
+		}
+	}
+
+	worker.runOnce(context.Background())
+
+	expected := []string{
+		"PollRuns", "GetRun", "GetDefinition", "ClaimRun", "Execute", "StopClaimedRun", "UpdateRun", "Terminate",
+		"RunReceipt.Done"}
+	if len(imp.Calls) != len(expected) {
+		t.Errorf("Unexpected number of run calls, expected %v but was %v", expected, imp.Calls)
+	}
+	for i, call := range imp.Calls {
+		if i < len(expected) && expected[i] != call {
+			t.Errorf("Expected call %v to be %s but was %s", i, expected[i], call)
+		}
+	}
+
+	run := imp.Runs["run:cupcake"]
+	if run.Status != state.StatusStopped || len(run.TaskArn) == 0 {
+		t.Errorf("Expected run to stay stopped and record its task, was %s [%s]", run.Status, run.TaskArn)
+	}
+}
+
+func TestSubmitWorker_RunSnapshotted(t *testing.T) {
+	// Test that runs carrying a copy of their definition launch from it, even
+	// if the definition has since changed
+	worker, imp := setUpSubmitWorkerTest1(t)
+
+	run := imp.Runs["run:cupcake"]
+	run.SnapshotDefinition(state.Definition{
+		DefinitionID: "def:cupcake",
+		Arn:          "arn:cupcake:1",
+		Image:        "cupcake:1",
+		Command:      "echo cupcake",
+	})
+	imp.Runs["run:cupcake"] = run
+	imp.Definitions["def:cupcake"] = state.Definition{
+		DefinitionID: "def:cupcake",
+		Arn:          "arn:cupcake:2",
+		Image:        "cupcake:2",
+		Command:      "echo changed",
+	}
+
+	worker.runOnce(context.Background())
+
+	// Importantly, the definition is NOT fetched
+	expected := []string{"PollRuns", "GetRun", "ClaimRun", "Execute", "UpdateRun", "Notify", "RunReceipt.Done"}
+	if len(imp.Calls) != len(expected) {
+		t.Errorf("Unexpected number of run calls, expected %v but was %v", len(expected), len(imp.Calls))
+	}
+
+	for i, call := range imp.Calls {
+		if expected[i] != call {
+			t.Errorf("Expected call %v to be %s but was %s", i, expected[i], call)
+		}
+	}
+
+	if len(imp.Executed) != 1 || imp.Executed[0].Image != "cupcake:1" {
+		t.Errorf("Expected run to be executed with its snapshotted image [cupcake:1], got %v", imp.Executed)
+	}
+}
+
+func TestSubmitWorker_RunBackfillsSnapshot(t *testing.T) {
+	// Test that runs created before snapshotting launch from their current
+	// definition, and that the copy is saved with the run
+	worker, imp := setUpSubmitWorkerTest1(t)
+
+	defEnv := state.EnvList{{Name: "DEF_VAR", Value: "a"}}
+	imp.Definitions["def:cupcake"] = state.Definition{
+		DefinitionID: "def:cupcake",
+		Arn:          "arn:cupcake:2",
+		Image:        "cupcake:2",
+		Command:      "echo cupcake",
+		Env:          &defEnv,
+	}
+
+	worker.runOnce(context.Background())
+
+	if len(imp.Executed) != 1 || imp.Executed[0].DefinitionArn != "arn:cupcake:2" {
+		t.Fatalf("Expected run to be executed from its current definition, got %v", imp.Executed)
+	}
+
+	executed := imp.Executed[0]
+	if executed.Env == nil || len(*executed.Env) != 1 {
+		t.Errorf("Expected definition env to be merged onto the run, got %v", executed.Env)
+	}
+
+	run, _ := imp.GetRun("run:cupcake")
+	if !run.HasSnapshot() {
+		t.Errorf("Expected backfilled definition information to be saved with the run")
+	}
+}
+
+func TestSubmitWorker_Shutdown(t *testing.T) {
+	// Received runs are left unacked once shutting down
+	worker, imp := setUpSubmitWorkerTest1(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	worker.runOnce(ctx)
+
+	expected := []string{"PollRuns"}
+	if len(imp.Calls) != len(expected) || imp.Calls[0] != expected[0] {
+		t.Errorf("Expected calls %v, got %v", expected, imp.Calls)
+	}
+	run, _ := imp.GetRun("run:cupcake")
+	if run.Status != state.StatusQueued {
+		t.Errorf("Expected run to stay queued, was %s", run.Status)
+	}
 }
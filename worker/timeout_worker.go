@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
+	"github.com/stitchfix/flotilla-os/config"
+	"github.com/stitchfix/flotilla-os/execution/engine"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/state"
+	"time"
+)
+
+// Number of running runs fetched at a time
+const timeoutBatchSize = 100
+
+type timeoutWorker struct {
+	sm           state.Manager
+	ee           engine.Engine
+	conf         config.Config
+	log          flotillaLog.Logger
+	notifier     webhook.Notifier
+	pollInterval time.Duration
+}
+
+func (tw *timeoutWorker) Initialize(
+	conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error {
+	tw.pollInterval = pollInterval
+	tw.conf = conf
+	tw.sm = sm
+	tw.ee = ee
+	tw.log = log
+
+	notifier, err := webhook.NewNotifier(conf, sm, log)
+	if err != nil {
+		return errors.Wrap(err, "problem initializing webhook notifier")
+	}
+	tw.notifier = notifier
+	return nil
+}
+
+//
+// Run finds RUNNING tasks that are past their deadline, terminates
+// them, and marks them stopped
+//
+func (tw *timeoutWorker) Run(ctx context.Context) {
+	for {
+		tw.runOnce()
+		if !sleep(ctx, tw.pollInterval) {
+			return
+		}
+	}
+}
+
+func (tw *timeoutWorker) runOnce() {
+	now := time.Now()
+
+	// Runs that are stopped drop out of the listing; page past the rest
+	offset := 0
+	for {
+		runList, err := tw.sm.ListRuns(
+			timeoutBatchSize, offset,
+			"started_at", "asc",
+			map[string][]string{"status": {state.StatusRunning}}, nil)
+
+		if err != nil {
+			tw.log.Log("message", "Error listing runs for timeout", "error", fmt.Sprintf("%+v", err))
+			return
+		}
+
+		for _, run := range runList.Runs {
+			if !tw.timeout(run, now) {
+				offset++
+			}
+		}
+
+		if len(runList.Runs) < timeoutBatchSize {
+			return
+		}
+	}
+}
+
+//
+// timeout terminates and stops the run if it is past its deadline;
+// returns true if the run was stopped
+//
+func (tw *timeoutWorker) timeout(run state.Run, now time.Time) bool {
+	deadline := run.Deadline()
+	if run.Status != state.StatusRunning || deadline == nil || deadline.After(now) {
+		return false
+	}
+
+	if err := tw.ee.Terminate(run); err != nil {
+		tw.log.Log("message", "Error terminating timed out run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		return false
+	}
+
+	timeout := time.Duration(*run.TimeoutSeconds) * time.Second
+	update := state.Run{
+		Status:        state.StatusStopped,
+		FinishedAt:    &now,
+		FailureReason: fmt.Sprintf("timed out after %s", timeout),
+	}
+	stopped, err := tw.sm.UpdateRun(run.RunID, update)
+	if err != nil {
+		tw.log.Log("message", "Error stopping timed out run", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+		return false
+	}
+	notifyStatusChange(tw.sm, tw.notifier, tw.log, stopped)
+
+	tw.log.Log("message", "Stopped timed out run", "run_id", run.RunID, "timeout", timeout.String())
+	return true
+}
@@ -0,0 +1,98 @@
+package worker
+
+import (
+	gklog "github.com/go-kit/kit/log"
+	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
+	"github.com/stitchfix/flotilla-os/state"
+	"github.com/stitchfix/flotilla-os/testutils"
+	"os"
+	"testing"
+	"time"
+)
+
+func setUpTimeoutWorkerTest(t *testing.T) (*timeoutWorker, *testutils.ImplementsAllTheThings) {
+	l := gklog.NewLogfmtLogger(gklog.NewSyncWriter(os.Stderr))
+	logger := flotillaLog.NewLogger(l, nil)
+
+	timeout := int64(60)
+	overdue := time.Now().Add(-2 * time.Minute)
+	recent := time.Now().Add(-10 * time.Second)
+
+	imp := testutils.ImplementsAllTheThings{
+		T: t,
+		Runs: map[string]state.Run{
+			"overdue": {
+				RunID: "overdue", Status: state.StatusRunning,
+				StartedAt: &overdue, TimeoutSeconds: &timeout},
+			"recent": {
+				RunID: "recent", Status: state.StatusRunning,
+				StartedAt: &recent, TimeoutSeconds: &timeout},
+			"untimed": {
+				RunID: "untimed", Status: state.StatusRunning,
+				StartedAt: &overdue},
+		},
+	}
+	return &timeoutWorker{
+		sm:       &imp,
+		ee:       &imp,
+		log:      logger,
+		notifier: &imp,
+	}, &imp
+}
+
+func TestTimeoutWorker_Run(t *testing.T) {
+	worker, imp := setUpTimeoutWorkerTest(t)
+	stopped := metrics.RunsStopped.Value("", "")
+	worker.runOnce()
+
+	// Only the overdue run is terminated, stopped and notified
+	expected := []string{"ListRuns", "Terminate", "UpdateRun", "Notify"}
+	if len(imp.Calls) != len(expected) {
+		t.Fatalf("Expected calls %v but was %v", expected, imp.Calls)
+	}
+	for i, call := range imp.Calls {
+		if expected[i] != call {
+			t.Errorf("Expected call %v to be %s but was %s", i, expected[i], call)
+		}
+	}
+
+	run, _ := imp.GetRun("overdue")
+	if run.Status != state.StatusStopped {
+		t.Errorf("Expected overdue run to be stopped but was %s", run.Status)
+	}
+	if run.FinishedAt == nil {
+		t.Errorf("Expected overdue run to have finished_at set")
+	}
+	if run.FailureReason != "timed out after 1m0s" {
+		t.Errorf("Expected timed out failure reason but was [%s]", run.FailureReason)
+	}
+	if len(imp.Notified) != 1 || imp.Notified[0].Status != state.StatusStopped {
+		t.Errorf("Expected webhooks to be notified of the stopped run, got %v", imp.Notified)
+	}
+	if metrics.RunsStopped.Value("", "") != stopped+1 {
+		t.Errorf("Expected the timed out run to be counted as stopped")
+	}
+
+	for _, runID := range []string{"recent", "untimed"} {
+		run, _ = imp.GetRun(runID)
+		if run.Status != state.StatusRunning {
+			t.Errorf("Expected run [%s] to still be running but was %s", runID, run.Status)
+		}
+	}
+}
+
+func TestTimeoutWorker_StoppedReasonKept(t *testing.T) {
+	worker, imp := setUpTimeoutWorkerTest(t)
+	worker.runOnce()
+
+	// The engine's own stopped update must not replace the timed out reason
+	exitCode := int64(137)
+	imp.UpdateRun("overdue", state.Run{
+		Status: state.StatusStopped, ExitCode: &exitCode, FailureReason: "Essential container in task exited"})
+
+	run, _ := imp.GetRun("overdue")
+	if run.FailureReason != "timed out after 1m0s" {
+		t.Errorf("Expected timed out failure reason to be kept but was [%s]", run.FailureReason)
+	}
+}
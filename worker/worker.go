@@ -1,22 +1,45 @@
 package worker
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/stitchfix/flotilla-os/clients/webhook"
 	"github.com/stitchfix/flotilla-os/config"
 	"github.com/stitchfix/flotilla-os/execution/engine"
 	flotillaLog "github.com/stitchfix/flotilla-os/log"
+	"github.com/stitchfix/flotilla-os/metrics"
+	"github.com/stitchfix/flotilla-os/services"
 	"github.com/stitchfix/flotilla-os/state"
 	"time"
 )
 
 //
 // Worker defines a background worker process
+// * Run polls until ctx is done; a poll that has started is finished
+//   before Run returns, so that work is not abandoned half way
 //
 type Worker interface {
 	Initialize(
 		conf config.Config, sm state.Manager, ee engine.Engine, log flotillaLog.Logger, pollInterval time.Duration) error
-	Run()
+	Run(ctx context.Context)
+}
+
+//
+// Types are the types of worker NewWorker creates
+//
+var Types = []string{"submit", "retry", "status", "schedule", "timeout", "reconcile"}
+
+//
+// IsValidType returns true if NewWorker creates workers of workerType
+//
+func IsValidType(workerType string) bool {
+	for _, t := range Types {
+		if t == workerType {
+			return true
+		}
+	}
+	return false
 }
 
 func NewWorker(
@@ -24,7 +47,8 @@ func NewWorker(
 	log flotillaLog.Logger,
 	conf config.Config,
 	ee engine.Engine,
-	sm state.Manager) (Worker, error) {
+	sm state.Manager,
+	es services.ExecutionService) (Worker, error) {
 
 	var worker Worker
 
@@ -35,6 +59,12 @@ func NewWorker(
 		worker = &retryWorker{}
 	case "status":
 		worker = &statusWorker{}
+	case "schedule":
+		worker = &scheduleWorker{es: es}
+	case "timeout":
+		worker = &timeoutWorker{}
+	case "reconcile":
+		worker = &reconcileWorker{}
 	default:
 		return nil, errors.Errorf("no workerType [%s] exists", workerType)
 	}
@@ -43,6 +73,26 @@ func NewWorker(
 	if err = worker.Initialize(conf, sm, ee, log, pollInterval); err != nil {
 		return worker, errors.Wrapf(err, "problem initializing worker [%s]", workerType)
 	}
+
+	//
+	// Singleton workers only run on the replica holding their lease, when
+	// the state manager can give out leases
+	//
+	if leaser, ok := sm.(state.Leaser); ok && singletonTypes[workerType] {
+		leaseInterval := 5 * time.Second
+		if conf.IsSet("worker.lease_interval") {
+			if leaseInterval, err = time.ParseDuration(conf.GetString("worker.lease_interval")); err != nil {
+				return worker, errors.Wrap(err, "worker.lease_interval must be a duration")
+			}
+		}
+		worker = &singletonWorker{
+			Worker:        worker,
+			workerType:    workerType,
+			leaser:        leaser,
+			log:           log,
+			leaseInterval: leaseInterval,
+		}
+	}
 	return worker, nil
 }
 
@@ -54,3 +104,30 @@ func GetPollInterval(workerType string, conf config.Config) (time.Duration, erro
 	}
 	return time.ParseDuration(pollIntervalString)
 }
+
+//
+// sleep waits for d, or until ctx is done; returns false if ctx is done
+//
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+//
+// notifyStatusChange tells those waiting on the run, and the webhooks
+// subscribed to it, that its status changed, and counts runs that stopped;
+// waiters read the run again later if they are not told
+//
+func notifyStatusChange(sm state.Manager, notifier webhook.Notifier, log flotillaLog.Logger, run state.Run) {
+	if run.Status == state.StatusStopped {
+		metrics.RunsStopped.Inc(run.ClusterName, run.GroupName)
+	}
+	notifier.Notify(run)
+	if err := state.NotifyStatusChange(sm, run); err != nil {
+		log.Log("message", "Error notifying run status change", "run_id", run.RunID, "error", fmt.Sprintf("%+v", err))
+	}
+}
@@ -1,6 +1,7 @@
 package worker
 
 import (
+	"context"
 	"github.com/stitchfix/flotilla-os/config"
 	"os"
 	"testing"
@@ -22,3 +23,27 @@ func TestGetPollInterval(t *testing.T) {
 		t.Errorf("Expected interval: [%v] but was [%v]", expected, interval)
 	}
 }
+
+func TestWorker_RunStops(t *testing.T) {
+	worker, imp := setUpRetryWorkerTest(t)
+	worker.pollInterval = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected worker to stop when its context is done")
+	}
+
+	// The poll that had started is finished
+	if len(imp.Calls) == 0 || imp.Calls[0] != "ListRuns" {
+		t.Errorf("Expected the worker to have polled once, got %v", imp.Calls)
+	}
+}